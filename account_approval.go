@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ListPendingApprovalsHandler lists the registrations waiting for an admin,
+// oldest first.
+func (s *Server) ListPendingApprovalsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit, offset, ok := pagination(c)
+	if !ok {
+		return InvalidRequestError(c)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT user_id, COALESCE(name, ''), COALESCE(email, ''), COALESCE(phone, ''), disposable_email, created_at
+		FROM users WHERE status=$1 ORDER BY created_at LIMIT $2 OFFSET $3`, AccountPending, limit, offset)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read pending users", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	users := []echo.Map{}
+	for rows.Next() {
+		var userID, name, email, phone string
+		var disposable bool
+		var createdAt time.Time
+		err = rows.Scan(&userID, &name, &email, &phone, &disposable, &createdAt)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read pending users", "error", err)
+			return InvalidRequestError(c)
+		}
+		users = append(users, echo.Map{
+			"user_id":          userID,
+			"name":             name,
+			"email":            email,
+			"phone":            phone,
+			"disposable_email": disposable,
+			"created_at":       createdAt,
+		})
+	}
+
+	return c.JSON(200, echo.Map{"users": users, "limit": limit, "offset": offset})
+}
+
+// notifyApproval emails the user about the decision on their registration.
+func (s *Server) notifyApproval(ctx context.Context, email string, subject string, text string) {
+	if s.Mailer == nil || email == "" {
+		return
+	}
+	go func(ctx context.Context) {
+		err := s.Mailer.Send(email, subject, text)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not send approval email", "error", err)
+		}
+	}(context.WithoutCancel(ctx))
+}
+
+// ApproveUserHandler activates a pending registration and starts the
+// verification it skipped. Users with nothing left to verify get a welcome
+// email instead.
+func (s *Server) ApproveUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+
+	var email, phone string
+	var verified, phoneVerified bool
+	err := s.DB.QueryRowContext(ctx, `UPDATE users SET status=$1 WHERE user_id=$2 AND status=$3
+		RETURNING COALESCE(email, ''), COALESCE(phone, ''), verified, phone_verified`, AccountActive, userID, AccountPending).Scan(&email, &phone, &verified, &phoneVerified)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NotFoundError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not approve user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventAccountApproved, userID, email)
+
+	response := echo.Map{"user_id": userID, "status": AccountActive}
+	if (email == "" || verified) && (phone == "" || phoneVerified) {
+		s.notifyApproval(ctx, email, "Your account is ready", "Your account has been approved. You can sign in now.\n")
+		return c.JSON(200, response)
+	}
+
+	if verified {
+		email = ""
+	}
+	if phoneVerified {
+		phone = ""
+	}
+	err = s.StartVerification(ctx, userID, email, phone, response)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create verification token", "error", err)
+		return InvalidRequestError(c)
+	}
+	return c.JSON(200, response)
+}
+
+// RejectUserHandler deletes a pending registration, so the email or phone
+// can register again later.
+func (s *Server) RejectUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+
+	var email string
+	err := s.DB.QueryRowContext(ctx, "DELETE FROM users WHERE user_id=$1 AND status=$2 RETURNING COALESCE(email, '')",
+		userID, AccountPending).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NotFoundError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not reject user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventAccountRejected, userID, email)
+	s.notifyApproval(ctx, email, "Your registration", "Your registration was not approved.\n")
+
+	return c.JSON(200, echo.Map{"user_id": userID, "status": "Registration rejected"})
+}
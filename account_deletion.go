@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const accountDeletionInterval = time.Hour
+
+// ScheduleAccountDeletionHandler signs the user out everywhere and deletes
+// the account once the grace period is over. Signing in again before then
+// cancels the deletion.
+func (s *Server) ScheduleAccountDeletionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	deleteAfter := time.Now().Add(s.AccountDeletionGracePeriod).UTC()
+	_, err := s.DB.ExecContext(ctx, "UPDATE users SET delete_after=$1 WHERE user_id=$2", deleteAfter, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not schedule account deletion", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventAccountDeletionScheduled, userID, "")
+
+	err = s.DeleteUserSessions(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not invalidate user sessions", "error", err)
+	}
+
+	s.ClearSessionCookie(c)
+
+	return c.JSON(200, echo.Map{"status": "Account deletion scheduled", "delete_after": deleteAfter})
+}
+
+// CancelAccountDeletion takes the user off the deletion schedule, which
+// signing in again does.
+func (s *Server) CancelAccountDeletion(c echo.Context, userID string) error {
+	result, err := s.DB.ExecContext(c.Request().Context(), "UPDATE users SET delete_after=NULL WHERE user_id=$1 AND delete_after IS NOT NULL", userID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		s.RecordAuthEvent(c, EventAccountDeletionCanceled, userID, "")
+	}
+	return nil
+}
+
+// DeleteScheduledAccounts deletes the accounts whose grace period is over.
+// The last admin is kept until someone else has the role.
+func (s *Server) DeleteScheduledAccounts(ctx context.Context) error {
+	rows, err := s.DB.QueryContext(ctx, "SELECT user_id FROM users WHERE delete_after < now()")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var due []string
+	for rows.Next() {
+		var userID string
+		err = rows.Scan(&userID)
+		if err != nil {
+			return err
+		}
+		due = append(due, userID)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userID := range due {
+		// Signing in since the query cancels the deletion
+		deleted, err := s.execKeepingAdmin(ctx, "DELETE FROM users WHERE user_id=$1 AND delete_after < now()", userID)
+		if errors.Is(err, errLastAdmin) {
+			s.Logger.WarnContext(ctx, "Not deleting the last admin", "user_id", userID)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			continue
+		}
+
+		// Sessions were revoked when the deletion was scheduled, this
+		// catches any left over
+		s.Logger.InfoContext(ctx, "Deleted account after grace period", "user_id", userID)
+		s.DeleteAvatar(ctx, userID)
+		err = s.DeleteUserSessions(ctx, userID)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not invalidate user sessions", "user_id", userID, "error", err)
+		}
+		err = s.RevokeUserRefreshTokens(ctx, userID)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not revoke refresh tokens", "user_id", userID, "error", err)
+		}
+	}
+	return nil
+}
+
+// RunAccountDeletion deletes scheduled accounts periodically until the
+// context ends.
+func (s *Server) RunAccountDeletion(ctx context.Context) {
+	ticker := time.NewTicker(accountDeletionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.DeleteScheduledAccounts(ctx)
+			if err != nil {
+				s.Logger.ErrorContext(ctx, "Could not delete scheduled accounts", "error", err)
+			}
+		}
+	}
+}
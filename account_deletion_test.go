@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeleteScheduledAccounts(t *testing.T) {
+	s := testServer(t)
+	s.RefreshTokenLifetime = time.Hour
+	ctx := context.Background()
+
+	admin := createTestUser(t, s, RoleAdmin)
+	user := createTestUser(t, s)
+	refreshToken, err := s.IssueRefreshToken(ctx, RefreshToken{UserID: user, ClientID: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DB.Exec("UPDATE users SET delete_after=now() - interval '1 minute'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.DeleteScheduledAccounts(ctx); err != nil {
+		t.Fatalf("DeleteScheduledAccounts: %v", err)
+	}
+
+	var remaining []string
+	rows, err := s.DB.Query("SELECT user_id FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			t.Fatal(err)
+		}
+		remaining = append(remaining, userID)
+	}
+	if len(remaining) != 1 || remaining[0] != admin {
+		t.Errorf("users left = %v, want only the last admin %s", remaining, admin)
+	}
+
+	if _, _, err := s.RotateRefreshToken(ctx, refreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("refresh token of a deleted account: error %v, want ErrRefreshTokenInvalid", err)
+	}
+	if members := s.RDB.SMembers(ctx, userRefreshFamiliesKey(user)).Val(); len(members) != 0 {
+		t.Errorf("refresh token families left = %v, want none", members)
+	}
+}
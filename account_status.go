@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Only active accounts can be used. Deactivated accounts come back when
+// their owner signs in again, while suspended and pending ones wait for an
+// admin.
+const (
+	AccountActive      = "active"
+	AccountDeactivated = "deactivated"
+	AccountSuspended   = "suspended"
+	AccountPending     = "pending"
+)
+
+var (
+	errAccountInactive  = errors.New("account is not active")
+	errAccountSuspended = fmt.Errorf("%w: suspended", errAccountInactive)
+	errAccountPending   = fmt.Errorf("%w: pending", errAccountInactive)
+)
+
+func AccountInactiveError(c echo.Context, err error) error {
+	if errors.Is(err, errAccountPending) {
+		return c.JSON(403, echo.Map{"error": "Account pending activation"})
+	}
+	return c.JSON(403, echo.Map{"error": "Account suspended"})
+}
+
+func (s *Server) AccountStatus(ctx context.Context, userID string) (string, error) {
+	var status string
+	err := s.DB.QueryRowContext(ctx, "SELECT status FROM users WHERE user_id=$1", userID).Scan(&status)
+	return status, err
+}
+
+// TokenOwnerActive reports whether tokens acting for the user still work.
+// Service client tokens, with no user behind them, always do.
+func (s *Server) TokenOwnerActive(ctx context.Context, userID string) bool {
+	if userID == "" {
+		return true
+	}
+	status, err := s.AccountStatus(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		s.Logger.ErrorContext(ctx, "Could not read account status", "error", err)
+	}
+	return err == nil && status == AccountActive
+}
+
+// ActivateForSignIn checks the account can be signed in to, reactivating it
+// when its owner had deactivated it.
+func (s *Server) ActivateForSignIn(c echo.Context, userID string) error {
+	ctx := c.Request().Context()
+	status, err := s.AccountStatus(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	switch status {
+	case AccountSuspended:
+		return errAccountSuspended
+	case AccountPending:
+		return errAccountPending
+	case AccountDeactivated:
+		_, err = s.DB.ExecContext(ctx, "UPDATE users SET status=$1 WHERE user_id=$2 AND status=$3", AccountActive, userID, AccountDeactivated)
+		if err != nil {
+			return err
+		}
+		s.RecordAuthEvent(c, EventAccountReactivated, userID, "")
+	}
+	return nil
+}
+
+// SetAccountStatus moves the account to another status, signing it out
+// everywhere when it stops being active. Its tokens and API keys are kept
+// but refused while it isn't, see TokenOwnerActive.
+func (s *Server) SetAccountStatus(ctx context.Context, userID string, status string) error {
+	rows, err := s.execKeepingAdmin(ctx, "UPDATE users SET status=$1 WHERE user_id=$2", status, userID)
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	if status == AccountActive {
+		return nil
+	}
+	return s.DeleteUserSessions(ctx, userID)
+}
+
+// DeactivateAccountHandler lets users put their account away without
+// deleting it. Signing in again reactivates it.
+func (s *Server) DeactivateAccountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	err := s.SetAccountStatus(ctx, userID, AccountDeactivated)
+	if errors.Is(err, errLastAdmin) {
+		return LastAdminError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not deactivate account", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventAccountDeactivated, userID, "")
+	s.ClearSessionCookie(c)
+
+	return c.JSON(200, echo.Map{"status": "Account deactivated"})
+}
+
+// adminSetStatus is the shared body of the admin status endpoints.
+func (s *Server) adminSetStatus(c echo.Context, status string, eventType string) error {
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+
+	err := s.SetAccountStatus(ctx, userID, status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NotFoundError(c)
+	}
+	if errors.Is(err, errLastAdmin) {
+		return LastAdminError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not change account status", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, eventType, userID, "")
+
+	return c.JSON(200, echo.Map{"user_id": userID, "status": status})
+}
+
+func (s *Server) SuspendUserHandler(c echo.Context) error {
+	return s.adminSetStatus(c, AccountSuspended, EventAccountSuspended)
+}
+
+func (s *Server) ActivateUserHandler(c echo.Context) error {
+	return s.adminSetStatus(c, AccountActive, EventAccountReactivated)
+}
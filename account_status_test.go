@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestSuspendedAccountTokens(t *testing.T) {
+	s := testServer(t)
+	s.RefreshTokenLifetime = time.Hour
+	ctx := context.Background()
+	userID := createTestUser(t, s)
+
+	pat := personalAccessTokenPrefix + RandomToken()
+	_, err := s.DB.Exec("INSERT INTO personal_access_tokens (user_id, name, token_hash, scope) VALUES($1, 'ci', $2, 'profile')",
+		userID, HashToken(pat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey := apiKeyPrefix + RandomToken()
+	_, err = s.DB.Exec("INSERT INTO api_keys (name, key_hash, key_prefix, user_id) VALUES('ci', $1, $2, $3)",
+		HashToken(apiKey), apiKey[:8], userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshToken, err := s.IssueRefreshToken(ctx, RefreshToken{UserID: userID, ClientID: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useAPIKey := func() int {
+		t.Helper()
+		e := echo.New()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("X-API-Key", apiKey)
+		err := s.APIKeyMiddleware(s.APIKeyVerifyHandler)(e.NewContext(request, recorder))
+		if err != nil {
+			t.Fatalf("APIKeyMiddleware returned %v", err)
+		}
+		return recorder.Code
+	}
+
+	if _, err := s.LookupBearerToken(ctx, pat); err != nil {
+		t.Fatalf("personal access token of an active account: %v", err)
+	}
+	if code := useAPIKey(); code != 200 {
+		t.Fatalf("API key of an active account: status %d, want 200", code)
+	}
+
+	if err := s.SetAccountStatus(ctx, userID, AccountSuspended); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.LookupBearerToken(ctx, pat); !errors.Is(err, errAccountInactive) {
+		t.Errorf("personal access token of a suspended account: error %v, want errAccountInactive", err)
+	}
+	if code := useAPIKey(); code != 401 {
+		t.Errorf("API key of a suspended account: status %d, want 401", code)
+	}
+	if _, _, err := s.RotateRefreshToken(ctx, refreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("refresh token of a suspended account: error %v, want ErrRefreshTokenInvalid", err)
+	}
+
+	// The refresh token family is gone for good, the rest come back
+	if err := s.SetAccountStatus(ctx, userID, AccountActive); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.LookupBearerToken(ctx, pat); err != nil {
+		t.Errorf("personal access token after reactivation: %v", err)
+	}
+	if _, _, err := s.RotateRefreshToken(ctx, refreshToken); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("refresh token after reactivation: error %v, want ErrRefreshTokenInvalid", err)
+	}
+}
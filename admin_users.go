@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// adminUserColumns are what admins see of a user, in the order
+// scanAdminUser reads them.
+const adminUserColumns = `user_id, COALESCE(name, ''), COALESCE(email, ''), verified, COALESCE(phone, ''), phone_verified,
+	COALESCE(username, ''), guest, ARRAY(SELECT role FROM user_roles WHERE user_roles.user_id=users.user_id
+		UNION SELECT role FROM group_roles JOIN group_members USING (group_id) WHERE group_members.user_id=users.user_id ORDER BY 1),
+	ARRAY(SELECT name FROM groups JOIN group_members USING (group_id) WHERE group_members.user_id=users.user_id ORDER BY name), status, disposable_email, totp_enabled OR sms_mfa_enabled, created_at, last_login_at,
+	last_seen_at, delete_after`
+
+// adminUserSorts maps the sort parameter of the user listing to columns.
+var adminUserSorts = map[string]string{
+	"created_at":    "created_at",
+	"last_login_at": "last_login_at",
+	"last_seen_at":  "last_seen_at",
+	"email":         "LOWER(email)",
+	"name":          "LOWER(name)",
+}
+
+// scanAdminUser reads adminUserColumns, plus any extra destinations after
+// them, with the Scan of a row.
+func scanAdminUser(scan func(dest ...interface{}) error, extra ...interface{}) (echo.Map, error) {
+	var userID, name, email, phone, username, status string
+	var verified, phoneVerified, guest, disposable, mfa bool
+	roles, groups := []string{}, []string{}
+	var createdAt, lastLoginAt, lastSeenAt, deleteAfter sql.NullTime
+	err := scan(append([]interface{}{&userID, &name, &email, &verified, &phone, &phoneVerified, &username, &guest, pq.Array(&roles), pq.Array(&groups), &status,
+		&disposable, &mfa, &createdAt, &lastLoginAt, &lastSeenAt, &deleteAfter}, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	user := echo.Map{
+		"user_id":          userID,
+		"name":             name,
+		"email":            email,
+		"email_verified":   verified,
+		"phone":            phone,
+		"phone_verified":   phoneVerified,
+		"username":         username,
+		"guest":            guest,
+		"roles":            roles,
+		"groups":           groups,
+		"status":           status,
+		"disposable_email": disposable,
+		"mfa_enabled":      mfa,
+		"created_at":       createdAt.Time,
+	}
+	if lastLoginAt.Valid {
+		user["last_login_at"] = lastLoginAt.Time
+	}
+	// Seen times reach the database in batches, so this lags a little
+	if lastSeenAt.Valid {
+		user["last_seen_at"] = lastSeenAt.Time
+	}
+	if deleteAfter.Valid {
+		user["delete_after"] = deleteAfter.Time
+	}
+	return user, nil
+}
+
+// likePattern matches the search anywhere in a column, with LIKE's wildcards
+// in it taken literally.
+func likePattern(search string) string {
+	search = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(strings.ToLower(search))
+	return "%" + search + "%"
+}
+
+// ListUsersHandler lists users for admins. q searches names, emails,
+// usernames and phone numbers, status filters by account status, and sort
+// and order pick the ordering, newest first by default.
+func (s *Server) ListUsersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit, offset, ok := pagination(c)
+	if !ok {
+		return InvalidRequestError(c)
+	}
+
+	sortBy := c.QueryParam("sort")
+	if sortBy == "" {
+		sortBy = "created_at"
+	}
+	column, ok := adminUserSorts[sortBy]
+	if !ok {
+		return ValidationError(c, map[string]string{"sort": "Must be created_at, last_login_at, last_seen_at, email or name"})
+	}
+	order := strings.ToUpper(c.QueryParam("order"))
+	if order == "" {
+		order = "DESC"
+	}
+	if order != "ASC" && order != "DESC" {
+		return ValidationError(c, map[string]string{"order": "Must be asc or desc"})
+	}
+
+	conditions := []string{"true"}
+	args := []interface{}{}
+	if search := strings.TrimSpace(c.QueryParam("q")); search != "" {
+		args = append(args, likePattern(search))
+		conditions = append(conditions, fmt.Sprintf("(LOWER(email) LIKE $%[1]d OR LOWER(name) LIKE $%[1]d OR LOWER(username) LIKE $%[1]d OR phone LIKE $%[1]d)", len(args)))
+	}
+	if status := c.QueryParam("status"); status != "" {
+		args = append(args, status)
+		conditions = append(conditions, fmt.Sprintf("status=$%d", len(args)))
+	}
+
+	args = append(args, limit, offset)
+	query := fmt.Sprintf("SELECT %s, count(*) OVER () FROM users WHERE %s ORDER BY %s %s NULLS LAST, user_id LIMIT $%d OFFSET $%d",
+		adminUserColumns, strings.Join(conditions, " AND "), column, order, len(args)-1, len(args))
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not list users", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	users := []echo.Map{}
+	var total int
+	for rows.Next() {
+		user, err := scanAdminUser(rows.Scan, &total)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not list users", "error", err)
+			return InvalidRequestError(c)
+		}
+		users = append(users, user)
+	}
+
+	return c.JSON(200, echo.Map{"users": users, "total": total, "limit": limit, "offset": offset})
+}
+
+// adminUser reads a user with their metadata.
+func (s *Server) adminUser(c echo.Context, userID string) (echo.Map, error) {
+	var metadata []byte
+	user, err := scanAdminUser(s.DB.QueryRowContext(c.Request().Context(), "SELECT "+adminUserColumns+", metadata FROM users WHERE user_id=$1",
+		userID).Scan, &metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	var sections map[string]json.RawMessage
+	err = json.Unmarshal(metadata, &sections)
+	if err != nil {
+		return nil, err
+	}
+	user[AppMetadata] = sections[AppMetadata]
+	user[UserMetadata] = sections[UserMetadata]
+	return user, nil
+}
+
+func (s *Server) GetUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	user, err := s.adminUser(c, c.Param("id"))
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not find user", "error", err)
+		return NotFoundError(c)
+	}
+	return c.JSON(200, user)
+}
+
+// createUser adds a user together with their roles.
+func (s *Server) createUser(ctx context.Context, name string, email string, phone string, username string, hashedPassword []byte,
+	verified bool, phoneVerified bool, roles []string, grantedBy string) (string, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var userID string
+	err = tx.QueryRowContext(ctx, `INSERT INTO users (name, email, phone, username, password, verified, phone_verified)
+		VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING user_id`, name, nullString(email), nullString(phone), nullString(username),
+		nullString(string(hashedPassword)), verified, phoneVerified).Scan(&userID)
+	if err != nil {
+		return "", err
+	}
+	if len(roles) > 0 {
+		err = grantRoles(ctx, tx, userID, roles, grantedBy)
+		if err != nil {
+			return "", err
+		}
+	}
+	return userID, tx.Commit()
+}
+
+// CreateUserHandler lets admins add users directly, bypassing registration
+// settings. Unverified emails are sent a verification link, and users
+// created without a password set one through the reset flow or sign in
+// without one.
+func (s *Server) CreateUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var body struct {
+		Name          string   `json:"name"`
+		Email         string   `json:"email"`
+		Phone         string   `json:"phone"`
+		Username      string   `json:"username"`
+		Password      string   `json:"password"`
+		Verified      bool     `json:"email_verified"`
+		PhoneVerified bool     `json:"phone_verified"`
+		Roles         []string `json:"roles"`
+	}
+	err := c.Bind(&body)
+	body.Email = normalizeEmail(body.Email)
+	if err != nil || (len(body.Email) == 0 && len(body.Phone) == 0) {
+		return InvalidRequestError(c)
+	}
+	if len(body.Password) > 0 && s.PasswordlessOnly {
+		return PasswordsDisabledError(c)
+	}
+
+	fieldErrors := map[string]string{}
+	name, ok := normalizeName(body.Name)
+	if !ok {
+		fieldErrors["name"] = invalidNameMessage
+	}
+	if len(body.Phone) > 0 {
+		body.Phone, ok = normalizePhone(body.Phone)
+		if !ok {
+			fieldErrors["phone"] = "Must be a phone number in international format"
+		}
+	}
+	if len(body.Username) > 0 {
+		body.Username, ok = normalizeUsername(body.Username)
+		if !ok {
+			fieldErrors["username"] = usernameRulesMessage
+		} else if isReservedUsername(body.Username) {
+			fieldErrors["username"] = "Already taken"
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return ValidationError(c, fieldErrors)
+	}
+
+	var hashedPassword []byte
+	var passwordWarnings []PasswordViolation
+	if len(body.Password) > 0 {
+		var violations []PasswordViolation
+		violations, passwordWarnings = s.CheckPassword(ctx, body.Password, passwordInputsOf(body.Email, body.Username, name)...)
+		if len(violations) > 0 {
+			return WeakPasswordError(c, violations)
+		}
+		hashedPassword, err = bcrypt.GenerateFromPassword([]byte(body.Password), s.BcryptCost)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not hash password", "error", err)
+			return InvalidRequestError(c)
+		}
+	}
+
+	userID, err := s.createUser(ctx, name, body.Email, body.Phone, body.Username, hashedPassword, body.Verified, body.PhoneVerified,
+		body.Roles, c.Get("userID").(string))
+	if errors.Is(err, errUnknownRole) {
+		return ValidationError(c, map[string]string{"roles": "Must be existing roles"})
+	}
+	if isUniqueViolation(err) {
+		s.Logger.InfoContext(ctx, "User exists")
+		return ConflictError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventUserCreated, userID, body.Email)
+
+	response, err := s.adminUser(c, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read created user", "error", err)
+		return InvalidRequestError(c)
+	}
+	if len(passwordWarnings) > 0 {
+		response["password_warnings"] = passwordWarnings
+	}
+
+	if body.Verified {
+		body.Email = ""
+	}
+	if body.PhoneVerified {
+		body.Phone = ""
+	}
+	err = s.StartVerification(ctx, userID, body.Email, body.Phone, response)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create verification token", "error", err)
+	}
+	return c.JSON(201, response)
+}
+
+// UpdateUserHandler changes a user's details as an admin. Unlike PATCH
+// /profile, emails change right away, and a new email or phone number is
+// unverified unless the request says otherwise.
+func (s *Server) UpdateUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+
+	var body struct {
+		Name          *string `json:"name"`
+		Email         *string `json:"email"`
+		Phone         *string `json:"phone"`
+		Username      *string `json:"username"`
+		Verified      *bool   `json:"email_verified"`
+		PhoneVerified *bool   `json:"phone_verified"`
+	}
+	err := c.Bind(&body)
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+
+	sets := []string{}
+	args := []interface{}{}
+	addField := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s=$%d", column, len(args)))
+	}
+
+	fieldErrors := map[string]string{}
+	if body.Name != nil {
+		name, ok := normalizeName(*body.Name)
+		if ok {
+			addField("name", name)
+		} else {
+			fieldErrors["name"] = invalidNameMessage
+		}
+	}
+	if body.Email != nil {
+		email := normalizeEmail(*body.Email)
+		addField("email", nullString(email))
+		if body.Verified == nil {
+			addField("verified", false)
+		}
+	}
+	if body.Phone != nil {
+		phone, ok := normalizePhone(*body.Phone)
+		switch {
+		case *body.Phone == "":
+			addField("phone", nil)
+		case !ok:
+			fieldErrors["phone"] = "Must be a phone number in international format"
+		default:
+			addField("phone", phone)
+		}
+		if body.PhoneVerified == nil {
+			addField("phone_verified", false)
+		}
+	}
+	if body.Username != nil {
+		username, ok := normalizeUsername(*body.Username)
+		switch {
+		case *body.Username == "":
+			addField("username", nil)
+		case !ok:
+			fieldErrors["username"] = usernameRulesMessage
+		case isReservedUsername(username):
+			fieldErrors["username"] = "Already taken"
+		default:
+			addField("username", username)
+		}
+	}
+	if body.Verified != nil {
+		addField("verified", *body.Verified)
+	}
+	if body.PhoneVerified != nil {
+		addField("phone_verified", *body.PhoneVerified)
+	}
+	if len(fieldErrors) > 0 {
+		return ValidationError(c, fieldErrors)
+	}
+	if len(sets) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	args = append(args, userID)
+	result, err := s.DB.ExecContext(ctx, fmt.Sprintf("UPDATE users SET %s WHERE user_id=$%d", strings.Join(sets, ", "), len(args)), args...)
+	if isUniqueViolation(err) {
+		return ConflictError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update user", "error", err)
+		return InvalidRequestError(c)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return NotFoundError(c)
+	}
+
+	s.RecordAuthEvent(c, EventUserUpdated, userID, "")
+
+	user, err := s.adminUser(c, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read updated user", "error", err)
+		return InvalidRequestError(c)
+	}
+	return c.JSON(200, user)
+}
+
+// DeleteUserHandler deletes the account right away, without the grace
+// period of self-service deletion.
+func (s *Server) DeleteUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+	if userID == c.Get("userID").(string) {
+		return ForbiddenError(c)
+	}
+
+	var email string
+	err := s.DB.QueryRowContext(ctx, "DELETE FROM users WHERE user_id=$1 RETURNING COALESCE(email, '')", userID).Scan(&email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NotFoundError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not delete user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventAccountDeleted, userID, email)
+	s.DeleteAvatar(ctx, userID)
+
+	err = s.DeleteUserSessions(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not invalidate user sessions", "error", err)
+	}
+	err = s.RevokeUserRefreshTokens(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not revoke refresh tokens", "error", err)
+	}
+
+	return c.JSON(200, echo.Map{"status": "User deleted"})
+}
+
+// LogoutUserHandler signs the user out of every session.
+func (s *Server) LogoutUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+
+	var exists bool
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE user_id=$1)", userID).Scan(&exists)
+	if err != nil || !exists {
+		return NotFoundError(c)
+	}
+
+	err = s.DeleteUserSessions(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not invalidate user sessions", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventSessionRevoked, userID, "")
+
+	return c.JSON(200, echo.Map{"status": "Signed out everywhere"})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// API keys start with a fixed prefix so leaked ones are easy to spot in
+// code and logs.
+const apiKeyPrefix = "agk_"
+
+// APIKeyMiddleware authenticates requests carrying an API key in the
+// X-API-Key header. Keys belong either to a user or to a service client.
+func (s *Server) APIKeyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		key := c.Request().Header.Get("X-API-Key")
+		if len(key) == 0 {
+			return UnauthorizedError(c)
+		}
+
+		var keyID string
+		var userID, clientID sql.NullString
+		err := s.DB.QueryRowContext(ctx, `UPDATE api_keys SET last_used_at=now()
+			WHERE key_hash=$1 AND (expires_at IS NULL OR expires_at > now())
+			RETURNING key_id, user_id, client_id`, HashToken(key)).Scan(&keyID, &userID, &clientID)
+		if err != nil {
+			s.Logger.InfoContext(ctx, "API key not found or expired", "error", err)
+			return UnauthorizedError(c)
+		}
+		if !s.TokenOwnerActive(ctx, userID.String) {
+			s.Logger.InfoContext(ctx, "API key of inactive account", "user_id", userID.String)
+			return UnauthorizedError(c)
+		}
+
+		c.Set("apiKeyID", keyID)
+		c.Set("userID", userID.String)
+		c.Set("clientID", clientID.String)
+		return next(c)
+	}
+}
+
+func (s *Server) APIKeyVerifyHandler(c echo.Context) error {
+	return c.JSON(200, echo.Map{
+		"api_key_id": c.Get("apiKeyID"),
+		"user_id":    c.Get("userID"),
+		"client_id":  c.Get("clientID"),
+	})
+}
+
+// CreateAPIKeyHandler issues a key for the user, or for one of the service
+// clients they own when client_id is given.
+func (s *Server) CreateAPIKeyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var body struct {
+		Name      string `json:"name"`
+		ClientID  string `json:"client_id"`
+		ExpiresIn int64  `json:"expires_in"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.Name) == 0 || body.ExpiresIn < 0 {
+		return InvalidRequestError(c)
+	}
+
+	owner := nullString(userID)
+	if body.ClientID != "" {
+		var owned bool
+		err = s.DB.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM clients WHERE client_id::text=$1 AND owner_id=$2)",
+			body.ClientID, userID).Scan(&owned)
+		if err != nil || !owned {
+			return NotFoundError(c)
+		}
+		owner = sql.NullString{}
+	}
+
+	var expiresAt sql.NullTime
+	if body.ExpiresIn > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(time.Duration(body.ExpiresIn) * time.Second), Valid: true}
+	}
+
+	key := apiKeyPrefix + RandomToken()
+	var keyID string
+	var createdAt time.Time
+	err = s.DB.QueryRowContext(ctx, `INSERT INTO api_keys (name, key_hash, key_prefix, user_id, client_id, expires_at)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING key_id, created_at`,
+		body.Name, HashToken(key), key[:len(apiKeyPrefix)+6], owner, nullString(body.ClientID), expiresAt).Scan(&keyID, &createdAt)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create API key", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	// The key is only ever shown here, we only keep its hash
+	return c.JSON(200, echo.Map{
+		"id":         keyID,
+		"name":       body.Name,
+		"key":        key,
+		"client_id":  nullString(body.ClientID).String,
+		"created_at": createdAt,
+		"expires_at": expiresAt.Time,
+	})
+}
+
+// apiKeysOwnedBy matches the user's own keys and those of their clients.
+const apiKeysOwnedBy = "(user_id=$1 OR client_id IN (SELECT client_id FROM clients WHERE owner_id=$1))"
+
+func (s *Server) ListAPIKeysHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT key_id, name, key_prefix, COALESCE(client_id::text, ''), created_at, last_used_at, expires_at
+		FROM api_keys WHERE `+apiKeysOwnedBy+` ORDER BY created_at DESC`, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not list API keys", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	keys := []echo.Map{}
+	for rows.Next() {
+		var keyID, name, prefix, clientID string
+		var createdAt time.Time
+		var lastUsedAt, expiresAt sql.NullTime
+		err = rows.Scan(&keyID, &name, &prefix, &clientID, &createdAt, &lastUsedAt, &expiresAt)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read API key", "error", err)
+			return InvalidRequestError(c)
+		}
+
+		key := echo.Map{
+			"id":         keyID,
+			"name":       name,
+			"prefix":     prefix,
+			"client_id":  clientID,
+			"created_at": createdAt,
+		}
+		if lastUsedAt.Valid {
+			key["last_used_at"] = lastUsedAt.Time
+		}
+		if expiresAt.Valid {
+			key["expires_at"] = expiresAt.Time
+		}
+		keys = append(keys, key)
+	}
+
+	return c.JSON(200, echo.Map{"api_keys": keys})
+}
+
+func (s *Server) UpdateAPIKeyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.Name) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	result, err := s.DB.ExecContext(ctx, "UPDATE api_keys SET name=$2 WHERE key_id::text=$3 AND "+apiKeysOwnedBy,
+		userID, body.Name, c.Param("id"))
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update API key", "error", err)
+		return InvalidRequestError(c)
+	}
+	if updated, _ := result.RowsAffected(); updated == 0 {
+		return NotFoundError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "API key updated"})
+}
+
+func (s *Server) DeleteAPIKeyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	result, err := s.DB.ExecContext(ctx, "DELETE FROM api_keys WHERE key_id::text=$2 AND "+apiKeysOwnedBy, userID, c.Param("id"))
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not delete API key", "error", err)
+		return InvalidRequestError(c)
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return NotFoundError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "API key deleted"})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+const appleIssuer = "https://appleid.apple.com"
+
+// LoadApplePrivateKey reads the PKCS#8 EC key downloaded from the Apple
+// developer portal as a .p8 file.
+func LoadApplePrivateKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("Apple key must be an EC key")
+	}
+	return private, nil
+}
+
+// Apple has no static client secret, every token request has to carry a
+// short-lived JWT signed with the team's key instead.
+func NewAppleProvider(clientID string, teamID string, keyID string, key *ecdsa.PrivateKey, redirectURL string) *UpstreamProvider {
+	return &UpstreamProvider{
+		Name: "apple",
+		OAuth2: &oauth2.Config{
+			ClientID:    clientID,
+			RedirectURL: redirectURL,
+			Scopes:      []string{"name", "email"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:   appleIssuer + "/auth/authorize",
+				TokenURL:  appleIssuer + "/auth/token",
+				AuthStyle: oauth2.AuthStyleInParams,
+			},
+		},
+		// Apple refuses to send the requested scopes in the query string
+		AuthCodeOptions: []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("response_mode", "form_post")},
+		FormPost:        true,
+		ClientSecret: func() (string, error) {
+			now := time.Now()
+			token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+				Issuer:    teamID,
+				Subject:   clientID,
+				Audience:  jwt.ClaimStrings{appleIssuer},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute * 5)),
+			})
+			token.Header["kid"] = keyID
+			return token.SignedString(key)
+		},
+		// Users who chose to hide their email get an address on Apple's
+		// private relay instead. It is unique to this app and Apple forwards
+		// it to their real inbox, so it is verified like any other address,
+		// but it will never match an account registered with the real one.
+		FetchIdentity: func(ctx context.Context, token *oauth2.Token, nonce string) (*UpstreamIdentity, error) {
+			identity, _, err := ParseUpstreamIDToken(token, []string{appleIssuer}, clientID, nonce)
+			return identity, err
+		},
+		// The ID token has no name, Apple posts it alongside the code but
+		// only the first time the user authorizes the app
+		CallbackIdentity: func(identity *UpstreamIdentity, form url.Values) {
+			var user struct {
+				Name struct {
+					FirstName string `json:"firstName"`
+					LastName  string `json:"lastName"`
+				} `json:"name"`
+			}
+			if json.Unmarshal([]byte(form.Get("user")), &user) == nil && identity.Name == "" {
+				identity.Name = strings.TrimSpace(user.Name.FirstName + " " + user.Name.LastName)
+			}
+		},
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	EventLoginSuccess             = "login_success"
+	EventLoginFailure             = "login_failure"
+	EventLogout                   = "logout"
+	EventPasswordChange           = "password_change"
+	EventPasswordReset            = "password_reset"
+	EventAccountDeleted           = "account_deleted"
+	EventAccountDeletionScheduled = "account_deletion_scheduled"
+	EventAccountDeletionCanceled  = "account_deletion_canceled"
+	EventMFAEnabled               = "mfa_enabled"
+	EventMFADisabled              = "mfa_disabled"
+	EventMFAFailure               = "mfa_failure"
+	EventRecoveryCodeUsed         = "recovery_code_used"
+	EventIdentityLinked           = "identity_linked"
+	EventIdentityUnlinked         = "identity_unlinked"
+	EventEmailChange              = "email_change"
+	EventEmailReverted            = "email_reverted"
+	EventDataExported             = "data_exported"
+	EventAccountDeactivated       = "account_deactivated"
+	EventAccountReactivated       = "account_reactivated"
+	EventAccountSuspended         = "account_suspended"
+	EventAccountUnlocked          = "account_unlocked"
+	EventSessionRevoked           = "session_revoked"
+	EventSuspiciousLogin          = "suspicious_login"
+	EventConsentAccepted          = "consent_accepted"
+	EventInvitationCreated        = "invitation_created"
+	EventInvitationAccepted       = "invitation_accepted"
+	EventAccountApproved          = "account_approved"
+	EventAccountRejected          = "account_rejected"
+	EventUserCreated              = "user_created"
+	EventUserUpdated              = "user_updated"
+	EventRoleGranted              = "role_granted"
+	EventRoleRevoked              = "role_revoked"
+	EventGroupMemberAdded         = "group_member_added"
+	EventGroupMemberRemoved       = "group_member_removed"
+)
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// RecordAuthEvent stores a security-relevant event in the audit log. Failing
+// to record an event is logged but never fails the request.
+func (s *Server) RecordAuthEvent(c echo.Context, eventType string, userID string, email string) {
+	ctx := c.Request().Context()
+	_, err := s.DB.ExecContext(ctx, "INSERT INTO auth_events (event_type, user_id, email, ip, user_agent) VALUES($1, $2, $3, $4, $5)",
+		eventType, nullString(userID), nullString(email), c.RealIP(), c.Request().UserAgent())
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not record auth event", "event_type", eventType, "error", err)
+	}
+}
+
+// pagination reads the limit and offset query parameters of list endpoints.
+func pagination(c echo.Context) (limit int, offset int, ok bool) {
+	limit = 50
+	if value := c.QueryParam("limit"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number <= 0 || number > 100 {
+			return 0, 0, false
+		}
+		limit = number
+	}
+
+	if value := c.QueryParam("offset"); value != "" {
+		number, err := strconv.Atoi(value)
+		if err != nil || number < 0 {
+			return 0, 0, false
+		}
+		offset = number
+	}
+	return limit, offset, true
+}
+
+func (s *Server) AuditLogHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	limit, offset, ok := pagination(c)
+	if !ok {
+		return InvalidRequestError(c)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT event_type, email, ip, user_agent, created_at FROM auth_events
+		WHERE user_id=$1 ORDER BY created_at DESC LIMIT $2 OFFSET $3`, userID, limit, offset)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read audit log", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	events := []echo.Map{}
+	for rows.Next() {
+		var eventType string
+		var email, ip, userAgent sql.NullString
+		var createdAt time.Time
+		err = rows.Scan(&eventType, &email, &ip, &userAgent, &createdAt)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read audit log", "error", err)
+			return InvalidRequestError(c)
+		}
+
+		events = append(events, echo.Map{
+			"event_type": eventType,
+			"email":      email.String,
+			"ip":         ip.String,
+			"user_agent": userAgent.String,
+			"device":     deviceJSON(ParseUserAgent(userAgent.String)),
+			"created_at": createdAt,
+		})
+	}
+
+	return c.JSON(200, echo.Map{
+		"events": events,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
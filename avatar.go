@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Avatars are cropped to a square and scaled to avatarSize pixels a side,
+// then stored as PNG whatever was uploaded.
+const (
+	avatarSize      = 256
+	maxAvatarBytes  = 5 << 20
+	maxAvatarPixels = 25_000_000
+)
+
+func avatarKey(userID string) string {
+	return "avatars/" + userID + ".png"
+}
+
+// avatarURL is where the user's avatar is served. It stays the same across
+// uploads, the version only busts caches.
+func (s *Server) avatarURL(userID string, updatedAt time.Time) string {
+	return s.IssuerURL + "/avatars/" + userID + "?v=" + strconv.FormatInt(updatedAt.Unix(), 10)
+}
+
+// resizeAvatar crops the middle square out of the image and scales it to
+// avatarSize, averaging the source pixels behind every pixel of the result.
+func resizeAvatar(source image.Image) image.Image {
+	bounds := source.Bounds()
+	side := min(bounds.Dx(), bounds.Dy())
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	size := min(side, avatarSize)
+	result := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		top, bottom := y0+y*side/size, y0+(y+1)*side/size
+		for x := 0; x < size; x++ {
+			left, right := x0+x*side/size, x0+(x+1)*side/size
+			var r, g, b, a, n uint64
+			for sy := top; sy < max(bottom, top+1); sy++ {
+				for sx := left; sx < max(right, left+1); sx++ {
+					pr, pg, pb, pa := source.At(sx, sy).RGBA()
+					r, g, b, a, n = r+uint64(pr), g+uint64(pg), b+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			// RGBA is premultiplied, NRGBA isn't
+			pixel := color.NRGBA{}
+			if a > 0 {
+				pixel = color.NRGBA{R: uint8(r * 0xff / a), G: uint8(g * 0xff / a), B: uint8(b * 0xff / a), A: uint8(a / n >> 8)}
+			}
+			result.SetNRGBA(x, y, pixel)
+		}
+	}
+	return result
+}
+
+// UploadAvatarHandler takes a JPEG, PNG or GIF as the avatar form file.
+func (s *Server) UploadAvatarHandler(c echo.Context) error {
+	if s.Avatars == nil {
+		return NotFoundError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxAvatarBytes+1<<20)
+	header, err := c.FormFile("avatar")
+	if err != nil || header.Size > maxAvatarBytes {
+		return InvalidRequestError(c)
+	}
+	file, err := header.Open()
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxAvatarBytes))
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+
+	// Checking the size before decoding keeps small files that unpack into
+	// huge images out
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width == 0 || config.Height == 0 || config.Width*config.Height > maxAvatarPixels {
+		return ValidationError(c, map[string]string{"avatar": "Must be a JPEG, PNG or GIF image of at most 25 megapixels"})
+	}
+	source, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ValidationError(c, map[string]string{"avatar": "Must be a JPEG, PNG or GIF image of at most 25 megapixels"})
+	}
+
+	var encoded bytes.Buffer
+	err = png.Encode(&encoded, resizeAvatar(source))
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not encode avatar", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	err = s.Avatars.Put(ctx, avatarKey(userID), "image/png", encoded.Bytes())
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store avatar", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	var updatedAt time.Time
+	err = s.DB.QueryRowContext(ctx, "UPDATE users SET avatar_updated_at=now() WHERE user_id=$1 RETURNING avatar_updated_at", userID).Scan(&updatedAt)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update avatar", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"avatar_url": s.avatarURL(userID, updatedAt)})
+}
+
+func (s *Server) DeleteAvatarHandler(c echo.Context) error {
+	if s.Avatars == nil {
+		return NotFoundError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	_, err := s.DB.ExecContext(ctx, "UPDATE users SET avatar_updated_at=NULL WHERE user_id=$1", userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update avatar", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.DeleteAvatar(ctx, userID)
+
+	return c.JSON(200, echo.Map{"status": "Avatar removed"})
+}
+
+// DeleteAvatar removes the user's stored avatar. Failures are only logged,
+// leaving at worst an orphaned file.
+func (s *Server) DeleteAvatar(ctx context.Context, userID string) {
+	if s.Avatars == nil {
+		return
+	}
+	err := s.Avatars.Delete(ctx, avatarKey(userID))
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not delete avatar", "user_id", userID, "error", err)
+	}
+}
+
+// AvatarHandler serves avatars to anyone, the way profile pictures are
+// usually shown to other users.
+func (s *Server) AvatarHandler(c echo.Context) error {
+	if s.Avatars == nil {
+		return NotFoundError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+
+	var updatedAt *time.Time
+	err := s.DB.QueryRowContext(ctx, "SELECT avatar_updated_at FROM users WHERE user_id=$1", userID).Scan(&updatedAt)
+	if err != nil || updatedAt == nil {
+		return NotFoundError(c)
+	}
+
+	etag := `"` + strconv.FormatInt(updatedAt.UnixNano(), 36) + `"`
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	data, contentType, err := s.Avatars.Get(ctx, avatarKey(userID))
+	if errors.Is(err, errBlobNotFound) {
+		return NotFoundError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read avatar", "error", err)
+		return InvalidRequestError(c)
+	}
+	return c.Blob(200, contentType, data)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	backchannelLogoutEvent   = "http://schemas.openid.net/event/backchannel-logout"
+	backchannelLogoutTimeout = time.Second * 10
+	logoutTokenLifetime      = time.Minute * 2
+)
+
+var errUnsafeLogoutURI = errors.New("back-channel logout URI must be https and not on an internal network")
+
+// backchannelLogoutClient posts logout tokens. Anyone can register a client,
+// so it refuses to reach internal addresses, checked again on every dial so
+// DNS can't point a name there later, and it never follows redirects.
+var backchannelLogoutClient = &http.Client{
+	Timeout: backchannelLogoutTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: backchannelLogoutTimeout,
+			Control: func(network string, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip, err := netip.ParseAddr(host)
+				if err != nil || !publicAddr(ip) {
+					return errUnsafeLogoutURI
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: backchannelLogoutTimeout,
+	},
+}
+
+// publicAddr tells whether the address is outside the loopback, private,
+// link-local and unspecified ranges.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsUnspecified()
+}
+
+// ValidBackchannelLogoutURI accepts https URIs that don't name an internal
+// address outright. Hosts given by name are checked once resolved.
+func ValidBackchannelLogoutURI(logoutURI string) bool {
+	uri, err := url.Parse(logoutURI)
+	if err != nil || uri.Scheme != "https" || uri.Host == "" || uri.User != nil || uri.Fragment != "" {
+		return false
+	}
+
+	host := strings.ToLower(uri.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !publicAddr(ip) {
+		return false
+	}
+	return true
+}
+
+// sessionClientsKey is the set of clients that got tokens through the
+// session, which are the ones to tell when it ends.
+func sessionClientsKey(sessionID string) string {
+	return "session_clients:" + HashToken(sessionID)
+}
+
+// SessionSID is the sid claim identifying a session to clients. The session
+// ID itself works as a credential, so clients only ever see its hash.
+func SessionSID(sessionID string) string {
+	return HashToken(sessionID)
+}
+
+// RecordSessionClient remembers that the client got tokens through the
+// session, for as long as the session could live.
+func (s *Server) RecordSessionClient(ctx context.Context, sessionID string, clientID string) error {
+	key := sessionClientsKey(sessionID)
+	err := s.RDB.SAdd(ctx, key, clientID).Err()
+	if err != nil {
+		return err
+	}
+	return s.RDB.Expire(ctx, key, s.RememberSessionLifetime).Err()
+}
+
+// BackchannelLogout tells every client that got tokens through the session
+// that it ended, following OpenID Connect Back-Channel Logout 1.0. Clients
+// are notified in the background, so a slow client never holds up the
+// sign-out.
+func (s *Server) BackchannelLogout(ctx context.Context, userID string, sessionID string) {
+	key := sessionClientsKey(sessionID)
+	clientIDs, err := s.RDB.SMembers(ctx, key).Result()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read session clients", "error", err)
+		return
+	}
+	s.RDB.Del(ctx, key)
+
+	for _, clientID := range clientIDs {
+		client, err := s.GetClient(ctx, clientID)
+		if err != nil || client.BackchannelLogoutURI == "" {
+			continue
+		}
+
+		go func(client *Client) {
+			ctx, cancel := context.WithTimeout(context.Background(), backchannelLogoutTimeout)
+			defer cancel()
+
+			err := s.SendLogoutToken(ctx, client, userID, SessionSID(sessionID))
+			if err != nil {
+				s.Logger.WarnContext(ctx, "Back-channel logout failed", "client_id", client.ClientID, "error", err)
+			}
+		}(client)
+	}
+}
+
+// SendLogoutToken posts a signed logout token to the client's back-channel
+// logout URI.
+func (s *Server) SendLogoutToken(ctx context.Context, client *Client, userID string, sid string) error {
+	// Clients registered before URIs were checked could still name one
+	if !ValidBackchannelLogoutURI(client.BackchannelLogoutURI) {
+		return errUnsafeLogoutURI
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":    s.IssuerURL,
+		"sub":    userID,
+		"aud":    client.ClientID,
+		"iat":    now.Unix(),
+		"exp":    now.Add(logoutTokenLifetime).Unix(),
+		"jti":    uuid.New().String(),
+		"sid":    sid,
+		"events": map[string]interface{}{backchannelLogoutEvent: map[string]interface{}{}},
+	})
+	key := s.SigningKeys.Current()
+	token.Header["kid"] = key.ID
+	token.Header["typ"] = "logout+jwt"
+	logoutToken, err := token.SignedString(key.Private)
+	if err != nil {
+		return err
+	}
+
+	form := url.Values{"logout_token": {logoutToken}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, client.BackchannelLogoutURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := backchannelLogoutClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("client returned %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps files such as avatars outside the database. Keys are
+// slash separated paths.
+type BlobStore interface {
+	Put(ctx context.Context, key string, contentType string, data []byte) error
+	// Get returns errBlobNotFound for keys that were never stored
+	Get(ctx context.Context, key string) (data []byte, contentType string, err error)
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalBlobStore keeps blobs as files under a directory.
+type LocalBlobStore struct {
+	Dir string
+}
+
+func (l *LocalBlobStore) path(key string) string {
+	return filepath.Join(l.Dir, filepath.FromSlash(filepath.Clean("/"+key)))
+}
+
+func (l *LocalBlobStore) Put(ctx context.Context, key string, contentType string, data []byte) error {
+	path := l.path(key)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	// Written aside and renamed, so readers never see half a file
+	temp := path + ".tmp"
+	err = os.WriteFile(temp, data, 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Get sniffs the content type, since only the data is kept.
+func (l *LocalBlobStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	data, err := os.ReadFile(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, "", errBlobNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return data, http.DetectContentType(data), nil
+}
+
+func (l *LocalBlobStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(l.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// S3BlobStore keeps blobs in an S3 bucket, or anything speaking the S3 API
+// like MinIO or R2. Requests are signed with AWS Signature Version 4 and use
+// path-style URLs, which every implementation supports.
+type S3BlobStore struct {
+	// Endpoint is like https://s3.eu-west-1.amazonaws.com
+	Endpoint        string
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+func (b *S3BlobStore) objectURL(key string) string {
+	return strings.TrimSuffix(b.Endpoint, "/") + "/" + url.PathEscape(b.Bucket) + "/" + (&url.URL{Path: key}).EscapedPath()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds the Signature Version 4 headers to the request.
+func (b *S3BlobStore) sign(request *http.Request, payload []byte) {
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(payload)
+	request.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + request.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + request.Header.Get("X-Amz-Date") + "\n"
+	canonicalRequest := strings.Join([]string{
+		request.Method, request.URL.EscapedPath(), request.URL.RawQuery, canonicalHeaders, signedHeaders, payloadHash,
+	}, "\n")
+
+	scope := date + "/" + b.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + request.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+b.SecretAccessKey), date)
+	key = hmacSHA256(key, b.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func (b *S3BlobStore) do(ctx context.Context, method string, key string, contentType string, payload []byte) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, b.objectURL(key), bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	b.sign(request, payload)
+	return http.DefaultClient.Do(request)
+}
+
+func (b *S3BlobStore) Put(ctx context.Context, key string, contentType string, data []byte) error {
+	response, err := b.do(ctx, http.MethodPut, key, contentType, data)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("S3 put returned %s", response.Status)
+	}
+	return nil
+}
+
+func (b *S3BlobStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	response, err := b.do(ctx, http.MethodGet, key, "", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return nil, "", errBlobNotFound
+	}
+	if response.StatusCode >= 300 {
+		return nil, "", fmt.Errorf("S3 get returned %s", response.Status)
+	}
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, response.Header.Get("Content-Type"), nil
+}
+
+func (b *S3BlobStore) Delete(ctx context.Context, key string) error {
+	response, err := b.do(ctx, http.MethodDelete, key, "", nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	// Deleting a missing object succeeds with S3 too
+	if response.StatusCode >= 300 && response.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("S3 delete returned %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Config struct {
+	DBURL string
+	// RedisAddrs is one address, or the sentinels or cluster nodes
+	RedisAddrs            []string
+	RedisPassword         string
+	RedisMode             string
+	RedisSentinelMaster   string
+	RedisSentinelPassword string
+	Port                  string
+	TLSCertFile           string
+	TLSKeyFile            string
+	// Client certificates signed by this CA can authenticate with mTLS
+	MTLSClientCAFile string
+	MTLSRequired     bool
+	AllowedOrigins   []string
+	LogLevel         string
+
+	BcryptCost        int
+	PasswordMinLength int
+	// PasswordMinScore is the lowest zxcvbn-style strength score accepted,
+	// and PasswordBannedFile lists more passwords to refuse
+	PasswordMinScore   int
+	PasswordBannedFile string
+	// BreachCheck is warn or reject to look new passwords up in Have I
+	// Been Pwned, empty to leave it off
+	BreachCheck         string
+	BreachCheckCacheTTL time.Duration
+	// DisposableEmailAction is flag or reject to check signups against
+	// DisposableEmailList, a path or URL, empty to leave it off
+	DisposableEmailAction          string
+	DisposableEmailList            string
+	DisposableEmailRefreshInterval time.Duration
+	PasswordHistory                int
+	PasswordMaxAge                 time.Duration
+	// SessionLifetime is the idle timeout, since sessions get extended as
+	// they are used, and SessionMaxLifetime the absolute lifetime
+	SessionLifetime         time.Duration
+	SessionRefreshThreshold time.Duration
+	RememberSessionLifetime time.Duration
+	SessionSliding          bool
+	SessionMaxLifetime      time.Duration
+	MaxSessions             int64
+	MaxSessionsByDomain     map[string]int64
+	SessionLimitAction      string
+	// SessionBindFingerprint ties sessions to the IP prefix and user agent
+	// they were created with
+	SessionBindFingerprint bool
+	// CookieSecrets sign the session cookies, newest first
+	CookieSecrets [][]byte
+	Cookie        CookieConfig
+	// SessionStore is redis, postgres, memory, or stateless to keep sessions
+	// in the cookie. Sessions outside Redis don't touch it, though flows like
+	// lockouts and one-time codes still do.
+	SessionStore       string
+	LoginMaxAttempts   int64
+	LoginLockoutWindow time.Duration
+	// Lockouts start at LoginLockoutDuration and double each time in a row
+	LoginMaxAttemptsPerIP   int64
+	LoginLockoutDuration    time.Duration
+	LoginLockoutMaxDuration time.Duration
+	LoginDelay              time.Duration
+	LoginDelayMax           time.Duration
+	ShutdownTimeout         time.Duration
+	// Sensitive changes need a password or factor entered within this long
+	ReauthMaxAge time.Duration
+	// Destructive changes need sudo mode, which lasts this long
+	SudoLifetime time.Duration
+	// Accounts deleted through DELETE /profile stay restorable this long
+	AccountDeletionGracePeriod time.Duration
+	// PasswordlessOnly turns passwords off, leaving magic links, codes and
+	// upstream providers to sign in with
+	PasswordlessOnly bool
+	// RegistrationClosed leaves only invited and admin created users
+	RegistrationClosed bool
+	RequireApproval    bool
+	// AllowedEmailDomains and BlockedEmailDomains are lowercase, without @
+	AllowedEmailDomains []string
+	BlockedEmailDomains []string
+	// RequireEmailVerification keeps password sign-ins out until the email
+	// address is confirmed
+	RequireEmailVerification bool
+	NewDeviceNotifications   bool
+	TermsVersion             string
+	PrivacyVersion           string
+	ConsentEnforcement       string
+
+	LoginPageURL               string
+	AccessTokenLifetime        time.Duration
+	IssuerURL                  string
+	SigningKeyFiles            []string
+	SigningKeyRotationInterval time.Duration
+	JWTAlgorithm               string
+	JWTSecret                  string
+	RefreshTokenLifetime       time.Duration
+
+	SocialLoginRedirectURL string
+	GoogleClientID         string
+	GoogleClientSecret     string
+	GitHubClientID         string
+	GitHubClientSecret     string
+	AppleClientID          string
+	AppleTeamID            string
+	AppleKeyID             string
+	ApplePrivateKeyFile    string
+	MicrosoftClientID      string
+	MicrosoftClientSecret  string
+	MicrosoftTenant        string
+	OIDCProviders          []OIDCProviderConfig
+	SAMLIDPMetadataURL     string
+	SAMLEntityID           string
+	SAMLCertFile           string
+	SAMLKeyFile            string
+
+	SMTPHost                  string
+	SMTPPort                  string
+	SMTPUsername              string
+	SMTPPassword              string
+	MailFrom                  string
+	MagicLinkLifetime         time.Duration
+	PasswordResetURL          string
+	PasswordResetLifetime     time.Duration
+	InvitationURL             string
+	InvitationLifetime        time.Duration
+	EmailVerificationLifetime time.Duration
+	// EmailRevertLifetime is how long the old address can undo a change
+	EmailRevertLifetime time.Duration
+	TOTPIssuer          string
+
+	TwilioAccountSID string
+	TwilioAuthToken  string
+	TwilioFrom       string
+	OTPLifetime      time.Duration
+	OTPSendLimit     int64
+	OTPSendWindow    time.Duration
+
+	// PushWebhookURL receives sign-in approvals to push to devices
+	PushWebhookURL string
+
+	// AvatarStore is local or s3, empty to turn avatars off. Local avatars
+	// go under AvatarDir.
+	AvatarStore       string
+	AvatarDir         string
+	S3Endpoint        string
+	S3Region          string
+	S3Bucket          string
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+
+	// SuspiciousLoginAction is alert, mfa or block, empty to not check
+	// sign-ins. SecurityWebhookURL receives the security events.
+	SuspiciousLoginAction string
+	TorExitNodesFile      string
+	SecurityWebhookURL    string
+
+	// CaptchaProvider is hcaptcha or recaptcha, empty to disable CAPTCHAs
+	CaptchaProvider      string
+	CaptchaSecret        string
+	CaptchaAfterFailures int64
+}
+
+// builtinProviders can't be reused as names for configured OIDC providers
+var builtinProviders = map[string]bool{"google": true, "github": true, "apple": true, "microsoft": true}
+
+// envLoader reads environment variables and collects every problem it finds,
+// so a misconfigured deployment reports all of them at once.
+type envLoader struct {
+	problems []string
+}
+
+func (l *envLoader) required(key string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		l.problems = append(l.problems, fmt.Sprintf("%s is required", key))
+	}
+	return value
+}
+
+func (l *envLoader) optional(key string, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func (l *envLoader) bool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		l.problems = append(l.problems, fmt.Sprintf("%s must be true or false", key))
+		return fallback
+	}
+	return enabled
+}
+
+func (l *envLoader) duration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		l.problems = append(l.problems, fmt.Sprintf("%s must be a duration like 10s or 24h", key))
+		return fallback
+	}
+	return duration
+}
+
+func (l *envLoader) int(key string, fallback int64) int64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		l.problems = append(l.problems, fmt.Sprintf("%s must be a number", key))
+		return fallback
+	}
+	return number
+}
+
+func (l *envLoader) check(ok bool, problem string) {
+	if !ok {
+		l.problems = append(l.problems, problem)
+	}
+}
+
+// splitList splits a comma-separated value, ignoring blank entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// devDefaults stand in for settings left unset in development mode, so the
+// server runs over plain HTTP. With DB_URL and REDIS_URL unset it starts its
+// own Postgres and Redis, see StartDevServices.
+var devDefaults = map[string]string{
+	"SESSION_STORE": SessionStoreMemory,
+	"COOKIE_NAME":   "session",
+	"COOKIE_SECURE": "false",
+	"LOG_LEVEL":     "debug",
+	"BCRYPT_COST":   "10",
+}
+
+// applyDevDefaults fills in devDefaults for every variable that isn't set.
+func applyDevDefaults() {
+	for key, value := range devDefaults {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, value)
+		}
+	}
+}
+
+// LoadConfig reads the server configuration from the environment, and from
+// a .env file when one is present. CONFIG_FILE points at another file in the
+// same format, which then has to exist. Variables already set in the
+// environment win over the file. In development mode unset variables fall
+// back to devDefaults.
+func LoadConfig(dev bool) (*Config, error) {
+	if file := os.Getenv("CONFIG_FILE"); file != "" {
+		err := godotenv.Load(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read config file %s: %w", file, err)
+		}
+	} else {
+		err := godotenv.Load()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("could not read .env file: %w", err)
+		}
+	}
+
+	if dev {
+		applyDevDefaults()
+	}
+
+	l := &envLoader{}
+	config := &Config{
+		DBURL:            os.Getenv("DB_URL"),
+		RedisAddrs:       splitList(os.Getenv("REDIS_URL")),
+		RedisPassword:    os.Getenv("REDIS_PASSWORD"),
+		Port:             l.optional("PORT", "3030"),
+		TLSCertFile:      os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:       os.Getenv("TLS_KEY_FILE"),
+		MTLSClientCAFile: os.Getenv("MTLS_CLIENT_CA_FILE"),
+		MTLSRequired:     l.bool("MTLS_REQUIRED", false),
+		AllowedOrigins:   splitList(l.optional("ALLOWED_ORIGINS", "http://localhost:3000")),
+		LogLevel:         os.Getenv("LOG_LEVEL"),
+
+		BcryptCost:                     int(l.int("BCRYPT_COST", 14)),
+		PasswordMinLength:              int(l.int("PASSWORD_MIN_LENGTH", 8)),
+		PasswordMinScore:               int(l.int("PASSWORD_MIN_SCORE", 2)),
+		PasswordBannedFile:             os.Getenv("PASSWORD_BANNED_FILE"),
+		BreachCheck:                    os.Getenv("PASSWORD_BREACH_CHECK"),
+		BreachCheckCacheTTL:            l.duration("PASSWORD_BREACH_CACHE_TTL", time.Hour*24),
+		DisposableEmailAction:          os.Getenv("DISPOSABLE_EMAIL_ACTION"),
+		DisposableEmailList:            l.optional("DISPOSABLE_EMAIL_LIST", defaultDisposableDomainsURL),
+		DisposableEmailRefreshInterval: l.duration("DISPOSABLE_EMAIL_REFRESH_INTERVAL", time.Hour*24),
+		PasswordHistory:                int(l.int("PASSWORD_HISTORY", 0)),
+		PasswordMaxAge:                 l.duration("PASSWORD_MAX_AGE", 0),
+		SessionLifetime:                l.duration("SESSION_LIFETIME", time.Hour),
+		LoginMaxAttempts:               l.int("LOGIN_MAX_ATTEMPTS", 5),
+		LoginLockoutWindow:             l.duration("LOGIN_LOCKOUT_WINDOW", time.Minute*15),
+		LoginMaxAttemptsPerIP:          l.int("LOGIN_MAX_ATTEMPTS_PER_IP", 50),
+		LoginLockoutDuration:           l.duration("LOGIN_LOCKOUT_DURATION", time.Minute*15),
+		LoginLockoutMaxDuration:        l.duration("LOGIN_LOCKOUT_MAX_DURATION", time.Hour*24),
+		LoginDelay:                     l.duration("LOGIN_DELAY", time.Millisecond*250),
+		LoginDelayMax:                  l.duration("LOGIN_DELAY_MAX", time.Second*8),
+		ShutdownTimeout:                l.duration("SHUTDOWN_TIMEOUT", time.Second*10),
+		ReauthMaxAge:                   l.duration("REAUTH_MAX_AGE", time.Minute*10),
+		PasswordlessOnly:               l.bool("PASSWORDLESS_ONLY", false),
+		RegistrationClosed:             l.bool("REGISTRATION_CLOSED", false),
+		RequireApproval:                l.bool("REQUIRE_APPROVAL", false),
+		AllowedEmailDomains:            normalizeDomains(splitList(os.Getenv("ALLOWED_EMAIL_DOMAINS"))),
+		BlockedEmailDomains:            normalizeDomains(splitList(os.Getenv("BLOCKED_EMAIL_DOMAINS"))),
+		RequireEmailVerification:       l.bool("REQUIRE_EMAIL_VERIFICATION", true),
+		NewDeviceNotifications:         l.bool("NEW_DEVICE_NOTIFICATIONS", true),
+		TermsVersion:                   os.Getenv("TERMS_VERSION"),
+		PrivacyVersion:                 os.Getenv("PRIVACY_VERSION"),
+		ConsentEnforcement:             strings.ToLower(l.optional("CONSENT_ENFORCEMENT", ConsentBlock)),
+		SudoLifetime:                   l.duration("SUDO_LIFETIME", time.Minute*5),
+		AccountDeletionGracePeriod:     l.duration("ACCOUNT_DELETION_GRACE_PERIOD", time.Hour*24*30),
+
+		LoginPageURL:               os.Getenv("LOGIN_PAGE_URL"),
+		AccessTokenLifetime:        l.duration("ACCESS_TOKEN_LIFETIME", time.Hour),
+		SigningKeyFiles:            splitList(os.Getenv("SIGNING_KEY_FILES")),
+		SigningKeyRotationInterval: l.duration("SIGNING_KEY_ROTATION_INTERVAL", time.Hour*24*30),
+		JWTAlgorithm:               strings.ToUpper(os.Getenv("JWT_ALGORITHM")),
+		JWTSecret:                  os.Getenv("JWT_SECRET"),
+
+		RefreshTokenLifetime: l.duration("REFRESH_TOKEN_LIFETIME", time.Hour*24*30),
+
+		SocialLoginRedirectURL: l.optional("SOCIAL_LOGIN_REDIRECT_URL", "/"),
+		GoogleClientID:         os.Getenv("GOOGLE_CLIENT_ID"),
+		GoogleClientSecret:     os.Getenv("GOOGLE_CLIENT_SECRET"),
+		GitHubClientID:         os.Getenv("GITHUB_CLIENT_ID"),
+		GitHubClientSecret:     os.Getenv("GITHUB_CLIENT_SECRET"),
+		AppleClientID:          os.Getenv("APPLE_CLIENT_ID"),
+		AppleTeamID:            os.Getenv("APPLE_TEAM_ID"),
+		AppleKeyID:             os.Getenv("APPLE_KEY_ID"),
+		ApplePrivateKeyFile:    os.Getenv("APPLE_PRIVATE_KEY_FILE"),
+		MicrosoftClientID:      os.Getenv("MICROSOFT_CLIENT_ID"),
+		MicrosoftClientSecret:  os.Getenv("MICROSOFT_CLIENT_SECRET"),
+		MicrosoftTenant:        l.optional("MICROSOFT_TENANT", "common"),
+		SAMLIDPMetadataURL:     os.Getenv("SAML_IDP_METADATA_URL"),
+		SAMLCertFile:           os.Getenv("SAML_CERT_FILE"),
+		SAMLKeyFile:            os.Getenv("SAML_KEY_FILE"),
+
+		SMTPHost:                  os.Getenv("SMTP_HOST"),
+		SMTPPort:                  l.optional("SMTP_PORT", "587"),
+		SMTPUsername:              os.Getenv("SMTP_USERNAME"),
+		SMTPPassword:              os.Getenv("SMTP_PASSWORD"),
+		MailFrom:                  os.Getenv("MAIL_FROM"),
+		MagicLinkLifetime:         l.duration("MAGIC_LINK_LIFETIME", time.Minute*15),
+		PasswordResetURL:          os.Getenv("PASSWORD_RESET_URL"),
+		PasswordResetLifetime:     l.duration("PASSWORD_RESET_LIFETIME", time.Minute*30),
+		InvitationURL:             os.Getenv("INVITATION_URL"),
+		InvitationLifetime:        l.duration("INVITATION_LIFETIME", time.Hour*24*7),
+		EmailVerificationLifetime: l.duration("EMAIL_VERIFICATION_LIFETIME", time.Hour*24),
+		EmailRevertLifetime:       l.duration("EMAIL_REVERT_LIFETIME", time.Hour*24*7),
+		TOTPIssuer:                l.optional("TOTP_ISSUER", "authgate"),
+
+		TwilioAccountSID: os.Getenv("TWILIO_ACCOUNT_SID"),
+		TwilioAuthToken:  os.Getenv("TWILIO_AUTH_TOKEN"),
+		TwilioFrom:       os.Getenv("TWILIO_FROM"),
+		OTPLifetime:      l.duration("OTP_LIFETIME", time.Minute*5),
+		OTPSendLimit:     l.int("OTP_SEND_LIMIT", 5),
+		OTPSendWindow:    l.duration("OTP_SEND_WINDOW", time.Hour),
+
+		PushWebhookURL: os.Getenv("PUSH_WEBHOOK_URL"),
+
+		AvatarStore:       strings.ToLower(os.Getenv("AVATAR_STORE")),
+		AvatarDir:         l.optional("AVATAR_DIR", "data/avatars"),
+		S3Endpoint:        os.Getenv("S3_ENDPOINT"),
+		S3Region:          l.optional("S3_REGION", "us-east-1"),
+		S3Bucket:          os.Getenv("S3_BUCKET"),
+		S3AccessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+		S3SecretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+
+		SuspiciousLoginAction: strings.ToLower(os.Getenv("SUSPICIOUS_LOGIN_ACTION")),
+		TorExitNodesFile:      os.Getenv("TOR_EXIT_NODES_FILE"),
+		SecurityWebhookURL:    os.Getenv("SECURITY_WEBHOOK_URL"),
+
+		CaptchaProvider:      strings.ToLower(os.Getenv("CAPTCHA_PROVIDER")),
+		CaptchaSecret:        os.Getenv("CAPTCHA_SECRET"),
+		CaptchaAfterFailures: l.int("CAPTCHA_AFTER_FAILURES", 3),
+	}
+	config.SessionRefreshThreshold = l.duration("SESSION_REFRESH_THRESHOLD", config.SessionLifetime/2)
+	config.IssuerURL = strings.TrimSuffix(l.optional("ISSUER_URL", "http://localhost:"+config.Port), "/")
+	config.RememberSessionLifetime = l.duration("REMEMBER_SESSION_LIFETIME", time.Hour*24*30)
+	config.SessionSliding = l.bool("SESSION_SLIDING", false)
+	config.SessionMaxLifetime = l.duration("SESSION_MAX_LIFETIME", 0)
+	config.MaxSessions = l.int("MAX_SESSIONS", 0)
+	config.SessionBindFingerprint = l.bool("SESSION_BIND_FINGERPRINT", false)
+	config.SessionStore = strings.ToLower(l.optional("SESSION_STORE", SessionStoreRedis))
+	config.RedisMode = strings.ToLower(l.optional("REDIS_MODE", RedisModeSingle))
+	config.RedisSentinelMaster = os.Getenv("REDIS_SENTINEL_MASTER")
+	config.RedisSentinelPassword = os.Getenv("REDIS_SENTINEL_PASSWORD")
+	config.Cookie = CookieConfig{
+		Name:   l.optional("COOKIE_NAME", "__Host-session"),
+		Domain: os.Getenv("COOKIE_DOMAIN"),
+		Path:   l.optional("COOKIE_PATH", "/"),
+		Secure: l.bool("COOKIE_SECURE", true),
+	}
+	sameSite, ok := cookieSameSiteModes[strings.ToLower(l.optional("COOKIE_SAMESITE", "strict"))]
+	l.check(ok, "COOKIE_SAMESITE must be strict, lax or none")
+	config.Cookie.SameSite = sameSite
+	// Browsers silently drop cookies that break these rules
+	l.check(!strings.HasPrefix(config.Cookie.Name, "__Host-") ||
+		(config.Cookie.Secure && config.Cookie.Domain == "" && config.Cookie.Path == "/"),
+		"COOKIE_NAME with the __Host- prefix needs COOKIE_SECURE=true, no COOKIE_DOMAIN and COOKIE_PATH=/")
+	l.check(!strings.HasPrefix(config.Cookie.Name, "__Secure-") || config.Cookie.Secure,
+		"COOKIE_NAME with the __Secure- prefix needs COOKIE_SECURE=true")
+	l.check(sameSite != http.SameSiteNoneMode || config.Cookie.Secure, "COOKIE_SAMESITE=none needs COOKIE_SECURE=true")
+	l.check(strings.HasPrefix(config.Cookie.Path, "/"), "COOKIE_PATH must start with /")
+	for _, secret := range splitList(os.Getenv("COOKIE_SECRETS")) {
+		l.check(len(secret) >= 32, "COOKIE_SECRETS entries must be at least 32 characters")
+		config.CookieSecrets = append(config.CookieSecrets, []byte(secret))
+	}
+	// Unsigned cookies would let anyone pick their session ID, development
+	// mode makes up a secret that lasts until the restart
+	if dev && len(config.CookieSecrets) == 0 {
+		config.CookieSecrets = [][]byte{[]byte(RandomToken())}
+	}
+	l.check(len(config.CookieSecrets) > 0, "COOKIE_SECRETS is required to sign session cookies")
+	config.SessionLimitAction = strings.ToLower(l.optional("SESSION_LIMIT_ACTION", SessionLimitEvict))
+	config.SAMLEntityID = l.optional("SAML_ENTITY_ID", config.IssuerURL+"/saml/metadata")
+
+	l.check(config.BcryptCost >= bcrypt.MinCost && config.BcryptCost <= bcrypt.MaxCost,
+		fmt.Sprintf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost))
+	l.check(config.PasswordMinLength > 0 && config.PasswordMinLength <= maxPasswordBytes,
+		fmt.Sprintf("PASSWORD_MIN_LENGTH must be between 1 and %d", maxPasswordBytes))
+	l.check(config.PasswordMinScore >= 0 && config.PasswordMinScore <= 4, "PASSWORD_MIN_SCORE must be between 0 and 4")
+	l.check(config.BreachCheck == "" || config.BreachCheck == BreachCheckWarn || config.BreachCheck == BreachCheckReject,
+		"PASSWORD_BREACH_CHECK must be warn or reject")
+	l.check(config.SuspiciousLoginAction == "" || config.SuspiciousLoginAction == SuspiciousLoginAlert ||
+		config.SuspiciousLoginAction == SuspiciousLoginMFA || config.SuspiciousLoginAction == SuspiciousLoginBlock,
+		"SUSPICIOUS_LOGIN_ACTION must be alert, mfa or block")
+	l.check(config.ConsentEnforcement == ConsentBlock || config.ConsentEnforcement == ConsentFlag, "CONSENT_ENFORCEMENT must be block or flag")
+	l.check(config.AvatarStore == "" || config.AvatarStore == "local" || config.AvatarStore == "s3", "AVATAR_STORE must be local or s3")
+	l.check(config.AvatarStore != "s3" || (config.S3Endpoint != "" && config.S3Bucket != ""),
+		"S3_ENDPOINT and S3_BUCKET are required when AVATAR_STORE is s3")
+	l.check(config.BreachCheckCacheTTL > 0, "PASSWORD_BREACH_CACHE_TTL must be positive")
+	l.check(config.DisposableEmailAction == "" || config.DisposableEmailAction == DisposableEmailFlag || config.DisposableEmailAction == DisposableEmailReject,
+		"DISPOSABLE_EMAIL_ACTION must be flag or reject")
+	l.check(config.DisposableEmailRefreshInterval > 0, "DISPOSABLE_EMAIL_REFRESH_INTERVAL must be positive")
+	l.check(config.PasswordHistory >= 0 && config.PasswordHistory <= 24, "PASSWORD_HISTORY must be between 0 and 24")
+	l.check(config.PasswordMaxAge >= 0, "PASSWORD_MAX_AGE must not be negative")
+	l.check(config.SessionLifetime > 0, "SESSION_LIFETIME must be positive")
+	l.check(config.RememberSessionLifetime >= config.SessionLifetime, "REMEMBER_SESSION_LIFETIME must not be shorter than SESSION_LIFETIME")
+	l.check(config.SessionRefreshThreshold > 0 && config.SessionRefreshThreshold <= config.SessionLifetime,
+		"SESSION_REFRESH_THRESHOLD must be positive and not longer than SESSION_LIFETIME")
+	l.check(config.SessionMaxLifetime == 0 || config.SessionMaxLifetime >= config.SessionLifetime,
+		"SESSION_MAX_LIFETIME must be unset or not shorter than SESSION_LIFETIME")
+	l.check(config.LoginMaxAttempts > 0, "LOGIN_MAX_ATTEMPTS must be positive")
+	l.check(config.LoginMaxAttemptsPerIP >= 0, "LOGIN_MAX_ATTEMPTS_PER_IP must not be negative")
+	l.check(config.LoginLockoutDuration > 0, "LOGIN_LOCKOUT_DURATION must be positive")
+	l.check(config.LoginLockoutMaxDuration >= config.LoginLockoutDuration, "LOGIN_LOCKOUT_MAX_DURATION must not be shorter than LOGIN_LOCKOUT_DURATION")
+	l.check(config.LoginDelay >= 0, "LOGIN_DELAY must not be negative")
+	l.check(config.LoginDelayMax >= config.LoginDelay, "LOGIN_DELAY_MAX must not be shorter than LOGIN_DELAY")
+	l.check(config.ReauthMaxAge > 0, "REAUTH_MAX_AGE must be positive")
+	l.check(config.SudoLifetime > 0, "SUDO_LIFETIME must be positive")
+	l.check(config.AccountDeletionGracePeriod >= 0, "ACCOUNT_DELETION_GRACE_PERIOD must not be negative")
+	l.check(config.SigningKeyRotationInterval >= time.Hour, "SIGNING_KEY_ROTATION_INTERVAL must be at least 1h")
+	l.check(config.JWTAlgorithm == "" || config.JWTAlgorithm == "HS256" || config.JWTAlgorithm == "RS256",
+		"JWT_ALGORITHM must be HS256 or RS256")
+	l.check(config.JWTAlgorithm != "HS256" || len(config.JWTSecret) >= 32, "JWT_SECRET must be at least 32 characters with HS256")
+	l.check(config.GoogleClientID == "" || config.GoogleClientSecret != "", "GOOGLE_CLIENT_SECRET is required with GOOGLE_CLIENT_ID")
+	l.check(config.GitHubClientID == "" || config.GitHubClientSecret != "", "GITHUB_CLIENT_SECRET is required with GITHUB_CLIENT_ID")
+	l.check(config.AppleClientID == "" || (config.AppleTeamID != "" && config.AppleKeyID != "" && config.ApplePrivateKeyFile != ""),
+		"APPLE_TEAM_ID, APPLE_KEY_ID and APPLE_PRIVATE_KEY_FILE are required with APPLE_CLIENT_ID")
+	l.check(config.MicrosoftClientID == "" || config.MicrosoftClientSecret != "", "MICROSOFT_CLIENT_SECRET is required with MICROSOFT_CLIENT_ID")
+	l.check(config.SAMLIDPMetadataURL == "" || (config.SAMLCertFile != "" && config.SAMLKeyFile != ""),
+		"SAML_CERT_FILE and SAML_KEY_FILE are required with SAML_IDP_METADATA_URL")
+	l.check((config.TLSCertFile == "") == (config.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	l.check(config.MTLSClientCAFile == "" || config.TLSCertFile != "", "MTLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE")
+	l.check(!config.MTLSRequired || config.MTLSClientCAFile != "", "MTLS_REQUIRED needs MTLS_CLIENT_CA_FILE")
+	l.check(config.SMTPHost == "" || config.MailFrom != "", "MAIL_FROM is required with SMTP_HOST")
+	l.check(config.MagicLinkLifetime > 0, "MAGIC_LINK_LIFETIME must be positive")
+	l.check(config.PasswordResetLifetime > 0, "PASSWORD_RESET_LIFETIME must be positive")
+	l.check(config.InvitationLifetime > 0, "INVITATION_LIFETIME must be positive")
+	l.check(config.EmailVerificationLifetime > 0, "EMAIL_VERIFICATION_LIFETIME must be positive")
+	l.check(config.EmailRevertLifetime > 0, "EMAIL_REVERT_LIFETIME must be positive")
+	l.check(config.TwilioAccountSID == "" || (config.TwilioAuthToken != "" && config.TwilioFrom != ""),
+		"TWILIO_AUTH_TOKEN and TWILIO_FROM are required with TWILIO_ACCOUNT_SID")
+	l.check(config.OTPLifetime > 0, "OTP_LIFETIME must be positive")
+	l.check(config.OTPSendLimit > 0, "OTP_SEND_LIMIT must be positive")
+	l.check(config.CaptchaProvider == "" || captchaVerifyURLs[config.CaptchaProvider] != "", "CAPTCHA_PROVIDER must be hcaptcha or recaptcha")
+	l.check(config.CaptchaProvider == "" || config.CaptchaSecret != "", "CAPTCHA_SECRET is required with CAPTCHA_PROVIDER")
+	l.check(config.CaptchaAfterFailures >= 0, "CAPTCHA_AFTER_FAILURES must not be negative")
+	l.check(dev || config.DBURL != "", "DB_URL is required")
+	l.check(dev || len(config.RedisAddrs) > 0, "REDIS_URL is required")
+	l.check(config.RedisMode == RedisModeSingle || config.RedisMode == RedisModeSentinel || config.RedisMode == RedisModeCluster,
+		"REDIS_MODE must be single, sentinel or cluster")
+	l.check(config.RedisMode != RedisModeSingle || len(config.RedisAddrs) <= 1, "REDIS_URL takes a single address unless REDIS_MODE is sentinel or cluster")
+	l.check(config.RedisMode != RedisModeSentinel || config.RedisSentinelMaster != "", "REDIS_SENTINEL_MASTER is required with REDIS_MODE=sentinel")
+	l.check(config.MaxSessions >= 0, "MAX_SESSIONS must not be negative")
+	l.check(config.SessionStore == SessionStoreRedis || config.SessionStore == SessionStorePostgres ||
+		config.SessionStore == SessionStoreMemory || config.SessionStore == SessionStoreStateless,
+		"SESSION_STORE must be redis, postgres, memory or stateless")
+	l.check(config.SessionLimitAction == SessionLimitEvict || config.SessionLimitAction == SessionLimitRefuse,
+		"SESSION_LIMIT_ACTION must be evict or refuse")
+	for _, entry := range splitList(os.Getenv("MAX_SESSIONS_BY_DOMAIN")) {
+		// Entries look like example.com=3
+		domain, value, _ := strings.Cut(entry, "=")
+		limit, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || limit < 0 {
+			l.problems = append(l.problems, fmt.Sprintf("MAX_SESSIONS_BY_DOMAIN entry %q must look like example.com=3", entry))
+			continue
+		}
+		if config.MaxSessionsByDomain == nil {
+			config.MaxSessionsByDomain = map[string]int64{}
+		}
+		config.MaxSessionsByDomain[strings.ToLower(strings.TrimSpace(domain))] = limit
+	}
+	// Stateless sessions can't be counted, so there is nothing to limit
+	l.check(config.SessionStore != SessionStoreStateless || (config.MaxSessions == 0 && len(config.MaxSessionsByDomain) == 0),
+		"MAX_SESSIONS and MAX_SESSIONS_BY_DOMAIN are not supported with SESSION_STORE=stateless")
+	for _, name := range splitList(os.Getenv("OIDC_PROVIDERS")) {
+		name = strings.ToLower(name)
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := OIDCProviderConfig{
+			Name:         name,
+			IssuerURL:    l.required(prefix + "ISSUER"),
+			ClientID:     l.required(prefix + "CLIENT_ID"),
+			ClientSecret: l.required(prefix + "CLIENT_SECRET"),
+			Scopes:       strings.Fields(l.optional(prefix+"SCOPES", "openid email profile")),
+		}
+		l.check(!builtinProviders[name], fmt.Sprintf("OIDC_PROVIDERS entry %q clashes with a built-in provider", name))
+		l.check(containsString(provider.Scopes, "openid"), prefix+"SCOPES must include openid")
+		config.OIDCProviders = append(config.OIDCProviders, provider)
+	}
+	for _, origin := range config.AllowedOrigins {
+		// Browsers refuse credentialed requests against a wildcard origin
+		l.check(!strings.Contains(origin, "*"), "ALLOWED_ORIGINS must list exact origins, wildcards are not allowed")
+		l.check(strings.HasPrefix(origin, "http://") || strings.HasPrefix(origin, "https://"),
+			fmt.Sprintf("ALLOWED_ORIGINS entry %q must include the scheme, like https://app.example.com", origin))
+	}
+
+	if len(l.problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n  %s", strings.Join(l.problems, "\n  "))
+	}
+	return config, nil
+}
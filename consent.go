@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Documents users accept versions of
+const (
+	ConsentTerms   = "terms"
+	ConsentPrivacy = "privacy"
+)
+
+// How sessions of users who haven't accepted the current versions are
+// treated. Blocked sessions only work to accept them, while flagged ones
+// work as usual and are only told about it.
+const (
+	ConsentBlock = "block"
+	ConsentFlag  = "flag"
+)
+
+// consentPendingRoutes still work while the session waits for the user to
+// accept the current documents.
+var consentPendingRoutes = map[string]bool{
+	"GET /profile":        true,
+	"GET /consents":       true,
+	"POST /consents":      true,
+	"POST /logout":        true,
+	"POST /session/renew": true,
+}
+
+// Consent is a version of a document.
+type Consent struct {
+	Document string `json:"document"`
+	Version  string `json:"version"`
+}
+
+func ConsentRequiredError(c echo.Context, pending []Consent) error {
+	return c.JSON(403, echo.Map{"error": "Terms must be accepted", "consent_required": pending})
+}
+
+// RequiredConsents are the current versions of the documents users have to
+// accept, which leaves out documents without a configured version.
+func (s *Server) RequiredConsents() []Consent {
+	required := []Consent{}
+	if s.TermsVersion != "" {
+		required = append(required, Consent{ConsentTerms, s.TermsVersion})
+	}
+	if s.PrivacyVersion != "" {
+		required = append(required, Consent{ConsentPrivacy, s.PrivacyVersion})
+	}
+	return required
+}
+
+// consentKey names the set of current versions, so sessions can remember
+// they were accepted without a lookup on every request.
+func (s *Server) consentKey() string {
+	key := ""
+	for _, consent := range s.RequiredConsents() {
+		key += consent.Document + "=" + consent.Version + ";"
+	}
+	return key
+}
+
+// PendingConsents lists the current versions the user hasn't accepted yet.
+func (s *Server) PendingConsents(ctx context.Context, userID string) ([]Consent, error) {
+	pending := []Consent{}
+	for _, consent := range s.RequiredConsents() {
+		var accepted bool
+		err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM consents WHERE user_id=$1 AND document=$2 AND version=$3)",
+			userID, consent.Document, consent.Version).Scan(&accepted)
+		if err != nil {
+			return nil, err
+		}
+		if !accepted {
+			pending = append(pending, consent)
+		}
+	}
+	return pending, nil
+}
+
+// RecordConsents stores that the user accepted the versions, along with the
+// client they accepted them from.
+func (s *Server) RecordConsents(c echo.Context, userID string, consents []Consent) error {
+	ctx := c.Request().Context()
+	for _, consent := range consents {
+		_, err := s.DB.ExecContext(ctx, `INSERT INTO consents (user_id, document, version, ip, user_agent) VALUES($1, $2, $3, $4, $5)
+			ON CONFLICT (user_id, document, version) DO NOTHING`, userID, consent.Document, consent.Version, c.RealIP(), c.Request().UserAgent())
+		if err != nil {
+			return err
+		}
+		s.RecordAuthEvent(c, EventConsentAccepted, userID, "")
+	}
+	return nil
+}
+
+// CheckConsent holds blocked sessions to accepting the current documents.
+// A session that has accepted them remembers the versions, so only sessions
+// created before a new version see the lookup.
+func (s *Server) CheckConsent(c echo.Context, sessionID string, session *Session) error {
+	key := s.consentKey()
+	if key == "" || s.ConsentEnforcement != ConsentBlock || session.Consented == key {
+		return nil
+	}
+
+	ctx := c.Request().Context()
+	pending, err := s.PendingConsents(ctx, session.UserID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up consents", "error", err)
+		return InvalidRequestError(c)
+	}
+	if len(pending) > 0 {
+		if consentPendingRoutes[c.Request().Method+" "+c.Path()] {
+			return nil
+		}
+		return ConsentRequiredError(c, pending)
+	}
+
+	session.Consented = key
+	err = s.UpdateSession(c, sessionID, session)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update session", "error", err)
+	}
+	return nil
+}
+
+// ListConsentsHandler shows the versions the user accepted and the current
+// ones still waiting.
+func (s *Server) ListConsentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	rows, err := s.DB.QueryContext(ctx, "SELECT document, version, accepted_at FROM consents WHERE user_id=$1 ORDER BY accepted_at DESC", userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read consents", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	accepted := []echo.Map{}
+	for rows.Next() {
+		var document, version string
+		var acceptedAt time.Time
+		err = rows.Scan(&document, &version, &acceptedAt)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read consents", "error", err)
+			return InvalidRequestError(c)
+		}
+		accepted = append(accepted, echo.Map{"document": document, "version": version, "accepted_at": acceptedAt})
+	}
+
+	pending, err := s.PendingConsents(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up consents", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"accepted": accepted, "pending": pending})
+}
+
+// AcceptConsentsHandler records that the user accepted documents. Only the
+// current versions can be accepted, so a client showing an outdated text
+// finds out.
+func (s *Server) AcceptConsentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var body struct {
+		Accept []Consent `json:"accept"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.Accept) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	current := map[string]string{}
+	for _, consent := range s.RequiredConsents() {
+		current[consent.Document] = consent.Version
+	}
+	fieldErrors := map[string]string{}
+	for _, consent := range body.Accept {
+		version, ok := current[consent.Document]
+		if !ok {
+			fieldErrors[consent.Document] = "Unknown document"
+		} else if consent.Version != version {
+			fieldErrors[consent.Document] = "Current version is " + version
+		}
+	}
+	if len(fieldErrors) > 0 {
+		return ValidationError(c, fieldErrors)
+	}
+
+	err = s.RecordConsents(c, userID, body.Accept)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not record consents", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	pending, err := s.PendingConsents(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up consents", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Accepted", "pending": pending})
+}
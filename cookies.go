@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CookieConfig holds the cookie attributes that depend on how the server is
+// deployed, like sharing the session across subdomains or developing over
+// plain HTTP.
+type CookieConfig struct {
+	// Name is the name of the session cookie
+	Name     string
+	Domain   string
+	Path     string
+	SameSite http.SameSite
+	Secure   bool
+}
+
+var cookieSameSiteModes = map[string]http.SameSite{
+	"strict": http.SameSiteStrictMode,
+	"lax":    http.SameSiteLaxMode,
+	"none":   http.SameSiteNoneMode,
+}
+
+// signCookie appends an HMAC of the cookie name and value, made with the
+// first cookie secret. Without secrets the value is left as it is.
+func (s *Server) signCookie(name string, value string) string {
+	if len(s.CookieSecrets) == 0 || value == "" {
+		return value
+	}
+	return value + "." + cookieSignature(s.CookieSecrets[0], name, value)
+}
+
+// verifyCookie returns the value of a signed cookie, accepting signatures
+// made with any of the cookie secrets so they can be rotated without
+// signing everyone out.
+func (s *Server) verifyCookie(name string, signed string) (string, bool) {
+	if len(s.CookieSecrets) == 0 {
+		return signed, true
+	}
+
+	value, signature, found := strings.Cut(signed, ".")
+	if !found {
+		return "", false
+	}
+	for _, secret := range s.CookieSecrets {
+		expected := cookieSignature(secret, name, value)
+		if hmac.Equal([]byte(signature), []byte(expected)) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func cookieSignature(secret []byte, name string, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	// Including the name stops a signed value being replayed in another cookie
+	mac.Write([]byte(name + "=" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignedCookie reads a cookie set with SetSessionCookie, failing when it is
+// missing or was tampered with.
+func (s *Server) SignedCookie(c echo.Context, name string) (string, bool) {
+	cookie, err := c.Cookie(name)
+	if err != nil {
+		return "", false
+	}
+	return s.verifyCookie(name, cookie.Value)
+}
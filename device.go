@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"html/template"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeLifetime  = time.Minute * 10
+	devicePollInterval  = time.Second * 5
+	// Consonants only, so codes can't spell words and are hard to misread
+	userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// Statuses a device authorization goes through
+const (
+	DeviceStatusPending  = "pending"
+	DeviceStatusApproved = "approved"
+	DeviceStatusDenied   = "denied"
+)
+
+// DeviceAuthorization is a pending RFC 8628 device grant, approved or denied
+// by the user in a browser on another device.
+type DeviceAuthorization struct {
+	ClientID string    `json:"client_id"`
+	Scope    string    `json:"scope"`
+	UserCode string    `json:"user_code"`
+	Status   string    `json:"status"`
+	UserID   string    `json:"user_id,omitempty"`
+	AuthTime time.Time `json:"auth_time,omitempty"`
+}
+
+func deviceCodeKey(deviceCode string) string {
+	return "device_code:" + HashToken(deviceCode)
+}
+
+func deviceUserCodeKey(userCode string) string {
+	return "device_user_code:" + userCode
+}
+
+func devicePollKey(deviceCode string) string {
+	return "device_poll:" + HashToken(deviceCode)
+}
+
+// NewUserCode returns a code like "BDFG-HJKL" for the user to type in.
+func NewUserCode() string {
+	var code strings.Builder
+	for i := 0; i < 8; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			panic(err)
+		}
+		if i == 4 {
+			code.WriteByte('-')
+		}
+		code.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+	return code.String()
+}
+
+// normalizeUserCode accepts the code however it was typed in.
+func normalizeUserCode(code string) string {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.ToUpper(code))
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// DeviceCodeHandler starts a device grant for a client that can't open a
+// browser itself, as described in RFC 8628 section 3.1.
+func (s *Server) DeviceCodeHandler(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "no-store")
+	ctx := c.Request().Context()
+
+	client := s.AuthenticateClient(c)
+	if client == nil {
+		return OAuthError(c, 401, "invalid_client", "Client authentication failed")
+	}
+
+	deviceCode := RandomToken()
+	authorization := DeviceAuthorization{
+		ClientID: client.ClientID,
+		Scope:    c.FormValue("scope"),
+		UserCode: NewUserCode(),
+		Status:   DeviceStatusPending,
+	}
+	data, err := json.Marshal(authorization)
+	if err != nil {
+		return OAuthError(c, 500, "server_error", "Could not start device authorization")
+	}
+
+	_, err = s.RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, deviceCodeKey(deviceCode), data, deviceCodeLifetime)
+		pipe.Set(ctx, deviceUserCodeKey(authorization.UserCode), deviceCode, deviceCodeLifetime)
+		return nil
+	})
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store device authorization", "error", err)
+		return OAuthError(c, 500, "server_error", "Could not start device authorization")
+	}
+
+	verificationURI := s.IssuerURL + "/device"
+	return c.JSON(200, echo.Map{
+		"device_code":               deviceCode,
+		"user_code":                 authorization.UserCode,
+		"verification_uri":          verificationURI,
+		"verification_uri_complete": verificationURI + "?user_code=" + url.QueryEscape(authorization.UserCode),
+		"expires_in":                int(deviceCodeLifetime.Seconds()),
+		"interval":                  int(devicePollInterval.Seconds()),
+	})
+}
+
+// exchangeDeviceCode answers the client's polling, as described in RFC 8628
+// section 3.5.
+func (s *Server) exchangeDeviceCode(c echo.Context, client *Client) error {
+	ctx := c.Request().Context()
+	deviceCode := c.FormValue("device_code")
+	if len(deviceCode) == 0 {
+		return OAuthError(c, 400, "invalid_request", "Missing device code")
+	}
+
+	data, err := s.RDB.Get(ctx, deviceCodeKey(deviceCode)).Bytes()
+	if err != nil {
+		return OAuthError(c, 400, "expired_token", "Device code is invalid or expired")
+	}
+
+	var authorization DeviceAuthorization
+	err = json.Unmarshal(data, &authorization)
+	if err != nil || authorization.ClientID != client.ClientID {
+		return OAuthError(c, 400, "invalid_grant", "Device code was not issued to this client")
+	}
+
+	polled, err := s.RDB.SetNX(ctx, devicePollKey(deviceCode), 1, devicePollInterval).Result()
+	if err == nil && !polled {
+		return OAuthError(c, 400, "slow_down", "Polling too fast")
+	}
+
+	switch authorization.Status {
+	case DeviceStatusPending:
+		return OAuthError(c, 400, "authorization_pending", "The user has not approved the request yet")
+	case DeviceStatusDenied:
+		s.RDB.Del(ctx, deviceCodeKey(deviceCode))
+		return OAuthError(c, 400, "access_denied", "The user denied the request")
+	}
+
+	// Deleting the code makes it single-use even under concurrent polls
+	deleted, err := s.RDB.Del(ctx, deviceCodeKey(deviceCode)).Result()
+	if err != nil || deleted == 0 {
+		return OAuthError(c, 400, "expired_token", "Device code is invalid or expired")
+	}
+
+	return s.issueTokens(c, client, &AuthorizationCode{
+		ClientID: client.ClientID,
+		UserID:   authorization.UserID,
+		Scope:    authorization.Scope,
+		AuthTime: authorization.AuthTime,
+	})
+}
+
+var deviceTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Connect a device</title></head>
+<body>
+{{if .Message}}
+<p>{{.Message}}</p>
+{{else if .ClientName}}
+<form method="post" action="/device">
+<p><strong>{{.ClientName}}</strong> wants to access your account{{if .Scope}} with the scopes <code>{{.Scope}}</code>{{end}}.</p>
+<p>Only continue if the device shows the code <strong>{{.UserCode}}</strong>.</p>
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="user_code" value="{{.UserCode}}">
+<button type="submit" name="action" value="approve">Allow</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+{{else}}
+<form method="get" action="/device">
+<p>Enter the code shown on your device.</p>
+<input name="user_code" autocomplete="off" autofocus>
+<button type="submit">Continue</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type devicePage struct {
+	Message    string
+	ClientName string
+	Scope      string
+	UserCode   string
+	CSRFToken  string
+}
+
+func renderDevicePage(c echo.Context, status int, page devicePage) error {
+	page.CSRFToken, _ = c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	var body strings.Builder
+	err := deviceTemplate.Execute(&body, page)
+	if err != nil {
+		return err
+	}
+	return c.HTML(status, body.String())
+}
+
+// lookupDeviceAuthorization finds the pending grant a user code belongs to.
+func (s *Server) lookupDeviceAuthorization(c echo.Context, userCode string) (string, *DeviceAuthorization) {
+	ctx := c.Request().Context()
+	deviceCode, err := s.RDB.Get(ctx, deviceUserCodeKey(userCode)).Result()
+	if err != nil {
+		return "", nil
+	}
+
+	data, err := s.RDB.Get(ctx, deviceCodeKey(deviceCode)).Bytes()
+	if err != nil {
+		return "", nil
+	}
+
+	var authorization DeviceAuthorization
+	err = json.Unmarshal(data, &authorization)
+	if err != nil || authorization.Status != DeviceStatusPending {
+		return "", nil
+	}
+	return deviceCode, &authorization
+}
+
+// DeviceVerificationHandler is the page where the user enters the code shown
+// on the device and confirms the request.
+func (s *Server) DeviceVerificationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	_, session := s.Authenticate(c)
+	if session == nil {
+		if s.LoginPageURL == "" {
+			return UnauthorizedError(c)
+		}
+		return redirectWithParams(c, s.LoginPageURL, map[string]string{
+			"return_to": c.Request().URL.RequestURI(),
+		})
+	}
+
+	if c.QueryParam("user_code") == "" {
+		return renderDevicePage(c, 200, devicePage{})
+	}
+
+	userCode := normalizeUserCode(c.QueryParam("user_code"))
+	_, authorization := s.lookupDeviceAuthorization(c, userCode)
+	if authorization == nil {
+		return renderDevicePage(c, 404, devicePage{Message: "That code is invalid or has expired."})
+	}
+
+	client, err := s.GetClient(ctx, authorization.ClientID)
+	if err != nil {
+		return renderDevicePage(c, 404, devicePage{Message: "That code is invalid or has expired."})
+	}
+
+	return renderDevicePage(c, 200, devicePage{
+		ClientName: client.Name,
+		Scope:      authorization.Scope,
+		UserCode:   userCode,
+	})
+}
+
+func (s *Server) DeviceApprovalHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID, session := s.Authenticate(c)
+	if session == nil {
+		return UnauthorizedError(c)
+	}
+
+	// The user code only gets one decision, so it can't be flipped later
+	userCode := normalizeUserCode(c.FormValue("user_code"))
+	deviceCode, authorization := s.lookupDeviceAuthorization(c, userCode)
+	if authorization == nil || s.RDB.Del(ctx, deviceUserCodeKey(userCode)).Val() == 0 {
+		return renderDevicePage(c, 404, devicePage{Message: "That code is invalid or has expired."})
+	}
+
+	message := "Access denied. You can close this window."
+	authorization.Status = DeviceStatusDenied
+	if c.FormValue("action") == "approve" {
+		message = "Device connected. You can return to your device."
+		authorization.Status = DeviceStatusApproved
+		authorization.UserID = userID
+		authorization.AuthTime = session.LastAuthenticated()
+	}
+
+	data, err := json.Marshal(authorization)
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+	err = s.RDB.Set(ctx, deviceCodeKey(deviceCode), data, redis.KeepTTL).Err()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store device decision", "error", err)
+		return renderDevicePage(c, 500, devicePage{Message: "Something went wrong, please try again."})
+	}
+
+	return renderDevicePage(c, http.StatusOK, devicePage{Message: message})
+}
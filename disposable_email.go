@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	DisposableEmailFlag   = "flag"
+	DisposableEmailReject = "reject"
+)
+
+// defaultDisposableDomainsURL is the community maintained list at
+// https://github.com/disposable-email-domains/disposable-email-domains
+const defaultDisposableDomainsURL = "https://raw.githubusercontent.com/disposable-email-domains/disposable-email-domains/main/disposable_email_blocklist.conf"
+
+// commonDisposableDomains are always known, so the check still works before
+// the list is first downloaded.
+var commonDisposableDomains = []string{
+	"mailinator.com", "guerrillamail.com", "guerrillamail.net", "sharklasers.com", "10minutemail.com", "temp-mail.org",
+	"tempmail.com", "throwawaymail.com", "yopmail.com", "trashmail.com", "getnada.com", "maildrop.cc", "dispostable.com",
+}
+
+// DisposableDomains is the list of throwaway email providers, read from a
+// file or downloaded from a URL and refreshed while the server runs.
+type DisposableDomains struct {
+	// Source is a path or an http(s) URL with a domain per line
+	Source string
+
+	mu      sync.RWMutex
+	domains map[string]bool
+}
+
+func NewDisposableDomains(source string) *DisposableDomains {
+	list := &DisposableDomains{Source: source}
+	list.set(nil)
+	return list
+}
+
+func (list *DisposableDomains) set(domains map[string]bool) {
+	if domains == nil {
+		domains = map[string]bool{}
+	}
+	for _, domain := range commonDisposableDomains {
+		domains[domain] = true
+	}
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	list.domains = domains
+}
+
+// open reads the source, from the network when it is a URL.
+func (list *DisposableDomains) open(ctx context.Context) (io.ReadCloser, error) {
+	if !strings.HasPrefix(list.Source, "http://") && !strings.HasPrefix(list.Source, "https://") {
+		return os.Open(list.Source)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, list.Source, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("disposable domain list answered %s", response.Status)
+	}
+	return response.Body, nil
+}
+
+// Refresh reloads the list from its source. The previous list stays in use
+// when that fails.
+func (list *DisposableDomains) Refresh(ctx context.Context) error {
+	reader, err := list.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	domains := map[string]bool{}
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains[line] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	list.set(domains)
+	return nil
+}
+
+// Disposable tells whether the normalized email is at a throwaway provider
+// or one of its subdomains.
+func (list *DisposableDomains) Disposable(email string) bool {
+	_, domain, found := strings.Cut(email, "@")
+	if !found {
+		return false
+	}
+
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+	for {
+		if list.domains[domain] {
+			return true
+		}
+		_, parent, found := strings.Cut(domain, ".")
+		if !found || !strings.Contains(parent, ".") {
+			return false
+		}
+		domain = parent
+	}
+}
+
+func (list *DisposableDomains) Len() int {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+	return len(list.domains)
+}
+
+var errDisposableEmail = errors.New("email is at a disposable provider")
+
+func DisposableEmailError(c echo.Context) error {
+	return c.JSON(403, echo.Map{"error": "Disposable email addresses are not allowed", "code": "disposable_email"})
+}
+
+// RunDisposableDomainRefresh reloads the disposable domain list periodically
+// until the context ends.
+func (s *Server) RunDisposableDomainRefresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.DisposableDomains.Refresh(ctx)
+			if err != nil {
+				s.Logger.ErrorContext(ctx, "Could not refresh disposable email domains", "error", err)
+			}
+		}
+	}
+}
+
+// RefreshDisposableDomainsHandler lets admins reload the list right away,
+// such as after editing the file.
+func (s *Server) RefreshDisposableDomainsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if s.DisposableDomains == nil {
+		return NotFoundError(c)
+	}
+
+	err := s.DisposableDomains.Refresh(ctx)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not refresh disposable email domains", "error", err)
+		return InvalidRequestError(c)
+	}
+	return c.JSON(200, echo.Map{"status": "Disposable email domains refreshed", "domains": s.DisposableDomains.Len()})
+}
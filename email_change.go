@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+var errEmailTaken = errors.New("email already in use")
+
+// emailChange is what confirmation and revert links stand for.
+type emailChange struct {
+	UserID   string `json:"user_id"`
+	OldEmail string `json:"old_email"`
+	NewEmail string `json:"new_email"`
+}
+
+func emailChangeKey(token string) string {
+	return "email_change:" + HashToken(token)
+}
+
+func emailRevertKey(token string) string {
+	return "email_revert:" + HashToken(token)
+}
+
+// sendEmailChangeLink stores the change under a fresh token and emails the
+// link for it in the background.
+func (s *Server) sendEmailChangeLink(ctx context.Context, key func(string) string, lifetime time.Duration, change emailChange,
+	path string, to string, subject string, text string) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+
+	token := RandomToken()
+	err = s.RDB.Set(ctx, key(token), data, lifetime).Err()
+	if err != nil {
+		return err
+	}
+
+	link := s.IssuerURL + path + "?token=" + url.QueryEscape(token)
+	go func(ctx context.Context) {
+		err := s.Mailer.Send(to, subject, text+" The link expires in "+lifetime.String()+".\n\n"+link+"\n")
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not send email change link", "user_id", change.UserID, "error", err)
+		}
+	}(context.WithoutCancel(ctx))
+	return nil
+}
+
+// StartEmailChange emails a confirmation link to the new address. The email
+// column only changes once that link is opened.
+func (s *Server) StartEmailChange(ctx context.Context, userID string, newEmail string) error {
+	if !s.EmailDomainAllowed(newEmail) {
+		return errEmailDomainNotAllowed
+	}
+	if s.DisposableDomains != nil && s.DisposableEmailAction == DisposableEmailReject && s.DisposableDomains.Disposable(newEmail) {
+		return errDisposableEmail
+	}
+
+	var taken bool
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email)=$1)", newEmail).Scan(&taken)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return errEmailTaken
+	}
+
+	var oldEmail string
+	err = s.DB.QueryRowContext(ctx, "SELECT COALESCE(email, '') FROM users WHERE user_id=$1", userID).Scan(&oldEmail)
+	if err != nil {
+		return err
+	}
+
+	return s.sendEmailChangeLink(ctx, emailChangeKey, s.EmailVerificationLifetime, emailChange{UserID: userID, OldEmail: oldEmail, NewEmail: newEmail},
+		"/profile/email/confirm", newEmail, "Confirm your new email address",
+		"Open this link to start using this address for your account.")
+}
+
+// ChangeEmailHandler starts an email change for the signed in user.
+func (s *Server) ChangeEmailHandler(c echo.Context) error {
+	if s.Mailer == nil {
+		return NotFoundError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var body struct {
+		Email string `json:"email"`
+	}
+	err := c.Bind(&body)
+	body.Email = normalizeEmail(body.Email)
+	if err != nil || len(body.Email) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	err = s.StartEmailChange(ctx, userID, body.Email)
+	if errors.Is(err, errEmailDomainNotAllowed) {
+		return EmailDomainNotAllowedError(c)
+	}
+	if errors.Is(err, errDisposableEmail) {
+		return DisposableEmailError(c)
+	}
+	if errors.Is(err, errEmailTaken) {
+		s.Logger.InfoContext(ctx, "Email already in use", "user_id", userID)
+		return ConflictError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not start email change", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Confirmation sent to the new address"})
+}
+
+// ConfirmEmailChangeHandler switches the address once the link sent to it is
+// opened, and tells the old address how to undo it.
+func (s *Server) ConfirmEmailChangeHandler(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	data, err := s.RDB.GetDel(ctx, emailChangeKey(token)).Bytes()
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Email change not found or expired", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	var change emailChange
+	err = json.Unmarshal(data, &change)
+	if err != nil {
+		return UnauthorizedError(c)
+	}
+
+	// Opening the link proves the user owns the new address. A change made
+	// some other way in the meantime wins over this one.
+	result, err := s.DB.ExecContext(ctx, "UPDATE users SET email=$1, verified=true WHERE user_id=$2 AND COALESCE(email, '')=$3",
+		change.NewEmail, change.UserID, change.OldEmail)
+	if isUniqueViolation(err) {
+		s.Logger.InfoContext(ctx, "Email already in use", "user_id", change.UserID)
+		return ConflictError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not change email", "error", err)
+		return InvalidRequestError(c)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return UnauthorizedError(c)
+	}
+
+	s.RecordAuthEvent(c, EventEmailChange, change.UserID, change.NewEmail)
+
+	if change.OldEmail != "" {
+		err = s.sendEmailChangeLink(ctx, emailRevertKey, s.EmailRevertLifetime, change, "/profile/email/revert", change.OldEmail,
+			"Your email address was changed",
+			"The email address of your account was changed to "+change.NewEmail+". If you didn't do this, open this link to switch it back and sign out everywhere.")
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not send email change notice", "error", err)
+		}
+	}
+
+	return c.JSON(200, echo.Map{"status": "Email changed"})
+}
+
+// RevertEmailChangeHandler puts back the old address from the link in the
+// security notice, signing out every session since the account may have
+// been taken over.
+func (s *Server) RevertEmailChangeHandler(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	data, err := s.RDB.GetDel(ctx, emailRevertKey(token)).Bytes()
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Email revert not found or expired", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	var change emailChange
+	err = json.Unmarshal(data, &change)
+	if err != nil {
+		return UnauthorizedError(c)
+	}
+
+	_, err = s.DB.ExecContext(ctx, "UPDATE users SET email=$1, verified=true WHERE user_id=$2", change.OldEmail, change.UserID)
+	if isUniqueViolation(err) {
+		s.Logger.InfoContext(ctx, "Old email taken since the change", "user_id", change.UserID)
+		return ConflictError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not revert email", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventEmailReverted, change.UserID, change.OldEmail)
+
+	err = s.DeleteUserSessions(ctx, change.UserID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not invalidate user sessions", "error", err)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Email change reverted"})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var errEmailDomainNotAllowed = errors.New("email domain is not allowed")
+
+func EmailDomainNotAllowedError(c echo.Context) error {
+	return c.JSON(403, echo.Map{"error": "Email domain is not allowed", "code": "email_domain_not_allowed"})
+}
+
+// normalizeDomains lowercases the configured domains, which may be written
+// with or without a leading @.
+func normalizeDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		normalized = append(normalized, strings.TrimPrefix(strings.ToLower(domain), "@"))
+	}
+	return normalized
+}
+
+// domainMatches tells whether the domain is one of the listed ones or a
+// subdomain of one of them.
+func domainMatches(domain string, domains []string) bool {
+	for _, listed := range domains {
+		if domain == listed || strings.HasSuffix(domain, "."+listed) {
+			return true
+		}
+	}
+	return false
+}
+
+// EmailDomainAllowed checks the domain of a normalized email against the
+// blocklist and, when one is set, the allowlist.
+func (s *Server) EmailDomainAllowed(email string) bool {
+	_, domain, found := strings.Cut(email, "@")
+	if !found {
+		return false
+	}
+	if domainMatches(domain, s.BlockedEmailDomains) {
+		return false
+	}
+	return len(s.AllowedEmailDomains) == 0 || domainMatches(domain, s.AllowedEmailDomains)
+}
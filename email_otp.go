@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/labstack/echo/v4"
+)
+
+// EmailOTPRequestHandler emails a sign-in code. It answers the same whether
+// or not the account exists.
+func (s *Server) EmailOTPRequestHandler(c echo.Context) error {
+	if s.Mailer == nil {
+		return NotFoundError(c)
+	}
+
+	var body struct {
+		Email string `json:"email"`
+	}
+	err := c.Bind(&body)
+	body.Email = normalizeEmail(body.Email)
+	if err != nil || len(body.Email) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	response := echo.Map{"status": "If the account exists, a code has been sent"}
+
+	var userID string
+	err = s.DB.QueryRowContext(ctx, "SELECT user_id FROM users WHERE LOWER(email)=$1", body.Email).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.Logger.InfoContext(ctx, "Email code requested for unknown user")
+		return c.JSON(200, response)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	if !s.AllowOTPSend(ctx, body.Email) {
+		return TooManyRequestsError(c)
+	}
+
+	code, err := s.CreateOTP(ctx, otpKey("email_login", body.Email), userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store email code", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	// Sent in the background so the response time doesn't reveal whether
+	// the account exists
+	go func(ctx context.Context) {
+		err := s.Mailer.Send(body.Email, "Your sign-in code",
+			"Your sign-in code is "+code+". It expires in "+s.OTPLifetime.String()+".\n")
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not send email code", "user_id", userID, "error", err)
+		}
+	}(context.WithoutCancel(ctx))
+
+	return c.JSON(200, response)
+}
+
+// EmailOTPVerifyHandler signs in with an emailed code in place of a password.
+func (s *Server) EmailOTPVerifyHandler(c echo.Context) error {
+	var body struct {
+		Email    string `json:"email"`
+		Code     string `json:"code"`
+		Remember bool   `json:"remember"`
+	}
+	err := c.Bind(&body)
+	body.Email = normalizeEmail(body.Email)
+	if err != nil || len(body.Email) == 0 || len(body.Code) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID, ok := s.CheckOTP(ctx, otpKey("email_login", body.Email), body.Code)
+	if !ok {
+		s.Logger.InfoContext(ctx, "Invalid email sign-in code")
+		s.RecordLogin(c, false, "email_otp", "", body.Email)
+		return UnauthorizedError(c)
+	}
+
+	// Receiving the code proves the user owns the address
+	_, err = s.DB.ExecContext(ctx, "UPDATE users SET verified=true WHERE user_id=$1", userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not verify user", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	return s.FinishSignIn(c, userID, body.Email, body.Remember, "email_otp")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+)
+
+func verificationTokenKey(token string) string {
+	return "verify:" + HashToken(token)
+}
+
+func (s *Server) CreateVerificationToken(ctx context.Context, userID string) (string, error) {
+	token := RandomToken()
+	err := s.RDB.Set(ctx, verificationTokenKey(token), userID, s.EmailVerificationLifetime).Err()
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// verificationLink is the link that confirms the address once opened.
+func (s *Server) verificationLink(token string) string {
+	return s.IssuerURL + "/verify-email?token=" + url.QueryEscape(token)
+}
+
+// SendVerificationEmail emails the user a link confirming they own the
+// address. The email goes out in the background, so delivery failures are
+// only logged.
+func (s *Server) SendVerificationEmail(ctx context.Context, userID string, email string) error {
+	token, err := s.CreateVerificationToken(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	link := s.verificationLink(token)
+	go func(ctx context.Context) {
+		err := s.Mailer.Send(email, "Confirm your email address",
+			"Open this link to confirm your email address. It expires in "+s.EmailVerificationLifetime.String()+".\n\n"+link+"\n")
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not send verification email", "user_id", userID, "error", err)
+		}
+	}(context.WithoutCancel(ctx))
+	return nil
+}
+
+func (s *Server) VerifyEmailHandler(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID, err := s.RDB.GetDel(ctx, verificationTokenKey(token)).Result()
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Verification token not found or expired", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	_, err = s.DB.Exec("UPDATE users SET verified=true WHERE user_id=$1", userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not verify user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Email verified"})
+}
+
+// EmailVerificationRequestHandler sends another verification link, for when
+// the first one expired or never arrived. It answers the same whether or
+// not the address is awaiting verification.
+func (s *Server) EmailVerificationRequestHandler(c echo.Context) error {
+	if s.Mailer == nil {
+		return NotFoundError(c)
+	}
+
+	var body struct {
+		Email string `json:"email"`
+	}
+	err := c.Bind(&body)
+	body.Email = normalizeEmail(body.Email)
+	if err != nil || len(body.Email) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	response := echo.Map{"status": "If the email is awaiting verification, a link has been sent"}
+
+	var userID string
+	err = s.DB.QueryRowContext(ctx, "SELECT user_id FROM users WHERE LOWER(email)=$1 AND NOT verified", body.Email).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.Logger.InfoContext(ctx, "Email verification requested for unknown address")
+		return c.JSON(200, response)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	err = s.SendVerificationEmail(ctx, userID, body.Email)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create verification token", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, response)
+}
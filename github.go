@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/oauth2"
+)
+
+// GitHub is plain OAuth2 without ID tokens, the identity comes from its API.
+func NewGitHubProvider(clientID string, clientSecret string, redirectURL string) *UpstreamProvider {
+	config := &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"read:user", "user:email"},
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  "https://github.com/login/oauth/authorize",
+			TokenURL: "https://github.com/login/oauth/access_token",
+		},
+	}
+
+	return &UpstreamProvider{
+		Name:   "github",
+		OAuth2: config,
+		FetchIdentity: func(ctx context.Context, token *oauth2.Token, nonce string) (*UpstreamIdentity, error) {
+			client := config.Client(ctx, token)
+
+			var user struct {
+				ID    int64  `json:"id"`
+				Login string `json:"login"`
+				Name  string `json:"name"`
+			}
+			err := getGitHubJSON(client, "https://api.github.com/user", &user)
+			if err != nil {
+				return nil, err
+			}
+
+			var emails []struct {
+				Email    string `json:"email"`
+				Primary  bool   `json:"primary"`
+				Verified bool   `json:"verified"`
+			}
+			err = getGitHubJSON(client, "https://api.github.com/user/emails", &emails)
+			if err != nil {
+				return nil, err
+			}
+
+			identity := &UpstreamIdentity{
+				Subject: strconv.FormatInt(user.ID, 10),
+				Name:    user.Name,
+			}
+			if identity.Name == "" {
+				identity.Name = user.Login
+			}
+			for _, email := range emails {
+				if email.Primary {
+					identity.Email = email.Email
+					identity.EmailVerified = email.Verified
+				}
+			}
+			return identity, nil
+		},
+	}
+}
+
+func getGitHubJSON(client *http.Client, url string, target interface{}) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/vnd.github+json")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GitHub API returned %s for %s", response.Status, url)
+	}
+	return json.NewDecoder(response.Body).Decode(target)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/oauth2"
+)
+
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+func NewGoogleProvider(clientID string, clientSecret string, redirectURL string) *UpstreamProvider {
+	return &UpstreamProvider{
+		Name: "google",
+		OAuth2: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{"openid", "email", "profile"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  "https://accounts.google.com/o/oauth2/v2/auth",
+				TokenURL: "https://oauth2.googleapis.com/token",
+			},
+		},
+		FetchIdentity: func(ctx context.Context, token *oauth2.Token, nonce string) (*UpstreamIdentity, error) {
+			identity, _, err := ParseUpstreamIDToken(token, googleIssuers, clientID, nonce)
+			return identity, err
+		},
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// UserGroups lists the names of the groups the user is in, sorted.
+func (s *Server) UserGroups(ctx context.Context, userID string) ([]string, error) {
+	groups := []string{}
+	err := s.DB.QueryRowContext(ctx, `SELECT ARRAY(SELECT name FROM groups JOIN group_members USING (group_id) WHERE user_id=$1 ORDER BY name)`,
+		userID).Scan(pq.Array(&groups))
+	return groups, err
+}
+
+// validGroupMember tells whether the group and user IDs are well formed,
+// anything else can't be in the database.
+func validGroupMember(groupID string, userID string) bool {
+	_, groupErr := uuid.Parse(groupID)
+	_, userErr := uuid.Parse(userID)
+	return groupErr == nil && userErr == nil
+}
+
+// groupExists tells whether the group exists, treating malformed IDs as
+// missing.
+func (s *Server) groupExists(ctx context.Context, groupID string) bool {
+	var exists bool
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM groups WHERE group_id=$1)", groupID).Scan(&exists)
+	return err == nil && exists
+}
+
+func (s *Server) ListGroupsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit, offset, ok := pagination(c)
+	if !ok {
+		return InvalidRequestError(c)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT group_id, name, description, created_at,
+		(SELECT count(*) FROM group_members WHERE group_members.group_id=groups.group_id),
+		ARRAY(SELECT role FROM group_roles WHERE group_roles.group_id=groups.group_id ORDER BY role)
+		FROM groups ORDER BY name LIMIT $1 OFFSET $2`, limit, offset)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read groups", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	groups := []echo.Map{}
+	for rows.Next() {
+		var groupID, name, description string
+		var createdAt time.Time
+		var members int
+		roles := []string{}
+		err = rows.Scan(&groupID, &name, &description, &createdAt, &members, pq.Array(&roles))
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read groups", "error", err)
+			return InvalidRequestError(c)
+		}
+		groups = append(groups, echo.Map{
+			"id":          groupID,
+			"name":        name,
+			"description": description,
+			"created_at":  createdAt,
+			"members":     members,
+			"roles":       roles,
+		})
+	}
+
+	return c.JSON(200, echo.Map{"groups": groups, "limit": limit, "offset": offset})
+}
+
+func (s *Server) CreateGroupHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var body struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	err := c.Bind(&body)
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+	name, ok := normalizeName(body.Name)
+	if !ok || name == "" {
+		return ValidationError(c, map[string]string{"name": invalidNameMessage})
+	}
+
+	var groupID string
+	err = s.DB.QueryRowContext(ctx, "INSERT INTO groups (name, description) VALUES($1, $2) RETURNING group_id", name, body.Description).Scan(&groupID)
+	if isUniqueViolation(err) {
+		return ConflictError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create group", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(201, echo.Map{"id": groupID, "name": name, "description": body.Description})
+}
+
+// DeleteGroupHandler deletes a group, refusing when its members would be
+// the last to lose RoleAdmin.
+func (s *Server) DeleteGroupHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	groupID := c.Param("id")
+	if _, err := uuid.Parse(groupID); err != nil {
+		return NotFoundError(c)
+	}
+
+	rows, err := s.execKeepingAdmin(ctx, "DELETE FROM groups WHERE group_id=$1", groupID)
+	if errors.Is(err, errLastAdmin) {
+		return LastAdminError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not delete group", "error", err)
+		return ServerError(c)
+	}
+	if rows == 0 {
+		return NotFoundError(c)
+	}
+	return c.JSON(200, echo.Map{"status": "Group deleted"})
+}
+
+func (s *Server) ListGroupMembersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	groupID := c.Param("id")
+
+	limit, offset, ok := pagination(c)
+	if !ok {
+		return InvalidRequestError(c)
+	}
+	if !s.groupExists(ctx, groupID) {
+		return NotFoundError(c)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT user_id, COALESCE(name, ''), COALESCE(email, ''), added_at FROM group_members
+		JOIN users USING (user_id) WHERE group_id=$1 ORDER BY added_at LIMIT $2 OFFSET $3`, groupID, limit, offset)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read group members", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	members := []echo.Map{}
+	for rows.Next() {
+		var userID, name, email string
+		var addedAt time.Time
+		err = rows.Scan(&userID, &name, &email, &addedAt)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read group members", "error", err)
+			return InvalidRequestError(c)
+		}
+		members = append(members, echo.Map{"user_id": userID, "name": name, "email": email, "added_at": addedAt})
+	}
+
+	return c.JSON(200, echo.Map{"members": members, "limit": limit, "offset": offset})
+}
+
+func (s *Server) AddGroupMemberHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	groupID := c.Param("id")
+	userID := c.Param("user")
+
+	if !validGroupMember(groupID, userID) {
+		return NotFoundError(c)
+	}
+
+	result, err := s.DB.ExecContext(ctx, "INSERT INTO group_members (group_id, user_id) VALUES($1, $2) ON CONFLICT DO NOTHING", groupID, userID)
+	// Unknown groups and users break the foreign keys
+	if isForeignKeyViolation(err) {
+		return NotFoundError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not add group member", "error", err)
+		return ServerError(c)
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		s.RecordAuthEvent(c, EventGroupMemberAdded, userID, "")
+	}
+	return c.JSON(200, echo.Map{"group_id": groupID, "user_id": userID})
+}
+
+// RemoveGroupMemberHandler takes the user out of the group, as long as
+// someone is left with RoleAdmin.
+func (s *Server) RemoveGroupMemberHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	groupID := c.Param("id")
+	userID := c.Param("user")
+	if !validGroupMember(groupID, userID) {
+		return NotFoundError(c)
+	}
+
+	rows, err := s.execKeepingAdmin(ctx, "DELETE FROM group_members WHERE group_id=$1 AND user_id=$2", groupID, userID)
+	if errors.Is(err, errLastAdmin) {
+		return LastAdminError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not remove group member", "error", err)
+		return ServerError(c)
+	}
+	if rows == 0 {
+		return NotFoundError(c)
+	}
+
+	s.RecordAuthEvent(c, EventGroupMemberRemoved, userID, "")
+
+	return c.JSON(200, echo.Map{"status": "Member removed"})
+}
+
+// GrantGroupRoleHandler gives the role to every member of the group, for as
+// long as they stay in it.
+func (s *Server) GrantGroupRoleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	groupID := c.Param("id")
+	role := c.Param("role")
+	if role == RoleUser {
+		return InvalidRequestError(c)
+	}
+
+	if _, err := uuid.Parse(groupID); err != nil {
+		return NotFoundError(c)
+	}
+
+	_, err := s.DB.ExecContext(ctx, "INSERT INTO group_roles (group_id, role) VALUES($1, $2) ON CONFLICT DO NOTHING", groupID, role)
+	// Unknown groups and roles break the foreign keys
+	if isForeignKeyViolation(err) {
+		return NotFoundError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not grant group role", "error", err)
+		return ServerError(c)
+	}
+	return c.JSON(200, echo.Map{"group_id": groupID, "role": role})
+}
+
+// RevokeGroupRoleHandler takes the role from the group, as long as someone
+// is left with RoleAdmin.
+func (s *Server) RevokeGroupRoleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	groupID := c.Param("id")
+	if _, err := uuid.Parse(groupID); err != nil {
+		return NotFoundError(c)
+	}
+
+	rows, err := s.execKeepingAdmin(ctx, "DELETE FROM group_roles WHERE group_id=$1 AND role=$2", groupID, c.Param("role"))
+	if errors.Is(err, errLastAdmin) {
+		return LastAdminError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not revoke group role", "error", err)
+		return ServerError(c)
+	}
+	if rows == 0 {
+		return NotFoundError(c)
+	}
+	return c.JSON(200, echo.Map{"status": "Role revoked"})
+}
+
+// GetGroupHandler reads a group with its roles.
+func (s *Server) GetGroupHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	groupID := c.Param("id")
+
+	var name, description string
+	var createdAt time.Time
+	var members int
+	roles := []string{}
+	err := s.DB.QueryRowContext(ctx, `SELECT name, description, created_at,
+		(SELECT count(*) FROM group_members WHERE group_id=$1),
+		ARRAY(SELECT role FROM group_roles WHERE group_id=$1 ORDER BY role)
+		FROM groups WHERE group_id=$1`, groupID).Scan(&name, &description, &createdAt, &members, pq.Array(&roles))
+	if err != nil {
+		return NotFoundError(c)
+	}
+
+	return c.JSON(200, echo.Map{
+		"id":          groupID,
+		"name":        name,
+		"description": description,
+		"created_at":  createdAt,
+		"members":     members,
+		"roles":       roles,
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const guestCleanupInterval = time.Hour
+
+// GuestSignInHandler starts a session for a new anonymous user. The guest
+// gets a real user_id, so anything stored against it survives when the guest
+// later signs up and becomes a registered user.
+func (s *Server) GuestSignInHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if s.RegistrationClosed {
+		return RegistrationClosedError(c)
+	}
+
+	var userID string
+	err := s.DB.QueryRowContext(ctx, "INSERT INTO users (guest) VALUES(true) RETURNING user_id").Scan(&userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create guest user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	// Guests have no way to sign back in, so their session outlives the browser
+	return s.StartUserSession(c, userID, "", true, "guest")
+}
+
+// GuestUserID returns the ID of the guest signed in with the request, or an
+// empty string when the request has no guest session.
+func (s *Server) GuestUserID(c echo.Context) string {
+	_, session := s.Authenticate(c)
+	if session == nil {
+		return ""
+	}
+
+	var guest bool
+	err := s.DB.QueryRowContext(c.Request().Context(), "SELECT guest FROM users WHERE user_id=$1", session.UserID).Scan(&guest)
+	if err != nil || !guest {
+		return ""
+	}
+	return session.UserID
+}
+
+// DeleteAbandonedGuests removes guests whose sessions have all expired, since
+// nobody can reach those accounts anymore.
+func (s *Server) DeleteAbandonedGuests(ctx context.Context) error {
+	rows, err := s.DB.QueryContext(ctx, "SELECT user_id FROM users WHERE guest AND created_at < $1 LIMIT 1000",
+		time.Now().Add(-s.RememberSessionLifetime))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var abandoned []string
+	for rows.Next() {
+		var userID string
+		err = rows.Scan(&userID)
+		if err != nil {
+			return err
+		}
+
+		sessions, err := s.Sessions.List(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if len(sessions) == 0 {
+			abandoned = append(abandoned, userID)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, userID := range abandoned {
+		_, err = s.DB.ExecContext(ctx, "DELETE FROM users WHERE user_id=$1 AND guest", userID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunGuestCleanup deletes abandoned guests periodically until the context ends.
+func (s *Server) RunGuestCleanup(ctx context.Context) {
+	ticker := time.NewTicker(guestCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.DeleteAbandonedGuests(ctx)
+			if err != nil {
+				s.Logger.ErrorContext(ctx, "Could not delete abandoned guests", "error", err)
+			}
+		}
+	}
+}
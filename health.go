@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// HealthCheckHandler reports whether the server can reach its dependencies.
+// Each check is bounded so a hung dependency can't hang the probe.
+func (s *Server) HealthCheckHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), time.Second*2)
+	defer cancel()
+
+	status := 200
+	result := echo.Map{"db": "ok", "redis": "ok"}
+
+	err := s.DB.PingContext(ctx)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Database health check failed", "error", err)
+		status = 503
+		result["db"] = "unavailable"
+	}
+
+	err = s.RDB.Ping(ctx).Err()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Redis health check failed", "error", err)
+		status = 503
+		result["redis"] = "unavailable"
+	}
+
+	return c.JSON(status, result)
+}
+
+// LivenessHandler only tells that the process is up and serving requests.
+func (s *Server) LivenessHandler(c echo.Context) error {
+	return c.JSON(200, echo.Map{"status": "ok"})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	BreachCheckWarn   = "warn"
+	BreachCheckReject = "reject"
+)
+
+const pwnedPasswordsRangeURL = "https://api.pwnedpasswords.com/range/"
+
+// BreachChecker looks passwords up in Have I Been Pwned. Only the first five
+// characters of the SHA-1 hash leave the server, and the matching range is
+// cached in Redis so popular prefixes don't hit the API every time.
+type BreachChecker struct {
+	RDB      redis.UniversalClient
+	CacheTTL time.Duration
+}
+
+func breachRangeKey(prefix string) string {
+	return "hibp:" + prefix
+}
+
+// rangeFor returns the hash suffixes and counts of the prefix, as the API
+// sends them.
+func (b *BreachChecker) rangeFor(ctx context.Context, prefix string) (string, error) {
+	cached, err := b.RDB.Get(ctx, breachRangeKey(prefix)).Result()
+	if err == nil {
+		return cached, nil
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, pwnedPasswordsRangeURL+prefix, nil)
+	if err != nil {
+		return "", err
+	}
+	// Padding keeps the response size from giving away the prefix
+	request.Header.Set("Add-Padding", "true")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("pwned passwords answered %s", response.Status)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	b.RDB.Set(ctx, breachRangeKey(prefix), body, b.CacheTTL)
+	return string(body), nil
+}
+
+// Breached returns how many times the password appeared in known breaches.
+func (b *BreachChecker) Breached(ctx context.Context, password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	ranges, err := b.rangeFor(ctx, prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(ranges))
+	for scanner.Scan() {
+		candidate, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok || candidate != suffix {
+			continue
+		}
+		// Padding entries come with a count of zero
+		return strconv.Atoi(count)
+	}
+	return 0, scanner.Err()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// identityProviderName maps the provider in the URL to the name identities
+// are stored under. The configured SAML IdP is addressed as "saml".
+func (s *Server) identityProviderName(param string) (string, bool) {
+	if param == "saml" {
+		if s.SAML == nil {
+			return "", false
+		}
+		return "saml:" + s.SAML.IDPMetadata.EntityID, true
+	}
+	provider, ok := s.Providers[param]
+	if !ok {
+		return "", false
+	}
+	return provider.Name, true
+}
+
+func (s *Server) ListIdentitiesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	rows, err := s.DB.QueryContext(ctx, "SELECT provider, provider_user_id, COALESCE(email, ''), created_at FROM identities WHERE user_id=$1 ORDER BY created_at",
+		userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not list identities", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	identities := []echo.Map{}
+	for rows.Next() {
+		var provider, subject, email string
+		var createdAt time.Time
+		err = rows.Scan(&provider, &subject, &email, &createdAt)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read identity", "error", err)
+			return InvalidRequestError(c)
+		}
+		identities = append(identities, echo.Map{
+			"provider":   provider,
+			"subject":    subject,
+			"email":      email,
+			"created_at": createdAt,
+		})
+	}
+
+	return c.JSON(200, echo.Map{"identities": identities})
+}
+
+// LinkIdentityHandler starts signing in with a provider to link the identity
+// to the current user. It answers with the URL to send the browser to, since
+// a plain link would let another site link its own identity to the user.
+func (s *Server) LinkIdentityHandler(c echo.Context) error {
+	userID := c.Get("userID").(string)
+
+	var body struct {
+		ReturnTo string `json:"return_to"`
+	}
+	err := c.Bind(&body)
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+	returnTo := s.SafeReturnTo(body.ReturnTo)
+
+	var authURL string
+	if c.Param("provider") == "saml" {
+		if s.SAML == nil {
+			return NotFoundError(c)
+		}
+		authURL, err = s.StartSAMLLogin(c, returnTo, userID)
+	} else {
+		provider, ok := s.Providers[c.Param("provider")]
+		if !ok {
+			return NotFoundError(c)
+		}
+		authURL, err = s.StartUpstreamLogin(c, provider, returnTo, userID)
+	}
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"authorization_url": authURL})
+}
+
+// CompleteIdentityLink links the identity the provider vouched for to the
+// user who started linking. The identity has to carry the same email as the
+// account, or one the provider confirmed.
+func (s *Server) CompleteIdentityLink(c echo.Context, userID string, provider string, identity *UpstreamIdentity, returnTo string) error {
+	ctx := c.Request().Context()
+
+	var email string
+	err := s.DB.QueryRowContext(ctx, "SELECT COALESCE(email, '') FROM users WHERE user_id=$1", userID).Scan(&email)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "User linking an identity no longer exists", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	identityEmail := normalizeEmail(identity.Email)
+	if !identity.EmailVerified && (identityEmail == "" || identityEmail != email) {
+		s.Logger.InfoContext(ctx, "Identity email is neither confirmed nor the account email", "provider", provider, "user_id", userID)
+		return UnauthorizedError(c)
+	}
+
+	_, err = s.DB.ExecContext(ctx, "INSERT INTO identities (provider, provider_user_id, user_id, email) VALUES($1, $2, $3, $4)",
+		provider, identity.Subject, userID, nullString(identityEmail))
+	if isUniqueViolation(err) {
+		var ownerID string
+		err = s.DB.QueryRowContext(ctx, "SELECT user_id FROM identities WHERE provider=$1 AND provider_user_id=$2",
+			provider, identity.Subject).Scan(&ownerID)
+		if err != nil || ownerID != userID {
+			s.Logger.InfoContext(ctx, "Identity is linked to another user", "provider", provider, "user_id", userID)
+			return ConflictError(c)
+		}
+		// Linking twice is harmless
+		return c.Redirect(http.StatusFound, returnTo)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not link identity", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventIdentityLinked, userID, email)
+	return c.Redirect(http.StatusFound, returnTo)
+}
+
+// UnlinkIdentityHandler removes the user's identities with a provider, as
+// long as that leaves them another way to sign in.
+func (s *Server) UnlinkIdentityHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	provider, ok := s.identityProviderName(c.Param("provider"))
+	if !ok {
+		return NotFoundError(c)
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not start transaction", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer tx.Rollback()
+
+	var email string
+	var hasPassword bool
+	err = tx.QueryRowContext(ctx, "SELECT COALESCE(email, ''), password IS NOT NULL FROM users WHERE user_id=$1 FOR UPDATE",
+		userID).Scan(&email, &hasPassword)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not find user information", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	result, err := tx.ExecContext(ctx, "DELETE FROM identities WHERE user_id=$1 AND provider=$2", userID, provider)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not unlink identity", "error", err)
+		return InvalidRequestError(c)
+	}
+	if unlinked, _ := result.RowsAffected(); unlinked == 0 {
+		return NotFoundError(c)
+	}
+
+	if !hasPassword {
+		var remaining int
+		err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM identities WHERE user_id=$1", userID).Scan(&remaining)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not count identities", "error", err)
+			return InvalidRequestError(c)
+		}
+		if remaining == 0 {
+			return c.JSON(409, echo.Map{"error": "Cannot remove the last way to sign in"})
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not unlink identity", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventIdentityUnlinked, userID, email)
+	return c.JSON(200, echo.Map{"status": "Identity unlinked"})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// IntrospectHandler lets resource servers check whether a token is active,
+// as described in RFC 7662. OAuth access tokens, refresh tokens and
+// first-party session IDs are all understood.
+func (s *Server) IntrospectHandler(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	client := s.AuthenticateClient(c)
+	if client == nil || client.Public {
+		return OAuthError(c, 401, "invalid_client", "Client authentication failed")
+	}
+
+	token := c.FormValue("token")
+	if len(token) == 0 {
+		return OAuthError(c, 400, "invalid_request", "Missing token")
+	}
+
+	lookups := []func(echo.Context, string) echo.Map{
+		s.introspectAccessToken,
+		s.introspectSession,
+		s.introspectRefreshToken,
+	}
+	if c.FormValue("token_type_hint") == "refresh_token" {
+		lookups = []func(echo.Context, string) echo.Map{
+			s.introspectRefreshToken,
+			s.introspectAccessToken,
+			s.introspectSession,
+		}
+	}
+
+	for _, lookup := range lookups {
+		result := lookup(c, token)
+		if result != nil {
+			result["active"] = true
+			return c.JSON(200, result)
+		}
+	}
+
+	return c.JSON(200, echo.Map{"active": false})
+}
+
+func (s *Server) introspectAccessToken(c echo.Context, token string) echo.Map {
+	accessToken, err := s.LookupBearerToken(c.Request().Context(), token)
+	if err != nil {
+		return nil
+	}
+
+	// Client credentials tokens act for the client itself
+	subject := accessToken.UserID
+	if subject == "" {
+		subject = accessToken.ClientID
+	}
+
+	result := echo.Map{
+		"token_type": "access_token",
+		"sub":        subject,
+		"client_id":  accessToken.ClientID,
+		"scope":      accessToken.Scope,
+		"iss":        s.IssuerURL,
+	}
+	if accessToken.ActorClientID != "" {
+		result["act"] = echo.Map{"sub": accessToken.ActorClientID}
+	}
+	// Personal access tokens can be created without an expiry
+	if !accessToken.ExpiresAt.IsZero() {
+		result["exp"] = accessToken.ExpiresAt.Unix()
+	}
+	return result
+}
+
+func (s *Server) introspectSession(c echo.Context, sessionID string) echo.Map {
+	ctx := c.Request().Context()
+	// Sessions that were signed out everywhere, outlived their maximum
+	// lifetime or belong to inactive accounts are reported inactive
+	session := s.LiveSession(ctx, sessionID)
+	if session == nil {
+		return nil
+	}
+
+	ttl, err := s.SessionTTL(ctx, sessionID)
+	if err != nil {
+		return nil
+	}
+	// Activity keeps pushing the TTL out, but never past the maximum
+	expiresAt := time.Now().Add(ttl)
+	if s.SessionMaxLifetime > 0 && session.CreatedAt.Add(s.SessionMaxLifetime).Before(expiresAt) {
+		expiresAt = session.CreatedAt.Add(s.SessionMaxLifetime)
+	}
+
+	return echo.Map{
+		"token_type": "session",
+		"sub":        session.UserID,
+		"iat":        session.CreatedAt.Unix(),
+		"exp":        expiresAt.Unix(),
+		"iss":        s.IssuerURL,
+	}
+}
+
+func (s *Server) introspectRefreshToken(c echo.Context, token string) echo.Map {
+	ctx := c.Request().Context()
+	tokenHash := HashToken(token)
+	data, err := s.RDB.Get(ctx, refreshTokenKey(tokenHash)).Bytes()
+	if err != nil {
+		return nil
+	}
+
+	var refreshToken RefreshToken
+	err = json.Unmarshal(data, &refreshToken)
+	if err != nil {
+		return nil
+	}
+
+	// Used tokens and revoked families are no longer active
+	if s.RDB.Exists(ctx, refreshTokenUsedKey(tokenHash)).Val() > 0 {
+		return nil
+	}
+	if s.RDB.Exists(ctx, refreshFamilyKey(refreshToken.FamilyID)).Val() == 0 {
+		return nil
+	}
+
+	ttl, err := s.RDB.TTL(ctx, refreshTokenKey(tokenHash)).Result()
+	if err != nil {
+		return nil
+	}
+
+	return echo.Map{
+		"token_type": "refresh_token",
+		"sub":        refreshToken.UserID,
+		"client_id":  refreshToken.ClientID,
+		"scope":      refreshToken.Scope,
+		"exp":        time.Now().Add(ttl).Unix(),
+		"iss":        s.IssuerURL,
+	}
+}
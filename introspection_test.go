@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestIntrospectSession(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	clientSecret := RandomToken()
+	var clientID string
+	err := s.DB.QueryRow("INSERT INTO clients (client_secret_hash, name, redirect_uris) VALUES($1, 'api', '{}') RETURNING client_id",
+		HashToken(clientSecret)).Scan(&clientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	introspect := func(token string) echo.Map {
+		t.Helper()
+		e := echo.New()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/oauth/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		request.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		request.SetBasicAuth(clientID, clientSecret)
+		err := s.IntrospectHandler(e.NewContext(request, recorder))
+		if err != nil {
+			t.Fatalf("IntrospectHandler returned %v", err)
+		}
+		if recorder.Code != 200 {
+			t.Fatalf("IntrospectHandler status %d, want 200", recorder.Code)
+		}
+		var result echo.Map
+		if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	t.Run("live session", func(t *testing.T) {
+		userID := createTestUser(t, s)
+		sessionID := createTestSession(t, s, userID)
+		result := introspect(sessionID)
+		if result["active"] != true || result["sub"] != userID {
+			t.Errorf("introspection = %v, want active for %s", result, userID)
+		}
+	})
+
+	t.Run("exp stops at the maximum lifetime", func(t *testing.T) {
+		s.SessionMaxLifetime = 90 * time.Minute
+		defer func() { s.SessionMaxLifetime = 0 }()
+		userID := createTestUser(t, s)
+		sessionID := createTestSession(t, s, userID)
+		session, _ := s.Sessions.Get(ctx, sessionID)
+		session.CreatedAt = time.Now().Add(-80 * time.Minute)
+		if err := s.Sessions.Save(ctx, sessionID, session); err != nil {
+			t.Fatal(err)
+		}
+
+		result := introspect(sessionID)
+		want := session.CreatedAt.Add(s.SessionMaxLifetime).Unix()
+		if exp, _ := result["exp"].(float64); int64(exp) != want {
+			t.Errorf("exp = %v, want %d, ten minutes before the session's hour TTL runs out", result["exp"], want)
+		}
+	})
+
+	inactive := []struct {
+		name   string
+		revoke func(t *testing.T, userID, sessionID string)
+	}{
+		{"signed out", func(t *testing.T, userID, sessionID string) {
+			if err := s.RemoveUserSession(ctx, userID, sessionID); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"version bumped", func(t *testing.T, userID, sessionID string) {
+			if _, err := s.BumpSessionVersion(ctx, userID); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"account suspended", func(t *testing.T, userID, sessionID string) {
+			if _, err := s.DB.Exec("UPDATE users SET status=$1 WHERE user_id=$2", AccountSuspended, userID); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, test := range inactive {
+		t.Run(test.name, func(t *testing.T) {
+			userID := createTestUser(t, s)
+			sessionID := createTestSession(t, s, userID)
+			test.revoke(t, userID, sessionID)
+			if result := introspect(sessionID); result["active"] != false || len(result) != 1 {
+				t.Errorf("introspection = %v, want only active false", result)
+			}
+		})
+	}
+}
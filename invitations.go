@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var errInvitationInvalid = errors.New("invitation is invalid, expired or used")
+
+// invitationLink points at the page where the invited user registers,
+// falling back to nothing when no page is configured.
+func (s *Server) invitationLink(token string) string {
+	if s.InvitationURL == "" {
+		return ""
+	}
+	uri, err := url.Parse(s.InvitationURL)
+	if err != nil {
+		return ""
+	}
+	query := uri.Query()
+	query.Set("token", token)
+	uri.RawQuery = query.Encode()
+	return uri.String()
+}
+
+// CreateInvitationHandler invites an email address to register. The invite
+// is emailed when a mailer is configured, and handed back to the admin to
+// pass on otherwise.
+func (s *Server) CreateInvitationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	adminID := c.Get("userID").(string)
+
+	var body struct {
+		Email string `json:"email"`
+		Role  string `json:"role"`
+		// ExpiresIn is in seconds, defaulting to the invitation lifetime
+		ExpiresIn int64 `json:"expires_in"`
+	}
+	err := c.Bind(&body)
+	body.Email = normalizeEmail(body.Email)
+	if err != nil || len(body.Email) == 0 || body.ExpiresIn < 0 {
+		return InvalidRequestError(c)
+	}
+	if body.Role == "" {
+		body.Role = RoleUser
+	}
+
+	lifetime := s.InvitationLifetime
+	if body.ExpiresIn > 0 {
+		lifetime = time.Duration(body.ExpiresIn) * time.Second
+	}
+
+	var registered, roleExists bool
+	err = s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email)=$1), EXISTS(SELECT 1 FROM roles WHERE name=$2)",
+		body.Email, body.Role).Scan(&registered, &roleExists)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up user", "error", err)
+		return InvalidRequestError(c)
+	}
+	if !roleExists {
+		return ValidationError(c, map[string]string{"role": "Must be user or an existing role"})
+	}
+	if registered {
+		return ConflictError(c)
+	}
+
+	token := RandomToken()
+	var invitationID string
+	var expiresAt time.Time
+	err = s.DB.QueryRowContext(ctx, `INSERT INTO invitations (email, role, token_hash, invited_by, expires_at) VALUES($1, $2, $3, $4, $5)
+		RETURNING invitation_id, expires_at`, body.Email, body.Role, HashToken(token), adminID, time.Now().Add(lifetime)).Scan(&invitationID, &expiresAt)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create invitation", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventInvitationCreated, adminID, body.Email)
+
+	response := echo.Map{"id": invitationID, "email": body.Email, "role": body.Role, "expires_at": expiresAt}
+	link := s.invitationLink(token)
+	if s.Mailer == nil {
+		response["token"] = token
+		if link != "" {
+			response["invitation_url"] = link
+		}
+		return c.JSON(201, response)
+	}
+
+	text := "You have been invited to create an account. The invitation expires in " + lifetime.String() + ".\n\n"
+	if link != "" {
+		text += "Open this link to register:\n\n" + link + "\n"
+	} else {
+		text += "Your invitation code is " + token + "\n"
+	}
+	go func(ctx context.Context) {
+		err := s.Mailer.Send(body.Email, "You're invited", text)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not send invitation", "error", err)
+		}
+	}(context.WithoutCancel(ctx))
+
+	return c.JSON(201, response)
+}
+
+// ListInvitationsHandler lists the invitations that can still be used.
+func (s *Server) ListInvitationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit, offset, ok := pagination(c)
+	if !ok {
+		return InvalidRequestError(c)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT invitation_id, email, role, invited_by, created_at, expires_at FROM invitations
+		WHERE accepted_at IS NULL AND expires_at > now() ORDER BY created_at DESC LIMIT $1 OFFSET $2`, limit, offset)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read invitations", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	invitations := []echo.Map{}
+	for rows.Next() {
+		var invitationID, email, role string
+		var invitedBy sql.NullString
+		var createdAt, expiresAt time.Time
+		err = rows.Scan(&invitationID, &email, &role, &invitedBy, &createdAt, &expiresAt)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read invitations", "error", err)
+			return InvalidRequestError(c)
+		}
+		invitations = append(invitations, echo.Map{
+			"id":         invitationID,
+			"email":      email,
+			"role":       role,
+			"invited_by": invitedBy.String,
+			"created_at": createdAt,
+			"expires_at": expiresAt,
+		})
+	}
+
+	return c.JSON(200, echo.Map{"invitations": invitations, "limit": limit, "offset": offset})
+}
+
+func (s *Server) RevokeInvitationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	result, err := s.DB.ExecContext(ctx, "DELETE FROM invitations WHERE invitation_id=$1 AND accepted_at IS NULL", c.Param("id"))
+	if err != nil {
+		return NotFoundError(c)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return NotFoundError(c)
+	}
+	return c.JSON(200, echo.Map{"status": "Invitation revoked"})
+}
+
+// acceptInvitation creates the invited user in one transaction with using
+// up the invitation, so a token can't register two accounts.
+func (s *Server) acceptInvitation(ctx context.Context, token string, name string, username string, hashedPassword []byte) (string, string, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback()
+
+	var invitationID, email, role string
+	var invitedBy sql.NullString
+	err = tx.QueryRowContext(ctx, `SELECT invitation_id, email, role, invited_by FROM invitations
+		WHERE token_hash=$1 AND accepted_at IS NULL AND expires_at > now() FOR UPDATE`, HashToken(token)).Scan(&invitationID, &email, &role, &invitedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", errInvitationInvalid
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	// Opening the invitation proves the user owns the address
+	var userID string
+	err = tx.QueryRowContext(ctx, "INSERT INTO users (name, email, username, password, verified) VALUES($1, $2, $3, $4, true) RETURNING user_id",
+		name, email, nullString(username), nullString(string(hashedPassword))).Scan(&userID)
+	if err != nil {
+		return "", "", err
+	}
+	// A role deleted since the invitation was sent is dropped
+	if role != RoleUser {
+		_, err = tx.ExecContext(ctx, `INSERT INTO user_roles (user_id, role, granted_by) SELECT $1, name, $3 FROM roles WHERE name=$2`,
+			userID, role, invitedBy)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE invitations SET accepted_at=now(), accepted_by=$1 WHERE invitation_id=$2", userID, invitationID)
+	if err != nil {
+		return "", "", err
+	}
+	return userID, email, tx.Commit()
+}
+
+// InvitationSignUpHandler registers the invited user, with the email of the
+// invitation.
+func (s *Server) InvitationSignUpHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var body struct {
+		Token       string `json:"token"`
+		Name        string `json:"name"`
+		Username    string `json:"username"`
+		Password    string `json:"password"`
+		AcceptTerms bool   `json:"accept_terms"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.Token) == 0 || (len(body.Password) == 0 && !s.PasswordlessOnly) {
+		return InvalidRequestError(c)
+	}
+	if len(body.Password) > 0 && s.PasswordlessOnly {
+		return PasswordsDisabledError(c)
+	}
+
+	name, ok := normalizeName(body.Name)
+	if !ok {
+		return ValidationError(c, map[string]string{"name": invalidNameMessage})
+	}
+	var username string
+	if len(body.Username) > 0 {
+		username, ok = normalizeUsername(body.Username)
+		if !ok {
+			return InvalidRequestError(c)
+		}
+		// Reserved names are treated as taken
+		if isReservedUsername(username) {
+			return ConflictError(c)
+		}
+	}
+
+	var passwordWarnings []PasswordViolation
+	var hashedPassword []byte
+	if len(body.Password) > 0 {
+		var violations []PasswordViolation
+		violations, passwordWarnings = s.CheckPassword(ctx, body.Password, passwordInputsOf("", username, name)...)
+		if len(violations) > 0 {
+			return WeakPasswordError(c, violations)
+		}
+		hashedPassword, err = bcrypt.GenerateFromPassword([]byte(body.Password), s.BcryptCost)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not hash password", "error", err)
+			return InvalidRequestError(c)
+		}
+	}
+
+	userID, email, err := s.acceptInvitation(ctx, body.Token, name, username, hashedPassword)
+	if errors.Is(err, errInvitationInvalid) {
+		s.Logger.InfoContext(ctx, "Invitation not found, expired or used")
+		return UnauthorizedError(c)
+	}
+	if isUniqueViolation(err) {
+		s.Logger.InfoContext(ctx, "User exists")
+		return ConflictError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not accept invitation", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventInvitationAccepted, userID, email)
+	if body.AcceptTerms {
+		err = s.RecordConsents(c, userID, s.RequiredConsents())
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not record consents", "error", err)
+		}
+	}
+
+	response := echo.Map{"status": "User created", "email": email}
+	if len(passwordWarnings) > 0 {
+		response["password_warnings"] = passwordWarnings
+	}
+	return c.JSON(200, response)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// keyRefreshInterval is how often signing keys are reloaded from the
+// database, which is also how long it takes for every instance to publish
+// a freshly generated key.
+const keyRefreshInterval = time.Minute * 10
+
+// keyActivationDelay keeps a new key published for a while before it signs
+// anything, so relying parties never see a kid missing from the JWKS.
+const keyActivationDelay = keyRefreshInterval * 2
+
+// SigningKey is an RSA key used to sign ID tokens and JWTs.
+type SigningKey struct {
+	ID        string
+	Private   *rsa.PrivateKey
+	CreatedAt time.Time
+}
+
+func NewSigningKey(private *rsa.PrivateKey) *SigningKey {
+	der, _ := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	sum := sha256.Sum256(der)
+	return &SigningKey{
+		ID:        base64.RawURLEncoding.EncodeToString(sum[:12]),
+		Private:   private,
+		CreatedAt: time.Now(),
+	}
+}
+
+func parseSigningKey(data []byte) (*SigningKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	if private, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return NewSigningKey(private), nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	private, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key must be an RSA key")
+	}
+	return NewSigningKey(private), nil
+}
+
+// LoadSigningKey reads a PEM encoded RSA private key, in PKCS#1 or PKCS#8 form.
+func LoadSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSigningKey(data)
+}
+
+func GenerateSigningKey() (*SigningKey, error) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	return NewSigningKey(private), nil
+}
+
+// JWK returns the public half of the key in JSON Web Key form.
+func (key *SigningKey) JWK() map[string]string {
+	public := key.Private.PublicKey
+	return map[string]string{
+		"kty": "RSA",
+		"use": "sig",
+		"alg": "RS256",
+		"kid": key.ID,
+		"n":   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+	}
+}
+
+// KeySet holds the key currently used for signing, and every key whose
+// tokens may still be around and must keep verifying.
+type KeySet struct {
+	mu      sync.RWMutex
+	current *SigningKey
+	keys    []*SigningKey
+}
+
+func NewKeySet(current *SigningKey, keys []*SigningKey) *KeySet {
+	set := &KeySet{}
+	set.Set(current, keys)
+	return set
+}
+
+func (set *KeySet) Set(current *SigningKey, keys []*SigningKey) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	set.current = current
+	set.keys = keys
+}
+
+func (set *KeySet) Current() *SigningKey {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	return set.current
+}
+
+func (set *KeySet) Lookup(kid string) *SigningKey {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	for _, key := range set.keys {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+func (set *KeySet) JWKS() []map[string]string {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	jwks := []map[string]string{}
+	for _, key := range set.keys {
+		jwks = append(jwks, key.JWK())
+	}
+	return jwks
+}
+
+// LoadStaticKeySet reads keys from files. The first one signs, the others
+// are only published so tokens they signed keep verifying, which allows
+// rotating keys by hand.
+func LoadStaticKeySet(paths []string) (*KeySet, error) {
+	var keys []*SigningKey
+	for _, path := range paths {
+		key, err := LoadSigningKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return NewKeySet(keys[0], keys), nil
+}
+
+// RotateSigningKeys loads the keys shared by every instance from the
+// database, generating a new one ahead of time when the current key is due
+// for rotation, and dropping keys that can't have live tokens anymore.
+func (s *Server) RotateSigningKeys(ctx context.Context) error {
+	keys, err := s.loadSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 || time.Since(keys[0].CreatedAt) > s.SigningKeyRotationInterval-keyActivationDelay {
+		key, err := GenerateSigningKey()
+		if err != nil {
+			return err
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+		if err != nil {
+			return err
+		}
+
+		encoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		_, err = s.DB.ExecContext(ctx, "INSERT INTO signing_keys (kid, private_key) VALUES($1, $2)", key.ID, string(encoded))
+		if err != nil {
+			return err
+		}
+		s.Logger.InfoContext(ctx, "Generated a new signing key", "kid", key.ID)
+
+		keys = append([]*SigningKey{key}, keys...)
+	}
+
+	// Keys are ordered newest first. Sign with the newest key that has been
+	// published long enough, or the oldest one while bootstrapping.
+	current := keys[len(keys)-1]
+	for _, key := range keys {
+		if time.Since(key.CreatedAt) >= keyActivationDelay {
+			current = key
+			break
+		}
+	}
+
+	// A key stops signing at most one rotation interval after it was
+	// created, and its tokens live for at most one token lifetime after that
+	cutoff := time.Now().Add(-(s.SigningKeyRotationInterval + keyActivationDelay + s.AccessTokenLifetime))
+	_, err = s.DB.ExecContext(ctx, "DELETE FROM signing_keys WHERE created_at < $1", cutoff)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not delete retired signing keys", "error", err)
+	}
+
+	var published []*SigningKey
+	for _, key := range keys {
+		if key.CreatedAt.After(cutoff) || key == current {
+			published = append(published, key)
+		}
+	}
+
+	s.SigningKeys.Set(current, published)
+	return nil
+}
+
+func (s *Server) loadSigningKeys(ctx context.Context) ([]*SigningKey, error) {
+	rows, err := s.DB.QueryContext(ctx, "SELECT private_key, created_at FROM signing_keys ORDER BY created_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*SigningKey
+	for rows.Next() {
+		var encoded string
+		var createdAt time.Time
+		err = rows.Scan(&encoded, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := parseSigningKey([]byte(encoded))
+		if err != nil {
+			return nil, err
+		}
+		key.CreatedAt = createdAt
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RunSigningKeyRotation keeps the key set up to date until the context ends.
+func (s *Server) RunSigningKeyRotation(ctx context.Context) {
+	ticker := time.NewTicker(keyRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.RotateSigningKeys(ctx)
+			if err != nil {
+				s.Logger.ErrorContext(ctx, "Could not rotate signing keys", "error", err)
+			}
+		}
+	}
+}
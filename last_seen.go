@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+const lastSeenFlushInterval = time.Minute
+
+// Sessions mark their user as seen in a Redis sorted set, scored by time,
+// which gets written to users.last_seen_at in batches. The braces keep both
+// keys in one cluster slot so the set can be renamed.
+const (
+	lastSeenKey         = "{last_seen}"
+	lastSeenFlushingKey = "{last_seen}:flushing"
+)
+
+// MarkSeen notes that the user is active now. It only touches Redis, so it
+// is cheap enough for every request.
+func (s *Server) MarkSeen(ctx context.Context, userID string) {
+	err := s.RDB.ZAdd(ctx, lastSeenKey, redis.Z{Score: float64(time.Now().Unix()), Member: userID}).Err()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not mark user as seen", "error", err)
+	}
+}
+
+// FlushLastSeen writes the users seen since the last flush to the database.
+// The set is renamed first, so marks made during the flush wait for the
+// next one. Flushing the same batch twice does no harm.
+func (s *Server) FlushLastSeen(ctx context.Context) error {
+	// A flush that failed leaves its batch behind, which goes first
+	pending, err := s.RDB.Exists(ctx, lastSeenFlushingKey, lastSeenKey).Result()
+	if err != nil || pending == 0 {
+		return err
+	}
+	flushing, err := s.RDB.Exists(ctx, lastSeenFlushingKey).Result()
+	if err != nil {
+		return err
+	}
+	if flushing == 0 {
+		err = s.RDB.Rename(ctx, lastSeenKey, lastSeenFlushingKey).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	seen, err := s.RDB.ZRangeWithScores(ctx, lastSeenFlushingKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+
+	userIDs := make([]string, 0, len(seen))
+	times := make([]float64, 0, len(seen))
+	for _, z := range seen {
+		userIDs = append(userIDs, z.Member.(string))
+		times = append(times, z.Score)
+	}
+
+	_, err = s.DB.ExecContext(ctx, `UPDATE users SET last_seen_at=to_timestamp(v.seen)
+		FROM unnest($1::uuid[], $2::float8[]) AS v(user_id, seen)
+		WHERE users.user_id=v.user_id AND (users.last_seen_at IS NULL OR users.last_seen_at < to_timestamp(v.seen))`,
+		pq.Array(userIDs), pq.Array(times))
+	if err != nil {
+		return err
+	}
+	return s.RDB.Del(ctx, lastSeenFlushingKey).Err()
+}
+
+// RunLastSeenFlush flushes last seen times periodically until the context
+// ends.
+func (s *Server) RunLastSeenFlush(ctx context.Context) {
+	ticker := time.NewTicker(lastSeenFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.FlushLastSeen(ctx)
+			if err != nil {
+				s.Logger.ErrorContext(ctx, "Could not flush last seen times", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Failed sign-ins are counted per login, the identifier the user signs in
+// with, and per client IP. Reaching the limit locks the login out, and
+// every lockout in a row lasts twice as long as the one before.
+
+func loginFailKey(login string) string {
+	return "login_fail:" + login
+}
+
+func loginLockKey(login string) string {
+	return "login_lock:" + login
+}
+
+// loginLockoutsKey counts the lockouts in a row, which is forgotten after
+// a successful sign-in or a long enough quiet spell
+func loginLockoutsKey(login string) string {
+	return "login_lockouts:" + login
+}
+
+// ipLogin is what failures from a client IP are counted against.
+func ipLogin(ip string) string {
+	return "ip:" + ip
+}
+
+func LoginLockedError(c echo.Context, retryAfter time.Duration) error {
+	c.Response().Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+	return TooManyRequestsError(c)
+}
+
+// LoginLockout returns how much longer the login is locked out, zero when
+// it isn't.
+func (s *Server) LoginLockout(ctx context.Context, login string) time.Duration {
+	ttl, err := s.RDB.PTTL(ctx, loginLockKey(login)).Result()
+	if err != nil || ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// IPLoginLockout is LoginLockout for the client IP of the request.
+func (s *Server) IPLoginLockout(c echo.Context) time.Duration {
+	if s.LoginMaxAttemptsPerIP == 0 {
+		return 0
+	}
+	return s.LoginLockout(c.Request().Context(), ipLogin(c.RealIP()))
+}
+
+// lockoutDuration doubles the base lockout for every earlier lockout in a
+// row, up to the maximum.
+func (s *Server) lockoutDuration(lockouts int64) time.Duration {
+	duration := s.LoginLockoutDuration
+	for i := int64(1); i < lockouts && duration < s.LoginLockoutMaxDuration; i++ {
+		duration *= 2
+	}
+	if duration > s.LoginLockoutMaxDuration {
+		duration = s.LoginLockoutMaxDuration
+	}
+	return duration
+}
+
+// recordFailure bumps the failure counter for the login. The window starts
+// with the first failure and the counter is dropped when it ends, or when
+// it reaches maxAttempts and locks the login out.
+func (s *Server) recordFailure(ctx context.Context, login string, maxAttempts int64) {
+	key := loginFailKey(login)
+	failures, err := s.RDB.Incr(ctx, key).Result()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not record failed login", "error", err)
+		return
+	}
+
+	if failures == 1 {
+		s.RDB.Expire(ctx, key, s.LoginLockoutWindow)
+	}
+	if failures < maxAttempts {
+		return
+	}
+
+	lockouts, err := s.RDB.Incr(ctx, loginLockoutsKey(login)).Result()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not record login lockout", "error", err)
+		return
+	}
+	duration := s.lockoutDuration(lockouts)
+	s.RDB.Expire(ctx, loginLockoutsKey(login), duration+s.LoginLockoutMaxDuration)
+	s.RDB.Set(ctx, loginLockKey(login), lockouts, duration)
+	s.RDB.Del(ctx, key)
+	s.Logger.WarnContext(ctx, "Locked out login after failed attempts", "lockouts", lockouts, "duration", duration)
+}
+
+// RecordLoginFailure counts a failed attempt against the login.
+func (s *Server) RecordLoginFailure(ctx context.Context, login string) {
+	s.recordFailure(ctx, login, s.LoginMaxAttempts)
+}
+
+// RecordIPLoginFailure counts a failed sign-in against the client IP, which
+// catches guessing spread over many accounts.
+func (s *Server) RecordIPLoginFailure(c echo.Context) {
+	if s.LoginMaxAttemptsPerIP == 0 {
+		return
+	}
+	s.recordFailure(c.Request().Context(), ipLogin(c.RealIP()), s.LoginMaxAttemptsPerIP)
+}
+
+func (s *Server) ClearLoginFailures(ctx context.Context, login string) {
+	s.RDB.Del(ctx, loginFailKey(login), loginLockoutsKey(login))
+}
+
+// UnlockLogin lifts any lockout of the login and forgets its failures.
+func (s *Server) UnlockLogin(ctx context.Context, login string) error {
+	return s.RDB.Del(ctx, loginFailKey(login), loginLockKey(login), loginLockoutsKey(login)).Err()
+}
+
+// UnlockUserHandler lifts the lockouts of every identifier the user signs
+// in with.
+func (s *Server) UnlockUserHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+
+	var email, username, phone string
+	err := s.DB.QueryRowContext(ctx, "SELECT COALESCE(LOWER(email), ''), COALESCE(LOWER(username), ''), COALESCE(phone, '') FROM users WHERE user_id=$1",
+		userID).Scan(&email, &username, &phone)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NotFoundError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not find user information", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	// Reauthentication counts failures against the user ID
+	for _, login := range []string{userID, email, username, phone} {
+		if login == "" {
+			continue
+		}
+		err = s.UnlockLogin(ctx, login)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not unlock login", "error", err)
+			return InvalidRequestError(c)
+		}
+	}
+
+	s.RecordAuthEvent(c, EventAccountUnlocked, userID, email)
+
+	return c.JSON(200, echo.Map{"user_id": userID, "status": "Account unlocked"})
+}
+
+// failureCount returns the failures counted against the login in the
+// current window.
+func (s *Server) failureCount(ctx context.Context, login string) int64 {
+	failures, err := s.RDB.Get(ctx, loginFailKey(login)).Int64()
+	if err != nil {
+		return 0
+	}
+	return failures
+}
+
+// loginDelay is how long to hold back a sign-in after the given number of
+// failures: nothing for the first attempt, then LoginDelay doubled for
+// each failure after the first, up to LoginDelayMax.
+func (s *Server) loginDelay(failures int64) time.Duration {
+	if s.LoginDelay == 0 || failures == 0 {
+		return 0
+	}
+	delay := s.LoginDelay
+	for i := int64(1); i < failures && delay < s.LoginDelayMax; i++ {
+		delay *= 2
+	}
+	return min(delay, s.LoginDelayMax)
+}
+
+// DelayLogin slows down guessing before the credentials are checked, by as
+// much as the most failed of the logins, or the client IP, has earned.
+// The counts live in Redis, so every instance holds back the same amount.
+func (s *Server) DelayLogin(c echo.Context, logins ...string) {
+	if s.LoginDelay == 0 {
+		return
+	}
+
+	ctx := c.Request().Context()
+	failures := s.failureCount(ctx, ipLogin(c.RealIP()))
+	for _, login := range logins {
+		failures = max(failures, s.failureCount(ctx, login))
+	}
+
+	delay := s.loginDelay(failures)
+	if delay == 0 {
+		return
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
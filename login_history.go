@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RecordLogin stores a sign-in attempt in the login history, along with the
+// matching event in the audit log, and for successes when the user last
+// signed in. method is the first factor, such as password or magic_link.
+// Like the audit log, failing to record the attempt never fails the request.
+func (s *Server) RecordLogin(c echo.Context, success bool, method string, userID string, email string) {
+	eventType := EventLoginFailure
+	if success {
+		eventType = EventLoginSuccess
+		_, err := s.DB.ExecContext(c.Request().Context(), "UPDATE users SET last_login_at=now(), last_seen_at=now() WHERE user_id=$1", userID)
+		if err != nil {
+			s.Logger.ErrorContext(c.Request().Context(), "Could not record last login", "error", err)
+		}
+	}
+	s.RecordAuthEvent(c, eventType, userID, email)
+	s.recordLoginEvent(c, success, method, userID, email)
+}
+
+// recordLoginEvent only stores the attempt in the login history, for
+// attempts audited under a different event.
+func (s *Server) recordLoginEvent(c echo.Context, success bool, method string, userID string, email string) {
+	ctx := c.Request().Context()
+	// Where the attempt came from feeds the suspicious sign-in checks
+	var latitude, longitude sql.NullFloat64
+	if lat, long, ok := requestCoordinates(c.Request()); ok {
+		latitude = sql.NullFloat64{Float64: lat, Valid: true}
+		longitude = sql.NullFloat64{Float64: long, Valid: true}
+	}
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO login_events (user_id, email, method, success, ip, user_agent, country, latitude, longitude)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)`, nullString(userID), nullString(email), method, success, c.RealIP(), c.Request().UserAgent(),
+		nullString(requestCountry(c.Request())), latitude, longitude)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not record login event", "method", method, "error", err)
+	}
+}
+
+// LoginHistoryHandler lists the user's sign-in attempts, newest first.
+func (s *Server) LoginHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	limit, offset, ok := pagination(c)
+	if !ok {
+		return InvalidRequestError(c)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT method, success, ip, user_agent, created_at FROM login_events
+		WHERE user_id=$1 ORDER BY created_at DESC LIMIT $2 OFFSET $3`, userID, limit, offset)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read login history", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	logins := []echo.Map{}
+	for rows.Next() {
+		var method string
+		var success bool
+		var ip, userAgent sql.NullString
+		var createdAt time.Time
+		err = rows.Scan(&method, &success, &ip, &userAgent, &createdAt)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read login history", "error", err)
+			return InvalidRequestError(c)
+		}
+
+		logins = append(logins, echo.Map{
+			"method":     method,
+			"success":    success,
+			"ip":         ip.String,
+			"user_agent": userAgent.String,
+			"device":     deviceJSON(ParseUserAgent(userAgent.String)),
+			"created_at": createdAt,
+		})
+	}
+	if err = rows.Err(); err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read login history", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{
+		"logins": logins,
+		"limit":  limit,
+		"offset": offset,
+	})
+}
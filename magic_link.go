@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+)
+
+// magicLink is what a sign-in link stands for until it is clicked.
+type magicLink struct {
+	UserID   string `json:"user_id"`
+	Remember bool   `json:"remember"`
+	ReturnTo string `json:"return_to"`
+}
+
+func magicLinkKey(token string) string {
+	return "magic_link:" + HashToken(token)
+}
+
+// MagicLinkRequestHandler emails a single-use sign-in link. It answers the
+// same whether or not the account exists, so it can't be used to probe for
+// registered emails.
+func (s *Server) MagicLinkRequestHandler(c echo.Context) error {
+	if s.Mailer == nil {
+		return NotFoundError(c)
+	}
+
+	var body struct {
+		Email    string `json:"email"`
+		Remember bool   `json:"remember"`
+		ReturnTo string `json:"return_to"`
+	}
+	err := c.Bind(&body)
+	body.Email = normalizeEmail(body.Email)
+	if err != nil || len(body.Email) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	response := echo.Map{"status": "If the account exists, a sign-in link has been sent"}
+
+	var userID string
+	err = s.DB.QueryRowContext(ctx, "SELECT user_id FROM users WHERE LOWER(email)=$1", body.Email).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.Logger.InfoContext(ctx, "Magic link requested for unknown user")
+		return c.JSON(200, response)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	data, err := json.Marshal(magicLink{UserID: userID, Remember: body.Remember, ReturnTo: s.SafeReturnTo(body.ReturnTo)})
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+
+	token := RandomToken()
+	err = s.RDB.Set(ctx, magicLinkKey(token), data, s.MagicLinkLifetime).Err()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store magic link", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	link := s.IssuerURL + "/login/magic-link?token=" + url.QueryEscape(token)
+	// Sent in the background so the response time doesn't reveal whether
+	// the account exists
+	go func(ctx context.Context) {
+		err := s.Mailer.Send(body.Email, "Your sign-in link",
+			"Open this link to sign in. It expires in "+s.MagicLinkLifetime.String()+" and works once.\n\n"+link+"\n")
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not send magic link", "user_id", userID, "error", err)
+		}
+	}(context.WithoutCancel(ctx))
+
+	return c.JSON(200, response)
+}
+
+// MagicLinkLoginHandler completes the sign-in when the emailed link is opened.
+func (s *Server) MagicLinkLoginHandler(c echo.Context) error {
+	token := c.QueryParam("token")
+	if len(token) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	data, err := s.RDB.GetDel(ctx, magicLinkKey(token)).Bytes()
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Magic link not found or expired", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	var link magicLink
+	err = json.Unmarshal(data, &link)
+	if err != nil {
+		return UnauthorizedError(c)
+	}
+
+	// Opening the link proves the user owns the address
+	var email string
+	err = s.DB.QueryRowContext(ctx, "UPDATE users SET verified=true WHERE user_id=$1 RETURNING email", link.UserID).Scan(&email)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Magic link user no longer exists", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	// The link stands in for the password, not for the second factor
+	return s.FinishRedirectSignIn(c, link.UserID, email, link.Remember, "magic_link", link.ReturnTo)
+}
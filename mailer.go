@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Mailer sends plain text email through an SMTP relay.
+type Mailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func NewMailer(host string, port string, username string, password string, from string) *Mailer {
+	mailer := &Mailer{Addr: net.JoinHostPort(host, port), From: from}
+	if username != "" {
+		mailer.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer
+}
+
+func (m *Mailer) Send(to string, subject string, body string) error {
+	// Header injection is only possible through newlines in these
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("invalid email header")
+	}
+
+	message := "From: " + m.From + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, []byte(message))
+}
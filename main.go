@@ -2,31 +2,190 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	"github.com/google/uuid"
-	"github.com/joho/godotenv"
+	"github.com/crewjam/saml"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type Server struct {
-	DB  *sql.DB
-	RDB *redis.Client
+	DB     *sql.DB
+	RDB    redis.UniversalClient
+	Logger *slog.Logger
+
+	// SessionLifetime is how long a session lives after it was last refreshed
+	SessionLifetime time.Duration
+	// SessionRefreshThreshold is the remaining TTL below which a session gets extended
+	SessionRefreshThreshold time.Duration
+	// RememberSessionLifetime replaces SessionLifetime when the user asked to be remembered
+	RememberSessionLifetime time.Duration
+	// SessionSliding extends the session on every request instead of only near expiry
+	SessionSliding bool
+	// SessionMaxLifetime caps how long a session can be kept alive by refreshing, or zero for no cap
+	SessionMaxLifetime time.Duration
+	// MaxSessions limits the active sessions per user, or zero for no limit.
+	// MaxSessionsByDomain overrides it for users with emails at a domain.
+	MaxSessions         int64
+	MaxSessionsByDomain map[string]int64
+	// CookieSecrets sign the session cookies. The first one signs new
+	// cookies and all of them are accepted, so secrets can be rotated.
+	CookieSecrets [][]byte
+	// Sessions stores sessions, unless StatelessSessions keeps them in the
+	// encrypted session cookie instead, with only revocations stored in Postgres
+	Sessions          SessionStore
+	StatelessSessions bool
+	// Cookie holds the attributes of the cookies we set
+	Cookie CookieConfig
+	// SessionBindFingerprint rejects sessions used from another network or browser
+	SessionBindFingerprint bool
+	// SessionLimitAction is what happens to a sign-in over the limit, SessionLimitEvict or SessionLimitRefuse
+	SessionLimitAction string
+
+	// LoginMaxAttempts is the number of failed logins allowed per email within LoginLockoutWindow
+	LoginMaxAttempts   int64
+	LoginLockoutWindow time.Duration
+	// LoginMaxAttemptsPerIP is the same per client IP, with zero turning it off
+	LoginMaxAttemptsPerIP int64
+	// LoginLockoutDuration is how long the first lockout lasts, and every
+	// lockout in a row after it twice as long, up to LoginLockoutMaxDuration
+	LoginLockoutDuration    time.Duration
+	LoginLockoutMaxDuration time.Duration
+	// LoginDelay holds back sign-ins after a failure, twice as long for
+	// every failure after that up to LoginDelayMax. Zero turns it off.
+	LoginDelay    time.Duration
+	LoginDelayMax time.Duration
+	// PasswordlessOnly turns off everything to do with passwords
+	PasswordlessOnly bool
+	// RegistrationClosed turns off public signup, including guests and new
+	// users from upstream providers, leaving invitations and admins to
+	// create accounts
+	RegistrationClosed bool
+	// RequireApproval holds new registrations as pending until an admin
+	// approves them
+	RequireApproval bool
+	// AllowedEmailDomains limits signup to emails at these domains and their
+	// subdomains, when set. BlockedEmailDomains are refused either way.
+	AllowedEmailDomains []string
+	BlockedEmailDomains []string
+	// RequireEmailVerification turns away password sign-ins with an
+	// unconfirmed email. Without it apps can check email_verified instead.
+	RequireEmailVerification bool
+	// TermsVersion and PrivacyVersion are the current versions users have
+	// to accept, empty when not tracked. ConsentEnforcement is ConsentBlock
+	// or ConsentFlag.
+	TermsVersion       string
+	PrivacyVersion     string
+	ConsentEnforcement string
+	// NewDeviceNotifications emails users when they sign in from a device
+	// they haven't used before
+	NewDeviceNotifications bool
+	// SudoLifetime is how long sudo mode lasts after signing in or reauthenticating
+	SudoLifetime time.Duration
+	// AccountDeletionGracePeriod is how long a scheduled deletion waits,
+	// during which signing in again cancels it
+	AccountDeletionGracePeriod time.Duration
+
+	BcryptCost     int
+	PasswordPolicy PasswordPolicy
+	// Breaches is nil unless new passwords are looked up in Have I Been
+	// Pwned, and BreachAction tells whether a hit refuses the password
+	Breaches     *BreachChecker
+	BreachAction string
+	// DisposableDomains is nil unless signups are checked for throwaway
+	// email providers, and DisposableEmailAction tells whether a hit
+	// refuses the signup or flags the user
+	DisposableDomains     *DisposableDomains
+	DisposableEmailAction string
+	// PasswordHistory is how many of the user's last passwords, the current
+	// one included, can't be set again. Zero turns it off.
+	PasswordHistory int
+	// PasswordMaxAge is how old a password can get before signing in with
+	// it only lets the user change it. Zero turns it off.
+	PasswordMaxAge time.Duration
+
+	// LoginPageURL is where browsers get sent to sign in during an OAuth flow
+	LoginPageURL        string
+	AccessTokenLifetime time.Duration
+
+	// IssuerURL is the public base URL of this server, used as the OIDC issuer
+	IssuerURL   string
+	SigningKeys *KeySet
+	// SigningKeyRotationInterval is how long a generated signing key is used
+	SigningKeyRotationInterval time.Duration
+
+	// JWTAlgorithm is HS256 or RS256 when sign-in also issues JWTs, empty otherwise
+	JWTAlgorithm string
+	JWTSecret    []byte
+
+	RefreshTokenLifetime time.Duration
+
+	AllowedOrigins []string
+	// Providers are the upstream identity providers users can sign in with
+	Providers map[string]*UpstreamProvider
+	// SAML is the service provider for the corporate IdP, nil when disabled
+	SAML *saml.ServiceProvider
+	// Mailer is nil when no SMTP relay is configured
+	Mailer            *Mailer
+	MagicLinkLifetime time.Duration
+	// PasswordResetURL is the page reset emails link to, with the token in
+	// the query. Without it the email carries the bare token.
+	PasswordResetURL      string
+	PasswordResetLifetime time.Duration
+	// InvitationURL is the registration page invitations link to, with the
+	// token in the query
+	InvitationURL             string
+	InvitationLifetime        time.Duration
+	EmailVerificationLifetime time.Duration
+	EmailRevertLifetime       time.Duration
+	TOTPIssuer                string
+	// SMS is nil when no SMS provider is configured
+	SMS           SMSSender
+	OTPLifetime   time.Duration
+	OTPSendLimit  int64
+	OTPSendWindow time.Duration
+	// Push is nil when sign-in approvals aren't pushed to devices, which
+	// then have to poll for them
+	Push PushNotifier
+	// SuspiciousLoginAction is what happens to sign-ins that look suspicious,
+	// empty to not check them
+	SuspiciousLoginAction string
+	// TorExitNodes are the addresses of Tor exit nodes
+	TorExitNodes map[string]bool
+	// SecurityWebhook is nil when security events aren't posted anywhere
+	SecurityWebhook *SecurityWebhook
+	// Avatars is nil when avatar uploads are turned off
+	Avatars BlobStore
+	// Captcha is nil when sign-up and sign-in don't ask for a CAPTCHA
+	Captcha *CaptchaVerifier
+	// CaptchaAfterFailures is how many failed sign-ins from a client trigger
+	// the CAPTCHA, zero to always ask for it
+	CaptchaAfterFailures int64
+	// SocialLoginRedirectURL is where users land after signing in with a provider
+	SocialLoginRedirectURL string
 }
 
 type User struct {
 	UserID   string `json:"id"`
 	Name     string `json:"name"`
 	Email    string `json:"email"`
+	Phone    string `json:"phone"`
+	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
@@ -40,186 +199,965 @@ func initDB(db *sql.DB) {
 		email VARCHAR,
 		password VARCHAR 
 	);
+	DO $$ DECLARE duplicates TEXT; BEGIN
+		IF NOT EXISTS (SELECT 1 FROM pg_indexes WHERE tablename='users' AND indexname='users_email_lower_idx') THEN
+			SELECT string_agg(email || ' (' || user_id || ')', ', ' ORDER BY LOWER(email), user_id) INTO duplicates FROM users
+				WHERE LOWER(email) IN (SELECT LOWER(email) FROM users GROUP BY LOWER(email) HAVING count(*) > 1);
+			IF duplicates IS NOT NULL THEN
+				RAISE EXCEPTION 'Emails must be unique regardless of case, merge or change these accounts before upgrading: %', duplicates;
+			END IF;
+		END IF;
+	END $$;
+	CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (LOWER(email));
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS verified BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS phone VARCHAR;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS phone_verified BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS sms_mfa_enabled BOOLEAN NOT NULL DEFAULT false;
+	CREATE UNIQUE INDEX IF NOT EXISTS users_phone_idx ON users (phone);
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS username VARCHAR;
+	CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_idx ON users (LOWER(username));
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS guest BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS session_version BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS delete_after TIMESTAMPTZ;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS status VARCHAR NOT NULL DEFAULT 'active'
+		CHECK (status IN ('active', 'deactivated', 'suspended', 'pending'));
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS password_changed_at TIMESTAMPTZ NOT NULL DEFAULT now();
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at TIMESTAMPTZ;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS last_seen_at TIMESTAMPTZ;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_updated_at TIMESTAMPTZ;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS disposable_email BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{"app_metadata": {}, "user_metadata": {}}'
+		CHECK (octet_length(metadata::text) <= 32768);
+	CREATE TABLE IF NOT EXISTS auth_events (
+		event_id BIGSERIAL PRIMARY KEY,
+		event_type VARCHAR NOT NULL,
+		user_id UUID,
+		email VARCHAR,
+		ip VARCHAR,
+		user_agent VARCHAR,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS auth_events_user_idx ON auth_events (user_id, created_at DESC);
+	CREATE TABLE IF NOT EXISTS known_devices (
+		user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+		fingerprint VARCHAR NOT NULL,
+		first_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_seen_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, fingerprint)
+	);
+	CREATE TABLE IF NOT EXISTS consents (
+		user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+		document VARCHAR NOT NULL,
+		version VARCHAR NOT NULL,
+		ip VARCHAR,
+		user_agent VARCHAR,
+		accepted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, document, version)
+	);
+	CREATE TABLE IF NOT EXISTS roles (
+		name VARCHAR PRIMARY KEY,
+		description VARCHAR NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	INSERT INTO roles (name, description) VALUES ('admin', 'Manages users and settings'), ('user', 'Every user') ON CONFLICT DO NOTHING;
+	CREATE TABLE IF NOT EXISTS user_roles (
+		user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+		role VARCHAR NOT NULL REFERENCES roles (name) ON DELETE CASCADE,
+		granted_by UUID REFERENCES users (user_id) ON DELETE SET NULL,
+		granted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, role)
+	);
+	CREATE INDEX IF NOT EXISTS user_roles_role_idx ON user_roles (role);
+	CREATE TABLE IF NOT EXISTS role_permissions (
+		role VARCHAR NOT NULL REFERENCES roles (name) ON DELETE CASCADE,
+		action VARCHAR NOT NULL,
+		resource VARCHAR NOT NULL DEFAULT '*',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (role, action, resource)
+	);
+	INSERT INTO role_permissions (role, action, resource) VALUES ('admin', '*', '*') ON CONFLICT DO NOTHING;
+	CREATE TABLE IF NOT EXISTS groups (
+		group_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		name VARCHAR NOT NULL UNIQUE,
+		description VARCHAR NOT NULL DEFAULT '',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS group_members (
+		group_id UUID NOT NULL REFERENCES groups (group_id) ON DELETE CASCADE,
+		user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+		added_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (group_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS group_members_user_idx ON group_members (user_id);
+	CREATE TABLE IF NOT EXISTS group_roles (
+		group_id UUID NOT NULL REFERENCES groups (group_id) ON DELETE CASCADE,
+		role VARCHAR NOT NULL REFERENCES roles (name) ON DELETE CASCADE,
+		PRIMARY KEY (group_id, role)
+	);
+	DO $$ BEGIN
+		IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name='users' AND column_name='is_admin') THEN
+			INSERT INTO user_roles (user_id, role) SELECT user_id, 'admin' FROM users WHERE is_admin ON CONFLICT DO NOTHING;
+			ALTER TABLE users DROP COLUMN is_admin;
+		END IF;
+	END $$;
+	CREATE TABLE IF NOT EXISTS invitations (
+		invitation_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		email VARCHAR NOT NULL,
+		role VARCHAR NOT NULL DEFAULT 'user',
+		token_hash VARCHAR NOT NULL UNIQUE,
+		invited_by UUID REFERENCES users (user_id) ON DELETE SET NULL,
+		accepted_by UUID REFERENCES users (user_id) ON DELETE SET NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		expires_at TIMESTAMPTZ NOT NULL,
+		accepted_at TIMESTAMPTZ
+	);
+	CREATE TABLE IF NOT EXISTS login_events (
+		event_id BIGSERIAL PRIMARY KEY,
+		user_id UUID REFERENCES users (user_id) ON DELETE CASCADE,
+		email VARCHAR,
+		method VARCHAR NOT NULL,
+		success BOOLEAN NOT NULL,
+		ip VARCHAR,
+		user_agent VARCHAR,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS login_events_user_idx ON login_events (user_id, created_at DESC);
+	ALTER TABLE login_events ADD COLUMN IF NOT EXISTS country VARCHAR;
+	ALTER TABLE login_events ADD COLUMN IF NOT EXISTS latitude DOUBLE PRECISION;
+	ALTER TABLE login_events ADD COLUMN IF NOT EXISTS longitude DOUBLE PRECISION;
+	CREATE TABLE IF NOT EXISTS clients (
+		client_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		client_secret_hash VARCHAR NOT NULL,
+		name VARCHAR NOT NULL,
+		redirect_uris TEXT[] NOT NULL,
+		owner_id UUID REFERENCES users (user_id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	ALTER TABLE clients ADD COLUMN IF NOT EXISTS public BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE clients ADD COLUMN IF NOT EXISTS allowed_scopes TEXT[] NOT NULL DEFAULT '{}';
+	ALTER TABLE clients ADD COLUMN IF NOT EXISTS backchannel_logout_uri TEXT;
+	ALTER TABLE clients ADD COLUMN IF NOT EXISTS resource_server BOOLEAN NOT NULL DEFAULT false;
+	ALTER TABLE clients ADD COLUMN IF NOT EXISTS exchange_audiences TEXT[] NOT NULL DEFAULT '{}';
+	CREATE TABLE IF NOT EXISTS oauth_grants (
+		user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+		client_id UUID NOT NULL REFERENCES clients (client_id) ON DELETE CASCADE,
+		scopes TEXT[] NOT NULL,
+		granted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, client_id)
+	);
+	CREATE TABLE IF NOT EXISTS sessions (
+		session_id VARCHAR PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+		data JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id, created_at);
+	CREATE INDEX IF NOT EXISTS sessions_expires_idx ON sessions (expires_at);
+	CREATE TABLE IF NOT EXISTS revoked_sessions (
+		session_id UUID PRIMARY KEY,
+		expires_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS session_cutoffs (
+		user_id UUID PRIMARY KEY REFERENCES users (user_id) ON DELETE CASCADE,
+		revoked_before TIMESTAMPTZ NOT NULL,
+		kept_session_id UUID
+	);
+	CREATE TABLE IF NOT EXISTS signing_keys (
+		kid VARCHAR PRIMARY KEY,
+		private_key TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS identities (
+		provider VARCHAR NOT NULL,
+		provider_user_id VARCHAR NOT NULL,
+		user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+		email VARCHAR,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (provider, provider_user_id)
+	);
+	CREATE INDEX IF NOT EXISTS identities_user_idx ON identities (user_id);
+	CREATE TABLE IF NOT EXISTS api_keys (
+		key_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		name VARCHAR NOT NULL,
+		key_hash VARCHAR NOT NULL UNIQUE,
+		key_prefix VARCHAR NOT NULL,
+		user_id UUID REFERENCES users (user_id) ON DELETE CASCADE,
+		client_id UUID REFERENCES clients (client_id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_used_at TIMESTAMPTZ,
+		expires_at TIMESTAMPTZ,
+		CHECK ((user_id IS NULL) <> (client_id IS NULL))
+	);
+	CREATE TABLE IF NOT EXISTS personal_access_tokens (
+		token_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+		name VARCHAR NOT NULL,
+		token_hash VARCHAR NOT NULL UNIQUE,
+		scope VARCHAR NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_used_at TIMESTAMPTZ,
+		expires_at TIMESTAMPTZ
+	);
+	CREATE TABLE IF NOT EXISTS client_certificates (
+		subject VARCHAR PRIMARY KEY,
+		client_id UUID NOT NULL REFERENCES clients (client_id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS push_devices (
+		device_id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+		user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+		name VARCHAR NOT NULL,
+		push_token VARCHAR,
+		secret_hash VARCHAR NOT NULL UNIQUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_used_at TIMESTAMPTZ
+	);
+	CREATE TABLE IF NOT EXISTS password_history (
+		history_id BIGSERIAL PRIMARY KEY,
+		user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+		password_hash VARCHAR NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS password_history_user_idx ON password_history (user_id, created_at DESC);
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id UUID NOT NULL REFERENCES users (user_id) ON DELETE CASCADE,
+		code_hash VARCHAR NOT NULL,
+		used_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, code_hash)
+	);
 	`)
 	if err != nil {
 		panic(err)
 	}
 }
 
+// normalizeEmail makes email lookups case-insensitive, matching the
+// LOWER(email) unique index.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+func isForeignKeyViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23503"
+}
+
+func isCheckViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23514"
+}
+
 func InvalidRequestError(c echo.Context) error {
 	return c.JSON(400, echo.Map{"error": "Invalid request"})
 }
 
+// ValidationError lists what's wrong with each field of the request.
+func ValidationError(c echo.Context, fields map[string]string) error {
+	return c.JSON(400, echo.Map{"error": "Invalid request", "fields": fields})
+}
+
+func ServerError(c echo.Context) error {
+	return c.JSON(500, echo.Map{"error": "Something went wrong"})
+}
+
+func ForbiddenError(c echo.Context) error {
+	return c.JSON(403, echo.Map{"error": "Forbidden"})
+}
+
 func UnauthorizedError(c echo.Context) error {
 	return c.JSON(401, echo.Map{"error": "Unauthorized"})
 }
 
-func SetCookie(c echo.Context, key, value string, expiration time.Time) {
+func NotFoundError(c echo.Context) error {
+	return c.JSON(404, echo.Map{"error": "Not found"})
+}
+
+func ConflictError(c echo.Context) error {
+	return c.JSON(409, echo.Map{"error": "Already exists"})
+}
+
+func EmailNotVerifiedError(c echo.Context) error {
+	return c.JSON(403, echo.Map{"error": "Email not verified"})
+}
+
+func PhoneNotVerifiedError(c echo.Context) error {
+	return c.JSON(403, echo.Map{"error": "Phone not verified"})
+}
+
+func PasswordsDisabledError(c echo.Context) error {
+	return c.JSON(403, echo.Map{"error": "Passwords are disabled, sign in with a magic link, a code or a provider"})
+}
+
+var errRegistrationClosed = errors.New("registration is closed")
+
+func RegistrationClosedError(c echo.Context) error {
+	return c.JSON(403, echo.Map{"error": "Registration is closed, accounts are by invitation only"})
+}
+
+func TooManyRequestsError(c echo.Context) error {
+	return c.JSON(429, echo.Map{"error": "Too many attempts, try again later"})
+}
+
+// SetCookie sets an HTTP-only cookie with the configured cookie attributes.
+// A zero expiration makes it a session cookie that the browser drops when it
+// closes.
+func (s *Server) SetCookie(c echo.Context, key, value string, expiration time.Time) {
 	cookie := &http.Cookie{
 		Name:     key,
 		Value:    value,
+		Domain:   s.Cookie.Domain,
+		Path:     s.Cookie.Path,
 		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteStrictMode,
+		Secure:   s.Cookie.Secure,
+		SameSite: s.Cookie.SameSite,
 		Expires:  expiration,
 	}
 	c.SetCookie(cookie)
 }
 
-func (s *Server) VerifySessionAndUserID(ctx context.Context, sessionID string, userID string) bool {
-	storedUserID, err := s.RDB.Get(ctx, sessionID).Result()
+// SetSessionCookie issues the session cookie, signed when cookie secrets
+// are configured. It carries the session ID and nothing else, the user is
+// always looked up from the session.
+func (s *Server) SetSessionCookie(c echo.Context, sessionID string, expiration time.Time) {
+	s.SetCookie(c, s.Cookie.Name, s.signCookie(s.Cookie.Name, sessionID), expiration)
+}
+
+// ClearSessionCookie removes the session cookie, along with the userid and
+// session cookies older versions issued.
+func (s *Server) ClearSessionCookie(c echo.Context) {
+	s.SetCookie(c, s.Cookie.Name, "", time.Unix(0, 0))
+	s.SetCookie(c, "userid", "", time.Unix(0, 0))
+	s.SetCookie(c, "session", "", time.Unix(0, 0))
+}
+
+// VerifySessionAndUserID returns the session if it still works and belongs
+// to the user, nil otherwise.
+func (s *Server) VerifySessionAndUserID(ctx context.Context, sessionID string, userID string) *Session {
+	session := s.LiveSession(ctx, sessionID)
+	if session == nil {
+		return nil
+	}
+
+	if session.UserID != userID {
+		s.Logger.WarnContext(ctx, "Session does not belong to user", "user_id", userID)
+		return nil
+	}
+	return session
+}
+
+// LiveSession returns the session if it still works, nil otherwise. It is
+// for callers that hold a session ID without the browser's request, which
+// leaves out the fingerprint check Authenticate makes.
+func (s *Server) LiveSession(ctx context.Context, sessionID string) *Session {
+	session, err := s.GetSession(ctx, sessionID)
 	if err != nil {
-		fmt.Printf("Session not found or expired: %s\n", err)
+		s.Logger.InfoContext(ctx, "Session not found or expired", "error", err)
+		return nil
+	}
+	if !s.sessionUsable(ctx, sessionID, session) {
+		return nil
+	}
+	return session
+}
+
+// sessionUsable checks a stored session still counts: it carries the user's
+// current session version, is within its maximum lifetime, and belongs to
+// an active account. Sessions past their maximum lifetime are removed.
+func (s *Server) sessionUsable(ctx context.Context, sessionID string, session *Session) bool {
+	if !s.SessionVersionCurrent(ctx, session) {
+		s.Logger.InfoContext(ctx, "Session was invalidated", "user_id", session.UserID)
 		return false
 	}
 
-	if storedUserID != userID {
-		fmt.Printf("Invalid session: %s\n", err)
+	if s.SessionExpired(session) {
+		s.Logger.InfoContext(ctx, "Session reached its maximum lifetime", "user_id", session.UserID)
+		err := s.RemoveUserSession(ctx, session.UserID, sessionID)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not remove expired session", "error", err)
+		}
 		return false
 	}
 
+	// Sessions are revoked when an account stops being active, this
+	// catches any that slipped through
+	status, err := s.AccountStatus(ctx, session.UserID)
+	if err != nil || status != AccountActive {
+		s.Logger.InfoContext(ctx, "Session of inactive account", "user_id", session.UserID, "status", status)
+		return false
+	}
 	return true
 }
 
+// SessionLifetimes returns the lifetime of a session and the remaining TTL
+// below which it gets refreshed. Remembered sessions refresh at half-life.
+func (s *Server) SessionLifetimes(remember bool) (lifetime time.Duration, refreshThreshold time.Duration) {
+	if remember {
+		return s.RememberSessionLifetime, s.RememberSessionLifetime / 2
+	}
+	return s.SessionLifetime, s.SessionRefreshThreshold
+}
+
+// SessionCookieExpiration is when the session cookies should expire. Sessions
+// that aren't remembered get browser-session cookies.
+func (s *Server) SessionCookieExpiration(remember bool) time.Time {
+	if !remember {
+		return time.Time{}
+	}
+	if s.SessionMaxLifetime > 0 && s.SessionMaxLifetime < s.RememberSessionLifetime {
+		return time.Now().Add(s.SessionMaxLifetime)
+	}
+	return time.Now().Add(s.RememberSessionLifetime)
+}
+
+// SessionExpired reports whether the session has outlived the absolute
+// maximum lifetime, no matter how recently it was used.
+func (s *Server) SessionExpired(session *Session) bool {
+	return s.SessionMaxLifetime > 0 && time.Since(session.CreatedAt) >= s.SessionMaxLifetime
+}
+
+// RenewalLifetime is how long the session could be extended for from now:
+// its full lifetime, capped so it never goes past the absolute maximum.
+func (s *Server) RenewalLifetime(session *Session) time.Duration {
+	lifetime, _ := s.SessionLifetimes(session.Remember)
+	if s.SessionMaxLifetime > 0 {
+		remaining := time.Until(session.CreatedAt.Add(s.SessionMaxLifetime))
+		if remaining < lifetime {
+			lifetime = remaining
+		}
+	}
+	return lifetime
+}
+
+// ExtendSession makes the session expire lifetime from now and re-issues the
+// cookies to match.
+func (s *Server) ExtendSession(c echo.Context, sessionID string, session *Session, lifetime time.Duration) error {
+	if s.StatelessSessions {
+		return s.reissueStatelessSession(c, sessionID, session, time.Now().Add(lifetime))
+	}
+
+	err := s.Sessions.Extend(c.Request().Context(), session.UserID, sessionID, lifetime)
+	if err != nil {
+		return err
+	}
+
+	expiration := time.Time{}
+	if session.Remember {
+		expiration = time.Now().Add(lifetime)
+	}
+	s.SetSessionCookie(c, sessionID, expiration)
+	return nil
+}
+
+// RefreshSession pushes the session expiry back out once its remaining TTL
+// drops below the refresh threshold, or on every request with sliding
+// sessions, and re-issues the cookies to match. The new expiry never goes
+// past the absolute maximum lifetime.
+func (s *Server) RefreshSession(c echo.Context, sessionID string, session *Session) {
+	ctx := c.Request().Context()
+	ttl, err := s.SessionTTL(ctx, sessionID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read session TTL", "error", err)
+		return
+	}
+
+	_, threshold := s.SessionLifetimes(session.Remember)
+	if !s.SessionSliding && ttl >= threshold {
+		return
+	}
+
+	lifetime := s.RenewalLifetime(session)
+	if lifetime <= ttl {
+		return
+	}
+
+	err = s.ExtendSession(c, sessionID, session, lifetime)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Failed to refresh user session", "error", err)
+	}
+}
+
+// Authenticate resolves the session cookie of the request, returning a nil
+// session when it is missing or invalid.
+func (s *Server) Authenticate(c echo.Context) (string, *Session) {
+	ctx := c.Request().Context()
+	// Tampered cookies are turned away here, before they cost a Redis lookup
+	sessionID, ok := s.SignedCookie(c, s.Cookie.Name)
+	if !ok {
+		s.Logger.DebugContext(ctx, "Session cookie missing or not validly signed")
+		return "", nil
+	}
+
+	session, err := s.GetSession(ctx, sessionID)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Invalid session", "error", err)
+		return "", nil
+	}
+
+	// Sessions from before fingerprints were recorded have none to compare
+	if s.SessionBindFingerprint && session.Fingerprint != "" &&
+		session.Fingerprint != ClientFingerprint(c.Request(), c.RealIP()) {
+		s.Logger.WarnContext(ctx, "Session used from a different client", "user_id", session.UserID, "ip", c.RealIP())
+		return "", nil
+	}
+
+	if !s.sessionUsable(ctx, sessionID, session) {
+		return "", nil
+	}
+
+	s.RefreshSession(c, sessionID, session)
+	s.MarkSeen(ctx, session.UserID)
+	return sessionID, session
+}
+
 func (s *Server) SessionMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		userID, err := c.Cookie("userid")
-		if err != nil {
-			fmt.Printf("User cookie not found: %s\n", err)
+		sessionID, session := s.Authenticate(c)
+		if session == nil {
 			return UnauthorizedError(c)
 		}
 
-		sessionID, err := c.Cookie("session")
-		if err != nil {
-			fmt.Printf("Session cookie not found: %s\n", err)
-			return UnauthorizedError(c)
+		if session.PasswordExpired && !passwordExpiredAllowed(c) {
+			return PasswordExpiredError(c)
 		}
-
-		if !s.VerifySessionAndUserID(context.Background(), sessionID.Value, userID.Value) {
-			fmt.Printf("Invalid session: %s\n", err)
-			return UnauthorizedError(c)
+		if err := s.CheckConsent(c, sessionID, session); err != nil {
+			return err
 		}
 
-		c.Set("userID", userID.Value)
-		c.Set("sessionID", sessionID.Value)
+		c.Set("userID", session.UserID)
+		c.Set("sessionID", sessionID)
+		c.Set("session", session)
+		return next(c)
+	}
+}
+
+// PasswordsEnabled turns away password endpoints in passwordless-only mode.
+func (s *Server) PasswordsEnabled(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if s.PasswordlessOnly {
+			return PasswordsDisabledError(c)
+		}
 		return next(c)
 	}
 }
 
 func (s *Server) UserSignUpHandler(c echo.Context) error {
-	var user User
+	var user struct {
+		User
+		CaptchaToken string `json:"captcha_token"`
+		// AcceptTerms accepts the current terms and privacy policy
+		AcceptTerms bool `json:"accept_terms"`
+	}
+
+	if s.RegistrationClosed {
+		return RegistrationClosedError(c)
+	}
 
 	err := c.Bind(&user)
-	if err != nil || len(user.Email) == 0 || len(user.Password) == 0 {
+	user.Email = normalizeEmail(user.Email)
+	if err != nil || (len(user.Password) == 0 && !s.PasswordlessOnly) || (len(user.Email) == 0 && len(user.Phone) == 0) {
 		return InvalidRequestError(c)
 	}
+	if len(user.Password) > 0 && s.PasswordlessOnly {
+		return PasswordsDisabledError(c)
+	}
+	if len(user.Email) > 0 && !s.EmailDomainAllowed(user.Email) {
+		return EmailDomainNotAllowedError(c)
+	}
+	// Flagged users can sign up, it's up to the app what they may do
+	disposable := len(user.Email) > 0 && s.DisposableDomains != nil && s.DisposableDomains.Disposable(user.Email)
+	if disposable && s.DisposableEmailAction == DisposableEmailReject {
+		return DisposableEmailError(c)
+	}
+	var passwordWarnings []PasswordViolation
+	if len(user.Password) > 0 {
+		var violations []PasswordViolation
+		violations, passwordWarnings = s.CheckPassword(c.Request().Context(), user.Password, passwordInputsOf(user.Email, user.Username, user.Name)...)
+		if len(violations) > 0 {
+			return WeakPasswordError(c, violations)
+		}
+	}
 
-	var exists bool
-	err = s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE email=$1)", user.Email).Scan(&exists)
-	if err != nil || exists {
-		fmt.Printf("User exists: %s\n", err)
-		return InvalidRequestError(c)
+	if !s.CheckCaptcha(c, user.CaptchaToken) {
+		return CaptchaRequiredError(c)
+	}
+
+	// Users can register with a phone number in place of an email, which
+	// then has to be verified by SMS before they can sign in with it
+	if len(user.Phone) > 0 {
+		if s.SMS == nil {
+			return NotFoundError(c)
+		}
+		phone, ok := normalizePhone(user.Phone)
+		if !ok {
+			return InvalidRequestError(c)
+		}
+		user.Phone = phone
+	}
+
+	name, ok := normalizeName(user.Name)
+	if !ok {
+		return ValidationError(c, map[string]string{"name": invalidNameMessage})
+	}
+	user.Name = name
+
+	if len(user.Username) > 0 {
+		username, ok := normalizeUsername(user.Username)
+		if !ok {
+			return InvalidRequestError(c)
+		}
+		// Reserved names are treated as taken
+		if isReservedUsername(username) {
+			return ConflictError(c)
+		}
+		user.Username = username
+	}
+
+	ctx := c.Request().Context()
+
+	// Passwordless accounts are created without a password at all
+	var hashedPassword []byte
+	if len(user.Password) > 0 {
+		hashedPassword, err = bcrypt.GenerateFromPassword([]byte(user.Password), s.BcryptCost)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not hash password", "error", err)
+			return InvalidRequestError(c)
+		}
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 14)
+	status := AccountActive
+	if s.RequireApproval {
+		status = AccountPending
+	}
+
+	// A guest signing up keeps their user_id and session, so whatever was
+	// stored for them as a guest carries over to the new account
+	var userID string
+	guestID := s.GuestUserID(c)
+	if guestID != "" {
+		err = s.DB.QueryRow(`UPDATE users SET name=$1, email=$2, phone=$3, username=$4, password=$5, disposable_email=$6, status=$7, guest=false
+			WHERE user_id=$8 AND guest RETURNING user_id`, user.Name, nullString(user.Email), nullString(user.Phone), nullString(user.Username),
+			nullString(string(hashedPassword)), disposable, status, guestID).Scan(&userID)
+	} else {
+		err = s.DB.QueryRow(`INSERT INTO users (name, email, phone, username, password, disposable_email, status) VALUES($1, $2, $3, $4, $5, $6, $7)
+			RETURNING user_id`, user.Name, nullString(user.Email), nullString(user.Phone), nullString(user.Username),
+			nullString(string(hashedPassword)), disposable, status).Scan(&userID)
+	}
+	if isUniqueViolation(err) {
+		s.Logger.InfoContext(ctx, "User exists")
+		return ConflictError(c)
+	}
 	if err != nil {
-		fmt.Printf("Could not hash password: %s\n", err)
+		s.Logger.ErrorContext(ctx, "Could not create user", "error", err)
 		return InvalidRequestError(c)
 	}
 
-	_, err = s.DB.Exec("INSERT INTO users (name, email, password) VALUES($1, $2, $3)",
-		user.Name, user.Email, string(hashedPassword))
+	if user.AcceptTerms {
+		err = s.RecordConsents(c, userID, s.RequiredConsents())
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not record consents", "error", err)
+		}
+	}
+
+	response := echo.Map{"status": "User created"}
+	if len(passwordWarnings) > 0 {
+		response["password_warnings"] = passwordWarnings
+	}
+
+	// Verification waits for an admin to approve the account, and a guest
+	// can't carry on until then
+	if s.RequireApproval {
+		if guestID != "" {
+			err = s.DeleteUserSessions(ctx, userID)
+			if err != nil {
+				s.Logger.ErrorContext(ctx, "Could not invalidate user sessions", "error", err)
+			}
+			s.ClearSessionCookie(c)
+		}
+		response["approval"] = AccountPending
+		return c.JSON(200, response)
+	}
+
+	err = s.StartVerification(ctx, userID, user.Email, user.Phone, response)
 	if err != nil {
-		fmt.Printf("Could not create user: %s\n", err)
+		s.Logger.ErrorContext(ctx, "Could not create verification token", "error", err)
 		return InvalidRequestError(c)
 	}
+	return c.JSON(200, response)
+}
+
+// StartVerification sends the new user's email link and phone code, noting
+// what was sent in the response.
+func (s *Server) StartVerification(ctx context.Context, userID string, email string, phone string, response echo.Map) error {
+	if len(phone) > 0 {
+		err := s.SendSMSCode(ctx, phoneVerificationKey(phone), phone, userID)
+		if err != nil {
+			// The user can ask for another code
+			s.Logger.ErrorContext(ctx, "Could not send phone verification code", "error", err)
+		}
+		response["phone_verification"] = "Code sent"
+	}
 
-	return c.JSON(200, echo.Map{"status": "User created"})
+	if len(email) > 0 && s.Mailer != nil {
+		err := s.SendVerificationEmail(ctx, userID, email)
+		if err != nil {
+			// The user can ask for another link
+			s.Logger.ErrorContext(ctx, "Could not create verification token", "error", err)
+		}
+		response["email_verification"] = "Link sent"
+	} else if len(email) > 0 {
+		// Without a mailer there is no other way to hand the link over
+		token, err := s.CreateVerificationToken(ctx, userID)
+		if err != nil {
+			return err
+		}
+		response["verification_url"] = s.verificationLink(token)
+	}
+	return nil
 }
 
 func (s *Server) UserSignInHandler(c echo.Context) error {
-	var user User
+	var user struct {
+		User
+		Remember bool `json:"remember"`
+		// RememberMe is accepted as another name for Remember
+		RememberMe   bool   `json:"remember_me"`
+		CaptchaToken string `json:"captcha_token"`
+	}
 
 	// Read JSON body
 	err := c.Bind(&user)
-	if err != nil || len(user.Email) == 0 || len(user.Password) == 0 {
+	user.Email = normalizeEmail(user.Email)
+	if err != nil || len(user.Password) == 0 || (len(user.Email) == 0 && len(user.Phone) == 0) {
 		return InvalidRequestError(c)
 	}
 
+	// login is whichever identifier the user signs in with, which failed
+	// attempts are counted against. The email field also takes a username.
+	login := user.Email
+	query := "SELECT user_id, password, verified FROM users WHERE LOWER(email)=$1"
+	if len(user.Email) > 0 && !strings.Contains(user.Email, "@") {
+		// Either identifier the user registered with activates the account
+		query = "SELECT user_id, password, verified OR phone_verified FROM users WHERE LOWER(username)=$1"
+	} else if len(user.Email) == 0 {
+		phone, ok := normalizePhone(user.Phone)
+		if !ok {
+			return InvalidRequestError(c)
+		}
+		login = phone
+		query = "SELECT user_id, password, phone_verified FROM users WHERE phone=$1"
+	}
+
+	if !s.CheckCaptcha(c, user.CaptchaToken) {
+		return CaptchaRequiredError(c)
+	}
+
+	ctx := c.Request().Context()
+	lockout := max(s.LoginLockout(ctx, login), s.IPLoginLockout(c))
+	if lockout > 0 {
+		s.Logger.WarnContext(ctx, "Too many failed login attempts")
+		s.RecordLogin(c, false, "password", "", user.Email)
+		return LoginLockedError(c, lockout)
+	}
+	s.DelayLogin(c, login)
+
 	var userID string
 	var hashedPassword string
+	var verified bool
 	// Check if user exists
-	err = s.DB.QueryRow("SELECT user_id, password FROM users WHERE email=$1", user.Email).Scan(&userID, &hashedPassword)
+	err = s.DB.QueryRow(query, login).Scan(&userID, &hashedPassword, &verified)
 	if err != nil {
-		fmt.Printf("Could find user information: %s\n", err)
+		s.Logger.InfoContext(ctx, "Could not find user information", "error", err)
+		s.RecordLoginFailure(ctx, login)
+		s.RecordIPLoginFailure(c)
+		s.RecordCaptchaFailure(c)
+		s.RecordLogin(c, false, "password", "", user.Email)
 		return UnauthorizedError(c)
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(user.Password))
 	if err != nil {
-		fmt.Printf("Failed to compare password hashes: %s\n", err)
+		s.Logger.InfoContext(ctx, "Invalid password", "user_id", userID)
+		s.RecordLoginFailure(ctx, login)
+		s.RecordIPLoginFailure(c)
+		s.RecordCaptchaFailure(c)
+		s.RecordLogin(c, false, "password", userID, user.Email)
 		return UnauthorizedError(c)
 	}
 
-	sessionID := uuid.New().String()
-	err = s.RDB.Set(c.Request().Context(), sessionID, userID, time.Hour*24).Err()
+	s.ClearLoginFailures(ctx, login)
+
+	if !verified && len(user.Email) == 0 {
+		s.RecordLogin(c, false, "password", userID, user.Email)
+		s.Logger.InfoContext(ctx, "User phone not verified", "user_id", userID)
+		return PhoneNotVerifiedError(c)
+	}
+	if !verified && s.RequireEmailVerification {
+		s.RecordLogin(c, false, "password", userID, user.Email)
+		s.Logger.InfoContext(ctx, "User email not verified", "user_id", userID)
+		return EmailNotVerifiedError(c)
+	}
+
+	return s.FinishSignIn(c, userID, user.Email, user.Remember || user.RememberMe, "password")
+}
+
+// StartUserSession signs the user in once every check has passed, with the
+// session cookies and, when JWT is enabled, a token pair. method is the
+// first factor the user signed in with.
+func (s *Server) StartUserSession(c echo.Context, userID string, email string, remember bool, method string) error {
+	ctx := c.Request().Context()
+	sessionID, err := s.CreateSession(c, userID, remember)
+	if errors.Is(err, errAccountInactive) {
+		s.Logger.InfoContext(ctx, "Refused sign-in to inactive account", "user_id", userID)
+		return AccountInactiveError(c, err)
+	}
+	if errors.Is(err, errSessionLimitReached) {
+		s.Logger.InfoContext(ctx, "Refused sign-in over the session limit", "user_id", userID)
+		return SessionLimitError(c)
+	}
 	if err != nil {
-		fmt.Printf("Failed to create user session: %s\n", err)
+		s.Logger.ErrorContext(ctx, "Failed to create user session", "error", err)
 		return UnauthorizedError(c)
 	}
 
-	SetCookie(c, "userid", userID, time.Now().Add(time.Hour*24))
-	SetCookie(c, "session", sessionID, time.Now().Add(time.Hour*24))
+	s.SetSessionCookie(c, sessionID, s.SessionCookieExpiration(remember))
+	s.RecordLogin(c, true, method, userID, email)
 
-	return c.JSON(200, echo.Map{
+	response := echo.Map{
 		"status": "success",
-	})
+	}
+	// The session works, but only to change the password
+	if expired, _ := s.PasswordExpired(ctx, userID); expired {
+		response["password_expired"] = true
+	}
+	if pending, _ := s.PendingConsents(ctx, userID); len(pending) > 0 {
+		response["consent_required"] = pending
+	}
+
+	if s.JWTAlgorithm != "" {
+		token, err := s.IssueSessionJWT(ctx, userID, sessionID)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Failed to issue JWT", "error", err)
+			return UnauthorizedError(c)
+		}
+		refreshToken, err := s.IssueRefreshToken(ctx, RefreshToken{UserID: userID, SessionID: sessionID})
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Failed to issue refresh token", "error", err)
+			return UnauthorizedError(c)
+		}
+
+		response["access_token"] = token
+		response["token_type"] = "Bearer"
+		response["expires_in"] = int(s.AccessTokenLifetime.Seconds())
+		response["refresh_token"] = refreshToken
+	}
+
+	return c.JSON(200, response)
 }
 
 func (s *Server) UserInfoHandler(c echo.Context) error {
+	ctx := c.Request().Context()
 	userID := c.Get("userID").(string)
 	var userEmail string
 	var userName string
-	err := s.DB.QueryRow("SELECT email, name FROM users WHERE user_id=$1", userID).Scan(&userEmail, &userName)
+	var username string
+	var guest bool
+	var verified, disposable bool
+	var lastLoginAt, lastSeenAt, avatarUpdatedAt sql.NullTime
+	var metadata []byte
+	err := s.DB.QueryRow(`SELECT COALESCE(email, ''), COALESCE(name, ''), COALESCE(username, ''), guest, verified, disposable_email, last_login_at,
+		last_seen_at, avatar_updated_at, metadata FROM users WHERE user_id=$1`, userID).Scan(&userEmail, &userName, &username, &guest, &verified,
+		&disposable, &lastLoginAt, &lastSeenAt, &avatarUpdatedAt, &metadata)
 	if err != nil {
-		fmt.Printf("Could find user information: %s\n", err)
+		s.Logger.InfoContext(ctx, "Could not find user information", "error", err)
 		return UnauthorizedError(c)
 	}
-	return c.JSON(200, echo.Map{
-		"user_id": userID,
-		"email":   userEmail,
-		"name":    userName,
-	})
+	response := echo.Map{
+		"user_id":        userID,
+		"email":          userEmail,
+		"name":           userName,
+		"username":       username,
+		"guest":          guest,
+		"email_verified": verified,
+	}
+	if disposable {
+		response["disposable_email"] = true
+	}
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(metadata, &sections); err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read metadata", "error", err)
+	}
+	response[AppMetadata] = sections[AppMetadata]
+	response[UserMetadata] = sections[UserMetadata]
+	if lastLoginAt.Valid {
+		response["last_login_at"] = lastLoginAt.Time
+	}
+	// Seen times reach the database in batches, so this lags a little
+	if lastSeenAt.Valid {
+		response["last_seen_at"] = lastSeenAt.Time
+	}
+	if avatarUpdatedAt.Valid && s.Avatars != nil {
+		response["avatar_url"] = s.avatarURL(userID, avatarUpdatedAt.Time)
+	}
+	if pending, _ := s.PendingConsents(ctx, userID); len(pending) > 0 {
+		response["consent_required"] = pending
+	}
+	roles, err := s.UserRoles(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read roles", "error", err)
+	}
+	response["roles"] = roles
+	groups, err := s.UserGroups(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read groups", "error", err)
+	}
+	response["groups"] = groups
+	return c.JSON(200, response)
 }
 
 func (s *Server) UserSignOutHandler(c echo.Context) error {
+	userID := c.Get("userID").(string)
 	sessionID := c.Get("sessionID").(string)
-	s.RDB.Del(c.Request().Context(), sessionID)
+	s.RemoveUserSession(c.Request().Context(), userID, sessionID)
 
-	SetCookie(c, "userid", "", time.Unix(0, 0))
-	SetCookie(c, "session", "", time.Unix(0, 0))
+	s.ClearSessionCookie(c)
+	s.RecordAuthEvent(c, EventLogout, userID, "")
 
 	return c.JSON(201, echo.Map{"status": "success"})
 }
 
+// UserSessionVerify tells backends who a session belongs to. The userid
+// parameter is optional and, when sent, has to match the session.
 func (s *Server) UserSessionVerify(c echo.Context) error {
 	userID := c.QueryParam("userid")
 	sessionID := c.QueryParam("sessionid")
 
-	if len(userID) == 0 || len(sessionID) == 0 {
+	if len(sessionID) == 0 {
 		return InvalidRequestError(c)
 	}
 
-	if !s.VerifySessionAndUserID(c.Request().Context(), sessionID, userID) {
-		fmt.Printf("Invalid session (%s, %s)\n", sessionID, userID)
+	ctx := c.Request().Context()
+	session := s.LiveSession(ctx, sessionID)
+	if session == nil || (userID != "" && session.UserID != userID) {
+		s.Logger.InfoContext(ctx, "Invalid session", "user_id", userID)
 		return UnauthorizedError(c)
 	}
+	userID = session.UserID
 
 	var userEmail string
 	var userName string
-	err := s.DB.QueryRow("SELECT email, name FROM users WHERE user_id=$1", userID).Scan(&userEmail, &userName)
+	err := s.DB.QueryRow("SELECT COALESCE(email, ''), COALESCE(name, '') FROM users WHERE user_id=$1", userID).Scan(&userEmail, &userName)
 	if err != nil {
-		fmt.Printf("Could find user information: %s\n", err)
+		s.Logger.InfoContext(ctx, "Could not find user information", "error", err)
 		return UnauthorizedError(c)
 	}
 
@@ -231,52 +1169,490 @@ func (s *Server) UserSessionVerify(c echo.Context) error {
 }
 
 func main() {
-	err := godotenv.Load()
+	dev := flag.Bool("dev", false, "run with development defaults: embedded Postgres and Redis, in-memory sessions and cookies over plain HTTP")
+	grantAdmin := flag.String("grant-admin", "", "give the admin role to the user with this email and exit, to set up the first admin")
+	flag.Parse()
+
+	config, err := LoadConfig(*dev)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	db, err := sql.Open("postgres", os.Getenv("DB_URL"))
+	logger, err := NewLogger(os.Stdout, config.LogLevel)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n  LOG_LEVEL: %s\n", err)
+		os.Exit(1)
+	}
+
+	// The embedded database is thrown away on exit, granting in it is no use
+	if *grantAdmin != "" && config.DBURL == "" {
+		fmt.Fprintln(os.Stderr, "-grant-admin needs DB_URL")
+		os.Exit(1)
+	}
+
+	var devServices *DevServices
+	if *dev {
+		logger.Warn("Running in development mode, data is lost on restart and cookies work over plain HTTP")
+		devServices, err = StartDevServices(config)
+		if err != nil {
+			logger.Error("Could not start development services", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	db, err := sql.Open("postgres", config.DBURL)
 	if err != nil {
 		panic(err)
 	}
-	defer db.Close()
 	initDB(db)
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     os.Getenv("REDIS_URL"),
-		Password: os.Getenv("REDIS_PASSWORD"),
-		DB:       0,
-	})
-	defer rdb.Close()
+	if *grantAdmin != "" {
+		err = (&Server{DB: db}).GrantAdminByEmail(context.Background(), *grantAdmin)
+		if errors.Is(err, sql.ErrNoRows) {
+			fmt.Fprintf(os.Stderr, "no user has the email %s, they have to sign up first\n", *grantAdmin)
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not grant the admin role:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s is now an admin\n", *grantAdmin)
+		return
+	}
+
+	rdb := NewRedisClient(config)
+
+	var sessions SessionStore
+	switch config.SessionStore {
+	case SessionStorePostgres:
+		sessions = &PostgresSessionStore{DB: db}
+	case SessionStoreMemory:
+		sessions = NewMemorySessionStore()
+	default:
+		sessions = &RedisSessionStore{RDB: rdb, IndexLifetime: config.RememberSessionLifetime}
+	}
 
 	e := echo.New()
 	s := Server{
-		DB:  db,
-		RDB: rdb,
+		DB:                         db,
+		RDB:                        rdb,
+		Logger:                     logger,
+		SessionLifetime:            config.SessionLifetime,
+		SessionRefreshThreshold:    config.SessionRefreshThreshold,
+		RememberSessionLifetime:    config.RememberSessionLifetime,
+		SessionSliding:             config.SessionSliding,
+		SessionMaxLifetime:         config.SessionMaxLifetime,
+		MaxSessions:                config.MaxSessions,
+		MaxSessionsByDomain:        config.MaxSessionsByDomain,
+		SessionLimitAction:         config.SessionLimitAction,
+		SessionBindFingerprint:     config.SessionBindFingerprint,
+		CookieSecrets:              config.CookieSecrets,
+		Cookie:                     config.Cookie,
+		Sessions:                   sessions,
+		StatelessSessions:          config.SessionStore == SessionStoreStateless,
+		LoginMaxAttempts:           config.LoginMaxAttempts,
+		LoginLockoutWindow:         config.LoginLockoutWindow,
+		LoginMaxAttemptsPerIP:      config.LoginMaxAttemptsPerIP,
+		LoginLockoutDuration:       config.LoginLockoutDuration,
+		LoginLockoutMaxDuration:    config.LoginLockoutMaxDuration,
+		LoginDelay:                 config.LoginDelay,
+		LoginDelayMax:              config.LoginDelayMax,
+		PasswordlessOnly:           config.PasswordlessOnly,
+		RegistrationClosed:         config.RegistrationClosed,
+		RequireApproval:            config.RequireApproval,
+		AllowedEmailDomains:        config.AllowedEmailDomains,
+		BlockedEmailDomains:        config.BlockedEmailDomains,
+		RequireEmailVerification:   config.RequireEmailVerification,
+		NewDeviceNotifications:     config.NewDeviceNotifications,
+		TermsVersion:               config.TermsVersion,
+		PrivacyVersion:             config.PrivacyVersion,
+		ConsentEnforcement:         config.ConsentEnforcement,
+		SudoLifetime:               config.SudoLifetime,
+		AccountDeletionGracePeriod: config.AccountDeletionGracePeriod,
+		BcryptCost:                 config.BcryptCost,
+		PasswordPolicy: PasswordPolicy{
+			MinLength: config.PasswordMinLength,
+			MinScore:  config.PasswordMinScore,
+		},
+		PasswordHistory:            config.PasswordHistory,
+		PasswordMaxAge:             config.PasswordMaxAge,
+		LoginPageURL:               config.LoginPageURL,
+		AccessTokenLifetime:        config.AccessTokenLifetime,
+		IssuerURL:                  config.IssuerURL,
+		SigningKeyRotationInterval: config.SigningKeyRotationInterval,
+		JWTAlgorithm:               config.JWTAlgorithm,
+		JWTSecret:                  []byte(config.JWTSecret),
+		RefreshTokenLifetime:       config.RefreshTokenLifetime,
+		AllowedOrigins:             config.AllowedOrigins,
+		Providers:                  map[string]*UpstreamProvider{},
+		SocialLoginRedirectURL:     config.SocialLoginRedirectURL,
+		MagicLinkLifetime:          config.MagicLinkLifetime,
+		PasswordResetURL:           config.PasswordResetURL,
+		PasswordResetLifetime:      config.PasswordResetLifetime,
+		InvitationURL:              config.InvitationURL,
+		InvitationLifetime:         config.InvitationLifetime,
+		EmailVerificationLifetime:  config.EmailVerificationLifetime,
+		EmailRevertLifetime:        config.EmailRevertLifetime,
+		TOTPIssuer:                 config.TOTPIssuer,
+		OTPLifetime:                config.OTPLifetime,
+		OTPSendLimit:               config.OTPSendLimit,
+		OTPSendWindow:              config.OTPSendWindow,
+		CaptchaAfterFailures:       config.CaptchaAfterFailures,
+		SuspiciousLoginAction:      config.SuspiciousLoginAction,
+	}
+
+	if config.TwilioAccountSID != "" {
+		s.SMS = &TwilioSender{AccountSID: config.TwilioAccountSID, AuthToken: config.TwilioAuthToken, From: config.TwilioFrom}
+	}
+	if config.PushWebhookURL != "" {
+		s.Push = &WebhookPushNotifier{URL: config.PushWebhookURL}
+	}
+	switch config.AvatarStore {
+	case "local":
+		s.Avatars = &LocalBlobStore{Dir: config.AvatarDir}
+	case "s3":
+		s.Avatars = &S3BlobStore{Endpoint: config.S3Endpoint, Region: config.S3Region, Bucket: config.S3Bucket,
+			AccessKeyID: config.S3AccessKeyID, SecretAccessKey: config.S3SecretAccessKey}
+	}
+	if config.SecurityWebhookURL != "" {
+		s.SecurityWebhook = &SecurityWebhook{URL: config.SecurityWebhookURL}
+	}
+	if config.CaptchaProvider != "" {
+		s.Captcha = NewCaptchaVerifier(config.CaptchaProvider, config.CaptchaSecret)
+	}
+	if config.SMTPHost != "" {
+		s.Mailer = NewMailer(config.SMTPHost, config.SMTPPort, config.SMTPUsername, config.SMTPPassword, config.MailFrom)
+	}
+
+	if config.GoogleClientID != "" {
+		s.Providers["google"] = NewGoogleProvider(config.GoogleClientID, config.GoogleClientSecret, config.IssuerURL+"/callback/google")
+	}
+	if config.GitHubClientID != "" {
+		s.Providers["github"] = NewGitHubProvider(config.GitHubClientID, config.GitHubClientSecret, config.IssuerURL+"/callback/github")
+	}
+	if config.MicrosoftClientID != "" {
+		s.Providers["microsoft"] = NewMicrosoftProvider(config.MicrosoftClientID, config.MicrosoftClientSecret, config.MicrosoftTenant,
+			config.IssuerURL+"/callback/microsoft")
+	}
+	if config.AppleClientID != "" {
+		key, err := LoadApplePrivateKey(config.ApplePrivateKeyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load Apple private key: %s\n", err)
+			os.Exit(1)
+		}
+		s.Providers["apple"] = NewAppleProvider(config.AppleClientID, config.AppleTeamID, config.AppleKeyID, key, config.IssuerURL+"/callback/apple")
+	}
+
+	if config.BreachCheck != "" {
+		s.Breaches = &BreachChecker{RDB: rdb, CacheTTL: config.BreachCheckCacheTTL}
+		s.BreachAction = config.BreachCheck
+	}
+
+	if config.DisposableEmailAction != "" {
+		s.DisposableDomains = NewDisposableDomains(config.DisposableEmailList)
+		s.DisposableEmailAction = config.DisposableEmailAction
+		refreshCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		err = s.DisposableDomains.Refresh(refreshCtx)
+		cancel()
+		if err != nil {
+			// The built in domains are checked until the next refresh
+			logger.Warn("Could not load disposable email domains", "error", err)
+		}
+	}
+
+	s.PasswordPolicy.Banned, err = LoadBannedPasswords(config.PasswordBannedFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load banned passwords: %s\n", err)
+		os.Exit(1)
+	}
+	s.TorExitNodes, err = LoadTorExitNodes(config.TorExitNodesFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load Tor exit nodes: %s\n", err)
+		os.Exit(1)
 	}
 
+	for _, provider := range config.OIDCProviders {
+		discoveryCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		s.Providers[provider.Name], err = DiscoverOIDCProvider(discoveryCtx, provider, config.IssuerURL+"/callback/"+provider.Name)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not discover OIDC provider %s: %s\n", provider.Name, err)
+			os.Exit(1)
+		}
+	}
+
+	if config.SAMLIDPMetadataURL != "" {
+		metadataCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		s.SAML, err = NewSAMLServiceProvider(metadataCtx, config.SAMLEntityID, config.IssuerURL, config.SAMLIDPMetadataURL,
+			config.SAMLCertFile, config.SAMLKeyFile)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not set up SAML: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	rotationCtx, stopRotation := context.WithCancel(context.Background())
+	defer stopRotation()
+
+	if len(config.SigningKeyFiles) > 0 {
+		s.SigningKeys, err = LoadStaticKeySet(config.SigningKeyFiles)
+	} else {
+		s.SigningKeys = NewKeySet(nil, nil)
+		err = s.RotateSigningKeys(rotationCtx)
+		go s.RunSigningKeyRotation(rotationCtx)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load signing keys: %s\n", err)
+		os.Exit(1)
+	}
+	// Without a session index there is no telling which guests are abandoned
+	if !s.StatelessSessions {
+		go s.RunGuestCleanup(rotationCtx)
+	}
+	go s.RunAccountDeletion(rotationCtx)
+	go s.RunLastSeenFlush(rotationCtx)
+	if s.DisposableDomains != nil {
+		go s.RunDisposableDomainRefresh(rotationCtx, config.DisposableEmailRefreshInterval)
+	}
+
+	e.Use(middleware.RequestIDWithConfig(middleware.RequestIDConfig{
+		RequestIDHandler: StoreRequestID,
+	}))
+
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
-		Format: "${time_rfc3339} :: method=${method}, uri=${uri}, status=${status}, referrer=${referrer}\n",
+		Format: "${time_rfc3339} :: id=${id}, method=${method}, uri=${uri}, status=${status}, referrer=${referrer}\n",
 	}))
 
-	allowedOrigins := strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",")
+	// Credentials are needed for the session cookies to be sent cross-origin.
+	// With explicit origins the middleware echoes back the matching one, and
+	// leaves out the CORS headers for any other origin so browsers reject it.
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: allowedOrigins,
+		AllowOrigins:     config.AllowedOrigins,
+		AllowCredentials: true,
+		AllowMethods:     []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete, http.MethodOptions},
+		AllowHeaders:     []string{echo.HeaderContentType, echo.HeaderXRequestID, "X-CSRF-Token"},
+		ExposeHeaders:    []string{echo.HeaderXRequestID},
 	}))
 
 	e.Use(middleware.Recover())
 
+	csrf := NewCSRFMiddleware(config.Cookie.Secure)
+	formCSRF := NewFormCSRFMiddleware(config.Cookie.Secure)
+	recentAuth := s.RequireRecentAuth(config.ReauthMaxAge)
+	admin := s.RequireRole(RoleAdmin)
+
+	e.GET("/healthz", s.HealthCheckHandler)
+	e.GET("/livez", s.LivenessHandler)
+
+	e.GET("/csrf-token", s.CSRFTokenHandler, csrf)
 	e.POST("/register", s.UserSignUpHandler)
-	e.POST("/login", s.UserSignInHandler)
-	e.POST("/logout", s.UserSignOutHandler, s.SessionMiddleware)
+	e.POST("/register/invitation", s.InvitationSignUpHandler)
+	e.POST("/guest", s.GuestSignInHandler)
+	e.POST("/login", s.UserSignInHandler, s.PasswordsEnabled)
+	e.POST("/logout", s.UserSignOutHandler, csrf, s.SessionMiddleware)
 	e.GET("/profile", s.UserInfoHandler, s.SessionMiddleware)
+	e.PATCH("/profile", s.UpdateProfileHandler, csrf, s.SessionMiddleware, recentAuth)
+	e.POST("/profile/password", s.ChangePasswordHandler, csrf, s.SessionMiddleware, s.PasswordsEnabled)
+	e.POST("/profile/email", s.ChangeEmailHandler, csrf, s.SessionMiddleware, recentAuth)
+	e.GET("/profile/email/confirm", s.ConfirmEmailChangeHandler)
+	e.GET("/profile/email/revert", s.RevertEmailChangeHandler)
+	e.POST("/reauthenticate", s.ReauthenticateHandler, csrf, s.SessionMiddleware)
 	e.GET("/verify-session", s.UserSessionVerify)
+	e.GET("/verify-token", s.UserInfoHandler, s.JWTMiddleware)
+	e.GET("/verify-api-key", s.APIKeyVerifyHandler, s.APIKeyMiddleware)
+	e.GET("/verify-certificate", s.CertificateVerifyHandler, s.ClientCertMiddleware)
+	e.POST("/token/refresh", s.RefreshTokenHandler)
+	e.POST("/login/magic-link", s.MagicLinkRequestHandler)
+	e.GET("/login/magic-link", s.MagicLinkLoginHandler)
+	e.POST("/login/totp", s.TOTPLoginHandler)
+	e.POST("/login/otp/request", s.EmailOTPRequestHandler)
+	e.POST("/login/otp/verify", s.EmailOTPVerifyHandler)
+	e.POST("/login/sms/request", s.SMSLoginRequestHandler)
+	e.POST("/login/sms/verify", s.SMSLoginVerifyHandler)
+	e.POST("/login/mfa/sms/send", s.SMSMFASendHandler)
+	e.POST("/login/mfa/sms", s.SMSMFALoginHandler)
+	e.POST("/login/mfa/recovery", s.RecoveryCodeLoginHandler)
+	e.POST("/login/mfa/email/send", s.EmailMFASendHandler)
+	e.POST("/login/mfa/email", s.EmailMFALoginHandler)
+	e.POST("/login/push", s.PushLoginRequestHandler)
+	e.GET("/login/push/:id", s.PushLoginPollHandler)
+	e.GET("/login/push/:id/events", s.PushLoginEventsHandler)
+	e.GET("/login/:provider", s.UpstreamLoginHandler)
+	e.GET("/callback/:provider", s.UpstreamCallbackHandler)
+	e.POST("/callback/:provider", s.UpstreamCallbackHandler)
+	e.GET("/saml/metadata", s.SAMLMetadataHandler)
+	e.GET("/saml/login", s.SAMLLoginHandler)
+	e.POST("/saml/acs", s.SAMLAssertionConsumerHandler)
+	e.POST("/2fa/totp/enroll", s.TOTPEnrollHandler, csrf, s.SessionMiddleware)
+	e.POST("/2fa/totp/confirm", s.TOTPConfirmHandler, csrf, s.SessionMiddleware)
+	e.DELETE("/2fa/totp", s.TOTPDisableHandler, csrf, s.SessionMiddleware)
+	e.POST("/2fa/sms", s.SMSMFAEnableHandler, csrf, s.SessionMiddleware)
+	e.DELETE("/2fa/sms", s.SMSMFADisableHandler, csrf, s.SessionMiddleware, s.RequireSudo)
+	e.POST("/2fa/recovery-codes", s.RegenerateRecoveryCodesHandler, csrf, s.SessionMiddleware, recentAuth)
+	e.GET("/profile/tokens", s.ListPersonalAccessTokensHandler, s.SessionMiddleware)
+	e.POST("/profile/tokens", s.CreatePersonalAccessTokenHandler, csrf, s.SessionMiddleware)
+	e.DELETE("/profile/tokens/:id", s.RevokePersonalAccessTokenHandler, csrf, s.SessionMiddleware)
+	e.GET("/profile/identities", s.ListIdentitiesHandler, s.SessionMiddleware)
+	e.POST("/profile/identities/:provider", s.LinkIdentityHandler, csrf, s.SessionMiddleware, recentAuth)
+	e.DELETE("/profile/identities/:provider", s.UnlinkIdentityHandler, csrf, s.SessionMiddleware, s.RequireSudo)
+	e.GET("/push/devices", s.ListPushDevicesHandler, s.SessionMiddleware)
+	e.POST("/push/devices", s.RegisterPushDeviceHandler, csrf, s.SessionMiddleware, recentAuth)
+	e.DELETE("/push/devices/:id", s.DeletePushDeviceHandler, csrf, s.SessionMiddleware)
+	e.GET("/push/approvals", s.ListPushApprovalsHandler, s.PushDeviceMiddleware)
+	e.POST("/push/approvals/:id/approve", s.ApprovePushLoginHandler, s.PushDeviceMiddleware)
+	e.POST("/push/approvals/:id/deny", s.DenyPushLoginHandler, s.PushDeviceMiddleware)
+	e.POST("/profile/phone", s.PhoneEnrollHandler, csrf, s.SessionMiddleware)
+	e.POST("/profile/phone/verify", s.PhoneVerifyHandler, csrf, s.SessionMiddleware)
+	e.GET("/verify-email", s.VerifyEmailHandler)
+	e.POST("/verify-email/request", s.EmailVerificationRequestHandler)
+	e.POST("/verify-phone/request", s.PhoneVerificationRequestHandler)
+	e.POST("/verify-phone", s.PhoneVerificationHandler)
+	e.DELETE("/account", s.DeleteAccountHandler, csrf, s.SessionMiddleware, s.RequireSudo)
+	e.POST("/profile/avatar", s.UploadAvatarHandler, csrf, s.SessionMiddleware)
+	e.DELETE("/profile/avatar", s.DeleteAvatarHandler, csrf, s.SessionMiddleware)
+	e.GET("/avatars/:id", s.AvatarHandler)
+	e.GET("/consents", s.ListConsentsHandler, s.SessionMiddleware)
+	e.POST("/consents", s.AcceptConsentsHandler, csrf, s.SessionMiddleware)
+	e.GET("/profile/logins", s.LoginHistoryHandler, s.SessionMiddleware)
+	e.GET("/profile/export", s.ExportProfileHandler, s.SessionMiddleware, recentAuth)
+	e.POST("/profile/deactivate", s.DeactivateAccountHandler, csrf, s.SessionMiddleware, s.RequireSudo)
+	e.DELETE("/profile", s.ScheduleAccountDeletionHandler, csrf, s.SessionMiddleware, s.RequireSudo)
+	e.POST("/oauth/clients", s.CreateClientHandler, csrf, s.SessionMiddleware, admin)
+	e.POST("/oauth/clients/:id/certificates", s.BindClientCertificateHandler, csrf, s.SessionMiddleware)
+	e.DELETE("/oauth/clients/:id/certificates", s.UnbindClientCertificateHandler, csrf, s.SessionMiddleware)
+	e.GET("/apikeys", s.ListAPIKeysHandler, s.SessionMiddleware)
+	e.POST("/apikeys", s.CreateAPIKeyHandler, csrf, s.SessionMiddleware)
+	e.PATCH("/apikeys/:id", s.UpdateAPIKeyHandler, csrf, s.SessionMiddleware)
+	e.DELETE("/apikeys/:id", s.DeleteAPIKeyHandler, csrf, s.SessionMiddleware)
+	e.GET("/oauth/authorize", s.AuthorizeHandler, formCSRF)
+	e.POST("/oauth/authorize", s.AuthorizeDecisionHandler, formCSRF)
+	e.POST("/oauth/token", s.TokenHandler)
+	e.POST("/device/code", s.DeviceCodeHandler)
+	e.POST("/device/token", s.TokenHandler)
+	e.GET("/device", s.DeviceVerificationHandler, formCSRF)
+	e.POST("/device", s.DeviceApprovalHandler, formCSRF)
+	e.POST("/qr/session", s.QRLoginStartHandler)
+	e.GET("/qr/session/:id", s.QRLoginPollHandler)
+	e.GET("/qr/session/:id/details", s.QRLoginDetailsHandler, s.SessionMiddleware)
+	e.POST("/qr/session/:id/approve", s.QRLoginApproveHandler, csrf, s.SessionMiddleware)
+	e.POST("/qr/session/:id/deny", s.QRLoginDenyHandler, csrf, s.SessionMiddleware)
+	e.POST("/oauth/introspect", s.IntrospectHandler)
+	e.POST("/authorize", s.AuthorizationCheckHandler)
+	e.POST("/oauth/revoke", s.RevokeHandler)
+	e.GET("/.well-known/openid-configuration", s.OpenIDConfigurationHandler)
+	e.GET("/.well-known/jwks.json", s.JWKSHandler)
+	e.GET("/userinfo", s.UserInfoEndpointHandler, s.AccessTokenMiddleware)
+	e.POST("/userinfo", s.UserInfoEndpointHandler, s.AccessTokenMiddleware)
+	e.GET("/audit", s.AuditLogHandler, s.SessionMiddleware)
+	e.GET("/admin/users", s.ListUsersHandler, s.SessionMiddleware, admin)
+	e.POST("/admin/users", s.CreateUserHandler, csrf, s.SessionMiddleware, admin)
+	e.GET("/admin/users/:id", s.GetUserHandler, s.SessionMiddleware, admin)
+	e.PATCH("/admin/users/:id", s.UpdateUserHandler, csrf, s.SessionMiddleware, admin)
+	e.DELETE("/admin/users/:id", s.DeleteUserHandler, csrf, s.SessionMiddleware, admin)
+	e.POST("/admin/users/:id/logout", s.LogoutUserHandler, csrf, s.SessionMiddleware, admin)
+	e.GET("/admin/users/:id/roles", s.ListUserRolesHandler, s.SessionMiddleware, admin)
+	e.PUT("/admin/users/:id/roles/:role", s.GrantRoleHandler, csrf, s.SessionMiddleware, admin)
+	e.DELETE("/admin/users/:id/roles/:role", s.RevokeRoleHandler, csrf, s.SessionMiddleware, admin)
+	e.GET("/admin/roles", s.ListRolesHandler, s.SessionMiddleware, admin)
+	e.POST("/admin/roles", s.CreateRoleHandler, csrf, s.SessionMiddleware, admin)
+	e.DELETE("/admin/roles/:role", s.DeleteRoleHandler, csrf, s.SessionMiddleware, admin)
+	e.GET("/admin/groups", s.ListGroupsHandler, s.SessionMiddleware, admin)
+	e.POST("/admin/groups", s.CreateGroupHandler, csrf, s.SessionMiddleware, admin)
+	e.GET("/admin/groups/:id", s.GetGroupHandler, s.SessionMiddleware, admin)
+	e.DELETE("/admin/groups/:id", s.DeleteGroupHandler, csrf, s.SessionMiddleware, admin)
+	e.GET("/admin/groups/:id/members", s.ListGroupMembersHandler, s.SessionMiddleware, admin)
+	e.PUT("/admin/groups/:id/members/:user", s.AddGroupMemberHandler, csrf, s.SessionMiddleware, admin)
+	e.DELETE("/admin/groups/:id/members/:user", s.RemoveGroupMemberHandler, csrf, s.SessionMiddleware, admin)
+	e.PUT("/admin/groups/:id/roles/:role", s.GrantGroupRoleHandler, csrf, s.SessionMiddleware, admin)
+	e.DELETE("/admin/groups/:id/roles/:role", s.RevokeGroupRoleHandler, csrf, s.SessionMiddleware, admin)
+	e.GET("/admin/roles/:role/permissions", s.ListRolePermissionsHandler, s.SessionMiddleware, admin)
+	e.POST("/admin/roles/:role/permissions", s.AddRolePermissionHandler, csrf, s.SessionMiddleware, admin)
+	e.DELETE("/admin/roles/:role/permissions", s.RemoveRolePermissionHandler, csrf, s.SessionMiddleware, admin)
+	e.PUT("/admin/clients/:id/scopes", s.SetClientScopesHandler, csrf, s.SessionMiddleware, admin)
+	e.PUT("/admin/clients/:id/resource-server", s.MarkResourceServerHandler, csrf, s.SessionMiddleware, admin)
+	e.DELETE("/admin/clients/:id/resource-server", s.UnmarkResourceServerHandler, csrf, s.SessionMiddleware, admin)
+	e.PUT("/admin/clients/:id/exchange-audiences/:audience", s.AllowExchangeAudienceHandler, csrf, s.SessionMiddleware, admin)
+	e.DELETE("/admin/clients/:id/exchange-audiences/:audience", s.DisallowExchangeAudienceHandler, csrf, s.SessionMiddleware, admin)
+	e.GET("/profile/permissions", s.ListPermissionsHandler, s.SessionMiddleware)
+	e.POST("/admin/users/:id/suspend", s.SuspendUserHandler, csrf, s.SessionMiddleware, admin)
+	e.POST("/admin/users/:id/activate", s.ActivateUserHandler, csrf, s.SessionMiddleware, admin)
+	e.POST("/admin/users/:id/unlock", s.UnlockUserHandler, csrf, s.SessionMiddleware, admin)
+	e.PATCH("/admin/users/:id/metadata", s.UpdateMetadataHandler, csrf, s.SessionMiddleware, admin)
+	e.GET("/admin/approvals", s.ListPendingApprovalsHandler, s.SessionMiddleware, admin)
+	e.POST("/admin/users/:id/approve", s.ApproveUserHandler, csrf, s.SessionMiddleware, admin)
+	e.POST("/admin/users/:id/reject", s.RejectUserHandler, csrf, s.SessionMiddleware, admin)
+	e.POST("/admin/disposable-domains/refresh", s.RefreshDisposableDomainsHandler, csrf, s.SessionMiddleware, admin)
+	e.POST("/admin/invitations", s.CreateInvitationHandler, csrf, s.SessionMiddleware, admin)
+	e.GET("/admin/invitations", s.ListInvitationsHandler, s.SessionMiddleware, admin)
+	e.DELETE("/admin/invitations/:id", s.RevokeInvitationHandler, csrf, s.SessionMiddleware, admin)
+	e.GET("/sessions", s.ListSessionsHandler, s.SessionMiddleware)
+	e.POST("/session/renew", s.RenewSessionHandler, csrf, s.SessionMiddleware)
+	e.GET("/session/revoke", s.DeviceRevokeConfirmationHandler, formCSRF)
+	e.POST("/session/revoke", s.RevokeDeviceSessionHandler, formCSRF)
+	e.DELETE("/sessions", s.RevokeAllSessionsHandler, csrf, s.SessionMiddleware)
+	e.DELETE("/sessions/:id", s.RevokeSessionHandler, csrf, s.SessionMiddleware)
+	e.POST("/password/forgot", s.ForgotPasswordHandler, s.PasswordsEnabled)
+	e.POST("/password/reset", s.ResetPasswordHandler, s.PasswordsEnabled)
+	// Kept for clients built against the old paths
+	e.POST("/forgot-password", s.ForgotPasswordHandler, s.PasswordsEnabled)
+	e.POST("/reset-password", s.ResetPasswordHandler, s.PasswordsEnabled)
+
+	var tlsConfig *tls.Config
+	if config.TLSCertFile != "" {
+		tlsConfig, err = NewTLSConfig(config.TLSCertFile, config.TLSKeyFile, config.MTLSClientCAFile, config.MTLSRequired)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "could not load TLS configuration: %s\n", err)
+			os.Exit(1)
+		}
+	}
 
 	// Start server
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3030"
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			e.TLSServer.Addr = ":" + config.Port
+			e.TLSServer.TLSConfig = tlsConfig
+			err = e.StartServer(e.TLSServer)
+		} else {
+			err = e.Start(":" + config.Port)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("Server stopped unexpectedly", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Wait for the orchestrator to ask us to stop, then drain in-flight
+	// requests before closing the connections they depend on
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	logger.Info("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	err = e.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.Error("Could not drain in-flight requests", "error", err)
+	}
+
+	err = rdb.Close()
+	if err != nil {
+		logger.Error("Could not close Redis client", "error", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		logger.Error("Could not close database", "error", err)
+	}
+
+	if devServices != nil {
+		err = devServices.Stop()
+		if err != nil {
+			logger.Error("Could not stop development services", "error", err)
+		}
 	}
-	e.Start(":" + port)
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// createTestSession stores a session for the user stamped with their
+// current session version, the way CreateSession would.
+func createTestSession(t *testing.T, s *Server, userID string) string {
+	t.Helper()
+	ctx := context.Background()
+	version, err := s.UserSessionVersion(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionID := uuid.New().String()
+	session := Session{UserID: userID, Version: version, CreatedAt: time.Now()}
+	err = s.Sessions.Create(ctx, sessionID, &session, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessionID
+}
+
+func TestUserSessionVerify(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	verify := func(userID, sessionID string) int {
+		t.Helper()
+		e := echo.New()
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodGet, "/verify-session?userid="+userID+"&sessionid="+sessionID, nil)
+		err := s.UserSessionVerify(e.NewContext(request, recorder))
+		if err != nil {
+			t.Fatalf("UserSessionVerify returned %v", err)
+		}
+		return recorder.Code
+	}
+
+	userID := createTestUser(t, s)
+	sessionID := createTestSession(t, s, userID)
+	if code := verify(userID, sessionID); code != 200 {
+		t.Errorf("live session: status %d, want 200", code)
+	}
+	if code := verify("", sessionID); code != 200 {
+		t.Errorf("live session without userid: status %d, want 200", code)
+	}
+	if code := verify(createTestUser(t, s), sessionID); code != 401 {
+		t.Errorf("someone else's session: status %d, want 401", code)
+	}
+
+	if _, err := s.BumpSessionVersion(ctx, userID); err != nil {
+		t.Fatal(err)
+	}
+	if code := verify(userID, sessionID); code != 401 {
+		t.Errorf("session after a version bump: status %d, want 401", code)
+	}
+
+	suspended := createTestUser(t, s)
+	suspendedSessionID := createTestSession(t, s, suspended)
+	if _, err := s.DB.Exec("UPDATE users SET status=$1 WHERE user_id=$2", AccountSuspended, suspended); err != nil {
+		t.Fatal(err)
+	}
+	if code := verify(suspended, suspendedSessionID); code != 401 {
+		t.Errorf("session of a suspended user: status %d, want 401", code)
+	}
+
+	s.SessionMaxLifetime = time.Minute
+	old := createTestUser(t, s)
+	oldSessionID := createTestSession(t, s, old)
+	stored, _ := s.Sessions.Get(ctx, oldSessionID)
+	stored.CreatedAt = time.Now().Add(-2 * time.Minute)
+	if err := s.Sessions.Save(ctx, oldSessionID, stored); err != nil {
+		t.Fatal(err)
+	}
+	if code := verify(old, oldSessionID); code != 401 {
+		t.Errorf("session past its maximum lifetime: status %d, want 401", code)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// users.metadata holds two sections of custom attributes: app_metadata,
+// which only the server and admins set, and user_metadata, which users edit
+// themselves. The column's check constraint caps its size at
+// maxMetadataBytes.
+const (
+	AppMetadata  = "app_metadata"
+	UserMetadata = "user_metadata"
+)
+
+const maxMetadataBytes = 32 << 10
+
+var metadataTooLargeMessage = fmt.Sprintf("Metadata must stay under %d bytes", maxMetadataBytes)
+
+// metadataAssignment turns shallow JSON merge patches of metadata sections
+// into an UPDATE assignment: keys set to null are removed and the others
+// replace what was there. The patch values are appended to args.
+func metadataAssignment(patches map[string]map[string]json.RawMessage, args *[]interface{}) (string, error) {
+	sections := []string{}
+	for section := range patches {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+
+	// A column can only be assigned once, so the sections nest
+	value := "metadata"
+	for _, section := range sections {
+		set := map[string]json.RawMessage{}
+		remove := []string{}
+		for key, change := range patches[section] {
+			if string(change) == "null" {
+				remove = append(remove, key)
+			} else {
+				set[key] = change
+			}
+		}
+
+		data, err := json.Marshal(set)
+		if err != nil {
+			return "", err
+		}
+		*args = append(*args, string(data), pq.Array(remove))
+		value = fmt.Sprintf("jsonb_set(%s, '{%s}', (COALESCE(metadata->'%s', '{}') || $%d::jsonb) - $%d::text[])",
+			value, section, section, len(*args)-1, len(*args))
+	}
+	return "metadata=" + value, nil
+}
+
+// metadataOf returns both sections of the user's metadata.
+func (s *Server) metadataOf(c echo.Context, userID string) (echo.Map, error) {
+	var data []byte
+	err := s.DB.QueryRowContext(c.Request().Context(), "SELECT metadata FROM users WHERE user_id=$1", userID).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+	metadata := echo.Map{AppMetadata: echo.Map{}, UserMetadata: echo.Map{}}
+	err = json.Unmarshal(data, &metadata)
+	return metadata, err
+}
+
+// UpdateMetadataHandler lets admins patch either section of a user's
+// metadata, with the same merge rules as user_metadata in PATCH /profile.
+func (s *Server) UpdateMetadataHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+
+	var body map[string]map[string]json.RawMessage
+	err := c.Bind(&body)
+	if err != nil || len(body) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	for section := range body {
+		if section != AppMetadata && section != UserMetadata {
+			return ValidationError(c, map[string]string{section: "Unknown metadata section"})
+		}
+	}
+
+	var args []interface{}
+	assignment, err := metadataAssignment(body, &args)
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+
+	args = append(args, userID)
+	result, err := s.DB.ExecContext(ctx, fmt.Sprintf("UPDATE users SET %s WHERE user_id=$%d", assignment, len(args)), args...)
+	if isCheckViolation(err) {
+		return ValidationError(c, map[string]string{"metadata": metadataTooLargeMessage})
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update metadata", "error", err)
+		return InvalidRequestError(c)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return NotFoundError(c)
+	}
+
+	metadata, err := s.metadataOf(c, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read metadata", "error", err)
+		return InvalidRequestError(c)
+	}
+	metadata["user_id"] = userID
+	return c.JSON(200, metadata)
+}
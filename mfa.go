@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const mfaChallengeLifetime = time.Minute * 5
+
+// Second factors a user can have turned on
+const (
+	MFAMethodTOTP = "totp"
+	MFAMethodSMS  = "sms"
+	// MFAMethodEmail is only offered to suspicious sign-ins
+	MFAMethodEmail = "email"
+)
+
+// mfaChallenge is a sign-in that passed the first factor and is waiting
+// for the second one.
+type mfaChallenge struct {
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
+	Remember bool   `json:"remember"`
+	// Method is the first factor, for the login history
+	Method string `json:"method"`
+	// Methods are the second factors offered
+	Methods []string `json:"methods,omitempty"`
+}
+
+func mfaChallengeKey(token string) string {
+	return "mfa_challenge:" + HashToken(token)
+}
+
+// MFAMethods lists the second factors the user has turned on, leaving out
+// the one they already signed in with.
+func (s *Server) MFAMethods(ctx context.Context, userID string, firstFactor string) ([]string, error) {
+	var totpEnabled, smsEnabled bool
+	err := s.DB.QueryRowContext(ctx, "SELECT totp_enabled, sms_mfa_enabled FROM users WHERE user_id=$1",
+		userID).Scan(&totpEnabled, &smsEnabled)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := []string{}
+	if totpEnabled && firstFactor != MFAMethodTOTP {
+		methods = append(methods, MFAMethodTOTP)
+	}
+	if smsEnabled && firstFactor != MFAMethodSMS {
+		methods = append(methods, MFAMethodSMS)
+	}
+	return methods, nil
+}
+
+// CreateMFAChallenge stores a sign-in waiting for its second factor,
+// returning the token that completes it.
+func (s *Server) CreateMFAChallenge(ctx context.Context, challenge mfaChallenge) (string, error) {
+	data, err := json.Marshal(challenge)
+	if err != nil {
+		return "", err
+	}
+
+	token := RandomToken()
+	err = s.RDB.Set(ctx, mfaChallengeKey(token), data, mfaChallengeLifetime).Err()
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RequireSecondFactor holds a sign-in until one of the methods is used, the
+// session is only created once it is.
+func (s *Server) RequireSecondFactor(c echo.Context, challenge mfaChallenge, methods []string) error {
+	ctx := c.Request().Context()
+	token, err := s.CreateMFAChallenge(ctx, challenge)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Failed to create MFA challenge", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	return c.JSON(200, echo.Map{
+		"status":      "mfa_required",
+		"mfa_token":   token,
+		"mfa_methods": methods,
+	})
+}
+
+// SecondFactors runs the checks between the first factor and the session.
+// It lists the second factors to ask for, and refused tells whether the
+// sign-in was blocked as suspicious, which has already been recorded.
+func (s *Server) SecondFactors(c echo.Context, userID string, email string, firstFactor string) (methods []string, refused bool, err error) {
+	ctx := c.Request().Context()
+	methods, err = s.MFAMethods(ctx, userID, firstFactor)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if s.SuspiciousLoginAction != "" {
+		risks, err := s.LoginRisks(c, userID)
+		if err != nil {
+			// Like the breach check, an outage shouldn't block sign-ins
+			s.Logger.ErrorContext(ctx, "Could not check sign-in risks", "error", err)
+		}
+		if len(risks) > 0 {
+			s.ReportSuspiciousLogin(c, userID, risks)
+
+			if s.SuspiciousLoginAction == SuspiciousLoginMFA && len(methods) == 0 && s.Mailer != nil && firstFactor != "email_otp" {
+				methods = []string{MFAMethodEmail}
+			}
+			if s.SuspiciousLoginAction == SuspiciousLoginBlock || (s.SuspiciousLoginAction == SuspiciousLoginMFA && len(methods) == 0) {
+				s.RecordLogin(c, false, firstFactor, userID, email)
+				return nil, true, nil
+			}
+		}
+	}
+	return methods, false, nil
+}
+
+// FinishSignIn starts the session for a user who passed the first factor,
+// or asks for a second one when they have any turned on.
+func (s *Server) FinishSignIn(c echo.Context, userID string, email string, remember bool, firstFactor string) error {
+	ctx := c.Request().Context()
+	methods, refused, err := s.SecondFactors(c, userID, email, firstFactor)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up MFA methods", "error", err)
+		return UnauthorizedError(c)
+	}
+	if refused {
+		return SuspiciousLoginError(c)
+	}
+
+	if len(methods) > 0 {
+		challenge := mfaChallenge{UserID: userID, Email: email, Remember: remember, Method: firstFactor, Methods: methods}
+		return s.RequireSecondFactor(c, challenge, methods)
+	}
+	return s.StartUserSession(c, userID, email, remember, firstFactor)
+}
+
+// FinishRedirectSignIn is FinishSignIn for sign-ins the browser arrives at
+// through a redirect, like upstream providers and emailed links. It sends
+// the browser on to returnTo, carrying the MFA challenge when a second
+// factor is needed so the page there can finish through the MFA endpoints.
+func (s *Server) FinishRedirectSignIn(c echo.Context, userID string, email string, remember bool, firstFactor string, returnTo string) error {
+	ctx := c.Request().Context()
+	methods, refused, err := s.SecondFactors(c, userID, email, firstFactor)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up MFA methods", "error", err)
+		return UnauthorizedError(c)
+	}
+	if refused {
+		return SuspiciousLoginError(c)
+	}
+
+	if len(methods) > 0 {
+		challenge := mfaChallenge{UserID: userID, Email: email, Remember: remember, Method: firstFactor, Methods: methods}
+		token, err := s.CreateMFAChallenge(ctx, challenge)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Failed to create MFA challenge", "error", err)
+			return UnauthorizedError(c)
+		}
+		return redirectWithParams(c, returnTo, map[string]string{
+			"status":      "mfa_required",
+			"mfa_token":   token,
+			"mfa_methods": strings.Join(methods, ","),
+		})
+	}
+
+	sessionID, err := s.CreateSession(c, userID, remember)
+	if errors.Is(err, errAccountInactive) {
+		s.Logger.InfoContext(ctx, "Refused sign-in to inactive account", "user_id", userID)
+		return AccountInactiveError(c, err)
+	}
+	if errors.Is(err, errSessionLimitReached) {
+		s.Logger.InfoContext(ctx, "Refused sign-in over the session limit", "user_id", userID)
+		return SessionLimitError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Failed to create user session", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	s.SetSessionCookie(c, sessionID, s.SessionCookieExpiration(remember))
+	s.RecordLogin(c, true, firstFactor, userID, email)
+
+	return c.Redirect(http.StatusFound, returnTo)
+}
+
+// GetMFAChallenge reads a pending challenge without using it up.
+func (s *Server) GetMFAChallenge(ctx context.Context, token string) (*mfaChallenge, error) {
+	data, err := s.RDB.Get(ctx, mfaChallengeKey(token)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var challenge mfaChallenge
+	err = json.Unmarshal(data, &challenge)
+	if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// CompleteMFAChallenge starts the session once verify accepts the second
+// factor for the challenge.
+func (s *Server) CompleteMFAChallenge(c echo.Context, token string, verify func(ctx context.Context, challenge mfaChallenge) bool) error {
+	ctx := c.Request().Context()
+	challenge, err := s.GetMFAChallenge(ctx, token)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "MFA challenge not found or expired", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords
+	if lockout := s.LoginLockout(ctx, challenge.Email); lockout > 0 {
+		s.RDB.Del(ctx, mfaChallengeKey(token))
+		s.RecordAuthEvent(c, EventMFAFailure, challenge.UserID, challenge.Email)
+		s.recordLoginEvent(c, false, challenge.Method, challenge.UserID, challenge.Email)
+		return LoginLockedError(c, lockout)
+	}
+
+	if !verify(ctx, *challenge) {
+		s.Logger.InfoContext(ctx, "Invalid second factor", "user_id", challenge.UserID)
+		s.RecordLoginFailure(ctx, challenge.Email)
+		s.RecordAuthEvent(c, EventMFAFailure, challenge.UserID, challenge.Email)
+		s.recordLoginEvent(c, false, challenge.Method, challenge.UserID, challenge.Email)
+		return UnauthorizedError(c)
+	}
+
+	// The challenge is single use, whoever deletes it completes the sign-in
+	deleted, err := s.RDB.Del(ctx, mfaChallengeKey(token)).Result()
+	if err != nil || deleted == 0 {
+		return UnauthorizedError(c)
+	}
+	s.ClearLoginFailures(ctx, challenge.Email)
+
+	return s.StartUserSession(c, challenge.UserID, challenge.Email, challenge.Remember, challenge.Method)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/oauth2"
+)
+
+// Tenants that accept accounts from more than one directory
+var microsoftMultiTenants = map[string]bool{"common": true, "organizations": true, "consumers": true}
+
+// With a tenant ID only that directory's workforce accounts can sign in.
+// The multi-tenant names accept any work account, personal account or both.
+func NewMicrosoftProvider(clientID string, clientSecret string, tenant string, redirectURL string) *UpstreamProvider {
+	endpoint := "https://login.microsoftonline.com/" + tenant + "/oauth2/v2.0"
+
+	return &UpstreamProvider{
+		Name: "microsoft",
+		OAuth2: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{"openid", "email", "profile"},
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  endpoint + "/authorize",
+				TokenURL: endpoint + "/token",
+			},
+		},
+		FetchIdentity: func(ctx context.Context, token *oauth2.Token, nonce string) (*UpstreamIdentity, error) {
+			// The issuer depends on the tenant the account belongs to
+			identity, claims, err := ParseUpstreamIDToken(token, nil, clientID, nonce)
+			if err != nil {
+				return nil, err
+			}
+
+			tenantID, _ := claims["tid"].(string)
+			if !microsoftMultiTenants[tenant] && tenantID != tenant {
+				return nil, fmt.Errorf("account belongs to tenant %q", tenantID)
+			}
+
+			issuer, _ := claims.GetIssuer()
+			if issuer != "https://login.microsoftonline.com/"+tenantID+"/v2.0" {
+				return nil, fmt.Errorf("unexpected issuer %q", issuer)
+			}
+
+			// Tenant admins can set any email on their accounts, so it only
+			// counts as verified when Microsoft vouches for the domain. This
+			// needs the xms_edov optional claim enabled on the app.
+			verified, _ := claims["xms_edov"].(bool)
+			identity.EmailVerified = verified
+			return identity, nil
+		},
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"os"
+
+	"github.com/labstack/echo/v4"
+)
+
+// NewTLSConfig serves HTTPS with the given certificate. With a client CA,
+// clients presenting a certificate it signed can authenticate with it, and
+// requireClientCert turns away everyone else at the handshake.
+func NewTLSConfig(certFile string, keyFile string, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in client CA file")
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// certificateSubjects lists the names a client certificate vouches for, most
+// specific first: URI SANs (like SPIFFE IDs), DNS SANs, then the common name.
+func certificateSubjects(certificate *x509.Certificate) []string {
+	var subjects []string
+	for _, uri := range certificate.URIs {
+		subjects = append(subjects, uri.String())
+	}
+	subjects = append(subjects, certificate.DNSNames...)
+	if certificate.Subject.CommonName != "" {
+		subjects = append(subjects, certificate.Subject.CommonName)
+	}
+	return subjects
+}
+
+// verifiedClientCertificate returns the certificate the TLS handshake
+// verified against the client CA, if there was one.
+func verifiedClientCertificate(c echo.Context) *x509.Certificate {
+	state := c.Request().TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+// CertificateIdentity maps a client certificate to a service client bound to
+// one of its subjects, or else to the verified user whose email is in it.
+func (s *Server) CertificateIdentity(ctx context.Context, certificate *x509.Certificate) (userID string, clientID string, err error) {
+	for _, subject := range certificateSubjects(certificate) {
+		err = s.DB.QueryRowContext(ctx, "SELECT client_id FROM client_certificates WHERE subject=$1", subject).Scan(&clientID)
+		if err == nil {
+			return "", clientID, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", "", err
+		}
+	}
+
+	for _, email := range certificate.EmailAddresses {
+		err = s.DB.QueryRowContext(ctx, "SELECT user_id FROM users WHERE LOWER(email)=$1 AND verified",
+			normalizeEmail(email)).Scan(&userID)
+		if err == nil {
+			return userID, "", nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", "", err
+		}
+	}
+	return "", "", sql.ErrNoRows
+}
+
+// ClientCertMiddleware authenticates internal services by the certificate
+// they presented during the TLS handshake, in place of any password.
+func (s *Server) ClientCertMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		certificate := verifiedClientCertificate(c)
+		if certificate == nil {
+			return UnauthorizedError(c)
+		}
+
+		userID, clientID, err := s.CertificateIdentity(ctx, certificate)
+		if err != nil {
+			s.Logger.InfoContext(ctx, "Client certificate is not mapped to an identity", "subject", certificate.Subject.String(), "error", err)
+			return UnauthorizedError(c)
+		}
+
+		c.Set("userID", userID)
+		c.Set("clientID", clientID)
+		return next(c)
+	}
+}
+
+func (s *Server) CertificateVerifyHandler(c echo.Context) error {
+	return c.JSON(200, echo.Map{
+		"user_id":   c.Get("userID"),
+		"client_id": c.Get("clientID"),
+	})
+}
+
+// BindClientCertificateHandler lets the owner of a service client say which
+// certificate subject authenticates as it.
+func (s *Server) BindClientCertificateHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var body struct {
+		Subject string `json:"subject"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.Subject) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	result, err := s.DB.ExecContext(ctx, `INSERT INTO client_certificates (subject, client_id)
+		SELECT $1, client_id FROM clients WHERE client_id::text=$2 AND owner_id=$3 AND NOT public`,
+		body.Subject, c.Param("id"), userID)
+	if isUniqueViolation(err) {
+		return ConflictError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not bind client certificate", "error", err)
+		return InvalidRequestError(c)
+	}
+	if inserted, _ := result.RowsAffected(); inserted == 0 {
+		return NotFoundError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Certificate bound", "subject": body.Subject})
+}
+
+func (s *Server) UnbindClientCertificateHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	result, err := s.DB.ExecContext(ctx, `DELETE FROM client_certificates WHERE subject=$1 AND client_id IN
+		(SELECT client_id FROM clients WHERE client_id::text=$2 AND owner_id=$3)`,
+		c.QueryParam("subject"), c.Param("id"), userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not unbind client certificate", "error", err)
+		return InvalidRequestError(c)
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return NotFoundError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Certificate unbound"})
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// deviceRevocation is what the revoke link of a new sign-in email stands for.
+type deviceRevocation struct {
+	UserID    string `json:"user_id"`
+	SessionID string `json:"session_id"`
+}
+
+func deviceRevokeKey(token string) string {
+	return "device_revoke:" + HashToken(token)
+}
+
+// rememberDevice records the session's client fingerprint as one of the
+// user's devices, and reports whether it is new to a user who has signed in
+// elsewhere before. The first device of an account is never new.
+func (s *Server) rememberDevice(ctx context.Context, userID string, fingerprint string) (bool, error) {
+	var known bool
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM known_devices WHERE user_id=$1)", userID).Scan(&known)
+	if err != nil {
+		return false, err
+	}
+
+	// xmax is only zero for rows the statement inserted
+	var inserted bool
+	err = s.DB.QueryRowContext(ctx, `INSERT INTO known_devices (user_id, fingerprint) VALUES($1, $2)
+		ON CONFLICT (user_id, fingerprint) DO UPDATE SET last_seen_at=now() RETURNING xmax = 0`, userID, fingerprint).Scan(&inserted)
+	if err != nil {
+		return false, err
+	}
+	return known && inserted, nil
+}
+
+// NotifyNewDevice emails the user when the session comes from a device they
+// haven't signed in from before, with a link that revokes the session.
+// Failures are only logged, they never hold up signing in.
+func (s *Server) NotifyNewDevice(ctx context.Context, userID string, sessionID string, session *Session, lifetime time.Duration) {
+	if !s.NewDeviceNotifications || s.Mailer == nil {
+		return
+	}
+
+	isNew, err := s.rememberDevice(ctx, userID, session.Fingerprint)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not remember device", "error", err)
+		return
+	}
+	if !isNew {
+		return
+	}
+
+	var email string
+	err = s.DB.QueryRowContext(ctx, "SELECT COALESCE(email, '') FROM users WHERE user_id=$1", userID).Scan(&email)
+	if err != nil || email == "" {
+		return
+	}
+
+	data, err := json.Marshal(deviceRevocation{UserID: userID, SessionID: sessionID})
+	if err != nil {
+		return
+	}
+	token := RandomToken()
+	err = s.RDB.Set(ctx, deviceRevokeKey(token), data, lifetime).Err()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store session revoke link", "error", err)
+		return
+	}
+
+	where := session.IP
+	if session.Location != "" {
+		where += ", " + session.Location
+	}
+	text := fmt.Sprintf("Your account was just signed in to from a new device.\n\nDevice: %s\nAddress: %s\nTime: %s\n\n"+
+		"If this wasn't you, open this link to sign the device out, then change your password.\n\n%s\n",
+		session.DeviceInfo().Name(), where, session.CreatedAt.Format(time.RFC1123),
+		s.IssuerURL+"/session/revoke?token="+url.QueryEscape(token))
+	go func(ctx context.Context) {
+		err := s.Mailer.Send(email, "New sign-in to your account", text)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not send new sign-in email", "user_id", userID, "error", err)
+		}
+	}(context.WithoutCancel(ctx))
+}
+
+var deviceRevokeTemplate = template.Must(template.New("device_revoke").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign out a device</title></head>
+<body>
+{{if .Message}}
+<p>{{.Message}}</p>
+{{else}}
+<form method="post" action="/session/revoke">
+<p>Sign out the device from the new sign-in email? If it wasn't you, change your password afterwards.</p>
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<input type="hidden" name="token" value="{{.Token}}">
+<button type="submit">Sign out the device</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+const deviceRevokeExpired = "This link has expired or was already used."
+
+type deviceRevokePage struct {
+	Message   string
+	Token     string
+	CSRFToken string
+}
+
+func renderDeviceRevokePage(c echo.Context, status int, page deviceRevokePage) error {
+	page.CSRFToken, _ = c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	var body strings.Builder
+	err := deviceRevokeTemplate.Execute(&body, page)
+	if err != nil {
+		return err
+	}
+	return c.HTML(status, body.String())
+}
+
+// DeviceRevokeConfirmationHandler shows what the revoke link of a new
+// sign-in email does. Mail scanners open links on their own, so only the
+// form it posts signs the session out.
+func (s *Server) DeviceRevokeConfirmationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	token := c.QueryParam("token")
+
+	exists, err := s.RDB.Exists(ctx, deviceRevokeKey(token)).Result()
+	if len(token) == 0 || err != nil || exists == 0 {
+		return renderDeviceRevokePage(c, 400, deviceRevokePage{Message: deviceRevokeExpired})
+	}
+	return renderDeviceRevokePage(c, 200, deviceRevokePage{Token: token})
+}
+
+// RevokeDeviceSessionHandler signs out the session a new sign-in email was
+// about. The link works without being signed in, as the user may not have
+// the session it revokes.
+func (s *Server) RevokeDeviceSessionHandler(c echo.Context) error {
+	token := c.FormValue("token")
+	if len(token) == 0 {
+		return renderDeviceRevokePage(c, 400, deviceRevokePage{Message: deviceRevokeExpired})
+	}
+
+	ctx := c.Request().Context()
+	data, err := s.RDB.GetDel(ctx, deviceRevokeKey(token)).Bytes()
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Session revoke link not found or expired", "error", err)
+		return renderDeviceRevokePage(c, 400, deviceRevokePage{Message: deviceRevokeExpired})
+	}
+
+	var revocation deviceRevocation
+	err = json.Unmarshal(data, &revocation)
+	if err != nil {
+		return renderDeviceRevokePage(c, 400, deviceRevokePage{Message: deviceRevokeExpired})
+	}
+
+	err = s.RemoveUserSession(ctx, revocation.UserID, revocation.SessionID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not revoke session", "error", err)
+		return renderDeviceRevokePage(c, 500, deviceRevokePage{Message: "Something went wrong, please try again."})
+	}
+
+	s.RecordAuthEvent(c, EventSessionRevoked, revocation.UserID, "")
+
+	return renderDeviceRevokePage(c, 200, deviceRevokePage{Message: "The device was signed out. Change your password if the sign-in wasn't you."})
+}
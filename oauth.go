@@ -0,0 +1,737 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+const authorizationCodeLifetime = time.Minute * 10
+
+type Client struct {
+	ClientID     string
+	SecretHash   string
+	Name         string
+	RedirectURIs []string
+	// Public clients, like SPAs and mobile apps, can't keep a secret and
+	// must use PKCE instead
+	Public bool
+	// AllowedScopes, set by an admin, limit what the client can get for
+	// itself with the client credentials grant
+	AllowedScopes []string
+	// BackchannelLogoutURI receives a logout token when a session the client
+	// got tokens through ends
+	BackchannelLogoutURI string
+	// ResourceServer clients are trusted by an admin to ask for
+	// authorization decisions about any user
+	ResourceServer bool
+	// ExchangeAudiences are the other clients an admin lets this one
+	// exchange tokens for
+	ExchangeAudiences []string
+}
+
+func (client *Client) AllowsRedirectURI(redirectURI string) bool {
+	for _, uri := range client.RedirectURIs {
+		if uri == redirectURI {
+			return true
+		}
+	}
+	return false
+}
+
+type AuthorizationCode struct {
+	ClientID string `json:"client_id"`
+	UserID   string `json:"user_id"`
+	// RedirectURI is the one sent with the authorization request, the token
+	// request must repeat it. Empty when the client relied on its default.
+	RedirectURI string    `json:"redirect_uri"`
+	Scope       string    `json:"scope"`
+	Nonce       string    `json:"nonce"`
+	AuthTime    time.Time `json:"auth_time"`
+	// CodeChallenge is the S256 PKCE challenge the token request must answer
+	CodeChallenge string `json:"code_challenge"`
+	// SessionID is the browser session the user authorized the client from
+	SessionID string `json:"session_id,omitempty"`
+}
+
+type AccessToken struct {
+	ClientID  string    `json:"client_id"`
+	UserID    string    `json:"user_id"`
+	Scope     string    `json:"scope"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// FamilyID ties the token to the refresh token family it was issued
+	// with, revoking the family revokes the token too
+	FamilyID string `json:"family_id,omitempty"`
+	// ActorClientID is the client that obtained the token for ClientID
+	// through a token exchange
+	ActorClientID string `json:"actor_client_id,omitempty"`
+}
+
+// Codes and tokens are stored under their hash, so a leaked Redis snapshot
+// doesn't hand out usable credentials.
+func authorizationCodeKey(code string) string {
+	return "oauth_code:" + HashToken(code)
+}
+
+func accessTokenKey(token string) string {
+	return "oauth_token:" + HashToken(token)
+}
+
+// OAuthError writes an error response in the format of RFC 6749 section 5.2.
+func OAuthError(c echo.Context, status int, code string, description string) error {
+	return c.JSON(status, echo.Map{"error": code, "error_description": description})
+}
+
+func (s *Server) GetClient(ctx context.Context, clientID string) (*Client, error) {
+	client := Client{ClientID: clientID}
+	err := s.DB.QueryRowContext(ctx, `SELECT client_secret_hash, name, redirect_uris, public, allowed_scopes, COALESCE(backchannel_logout_uri, ''),
+		resource_server, exchange_audiences FROM clients WHERE client_id::text=$1`, clientID).
+		Scan(&client.SecretHash, &client.Name, pq.Array(&client.RedirectURIs), &client.Public, pq.Array(&client.AllowedScopes), &client.BackchannelLogoutURI,
+			&client.ResourceServer, pq.Array(&client.ExchangeAudiences))
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// AuthenticateClient checks the client credentials of a token request, sent
+// either with HTTP Basic auth or in the form body. Public clients only send
+// their client_id.
+func (s *Server) AuthenticateClient(c echo.Context) *Client {
+	ctx := c.Request().Context()
+	clientID, clientSecret, ok := c.Request().BasicAuth()
+	if !ok {
+		clientID = c.FormValue("client_id")
+		clientSecret = c.FormValue("client_secret")
+	}
+
+	// A certificate bound to the client stands in for its secret, as in
+	// RFC 8705 section 2
+	if certificate := verifiedClientCertificate(c); certificate != nil && len(clientSecret) == 0 {
+		_, certClientID, err := s.CertificateIdentity(ctx, certificate)
+		if err == nil && certClientID != "" && (clientID == "" || clientID == certClientID) {
+			client, err := s.GetClient(ctx, certClientID)
+			if err == nil {
+				return client
+			}
+		}
+	}
+
+	if len(clientID) == 0 {
+		return nil
+	}
+
+	client, err := s.GetClient(ctx, clientID)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not find client", "error", err)
+		return nil
+	}
+
+	if client.Public {
+		return client
+	}
+
+	if len(clientSecret) == 0 {
+		return nil
+	}
+
+	if subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(HashToken(clientSecret))) != 1 {
+		s.Logger.InfoContext(ctx, "Invalid client secret", "client_id", clientID)
+		return nil
+	}
+	return client
+}
+
+func (s *Server) GetAccessToken(ctx context.Context, token string) (*AccessToken, error) {
+	data, err := s.RDB.Get(ctx, accessTokenKey(token)).Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var accessToken AccessToken
+	err = json.Unmarshal(data, &accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if accessToken.FamilyID != "" {
+		exists, err := s.RDB.Exists(ctx, refreshFamilyKey(accessToken.FamilyID)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if exists == 0 {
+			return nil, ErrRefreshTokenInvalid
+		}
+	}
+	return &accessToken, nil
+}
+
+func HasScope(scope string, wanted string) bool {
+	for _, item := range strings.Fields(scope) {
+		if item == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+// AccessTokenMiddleware authenticates API requests that carry an OAuth
+// access token in the Authorization header.
+func (s *Server) AccessTokenMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if !ok || len(token) == 0 {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return UnauthorizedError(c)
+		}
+
+		accessToken, err := s.LookupBearerToken(ctx, token)
+		if err != nil {
+			s.Logger.InfoContext(ctx, "Access token not found or expired", "error", err)
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return UnauthorizedError(c)
+		}
+
+		c.Set("userID", accessToken.UserID)
+		c.Set("clientID", accessToken.ClientID)
+		c.Set("scope", accessToken.Scope)
+		return next(c)
+	}
+}
+
+// VerifyCodeChallenge checks a PKCE code verifier against its S256 challenge,
+// as described in RFC 7636 section 4.6.
+func VerifyCodeChallenge(challenge string, verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// IssueAccessToken stores a new access token. It lives for the access token
+// lifetime, or until accessToken.ExpiresAt if that comes sooner.
+func (s *Server) IssueAccessToken(ctx context.Context, accessToken AccessToken) (string, error) {
+	token := RandomToken()
+	expiresAt := time.Now().Add(s.AccessTokenLifetime).UTC()
+	if accessToken.ExpiresAt.IsZero() || accessToken.ExpiresAt.After(expiresAt) {
+		accessToken.ExpiresAt = expiresAt
+	}
+	lifetime := time.Until(accessToken.ExpiresAt)
+	if lifetime <= 0 {
+		return "", errors.New("access token would already be expired")
+	}
+
+	data, err := json.Marshal(accessToken)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.RDB.Set(ctx, accessTokenKey(token), data, lifetime).Err()
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func (s *Server) CreateClientHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var body struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Public       bool     `json:"public"`
+		// BackchannelLogoutURI is optional
+		BackchannelLogoutURI string `json:"backchannel_logout_uri"`
+	}
+
+	// Service clients that only use client credentials need no redirect URI
+	err := c.Bind(&body)
+	if err != nil || len(body.Name) == 0 || (len(body.RedirectURIs) == 0 && body.Public) {
+		return InvalidRequestError(c)
+	}
+	if body.RedirectURIs == nil {
+		body.RedirectURIs = []string{}
+	}
+
+	for _, redirectURI := range body.RedirectURIs {
+		uri, err := url.Parse(redirectURI)
+		if err != nil || !uri.IsAbs() || uri.Fragment != "" {
+			return InvalidRequestError(c)
+		}
+	}
+
+	if body.BackchannelLogoutURI != "" && !ValidBackchannelLogoutURI(body.BackchannelLogoutURI) {
+		return ValidationError(c, map[string]string{"backchannel_logout_uri": "Must be an https URI outside internal networks"})
+	}
+
+	var clientSecret, secretHash string
+	if !body.Public {
+		clientSecret = RandomToken()
+		secretHash = HashToken(clientSecret)
+	}
+
+	var clientID string
+	err = s.DB.QueryRowContext(ctx, "INSERT INTO clients (client_secret_hash, name, redirect_uris, owner_id, public, backchannel_logout_uri) VALUES($1, $2, $3, $4, $5, $6) RETURNING client_id",
+		secretHash, body.Name, pq.Array(body.RedirectURIs), userID, body.Public, nullString(body.BackchannelLogoutURI)).Scan(&clientID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create client", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	response := echo.Map{
+		"client_id":     clientID,
+		"name":          body.Name,
+		"redirect_uris": body.RedirectURIs,
+		"public":        body.Public,
+	}
+	if body.BackchannelLogoutURI != "" {
+		response["backchannel_logout_uri"] = body.BackchannelLogoutURI
+	}
+	// The secret is only ever shown here, we only keep its hash
+	if !body.Public {
+		response["client_secret"] = clientSecret
+	}
+	return c.JSON(200, response)
+}
+
+// SetClientScopesHandler replaces the scopes the client can get with the
+// client credentials grant. Only admins decide these, registration can't.
+func (s *Server) SetClientScopesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	clientID := c.Param("id")
+
+	var body struct {
+		Scopes []string `json:"scopes"`
+	}
+	err := c.Bind(&body)
+	if err != nil || body.Scopes == nil {
+		return InvalidRequestError(c)
+	}
+	for _, scope := range body.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\r\n\"\\") {
+			return ValidationError(c, map[string]string{"scopes": "Scopes can't be empty or contain spaces, quotes or backslashes"})
+		}
+	}
+
+	result, err := s.DB.ExecContext(ctx, "UPDATE clients SET allowed_scopes=$2 WHERE client_id::text=$1 AND NOT public",
+		clientID, pq.Array(body.Scopes))
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update client", "error", err)
+		return ServerError(c)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return NotFoundError(c)
+	}
+	return c.JSON(200, echo.Map{"client_id": clientID, "scopes": body.Scopes})
+}
+
+// redirectWithParams sends the browser back to the client, keeping any query
+// the registered redirect URI already had.
+func redirectWithParams(c echo.Context, redirectURI string, params map[string]string) error {
+	uri, err := url.Parse(redirectURI)
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+
+	query := uri.Query()
+	for key, value := range params {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	uri.RawQuery = query.Encode()
+	return c.Redirect(http.StatusFound, uri.String())
+}
+
+// AuthorizeHandler starts the authorization code flow. Clients the user
+// hasn't allowed the requested scopes yet get an authorization page first.
+func (s *Server) AuthorizeHandler(c echo.Context) error {
+	return s.authorize(c, c.QueryParams(), "")
+}
+
+// AuthorizeDecisionHandler takes the user's answer from the authorization
+// page, which sends the request back along with it.
+func (s *Server) AuthorizeDecisionHandler(c echo.Context) error {
+	params, err := c.FormParams()
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+	decision := params.Get("action")
+	if decision != "approve" && decision != "deny" {
+		return InvalidRequestError(c)
+	}
+	params.Del("action")
+	params.Del("csrf_token")
+	return s.authorize(c, params, decision)
+}
+
+// authorize checks the authorization request in params and issues a code.
+// decision is empty until the user answered the authorization page.
+func (s *Server) authorize(c echo.Context, params url.Values, decision string) error {
+	ctx := c.Request().Context()
+	clientID := params.Get("client_id")
+	redirectURI := params.Get("redirect_uri")
+	state := params.Get("state")
+	scope := params.Get("scope")
+
+	client, err := s.GetClient(ctx, clientID)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not find client", "error", err)
+		return OAuthError(c, 400, "invalid_client", "Unknown client")
+	}
+
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+
+	// Never redirect to an unregistered URI, errors are reported to the
+	// browser directly instead
+	if !client.AllowsRedirectURI(redirectURI) {
+		return OAuthError(c, 400, "invalid_request", "Redirect URI is not registered for this client")
+	}
+
+	if params.Get("response_type") != "code" {
+		return redirectWithParams(c, redirectURI, map[string]string{
+			"error": "unsupported_response_type",
+			"state": state,
+		})
+	}
+
+	for _, item := range strings.Fields(scope) {
+		if !containsString(supportedScopes, item) {
+			return redirectWithParams(c, redirectURI, map[string]string{
+				"error":             "invalid_scope",
+				"error_description": "Scope " + item + " is not supported",
+				"state":             state,
+			})
+		}
+	}
+
+	codeChallenge := params.Get("code_challenge")
+	if codeChallenge != "" && params.Get("code_challenge_method") != "S256" {
+		return redirectWithParams(c, redirectURI, map[string]string{
+			"error":             "invalid_request",
+			"error_description": "Only the S256 code challenge method is supported",
+			"state":             state,
+		})
+	}
+	if codeChallenge == "" && client.Public {
+		return redirectWithParams(c, redirectURI, map[string]string{
+			"error":             "invalid_request",
+			"error_description": "Public clients must use PKCE",
+			"state":             state,
+		})
+	}
+
+	sessionID, session := s.Authenticate(c)
+	if session == nil {
+		if s.LoginPageURL == "" || decision != "" {
+			return UnauthorizedError(c)
+		}
+		return redirectWithParams(c, s.LoginPageURL, map[string]string{
+			"return_to": c.Request().URL.RequestURI(),
+		})
+	}
+
+	switch decision {
+	case "":
+		covered, err := s.GrantCovers(ctx, session.UserID, client.ClientID, scope)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not check grant", "error", err)
+			return redirectWithParams(c, redirectURI, map[string]string{
+				"error": "server_error",
+				"state": state,
+			})
+		}
+		if !covered {
+			return renderAuthorizePage(c, authorizePage{
+				ClientName: client.Name,
+				Scope:      scope,
+				Params:     params,
+			})
+		}
+	case "deny":
+		return redirectWithParams(c, redirectURI, map[string]string{
+			"error": "access_denied",
+			"state": state,
+		})
+	case "approve":
+		err = s.RecordGrant(ctx, session.UserID, client.ClientID, scope)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not record grant", "error", err)
+			return redirectWithParams(c, redirectURI, map[string]string{
+				"error": "server_error",
+				"state": state,
+			})
+		}
+	}
+
+	data, err := json.Marshal(AuthorizationCode{
+		ClientID:      client.ClientID,
+		UserID:        session.UserID,
+		RedirectURI:   params.Get("redirect_uri"),
+		Scope:         scope,
+		Nonce:         params.Get("nonce"),
+		AuthTime:      session.LastAuthenticated(),
+		CodeChallenge: codeChallenge,
+		SessionID:     sessionID,
+	})
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+
+	code := RandomToken()
+	err = s.RDB.Set(ctx, authorizationCodeKey(code), data, authorizationCodeLifetime).Err()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store authorization code", "error", err)
+		return redirectWithParams(c, redirectURI, map[string]string{
+			"error": "server_error",
+			"state": state,
+		})
+	}
+
+	return redirectWithParams(c, redirectURI, map[string]string{
+		"code":  code,
+		"state": state,
+	})
+}
+
+func (s *Server) TokenHandler(c echo.Context) error {
+	c.Response().Header().Set("Cache-Control", "no-store")
+	c.Response().Header().Set("Pragma", "no-cache")
+
+	client := s.AuthenticateClient(c)
+	if client == nil {
+		return OAuthError(c, 401, "invalid_client", "Client authentication failed")
+	}
+
+	switch c.FormValue("grant_type") {
+	case "authorization_code":
+		return s.exchangeAuthorizationCode(c, client)
+	case "refresh_token":
+		return s.exchangeRefreshToken(c, client)
+	case deviceCodeGrantType:
+		return s.exchangeDeviceCode(c, client)
+	case "client_credentials":
+		return s.exchangeClientCredentials(c, client)
+	case tokenExchangeGrantType:
+		return s.exchangeToken(c, client)
+	default:
+		return OAuthError(c, 400, "unsupported_grant_type", "Grant type is not supported")
+	}
+}
+
+func (s *Server) exchangeAuthorizationCode(c echo.Context, client *Client) error {
+	ctx := c.Request().Context()
+	code := c.FormValue("code")
+	if len(code) == 0 {
+		return OAuthError(c, 400, "invalid_request", "Missing code")
+	}
+
+	// GetDel makes the code single-use even under concurrent requests
+	data, err := s.RDB.GetDel(ctx, authorizationCodeKey(code)).Bytes()
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Authorization code not found or expired", "error", err)
+		return OAuthError(c, 400, "invalid_grant", "Invalid or expired code")
+	}
+
+	var authorization AuthorizationCode
+	err = json.Unmarshal(data, &authorization)
+	if err != nil {
+		return OAuthError(c, 400, "invalid_grant", "Invalid or expired code")
+	}
+
+	if authorization.ClientID != client.ClientID || authorization.RedirectURI != c.FormValue("redirect_uri") {
+		s.Logger.WarnContext(ctx, "Authorization code used by the wrong client", "client_id", client.ClientID)
+		return OAuthError(c, 400, "invalid_grant", "Code was not issued to this client")
+	}
+
+	if authorization.CodeChallenge != "" && !VerifyCodeChallenge(authorization.CodeChallenge, c.FormValue("code_verifier")) {
+		s.Logger.WarnContext(ctx, "Invalid PKCE code verifier", "client_id", client.ClientID)
+		return OAuthError(c, 400, "invalid_grant", "Invalid code verifier")
+	}
+
+	return s.issueTokens(c, client, &authorization)
+}
+
+// issueTokens answers a successful grant with a new refresh token family,
+// an access token and, for openid requests, an ID token.
+func (s *Server) issueTokens(c echo.Context, client *Client, authorization *AuthorizationCode) error {
+	ctx := c.Request().Context()
+	familyID := uuid.New().String()
+	refreshToken, err := s.IssueRefreshToken(ctx, RefreshToken{
+		FamilyID: familyID,
+		UserID:   authorization.UserID,
+		ClientID: client.ClientID,
+		Scope:    authorization.Scope,
+	})
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not issue refresh token", "error", err)
+		return OAuthError(c, 500, "server_error", "Could not issue refresh token")
+	}
+
+	accessToken, err := s.IssueAccessToken(ctx, AccessToken{
+		ClientID: client.ClientID,
+		UserID:   authorization.UserID,
+		Scope:    authorization.Scope,
+		FamilyID: familyID,
+	})
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not issue access token", "error", err)
+		return OAuthError(c, 500, "server_error", "Could not issue access token")
+	}
+
+	if authorization.SessionID != "" {
+		err = s.RecordSessionClient(ctx, authorization.SessionID, client.ClientID)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not record session client", "error", err)
+		}
+	}
+
+	response := echo.Map{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(s.AccessTokenLifetime.Seconds()),
+		"scope":         authorization.Scope,
+		"refresh_token": refreshToken,
+	}
+
+	if HasScope(authorization.Scope, "openid") {
+		idToken, err := s.IssueIDToken(ctx, client.ClientID, authorization)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not issue ID token", "error", err)
+			return OAuthError(c, 500, "server_error", "Could not issue ID token")
+		}
+		response["id_token"] = idToken
+	}
+
+	return c.JSON(200, response)
+}
+
+func (s *Server) exchangeRefreshToken(c echo.Context, client *Client) error {
+	ctx := c.Request().Context()
+	token := c.FormValue("refresh_token")
+	if len(token) == 0 {
+		return OAuthError(c, 400, "invalid_request", "Missing refresh token")
+	}
+
+	refreshToken, newToken, err := s.RotateRefreshToken(ctx, token)
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			s.Logger.WarnContext(ctx, "Refresh token reuse detected, revoking token family", "client_id", client.ClientID)
+		} else {
+			s.Logger.InfoContext(ctx, "Could not rotate refresh token", "error", err)
+		}
+		return OAuthError(c, 400, "invalid_grant", "Invalid or expired refresh token")
+	}
+
+	if refreshToken.ClientID != client.ClientID {
+		s.Logger.WarnContext(ctx, "Refresh token used by the wrong client", "client_id", client.ClientID)
+		s.RDB.Del(ctx, refreshFamilyKey(refreshToken.FamilyID))
+		return OAuthError(c, 400, "invalid_grant", "Refresh token was not issued to this client")
+	}
+
+	accessToken, err := s.IssueAccessToken(ctx, AccessToken{
+		ClientID: client.ClientID,
+		UserID:   refreshToken.UserID,
+		Scope:    refreshToken.Scope,
+		FamilyID: refreshToken.FamilyID,
+	})
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not issue access token", "error", err)
+		return OAuthError(c, 500, "server_error", "Could not issue access token")
+	}
+
+	return c.JSON(200, echo.Map{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(s.AccessTokenLifetime.Seconds()),
+		"scope":         refreshToken.Scope,
+		"refresh_token": newToken,
+	})
+}
+
+// exchangeClientCredentials issues a token to the client itself, with no
+// user behind it, as described in RFC 6749 section 4.4. There is no refresh
+// token, the client can always ask again.
+func (s *Server) exchangeClientCredentials(c echo.Context, client *Client) error {
+	ctx := c.Request().Context()
+	if client.Public {
+		return OAuthError(c, 400, "unauthorized_client", "Public clients can't use client credentials")
+	}
+
+	scope := strings.Join(client.AllowedScopes, " ")
+	if requested := c.FormValue("scope"); requested != "" {
+		for _, item := range strings.Fields(requested) {
+			if !containsString(client.AllowedScopes, item) {
+				return OAuthError(c, 400, "invalid_scope", "Scope "+item+" is not allowed for this client")
+			}
+		}
+		scope = requested
+	}
+
+	accessToken, err := s.IssueAccessToken(ctx, AccessToken{
+		ClientID: client.ClientID,
+		Scope:    scope,
+	})
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not issue access token", "error", err)
+		return OAuthError(c, 500, "server_error", "Could not issue access token")
+	}
+
+	return c.JSON(200, echo.Map{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(s.AccessTokenLifetime.Seconds()),
+		"scope":        scope,
+	})
+}
+
+// RevokeHandler invalidates an access or refresh token issued to the calling
+// client, as described in RFC 7009. Revoking a refresh token revokes its
+// whole family, including the access tokens issued with it. Unknown tokens
+// are not an error.
+func (s *Server) RevokeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	client := s.AuthenticateClient(c)
+	if client == nil {
+		return OAuthError(c, 401, "invalid_client", "Client authentication failed")
+	}
+
+	token := c.FormValue("token")
+	if len(token) == 0 {
+		return OAuthError(c, 400, "invalid_request", "Missing token")
+	}
+
+	accessToken, err := s.GetAccessToken(ctx, token)
+	if err == nil && accessToken.ClientID == client.ClientID {
+		s.RDB.Del(ctx, accessTokenKey(token))
+		return c.NoContent(200)
+	}
+
+	data, err := s.RDB.Get(ctx, refreshTokenKey(HashToken(token))).Bytes()
+	if err == nil {
+		var refreshToken RefreshToken
+		err = json.Unmarshal(data, &refreshToken)
+		if err == nil && refreshToken.ClientID == client.ClientID {
+			s.RDB.Del(ctx, refreshFamilyKey(refreshToken.FamilyID))
+		}
+	}
+
+	return c.NoContent(200)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/lib/pq"
+)
+
+// GrantCovers reports whether the user already allowed the client every
+// scope in scope, so the authorization page can be skipped.
+func (s *Server) GrantCovers(ctx context.Context, userID string, clientID string, scope string) (bool, error) {
+	var covered bool
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM oauth_grants WHERE user_id=$1 AND client_id=$2 AND scopes @> $3)",
+		userID, clientID, pq.Array(strings.Fields(scope))).Scan(&covered)
+	return covered, err
+}
+
+// RecordGrant remembers the user allowed the client the scopes, on top of
+// any allowed before.
+func (s *Server) RecordGrant(ctx context.Context, userID string, clientID string, scope string) error {
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO oauth_grants (user_id, client_id, scopes) VALUES($1, $2, $3)
+		ON CONFLICT (user_id, client_id) DO UPDATE
+		SET scopes=ARRAY(SELECT DISTINCT unnest(oauth_grants.scopes || EXCLUDED.scopes)), granted_at=now()`,
+		userID, clientID, pq.Array(strings.Fields(scope)))
+	return err
+}
+
+var authorizeTemplate = template.Must(template.New("authorize").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Allow access</title></head>
+<body>
+<form method="post" action="/oauth/authorize">
+<p><strong>{{.ClientName}}</strong> wants to access your account{{if .Scope}} with the scopes <code>{{.Scope}}</code>{{end}}.</p>
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+{{range $name, $values := .Params}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<button type="submit" name="action" value="approve">Allow</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+</body>
+</html>
+`))
+
+type authorizePage struct {
+	ClientName string
+	Scope      string
+	// Params are the authorization request, sent back with the decision
+	Params    url.Values
+	CSRFToken string
+}
+
+func renderAuthorizePage(c echo.Context, page authorizePage) error {
+	page.CSRFToken, _ = c.Get(middleware.DefaultCSRFConfig.ContextKey).(string)
+	var body strings.Builder
+	err := authorizeTemplate.Execute(&body, page)
+	if err != nil {
+		return err
+	}
+	return c.HTML(200, body.String())
+}
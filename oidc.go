@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// IssueIDToken signs an OpenID Connect ID token for the user behind the
+// authorization, with the claims its scopes allow.
+func (s *Server) IssueIDToken(ctx context.Context, clientID string, authorization *AuthorizationCode) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":       s.IssuerURL,
+		"sub":       authorization.UserID,
+		"aud":       clientID,
+		"iat":       now.Unix(),
+		"exp":       now.Add(s.AccessTokenLifetime).Unix(),
+		"auth_time": authorization.AuthTime.Unix(),
+	}
+	if authorization.Nonce != "" {
+		claims["nonce"] = authorization.Nonce
+	}
+	if authorization.SessionID != "" {
+		claims["sid"] = SessionSID(authorization.SessionID)
+	}
+
+	userClaims, err := s.UserClaims(ctx, authorization.UserID, authorization.Scope)
+	if err != nil {
+		return "", err
+	}
+	for key, value := range userClaims {
+		claims[key] = value
+	}
+
+	key := s.SigningKeys.Current()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// UserClaims returns the standard OIDC claims about the user that the
+// scopes grant access to.
+func (s *Server) UserClaims(ctx context.Context, userID string, scope string) (map[string]interface{}, error) {
+	var email, name string
+	var verified bool
+	err := s.DB.QueryRowContext(ctx, "SELECT email, name, verified FROM users WHERE user_id=$1", userID).Scan(&email, &name, &verified)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{"sub": userID}
+	if HasScope(scope, "email") {
+		claims["email"] = email
+		claims["email_verified"] = verified
+	}
+	if HasScope(scope, "profile") {
+		claims["name"] = name
+	}
+	if HasScope(scope, "roles") {
+		claims["roles"], err = s.UserRoles(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if HasScope(scope, "groups") {
+		claims["groups"], err = s.UserGroups(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return claims, nil
+}
+
+var supportedScopes = []string{"openid", "email", "profile", "roles", "groups"}
+
+func (s *Server) OpenIDConfigurationHandler(c echo.Context) error {
+	return c.JSON(200, echo.Map{
+		"issuer":                        s.IssuerURL,
+		"authorization_endpoint":        s.IssuerURL + "/oauth/authorize",
+		"token_endpoint":                s.IssuerURL + "/oauth/token",
+		"userinfo_endpoint":             s.IssuerURL + "/userinfo",
+		"introspection_endpoint":        s.IssuerURL + "/oauth/introspect",
+		"revocation_endpoint":           s.IssuerURL + "/oauth/revoke",
+		"device_authorization_endpoint": s.IssuerURL + "/device/code",
+		"jwks_uri":                      s.IssuerURL + "/.well-known/jwks.json",
+		"response_types_supported":      []string{"code"},
+		"grant_types_supported": []string{"authorization_code", "refresh_token", "client_credentials", deviceCodeGrantType,
+			tokenExchangeGrantType},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      supportedScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "tls_client_auth", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"backchannel_logout_supported":          true,
+		"backchannel_logout_session_supported":  true,
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "sid", "email", "email_verified", "name"},
+	})
+}
+
+func (s *Server) JWKSHandler(c echo.Context) error {
+	return c.JSON(200, echo.Map{
+		"keys": s.SigningKeys.JWKS(),
+	})
+}
+
+func (s *Server) UserInfoEndpointHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+	scope := c.Get("scope").(string)
+
+	if !HasScope(scope, "openid") {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="insufficient_scope"`)
+		return c.JSON(403, echo.Map{"error": "insufficient_scope"})
+	}
+
+	claims, err := s.UserClaims(ctx, userID, scope)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not find user information", "error", err)
+		return UnauthorizedError(c)
+	}
+	return c.JSON(200, claims)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// OIDCProviderConfig registers any OpenID Connect provider by its issuer.
+type OIDCProviderConfig struct {
+	Name         string
+	IssuerURL    string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
+// DiscoverOIDCProvider looks up the provider's endpoints in its discovery
+// document, so only the issuer has to be configured.
+func DiscoverOIDCProvider(ctx context.Context, config OIDCProviderConfig, redirectURL string) (*UpstreamProvider, error) {
+	issuer := strings.TrimSuffix(config.IssuerURL, "/")
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery document returned %s", response.Status)
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	// OIDC Discovery 4.3, otherwise the document could impersonate another issuer
+	if discovery.Issuer != issuer && discovery.Issuer != issuer+"/" {
+		return nil, fmt.Errorf("discovery document is for issuer %q", discovery.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" {
+		return nil, fmt.Errorf("discovery document has no authorization or token endpoint")
+	}
+
+	return &UpstreamProvider{
+		Name: config.Name,
+		OAuth2: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       config.Scopes,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  discovery.AuthorizationEndpoint,
+				TokenURL: discovery.TokenEndpoint,
+			},
+		},
+		FetchIdentity: func(ctx context.Context, token *oauth2.Token, nonce string) (*UpstreamIdentity, error) {
+			identity, _, err := ParseUpstreamIDToken(token, []string{discovery.Issuer}, config.ClientID, nonce)
+			return identity, err
+		},
+	}, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Wrong guesses allowed before a code is thrown away
+const otpMaxAttempts = 5
+
+var errTooManyCodes = errors.New("too many codes sent")
+
+// storedOTP is a one-time code waiting to be entered, with whatever the
+// flow needs back once it is.
+type storedOTP struct {
+	CodeHash string `json:"code_hash"`
+	Payload  string `json:"payload"`
+}
+
+func otpKey(purpose string, subject string) string {
+	return "otp:" + purpose + ":" + subject
+}
+
+func otpAttemptsKey(key string) string {
+	return key + ":attempts"
+}
+
+func otpSendKey(destination string) string {
+	return "otp_send:" + destination
+}
+
+func randomCode() string {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%06d", n.Int64())
+}
+
+// CreateOTP stores a new 6 digit code under key, replacing any earlier one.
+func (s *Server) CreateOTP(ctx context.Context, key string, payload string) (string, error) {
+	code := randomCode()
+	data, err := json.Marshal(storedOTP{CodeHash: HashToken(code), Payload: payload})
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, data, s.OTPLifetime)
+		pipe.Del(ctx, otpAttemptsKey(key))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// CheckOTP uses up the code under key and returns its payload when the code
+// matches. Six digits are easy to guess, so the code is dropped after a few
+// wrong attempts.
+func (s *Server) CheckOTP(ctx context.Context, key string, code string) (string, bool) {
+	data, err := s.RDB.Get(ctx, key).Bytes()
+	if err != nil {
+		return "", false
+	}
+
+	var stored storedOTP
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		return "", false
+	}
+
+	attempts, err := s.RDB.Incr(ctx, otpAttemptsKey(key)).Result()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not count OTP attempt", "error", err)
+		return "", false
+	}
+	if attempts == 1 {
+		s.RDB.Expire(ctx, otpAttemptsKey(key), s.OTPLifetime)
+	}
+	if attempts > otpMaxAttempts {
+		s.RDB.Del(ctx, key, otpAttemptsKey(key))
+		return "", false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(HashToken(code)), []byte(stored.CodeHash)) != 1 {
+		return "", false
+	}
+
+	// Whoever deletes the code gets to use it
+	deleted, err := s.RDB.Del(ctx, key).Result()
+	if err != nil || deleted == 0 {
+		return "", false
+	}
+	s.RDB.Del(ctx, otpAttemptsKey(key))
+	return stored.Payload, true
+}
+
+// AllowOTPSend limits how many codes go to one destination per window, since
+// every code sent costs money and can be used to spam someone.
+func (s *Server) AllowOTPSend(ctx context.Context, destination string) bool {
+	key := otpSendKey(destination)
+	sent, err := s.RDB.Incr(ctx, key).Result()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not count OTP send", "error", err)
+		return false
+	}
+
+	if sent == 1 {
+		s.RDB.Expire(ctx, key, s.OTPSendWindow)
+	}
+	return sent <= s.OTPSendLimit
+}
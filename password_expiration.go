@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// passwordExpiredRoutes still work while the session waits for a new
+// password, which is enough to set one or sign out.
+var passwordExpiredRoutes = map[string]bool{
+	"GET /profile":           true,
+	"POST /profile/password": true,
+	"POST /logout":           true,
+	"POST /session/renew":    true,
+}
+
+func PasswordExpiredError(c echo.Context) error {
+	return c.JSON(403, echo.Map{"error": "Password expired, set a new one", "password_expired": true})
+}
+
+// PasswordExpired reports whether the user's password is older than the
+// maximum password age. Accounts without a password never expire.
+func (s *Server) PasswordExpired(ctx context.Context, userID string) (bool, error) {
+	if s.PasswordMaxAge == 0 {
+		return false, nil
+	}
+
+	var expired bool
+	err := s.DB.QueryRowContext(ctx, "SELECT password IS NOT NULL AND password_changed_at < $2 FROM users WHERE user_id=$1",
+		userID, time.Now().Add(-s.PasswordMaxAge)).Scan(&expired)
+	return expired, err
+}
+
+// passwordExpiredAllowed tells whether the route stays open to sessions
+// whose password expired.
+func passwordExpiredAllowed(c echo.Context) bool {
+	return passwordExpiredRoutes[c.Request().Method+" "+c.Path()]
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var passwordReusedViolation = PasswordViolation{"reused", "Password was used recently"}
+
+// PasswordReused reports whether the password matches the current one or
+// any kept in the user's history.
+func (s *Server) PasswordReused(ctx context.Context, userID string, password string) (bool, error) {
+	if s.PasswordHistory == 0 {
+		return false, nil
+	}
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT password FROM users WHERE user_id=$1 AND password IS NOT NULL
+		UNION ALL (SELECT password_hash FROM password_history WHERE user_id=$1 ORDER BY created_at DESC LIMIT $2)`,
+		userID, s.PasswordHistory-1)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return false, err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// RecordPasswordHistory keeps the user's current password in their history
+// before it gets replaced, dropping the ones too old to matter.
+func (s *Server) RecordPasswordHistory(ctx context.Context, userID string) error {
+	if s.PasswordHistory == 0 {
+		return nil
+	}
+
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO password_history (user_id, password_hash)
+		SELECT user_id, password FROM users WHERE user_id=$1 AND password IS NOT NULL`, userID)
+	if err != nil {
+		return err
+	}
+
+	// The current password counts as one of the last N
+	_, err = s.DB.ExecContext(ctx, `DELETE FROM password_history WHERE user_id=$1 AND history_id NOT IN
+		(SELECT history_id FROM password_history WHERE user_id=$1 ORDER BY created_at DESC LIMIT $2)`,
+		userID, s.PasswordHistory-1)
+	return err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+)
+
+// bcrypt ignores everything past the first 72 bytes, so longer passwords
+// would be weaker than they look
+const maxPasswordBytes = 72
+
+// commonPasswords are banned everywhere, on top of any configured list.
+var commonPasswords = []string{
+	"123456", "12345678", "123456789", "1234567890", "password", "password1", "passw0rd", "qwerty", "qwertyuiop",
+	"abc123", "111111", "123123", "letmein", "welcome", "monkey", "dragon", "iloveyou", "sunshine", "princess",
+	"football", "baseball", "master", "shadow", "superman", "trustno1", "admin", "login", "secret", "changeme",
+}
+
+// PasswordPolicy is what new passwords are checked against.
+type PasswordPolicy struct {
+	MinLength int
+	// MinScore is the lowest strength score accepted, from 0 to 4 like
+	// zxcvbn, with 0 accepting anything
+	MinScore int
+	// Banned passwords are lowercase
+	Banned map[string]bool
+}
+
+// PasswordViolation names a policy rule the password breaks.
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// LoadBannedPasswords reads a list of banned passwords, one per line, on top
+// of the built in common passwords. An empty path only uses the built in list.
+func LoadBannedPasswords(path string) (map[string]bool, error) {
+	banned := map[string]bool{}
+	for _, password := range commonPasswords {
+		banned[password] = true
+	}
+	if path == "" {
+		return banned, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		password := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if password != "" {
+			banned[password] = true
+		}
+	}
+	return banned, scanner.Err()
+}
+
+// PasswordScore estimates how hard the password is to guess on zxcvbn's
+// scale: 0 is too guessable, 4 very unguessable. Repeats, sequences, banned
+// words and the user's own details barely count towards it.
+func (policy *PasswordPolicy) PasswordScore(password string, userInputs ...string) int {
+	lower := strings.ToLower(password)
+	if policy.Banned[lower] {
+		return 0
+	}
+
+	var hasLower, hasUpper, hasDigit, hasSymbol, hasOther bool
+	var length float64
+	var previous rune
+	for i, r := range password {
+		switch {
+		case r < unicode.MaxASCII && unicode.IsLower(r):
+			hasLower = true
+		case r < unicode.MaxASCII && unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case r < unicode.MaxASCII:
+			hasSymbol = true
+		default:
+			hasOther = true
+		}
+
+		// aaaa and abcd add next to nothing past their first character
+		if i > 0 && (r == previous || r == previous+1 || r == previous-1) {
+			length += 0.25
+		} else {
+			length++
+		}
+		previous = r
+	}
+
+	// A common password or user detail inside the password is worth about
+	// one character
+	known := append(append([]string{}, userInputs...), commonPasswords...)
+	for _, word := range known {
+		word = strings.ToLower(word)
+		if len(word) >= 4 && strings.Contains(lower, word) {
+			length -= float64(len([]rune(word)) - 1)
+		}
+	}
+	if length < 1 {
+		length = 1
+	}
+
+	charset := 0.0
+	for _, class := range []struct {
+		present bool
+		size    float64
+	}{{hasLower, 26}, {hasUpper, 26}, {hasDigit, 10}, {hasSymbol, 33}, {hasOther, 100}} {
+		if class.present {
+			charset += class.size
+		}
+	}
+
+	// zxcvbn's score thresholds on the number of guesses
+	magnitude := length * math.Log10(charset)
+	switch {
+	case magnitude < 3:
+		return 0
+	case magnitude < 6:
+		return 1
+	case magnitude < 8:
+		return 2
+	case magnitude < 10:
+		return 3
+	}
+	return 4
+}
+
+// CheckPassword lists every rule a new password breaks, along with the
+// breaches it is only warned about. userInputs are the user's own details,
+// such as their email, which make weak passwords.
+func (s *Server) CheckPassword(ctx context.Context, password string, userInputs ...string) (violations []PasswordViolation, warnings []PasswordViolation) {
+	policy := s.PasswordPolicy
+	if len([]rune(password)) < policy.MinLength {
+		violations = append(violations, PasswordViolation{"min_length", fmt.Sprintf("Password must be at least %d characters", policy.MinLength)})
+	}
+	if len(password) > maxPasswordBytes {
+		violations = append(violations, PasswordViolation{"max_length", fmt.Sprintf("Password must be at most %d bytes", maxPasswordBytes)})
+	}
+	if policy.Banned[strings.ToLower(password)] {
+		violations = append(violations, PasswordViolation{"banned", "Password is too common"})
+	}
+	if policy.MinScore > 0 && policy.PasswordScore(password, userInputs...) < policy.MinScore {
+		violations = append(violations, PasswordViolation{"strength", "Password is too easy to guess"})
+	}
+
+	// Not worth asking about a password that is already refused
+	if s.Breaches != nil && len(violations) == 0 {
+		count, err := s.Breaches.Breached(ctx, password)
+		if err != nil {
+			// The lookup is best effort, an outage shouldn't block passwords
+			s.Logger.WarnContext(ctx, "Could not check password against breaches", "error", err)
+		} else if count > 0 {
+			breached := PasswordViolation{"breached", "Password has appeared in a data breach"}
+			if s.BreachAction == BreachCheckReject {
+				violations = append(violations, breached)
+			} else {
+				warnings = append(warnings, breached)
+			}
+		}
+	}
+	return violations, warnings
+}
+
+// passwordInputs are the user's details that shouldn't make up a password.
+func (s *Server) passwordInputs(ctx context.Context, userID string) []string {
+	var email, username, name string
+	err := s.DB.QueryRowContext(ctx, "SELECT COALESCE(email, ''), COALESCE(username, ''), COALESCE(name, '') FROM users WHERE user_id=$1",
+		userID).Scan(&email, &username, &name)
+	if err != nil {
+		return nil
+	}
+	return passwordInputsOf(email, username, name)
+}
+
+// passwordInputsOf splits the user's details into the words worth checking.
+func passwordInputsOf(email string, username string, name string) []string {
+	inputs := strings.Fields(name)
+	if local, _, ok := strings.Cut(email, "@"); ok {
+		inputs = append(inputs, local)
+	}
+	if username != "" {
+		inputs = append(inputs, username)
+	}
+	return inputs
+}
+
+func WeakPasswordError(c echo.Context, violations []PasswordViolation) error {
+	return c.JSON(400, echo.Map{"error": "Password does not meet the policy", "violations": violations})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func passwordResetKey(token string) string {
+	return "reset:" + HashToken(token)
+}
+
+// passwordResetLink points at the page where the user picks a new password,
+// falling back to nothing when no page is configured and the token has to
+// be entered by hand.
+func (s *Server) passwordResetLink(token string) string {
+	if s.PasswordResetURL == "" {
+		return ""
+	}
+	uri, err := url.Parse(s.PasswordResetURL)
+	if err != nil {
+		return ""
+	}
+	query := uri.Query()
+	query.Set("token", token)
+	uri.RawQuery = query.Encode()
+	return uri.String()
+}
+
+// ForgotPasswordHandler emails a single-use password reset token. It answers
+// the same whether or not the account exists, so it can't be used to probe
+// for registered emails.
+func (s *Server) ForgotPasswordHandler(c echo.Context) error {
+	if s.Mailer == nil {
+		return NotFoundError(c)
+	}
+
+	var user User
+
+	err := c.Bind(&user)
+	user.Email = normalizeEmail(user.Email)
+	if err != nil || len(user.Email) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+
+	// Always respond with success so callers can't tell which emails are registered
+	response := echo.Map{"status": "If the email exists, a reset link has been sent"}
+
+	var userID string
+	err = s.DB.QueryRowContext(ctx, "SELECT user_id FROM users WHERE LOWER(email)=$1", user.Email).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.Logger.InfoContext(ctx, "Password reset requested for unknown user")
+		return c.JSON(200, response)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	token := RandomToken()
+	err = s.RDB.Set(ctx, passwordResetKey(token), userID, s.PasswordResetLifetime).Err()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Failed to create reset token", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	body := "Use this code to reset your password. It expires in " + s.PasswordResetLifetime.String() + " and works once.\n\n" + token + "\n"
+	if link := s.passwordResetLink(token); link != "" {
+		body = "Open this link to reset your password. It expires in " + s.PasswordResetLifetime.String() + " and works once.\n\n" + link + "\n"
+	}
+	body += "\nIf you didn't ask to reset your password, you can ignore this email.\n"
+
+	// Sent in the background so the response time doesn't reveal whether
+	// the account exists
+	go func(ctx context.Context) {
+		err := s.Mailer.Send(user.Email, "Reset your password", body)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not send password reset email", "user_id", userID, "error", err)
+		}
+	}(context.WithoutCancel(ctx))
+
+	return c.JSON(200, response)
+}
+
+// ResetPasswordHandler sets a new password with an emailed reset token and
+// signs the user out everywhere, in case someone else was in the account.
+func (s *Server) ResetPasswordHandler(c echo.Context) error {
+	var body struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := c.Bind(&body)
+	if err != nil || len(body.Token) == 0 || len(body.Password) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID, err := s.RDB.Get(ctx, passwordResetKey(body.Token)).Result()
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Reset token not found or expired", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	// Checked before the token is used up, so the user can pick another
+	violations, warnings := s.CheckPassword(ctx, body.Password, s.passwordInputs(ctx, userID)...)
+	if len(violations) > 0 {
+		return WeakPasswordError(c, violations)
+	}
+	reused, err := s.PasswordReused(ctx, userID, body.Password)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not check password history", "error", err)
+		return InvalidRequestError(c)
+	}
+	if reused {
+		return WeakPasswordError(c, []PasswordViolation{passwordReusedViolation})
+	}
+
+	// Taken out in one step so the token can't be used twice
+	_, err = s.RDB.GetDel(ctx, passwordResetKey(body.Token)).Result()
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Reset token already used", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(body.Password), s.BcryptCost)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not hash password", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	err = s.RecordPasswordHistory(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not record password history", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	// Receiving the email proves the user owns the address
+	_, err = s.DB.ExecContext(ctx, "UPDATE users SET password=$1, password_changed_at=now(), verified=true WHERE user_id=$2", string(hashedPassword), userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update password", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventPasswordReset, userID, "")
+
+	err = s.DeleteUserSessions(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not invalidate user sessions", "error", err)
+	}
+	s.ClearSessionCookie(c)
+
+	response := echo.Map{"status": "Password updated"}
+	if len(warnings) > 0 {
+		response["password_warnings"] = warnings
+	}
+	return c.JSON(200, response)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// Permission lets holders of a role perform an action on a resource. Either
+// can be * to match anything, or end in * to match everything starting with
+// the rest, such as documents:* or projects/42/*.
+type Permission struct {
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+}
+
+// permissionMatches tells whether the pattern of a permission covers the
+// value.
+func permissionMatches(pattern string, value string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(value, prefix)
+	}
+	return pattern == value
+}
+
+// UserPermissions lists the permissions of every role the user has,
+// including the ones every user gets through RoleUser.
+func (s *Server) UserPermissions(ctx context.Context, userID string) ([]Permission, error) {
+	rows, err := s.DB.QueryContext(ctx, `SELECT DISTINCT action, resource FROM role_permissions
+		WHERE role=$2 OR role IN (`+userRolesQuery+`) ORDER BY action, resource`, userID, RoleUser)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := []Permission{}
+	for rows.Next() {
+		var permission Permission
+		err = rows.Scan(&permission.Action, &permission.Resource)
+		if err != nil {
+			return nil, err
+		}
+		permissions = append(permissions, permission)
+	}
+	return permissions, rows.Err()
+}
+
+// Authorized tells whether the user may perform the action on the resource.
+// Only active accounts are allowed anything.
+func (s *Server) Authorized(ctx context.Context, userID string, action string, resource string) (bool, error) {
+	status, err := s.AccountStatus(ctx, userID)
+	if err != nil || status != AccountActive {
+		return false, err
+	}
+
+	permissions, err := s.UserPermissions(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, permission := range permissions {
+		if permissionMatches(permission.Action, action) && permissionMatches(permission.Resource, resource) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AuthorizationCheckHandler answers allow or deny for resource servers, which
+// authenticate as confidential OAuth clients an admin marked as resource
+// servers, so decisions are made in one place. Unknown users are denied.
+func (s *Server) AuthorizationCheckHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	client := s.AuthenticateClient(c)
+	if client == nil || client.Public {
+		return OAuthError(c, 401, "invalid_client", "Client authentication failed")
+	}
+	// Anyone can register a client, and the answers tell who is an admin and
+	// whose account is inactive
+	if !client.ResourceServer {
+		return OAuthError(c, 403, "unauthorized_client", "Client is not a resource server")
+	}
+
+	var body struct {
+		User     string `json:"user" form:"user"`
+		Action   string `json:"action" form:"action"`
+		Resource string `json:"resource" form:"resource"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.User) == 0 || len(body.Action) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	// Malformed IDs can't be anyone, like IDs nobody has
+	if _, err := uuid.Parse(body.User); err != nil {
+		return c.JSON(200, echo.Map{"allowed": false})
+	}
+	allowed, err := s.Authorized(ctx, body.User, body.Action, body.Resource)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c.JSON(200, echo.Map{"allowed": false})
+	}
+	if err != nil {
+		// A deny here could be cached, so failures are told apart
+		s.Logger.ErrorContext(ctx, "Could not authorize", "client_id", client.ClientID, "error", err)
+		return OAuthError(c, 500, "server_error", "Could not check authorization")
+	}
+	return c.JSON(200, echo.Map{"allowed": allowed})
+}
+
+// MarkResourceServerHandler lets the client ask for authorization decisions.
+func (s *Server) MarkResourceServerHandler(c echo.Context) error {
+	return s.setResourceServer(c, true)
+}
+
+func (s *Server) UnmarkResourceServerHandler(c echo.Context) error {
+	return s.setResourceServer(c, false)
+}
+
+func (s *Server) setResourceServer(c echo.Context, resourceServer bool) error {
+	ctx := c.Request().Context()
+	clientID := c.Param("id")
+
+	result, err := s.DB.ExecContext(ctx, "UPDATE clients SET resource_server=$2 WHERE client_id::text=$1 AND NOT public", clientID, resourceServer)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update client", "error", err)
+		return InvalidRequestError(c)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return NotFoundError(c)
+	}
+	return c.JSON(200, echo.Map{"client_id": clientID, "resource_server": resourceServer})
+}
+
+// ListPermissionsHandler lists the user's own permissions, so apps can hide
+// what they aren't allowed to do.
+func (s *Server) ListPermissionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	permissions, err := s.UserPermissions(ctx, c.Get("userID").(string))
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read permissions", "error", err)
+		return InvalidRequestError(c)
+	}
+	return c.JSON(200, echo.Map{"permissions": permissions})
+}
+
+func (s *Server) ListRolePermissionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	role := c.Param("role")
+
+	var exists bool
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM roles WHERE name=$1)", role).Scan(&exists)
+	if err != nil || !exists {
+		return NotFoundError(c)
+	}
+
+	rows, err := s.DB.QueryContext(ctx, "SELECT action, resource, created_at FROM role_permissions WHERE role=$1 ORDER BY action, resource", role)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read permissions", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	permissions := []echo.Map{}
+	for rows.Next() {
+		var action, resource string
+		var createdAt time.Time
+		err = rows.Scan(&action, &resource, &createdAt)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read permissions", "error", err)
+			return InvalidRequestError(c)
+		}
+		permissions = append(permissions, echo.Map{"action": action, "resource": resource, "created_at": createdAt})
+	}
+
+	return c.JSON(200, echo.Map{"role": role, "permissions": permissions})
+}
+
+// AddRolePermissionHandler attaches a permission to a role. The resource
+// defaults to * for actions that aren't about a particular resource.
+func (s *Server) AddRolePermissionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	role := c.Param("role")
+
+	var body Permission
+	err := c.Bind(&body)
+	if err != nil || len(body.Action) == 0 {
+		return InvalidRequestError(c)
+	}
+	if body.Resource == "" {
+		body.Resource = "*"
+	}
+
+	_, err = s.DB.ExecContext(ctx, "INSERT INTO role_permissions (role, action, resource) VALUES($1, $2, $3) ON CONFLICT DO NOTHING",
+		role, body.Action, body.Resource)
+	if isForeignKeyViolation(err) {
+		return NotFoundError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not add permission", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(201, echo.Map{"role": role, "action": body.Action, "resource": body.Resource})
+}
+
+// RemoveRolePermissionHandler detaches the permission given by the action
+// and resource query parameters.
+func (s *Server) RemoveRolePermissionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	resource := c.QueryParam("resource")
+	if resource == "" {
+		resource = "*"
+	}
+
+	result, err := s.DB.ExecContext(ctx, "DELETE FROM role_permissions WHERE role=$1 AND action=$2 AND resource=$3",
+		c.Param("role"), c.QueryParam("action"), resource)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not remove permission", "error", err)
+		return InvalidRequestError(c)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return NotFoundError(c)
+	}
+	return c.JSON(200, echo.Map{"status": "Permission removed"})
+}
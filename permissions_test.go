@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestPermissionMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		want    bool
+	}{
+		// * covers everything, including requests that name no resource
+		{"*", "documents:read", true},
+		{"*", "", true},
+
+		// A trailing * covers everything starting with the rest
+		{"documents:*", "documents:read", true},
+		{"documents:*", "documents:", true},
+		{"documents:*", "documents", false},
+		{"documents:*", "projects:read", false},
+		{"documents:*", "", false},
+		{"projects/42/*", "projects/42/files/1", true},
+		{"projects/42/*", "projects/420/files/1", false},
+
+		// A * anywhere else is taken literally
+		{"documents:*:read", "documents:1:read", false},
+		{"*:read", "documents:read", false},
+
+		// Anything else has to match exactly
+		{"documents:read", "documents:read", true},
+		{"documents:read", "documents:readall", false},
+		{"documents:read", "Documents:read", false},
+		{"documents:read", "", false},
+		{"", "", true},
+		{"", "documents:read", false},
+	}
+	for _, test := range tests {
+		if got := permissionMatches(test.pattern, test.value); got != test.want {
+			t.Errorf("permissionMatches(%q, %q) = %v, want %v", test.pattern, test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Personal access tokens are sent as bearer tokens like OAuth access tokens,
+// the prefix tells them apart.
+const personalAccessTokenPrefix = "agp_"
+
+// GetPersonalAccessToken looks up an unexpired token and records its use.
+func (s *Server) GetPersonalAccessToken(ctx context.Context, token string) (*AccessToken, error) {
+	accessToken := AccessToken{}
+	var expiresAt sql.NullTime
+	err := s.DB.QueryRowContext(ctx, `UPDATE personal_access_tokens SET last_used_at=now()
+		WHERE token_hash=$1 AND (expires_at IS NULL OR expires_at > now())
+		RETURNING user_id, scope, expires_at`, HashToken(token)).Scan(&accessToken.UserID, &accessToken.Scope, &expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	accessToken.ExpiresAt = expiresAt.Time
+	return &accessToken, nil
+}
+
+// LookupBearerToken resolves a bearer token, which is either an OAuth access
+// token or a personal access token. Tokens of inactive accounts are refused.
+func (s *Server) LookupBearerToken(ctx context.Context, token string) (*AccessToken, error) {
+	lookup := s.GetAccessToken
+	if strings.HasPrefix(token, personalAccessTokenPrefix) {
+		lookup = s.GetPersonalAccessToken
+	}
+	accessToken, err := lookup(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if !s.TokenOwnerActive(ctx, accessToken.UserID) {
+		return nil, errAccountInactive
+	}
+	return accessToken, nil
+}
+
+func (s *Server) CreatePersonalAccessTokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var body struct {
+		Name      string   `json:"name"`
+		Scopes    []string `json:"scopes"`
+		ExpiresIn int64    `json:"expires_in"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.Name) == 0 || len(body.Scopes) == 0 || body.ExpiresIn < 0 {
+		return InvalidRequestError(c)
+	}
+	for _, scope := range body.Scopes {
+		if !containsString(supportedScopes, scope) {
+			return InvalidRequestError(c)
+		}
+	}
+
+	var expiresAt sql.NullTime
+	if body.ExpiresIn > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(time.Duration(body.ExpiresIn) * time.Second), Valid: true}
+	}
+
+	token := personalAccessTokenPrefix + RandomToken()
+	scope := strings.Join(body.Scopes, " ")
+	var tokenID string
+	var createdAt time.Time
+	err = s.DB.QueryRowContext(ctx, `INSERT INTO personal_access_tokens (user_id, name, token_hash, scope, expires_at)
+		VALUES($1, $2, $3, $4, $5) RETURNING token_id, created_at`,
+		userID, body.Name, HashToken(token), scope, expiresAt).Scan(&tokenID, &createdAt)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create personal access token", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	// The token is only ever shown here, we only keep its hash
+	response := echo.Map{
+		"id":         tokenID,
+		"name":       body.Name,
+		"token":      token,
+		"scope":      scope,
+		"created_at": createdAt,
+	}
+	if expiresAt.Valid {
+		response["expires_at"] = expiresAt.Time
+	}
+	return c.JSON(200, response)
+}
+
+func (s *Server) ListPersonalAccessTokensHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT token_id, name, scope, created_at, last_used_at, expires_at
+		FROM personal_access_tokens WHERE user_id=$1 ORDER BY created_at DESC`, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not list personal access tokens", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	tokens := []echo.Map{}
+	for rows.Next() {
+		var tokenID, name, scope string
+		var createdAt time.Time
+		var lastUsedAt, expiresAt sql.NullTime
+		err = rows.Scan(&tokenID, &name, &scope, &createdAt, &lastUsedAt, &expiresAt)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read personal access token", "error", err)
+			return InvalidRequestError(c)
+		}
+
+		token := echo.Map{
+			"id":         tokenID,
+			"name":       name,
+			"scope":      scope,
+			"created_at": createdAt,
+		}
+		if lastUsedAt.Valid {
+			token["last_used_at"] = lastUsedAt.Time
+		}
+		if expiresAt.Valid {
+			token["expires_at"] = expiresAt.Time
+		}
+		tokens = append(tokens, token)
+	}
+
+	return c.JSON(200, echo.Map{"tokens": tokens})
+}
+
+func (s *Server) RevokePersonalAccessTokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	result, err := s.DB.ExecContext(ctx, "DELETE FROM personal_access_tokens WHERE token_id::text=$1 AND user_id=$2",
+		c.Param("id"), userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not revoke personal access token", "error", err)
+		return InvalidRequestError(c)
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return NotFoundError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Token revoked"})
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxNameLength keeps display names to something a UI can show
+const maxNameLength = 100
+
+var invalidNameMessage = fmt.Sprintf("Must be at most %d characters without control characters", maxNameLength)
+
+// normalizeName trims the display name and reports whether it is short
+// enough and free of control characters.
+func normalizeName(name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > maxNameLength {
+		return name, false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return name, false
+		}
+	}
+	return name, true
+}
+
+// UpdateProfileHandler changes any subset of the editable profile fields,
+// answering with what's wrong with each field that doesn't validate.
+func (s *Server) UpdateProfileHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+	sessionID := c.Get("sessionID").(string)
+
+	// Pointers tell apart fields that were left out from fields set to empty
+	var body struct {
+		Name            *string `json:"name"`
+		Username        *string `json:"username"`
+		Email           *string `json:"email"`
+		Password        *string `json:"password"`
+		CurrentPassword string  `json:"current_password"`
+		// UserMetadata is merged into what is stored, with null removing keys
+		UserMetadata map[string]json.RawMessage `json:"user_metadata"`
+	}
+
+	err := c.Bind(&body)
+	if err != nil || (body.Name == nil && body.Username == nil && body.Email == nil && body.Password == nil && body.UserMetadata == nil) {
+		return InvalidRequestError(c)
+	}
+
+	var sets []string
+	var args []interface{}
+	addField := func(column string, value interface{}) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s=$%d", column, len(args)))
+	}
+
+	fieldErrors := map[string]string{}
+	var passwordWarnings []PasswordViolation
+
+	if body.Name != nil {
+		name, ok := normalizeName(*body.Name)
+		if ok {
+			addField("name", name)
+		} else {
+			fieldErrors["name"] = invalidNameMessage
+		}
+	}
+
+	if body.Username != nil {
+		username, ok := normalizeUsername(*body.Username)
+		switch {
+		case *body.Username == "":
+			// An empty username removes it, leaving email or phone to sign in with
+			addField("username", nil)
+		case !ok:
+			fieldErrors["username"] = usernameRulesMessage
+		case isReservedUsername(username):
+			fieldErrors["username"] = "Already taken"
+		default:
+			addField("username", username)
+		}
+	}
+
+	if body.UserMetadata != nil {
+		assignment, err := metadataAssignment(map[string]map[string]json.RawMessage{UserMetadata: body.UserMetadata}, &args)
+		if err != nil {
+			return InvalidRequestError(c)
+		}
+		sets = append(sets, assignment)
+	}
+
+	// The email only changes once the new address is confirmed
+	var newEmail string
+	if body.Email != nil {
+		if s.Mailer == nil {
+			return NotFoundError(c)
+		}
+		newEmail = normalizeEmail(*body.Email)
+		if len(newEmail) == 0 {
+			fieldErrors["email"] = "Must not be empty"
+		}
+	}
+
+	if len(fieldErrors) > 0 {
+		return ValidationError(c, fieldErrors)
+	}
+
+	if body.Password != nil {
+		if s.PasswordlessOnly {
+			return PasswordsDisabledError(c)
+		}
+		if len(*body.Password) == 0 || len(body.CurrentPassword) == 0 {
+			return InvalidRequestError(c)
+		}
+		var violations []PasswordViolation
+		violations, passwordWarnings = s.CheckPassword(ctx, *body.Password, s.passwordInputs(ctx, userID)...)
+		if len(violations) > 0 {
+			return WeakPasswordError(c, violations)
+		}
+
+		var hashedPassword string
+		err = s.DB.QueryRow("SELECT password FROM users WHERE user_id=$1", userID).Scan(&hashedPassword)
+		if err != nil {
+			s.Logger.InfoContext(ctx, "Could not find user information", "error", err)
+			return UnauthorizedError(c)
+		}
+
+		err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(body.CurrentPassword))
+		if err != nil {
+			s.Logger.InfoContext(ctx, "Invalid current password", "user_id", userID)
+			return UnauthorizedError(c)
+		}
+
+		reused, err := s.PasswordReused(ctx, userID, *body.Password)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not check password history", "error", err)
+			return InvalidRequestError(c)
+		}
+		if reused {
+			return WeakPasswordError(c, []PasswordViolation{passwordReusedViolation})
+		}
+
+		newHashedPassword, err := bcrypt.GenerateFromPassword([]byte(*body.Password), s.BcryptCost)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not hash password", "error", err)
+			return InvalidRequestError(c)
+		}
+		addField("password", string(newHashedPassword))
+		sets = append(sets, "password_changed_at=now()")
+	}
+
+	response := echo.Map{"status": "Profile updated"}
+	if len(passwordWarnings) > 0 {
+		response["password_warnings"] = passwordWarnings
+	}
+	if newEmail != "" {
+		err = s.StartEmailChange(ctx, userID, newEmail)
+		if errors.Is(err, errEmailDomainNotAllowed) {
+			return EmailDomainNotAllowedError(c)
+		}
+		if errors.Is(err, errDisposableEmail) {
+			return DisposableEmailError(c)
+		}
+		if errors.Is(err, errEmailTaken) {
+			s.Logger.InfoContext(ctx, "Email already in use", "user_id", userID)
+			return ConflictError(c)
+		}
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not start email change", "error", err)
+			return InvalidRequestError(c)
+		}
+		response["email_change"] = "Confirmation sent to the new address"
+	}
+
+	if body.Password != nil {
+		err = s.RecordPasswordHistory(ctx, userID)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not record password history", "error", err)
+			return InvalidRequestError(c)
+		}
+	}
+
+	if len(sets) > 0 {
+		args = append(args, userID)
+		query := fmt.Sprintf("UPDATE users SET %s WHERE user_id=$%d", strings.Join(sets, ", "), len(args))
+		_, err = s.DB.Exec(query, args...)
+		if isUniqueViolation(err) {
+			s.Logger.InfoContext(ctx, "Username already in use", "user_id", userID)
+			return ConflictError(c)
+		}
+		if isCheckViolation(err) {
+			return ValidationError(c, map[string]string{UserMetadata: metadataTooLargeMessage})
+		}
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not update user", "error", err)
+			return InvalidRequestError(c)
+		}
+	}
+
+	if body.Password != nil {
+		s.RecordAuthEvent(c, EventPasswordChange, userID, "")
+		err = s.DeleteUserSessionsExcept(ctx, userID, sessionID)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not invalidate user sessions", "error", err)
+		}
+	}
+
+	return c.JSON(200, response)
+}
+
+// ChangePasswordHandler replaces the password once the current one checks
+// out, then signs out every other session in case the old password leaked.
+func (s *Server) ChangePasswordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+	sessionID := c.Get("sessionID").(string)
+
+	var body struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	err := c.Bind(&body)
+	if err != nil || len(body.CurrentPassword) == 0 || len(body.NewPassword) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	violations, warnings := s.CheckPassword(ctx, body.NewPassword, s.passwordInputs(ctx, userID)...)
+	if len(violations) > 0 {
+		return WeakPasswordError(c, violations)
+	}
+
+	var hashedPassword string
+	err = s.DB.QueryRowContext(ctx, "SELECT COALESCE(password, '') FROM users WHERE user_id=$1", userID).Scan(&hashedPassword)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not find user information", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(body.CurrentPassword))
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Invalid current password", "user_id", userID)
+		s.RecordAuthEvent(c, EventLoginFailure, userID, "")
+		return UnauthorizedError(c)
+	}
+
+	reused, err := s.PasswordReused(ctx, userID, body.NewPassword)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not check password history", "error", err)
+		return InvalidRequestError(c)
+	}
+	if reused {
+		return WeakPasswordError(c, []PasswordViolation{passwordReusedViolation})
+	}
+
+	newHashedPassword, err := bcrypt.GenerateFromPassword([]byte(body.NewPassword), s.BcryptCost)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not hash password", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	err = s.RecordPasswordHistory(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not record password history", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	_, err = s.DB.ExecContext(ctx, "UPDATE users SET password=$1, password_changed_at=now() WHERE user_id=$2", string(newHashedPassword), userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update password", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventPasswordChange, userID, "")
+
+	// A new password lifts the hold an expired one put on the session
+	session := c.Get("session").(*Session)
+	if session.PasswordExpired {
+		session.PasswordExpired = false
+		err = s.UpdateSession(c, sessionID, session)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not update session", "error", err)
+		}
+	}
+
+	err = s.DeleteUserSessionsExcept(ctx, userID, sessionID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not invalidate user sessions", "error", err)
+	}
+
+	response := echo.Map{"status": "Password updated"}
+	if len(warnings) > 0 {
+		response["password_warnings"] = warnings
+	}
+	return c.JSON(200, response)
+}
+
+func (s *Server) DeleteAccountHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var body struct {
+		Password string `json:"password"`
+	}
+
+	// Without passwords, the recent sign-in the route requires has to do
+	err := c.Bind(&body)
+	if err != nil || (len(body.Password) == 0 && !s.PasswordlessOnly) {
+		return InvalidRequestError(c)
+	}
+
+	if !s.PasswordlessOnly {
+		var hashedPassword string
+		err = s.DB.QueryRow("SELECT password FROM users WHERE user_id=$1", userID).Scan(&hashedPassword)
+		if err != nil {
+			s.Logger.InfoContext(ctx, "Could not find user information", "error", err)
+			return UnauthorizedError(c)
+		}
+
+		err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(body.Password))
+		if err != nil {
+			s.Logger.InfoContext(ctx, "Invalid password", "user_id", userID)
+			return UnauthorizedError(c)
+		}
+	}
+
+	// Delete the account first so a Redis failure can at worst leave behind
+	// sessions pointing at a user that no longer exists, which expire on
+	// their own.
+	_, err = s.execKeepingAdmin(ctx, "DELETE FROM users WHERE user_id=$1", userID)
+	if errors.Is(err, errLastAdmin) {
+		return LastAdminError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not delete user", "error", err)
+		return c.JSON(500, echo.Map{"error": "Could not delete account"})
+	}
+
+	s.RecordAuthEvent(c, EventAccountDeleted, userID, "")
+	s.DeleteAvatar(ctx, userID)
+
+	err = s.DeleteUserSessions(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not invalidate user sessions", "error", err)
+	}
+	err = s.RevokeUserRefreshTokens(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not revoke refresh tokens", "error", err)
+	}
+
+	s.ClearSessionCookie(c)
+
+	return c.JSON(200, echo.Map{"status": "Account deleted"})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// exportSection is one part of a data export, read with the user ID as $1.
+// Secrets and their hashes are never selected.
+type exportSection struct {
+	Name  string
+	Query string
+}
+
+var exportSections = []exportSection{
+	{"profile", `SELECT user_id, name, email, verified, phone, phone_verified, username, guest, totp_enabled, sms_mfa_enabled, status,
+		created_at, last_login_at, last_seen_at, avatar_updated_at, metadata, disposable_email, delete_after FROM users WHERE user_id=$1`},
+	{"identities", "SELECT provider, provider_user_id, email, created_at FROM identities WHERE user_id=$1 ORDER BY created_at"},
+	{"api_keys", "SELECT key_id, name, key_prefix, created_at, last_used_at, expires_at FROM api_keys WHERE user_id=$1 ORDER BY created_at"},
+	{"personal_access_tokens", `SELECT token_id, name, scope, created_at, last_used_at, expires_at FROM personal_access_tokens
+		WHERE user_id=$1 ORDER BY created_at`},
+	{"roles", "SELECT role, granted_at FROM user_roles WHERE user_id=$1 ORDER BY role"},
+	{"groups", "SELECT name, added_at FROM group_members JOIN groups USING (group_id) WHERE user_id=$1 ORDER BY name"},
+	{"consents", "SELECT document, version, ip, user_agent, accepted_at FROM consents WHERE user_id=$1 ORDER BY accepted_at"},
+	{"known_devices", "SELECT first_seen_at, last_seen_at FROM known_devices WHERE user_id=$1 ORDER BY first_seen_at"},
+	{"push_devices", "SELECT device_id, name, created_at, last_used_at FROM push_devices WHERE user_id=$1 ORDER BY created_at"},
+	{"oauth_clients", "SELECT client_id, name, redirect_uris, allowed_scopes, created_at FROM clients WHERE owner_id=$1 ORDER BY created_at"},
+	{"login_history", "SELECT method, success, email, ip, user_agent, created_at FROM login_events WHERE user_id=$1 ORDER BY created_at"},
+	{"audit_events", "SELECT event_type, email, ip, user_agent, created_at FROM auth_events WHERE user_id=$1 ORDER BY created_at"},
+}
+
+// exportRows reads the rows of a section as JSON objects, which Postgres
+// builds so every column type comes out the same way.
+func (s *Server) exportRows(ctx context.Context, query string, userID string) ([]map[string]interface{}, error) {
+	var data []byte
+	err := s.DB.QueryRowContext(ctx, "SELECT COALESCE(json_agg(row_to_json(t)), '[]') FROM ("+query+") t", userID).Scan(&data)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var rows []map[string]interface{}
+	err = decoder.Decode(&rows)
+	return rows, err
+}
+
+// ExportUserData gathers everything stored about the user, keyed by section.
+func (s *Server) ExportUserData(ctx context.Context, userID string, currentSessionID string) (map[string][]map[string]interface{}, error) {
+	export := map[string][]map[string]interface{}{}
+	for _, section := range exportSections {
+		rows, err := s.exportRows(ctx, section.Query, userID)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", section.Name, err)
+		}
+		export[section.Name] = rows
+	}
+
+	sessions, err := s.describeSessions(ctx, userID, currentSessionID)
+	if err != nil {
+		return nil, fmt.Errorf("sessions: %w", err)
+	}
+	export["sessions"] = []map[string]interface{}{}
+	for _, session := range sessions {
+		export["sessions"] = append(export["sessions"], session)
+	}
+	return export, nil
+}
+
+// csvValue flattens a JSON value into a CSV cell.
+func csvValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case time.Time:
+		return value.Format(time.RFC3339)
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// writeExportCSV writes a section as CSV, with a column per field.
+func writeExportCSV(archive *zip.Writer, name string, rows []map[string]interface{}) error {
+	file, err := archive.Create(name + ".csv")
+	if err != nil {
+		return err
+	}
+
+	columnSet := map[string]bool{}
+	for _, row := range rows {
+		for column := range row {
+			columnSet[column] = true
+		}
+	}
+	columns := []string{}
+	for column := range columnSet {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	writer := csv.NewWriter(file)
+	err = writer.Write(columns)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = csvValue(row[column])
+		}
+		err = writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// ExportProfileHandler hands the user a copy of their data, as JSON or, with
+// format=csv, as a zip of one CSV file per section.
+func (s *Server) ExportProfileHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+	sessionID := c.Get("sessionID").(string)
+
+	format := c.QueryParam("format")
+	if format != "" && format != "json" && format != "csv" {
+		return InvalidRequestError(c)
+	}
+
+	export, err := s.ExportUserData(ctx, userID, sessionID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not export user data", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	s.RecordAuthEvent(c, EventDataExported, userID, "")
+
+	if format != "csv" {
+		c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="export.json"`)
+		return c.JSON(200, export)
+	}
+
+	names := []string{}
+	for name := range export {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+	for _, name := range names {
+		err = writeExportCSV(archive, name, export[name])
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not write data export", "error", err)
+			return InvalidRequestError(c)
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not write data export", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="export.zip"`)
+	return c.Blob(200, "application/zip", buffer.Bytes())
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// Push devices authenticate with a secret carrying this prefix
+const pushDeviceSecretPrefix = "agd_"
+
+const (
+	pushApprovalLifetime = time.Minute * 2
+	// pushLongPollTimeout stays below common proxy idle timeouts
+	pushLongPollTimeout = time.Second * 25
+)
+
+// PushApproval is a sign-in waiting for the user to accept or deny it on
+// one of their registered devices.
+type PushApproval struct {
+	UserID   string `json:"user_id"`
+	Email    string `json:"email"`
+	Remember bool   `json:"remember"`
+	// PollSecretHash ties the result to the browser that asked to sign in
+	PollSecretHash string    `json:"poll_secret_hash"`
+	IP             string    `json:"ip"`
+	UserAgent      string    `json:"user_agent"`
+	CreatedAt      time.Time `json:"created_at"`
+	Status         string    `json:"status"`
+}
+
+func pushApprovalKey(id string) string {
+	return "push_approval:" + HashToken(id)
+}
+
+func pushDecisionKey(id string) string {
+	return "push_decision:" + HashToken(id)
+}
+
+// pushPendingKey is a sorted set of the user's pending approval IDs, scored
+// by when they expire, for devices to pick up.
+func pushPendingKey(userID string) string {
+	return "push_pending:" + userID
+}
+
+// PushNotifier wakes up a device so it can show a pending approval.
+type PushNotifier interface {
+	Notify(ctx context.Context, pushToken string, approvalID string, approval *PushApproval) error
+}
+
+// WebhookPushNotifier hands notifications to a relay that delivers them
+// through APNs or FCM, so those credentials stay out of this service.
+type WebhookPushNotifier struct {
+	URL string
+}
+
+func (w *WebhookPushNotifier) Notify(ctx context.Context, pushToken string, approvalID string, approval *PushApproval) error {
+	body, err := json.Marshal(map[string]string{
+		"push_token":  pushToken,
+		"approval_id": approvalID,
+		"ip":          approval.IP,
+		"user_agent":  approval.UserAgent,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("push relay returned %s", response.Status)
+	}
+	return nil
+}
+
+// PushDeviceMiddleware authenticates the companion app by the device secret
+// it got when it was registered, sent as a Bearer token.
+func (s *Server) PushDeviceMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx := c.Request().Context()
+		secret, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if !ok || !strings.HasPrefix(secret, pushDeviceSecretPrefix) {
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+			return UnauthorizedError(c)
+		}
+
+		var deviceID, userID string
+		err := s.DB.QueryRowContext(ctx, "UPDATE push_devices SET last_used_at=now() WHERE secret_hash=$1 RETURNING device_id, user_id",
+			HashToken(secret)).Scan(&deviceID, &userID)
+		if err != nil {
+			s.Logger.InfoContext(ctx, "Push device not found", "error", err)
+			return UnauthorizedError(c)
+		}
+
+		c.Set("deviceID", deviceID)
+		c.Set("userID", userID)
+		return next(c)
+	}
+}
+
+// RegisterPushDeviceHandler registers the companion app of the signed in
+// user. The device secret is only ever shown here.
+func (s *Server) RegisterPushDeviceHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var body struct {
+		Name      string `json:"name"`
+		PushToken string `json:"push_token"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.Name) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	secret := pushDeviceSecretPrefix + RandomToken()
+	var deviceID string
+	err = s.DB.QueryRowContext(ctx, "INSERT INTO push_devices (user_id, name, push_token, secret_hash) VALUES($1, $2, $3, $4) RETURNING device_id",
+		userID, body.Name, nullString(body.PushToken), HashToken(secret)).Scan(&deviceID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not register push device", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"id": deviceID, "name": body.Name, "device_secret": secret})
+}
+
+func (s *Server) ListPushDevicesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	rows, err := s.DB.QueryContext(ctx, "SELECT device_id, name, created_at, last_used_at FROM push_devices WHERE user_id=$1 ORDER BY created_at",
+		userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not list push devices", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	devices := []echo.Map{}
+	for rows.Next() {
+		var deviceID, name string
+		var createdAt time.Time
+		var lastUsedAt sql.NullTime
+		err = rows.Scan(&deviceID, &name, &createdAt, &lastUsedAt)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read push device", "error", err)
+			return InvalidRequestError(c)
+		}
+		devices = append(devices, echo.Map{
+			"id":           deviceID,
+			"name":         name,
+			"created_at":   createdAt,
+			"last_used_at": lastUsedAt.Time,
+		})
+	}
+
+	return c.JSON(200, echo.Map{"devices": devices})
+}
+
+func (s *Server) DeletePushDeviceHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	result, err := s.DB.ExecContext(ctx, "DELETE FROM push_devices WHERE device_id::text=$1 AND user_id=$2", c.Param("id"), userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not delete push device", "error", err)
+		return InvalidRequestError(c)
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return NotFoundError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Device removed"})
+}
+
+// PushLoginRequestHandler asks the user's devices to approve a sign-in. It
+// answers the same whether or not the account exists or has devices, so it
+// can't be used to probe for registered emails.
+func (s *Server) PushLoginRequestHandler(c echo.Context) error {
+	var body struct {
+		Email    string `json:"email"`
+		Remember bool   `json:"remember"`
+	}
+	err := c.Bind(&body)
+	body.Email = normalizeEmail(body.Email)
+	if err != nil || len(body.Email) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	id := RandomToken()
+	pollSecret := RandomToken()
+
+	c.SetCookie(&http.Cookie{
+		Name:     "push_login",
+		Value:    pollSecret,
+		Path:     "/login/push/",
+		HttpOnly: true,
+		Secure:   s.Cookie.Secure,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Now().Add(pushApprovalLifetime),
+	})
+	response := echo.Map{
+		"id":         id,
+		"expires_in": int(pushApprovalLifetime.Seconds()),
+	}
+
+	// Unknown users still get an approval, which nobody can decide, so
+	// polling it looks the same until it expires
+	var userID string
+	err = s.DB.QueryRowContext(ctx, "SELECT user_id FROM users WHERE LOWER(email)=$1", body.Email).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.Logger.InfoContext(ctx, "Push sign-in requested for unknown user")
+	} else if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	approval := &PushApproval{
+		UserID:         userID,
+		Email:          body.Email,
+		Remember:       body.Remember,
+		PollSecretHash: HashToken(pollSecret),
+		IP:             c.RealIP(),
+		UserAgent:      c.Request().UserAgent(),
+		CreatedAt:      time.Now().UTC(),
+		Status:         DeviceStatusPending,
+	}
+	data, err := json.Marshal(approval)
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+
+	expiresAt := approval.CreatedAt.Add(pushApprovalLifetime)
+	_, err = s.RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, pushApprovalKey(id), data, pushApprovalLifetime)
+		if userID == "" {
+			return nil
+		}
+		pipe.Set(ctx, pushDecisionKey(id), 1, pushApprovalLifetime)
+		pipe.ZAdd(ctx, pushPendingKey(userID), redis.Z{Score: float64(expiresAt.Unix()), Member: id})
+		pipe.ZRemRangeByScore(ctx, pushPendingKey(userID), "-inf", fmt.Sprint(time.Now().Unix()))
+		pipe.Expire(ctx, pushPendingKey(userID), pushApprovalLifetime)
+		return nil
+	})
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store push approval", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	if s.Push != nil && userID != "" {
+		go s.notifyPushDevices(context.WithoutCancel(ctx), id, approval)
+	}
+
+	return c.JSON(200, response)
+}
+
+func (s *Server) notifyPushDevices(ctx context.Context, id string, approval *PushApproval) {
+	rows, err := s.DB.QueryContext(ctx, "SELECT push_token FROM push_devices WHERE user_id=$1 AND push_token IS NOT NULL", approval.UserID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not list push devices", "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pushToken string
+		err = rows.Scan(&pushToken)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read push device", "error", err)
+			return
+		}
+		err = s.Push.Notify(ctx, pushToken, id, approval)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not send push notification", "user_id", approval.UserID, "error", err)
+		}
+	}
+}
+
+func (s *Server) getPushApproval(ctx context.Context, id string) *PushApproval {
+	data, err := s.RDB.Get(ctx, pushApprovalKey(id)).Bytes()
+	if err != nil {
+		return nil
+	}
+
+	var approval PushApproval
+	err = json.Unmarshal(data, &approval)
+	if err != nil {
+		return nil
+	}
+	return &approval
+}
+
+// waitForPushDecision returns the approval once it is decided, or as it is
+// when the timeout runs out first. Nil means it expired or never existed.
+func (s *Server) waitForPushDecision(ctx context.Context, id string, timeout time.Duration) *PushApproval {
+	subscription := s.RDB.Subscribe(ctx, pushApprovalKey(id))
+	defer subscription.Close()
+
+	// Read after subscribing, so a decision made in between isn't missed
+	approval := s.getPushApproval(ctx, id)
+	if approval == nil || approval.Status != DeviceStatusPending {
+		return approval
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-subscription.Channel():
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return s.getPushApproval(ctx, id)
+}
+
+// PushLoginPollHandler long-polls for the decision on a push sign-in. Once
+// approved, it signs the browser in.
+func (s *Server) PushLoginPollHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	cookie, err := c.Cookie("push_login")
+	if err != nil {
+		return UnauthorizedError(c)
+	}
+	if approval := s.getPushApproval(ctx, id); approval != nil && HashToken(cookie.Value) != approval.PollSecretHash {
+		return UnauthorizedError(c)
+	}
+
+	approval := s.waitForPushDecision(ctx, id, pushLongPollTimeout)
+	if approval == nil {
+		return NotFoundError(c)
+	}
+	if HashToken(cookie.Value) != approval.PollSecretHash {
+		return UnauthorizedError(c)
+	}
+
+	switch approval.Status {
+	case DeviceStatusPending:
+		return c.JSON(202, echo.Map{"status": DeviceStatusPending})
+	case DeviceStatusDenied:
+		s.RDB.Del(ctx, pushApprovalKey(id))
+		s.RecordLogin(c, false, "push", approval.UserID, approval.Email)
+		return c.JSON(403, echo.Map{"error": "Sign-in was denied"})
+	}
+
+	// Deleting the approval makes it single-use even under concurrent polls
+	deleted, err := s.RDB.Del(ctx, pushApprovalKey(id)).Result()
+	if err != nil || deleted == 0 {
+		return NotFoundError(c)
+	}
+
+	return s.FinishSignIn(c, approval.UserID, approval.Email, approval.Remember, "push")
+}
+
+// PushLoginEventsHandler streams the status of a push sign-in as server-sent
+// events. Once it is decided the browser fetches the result from
+// PushLoginPollHandler, which can set the session cookies.
+func (s *Server) PushLoginEventsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+
+	cookie, err := c.Cookie("push_login")
+	if err != nil {
+		return UnauthorizedError(c)
+	}
+	approval := s.getPushApproval(ctx, id)
+	if approval != nil && HashToken(cookie.Value) != approval.PollSecretHash {
+		return UnauthorizedError(c)
+	}
+
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set("Cache-Control", "no-store")
+	response.WriteHeader(http.StatusOK)
+
+	deadline := time.Now().Add(pushApprovalLifetime)
+	for {
+		approval = s.waitForPushDecision(ctx, id, pushLongPollTimeout)
+		status := "expired"
+		if approval != nil {
+			status = approval.Status
+		}
+
+		_, err = fmt.Fprintf(response, "event: status\ndata: %s\n\n", status)
+		if err != nil {
+			return nil
+		}
+		response.Flush()
+
+		if status != DeviceStatusPending || ctx.Err() != nil || time.Now().After(deadline) {
+			return nil
+		}
+	}
+}
+
+// ListPushApprovalsHandler lets the companion app fetch the sign-ins waiting
+// for its user, for when a notification didn't arrive.
+func (s *Server) ListPushApprovalsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	ids, err := s.RDB.ZRangeByScore(ctx, pushPendingKey(userID), &redis.ZRangeBy{
+		Min: fmt.Sprint(time.Now().Unix()),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not list push approvals", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	approvals := []echo.Map{}
+	for _, id := range ids {
+		approval := s.getPushApproval(ctx, id)
+		if approval == nil || approval.Status != DeviceStatusPending || approval.UserID != userID {
+			continue
+		}
+		approvals = append(approvals, echo.Map{
+			"id":         id,
+			"ip":         approval.IP,
+			"user_agent": approval.UserAgent,
+			"created_at": approval.CreatedAt,
+		})
+	}
+
+	return c.JSON(200, echo.Map{"approvals": approvals})
+}
+
+func (s *Server) ApprovePushLoginHandler(c echo.Context) error {
+	return s.decidePushLogin(c, DeviceStatusApproved)
+}
+
+func (s *Server) DenyPushLoginHandler(c echo.Context) error {
+	return s.decidePushLogin(c, DeviceStatusDenied)
+}
+
+func (s *Server) decidePushLogin(c echo.Context, status string) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	userID := c.Get("userID").(string)
+
+	// The approval only gets one decision, so it can't be flipped later
+	approval := s.getPushApproval(ctx, id)
+	if approval == nil || approval.UserID != userID || approval.Status != DeviceStatusPending ||
+		s.RDB.Del(ctx, pushDecisionKey(id)).Val() == 0 {
+		return NotFoundError(c)
+	}
+
+	approval.Status = status
+	data, err := json.Marshal(approval)
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+	err = s.RDB.Set(ctx, pushApprovalKey(id), data, redis.KeepTTL).Err()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store push decision", "error", err)
+		return InvalidRequestError(c)
+	}
+	s.RDB.ZRem(ctx, pushPendingKey(userID), id)
+	s.RDB.Publish(ctx, pushApprovalKey(id), status)
+
+	return c.JSON(200, echo.Map{"status": status})
+}
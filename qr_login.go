@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	qrLoginLifetime     = time.Minute * 2
+	qrLoginPollInterval = time.Second * 2
+)
+
+// QRLogin is a sign-in started on one device, typically a desktop, and
+// approved from a phone where the user is already signed in.
+type QRLogin struct {
+	// PollSecretHash ties the polling to the browser that showed the code,
+	// so someone who only sees the QR code can't collect the session
+	PollSecretHash string    `json:"poll_secret_hash"`
+	IP             string    `json:"ip"`
+	UserAgent      string    `json:"user_agent"`
+	CreatedAt      time.Time `json:"created_at"`
+	Status         string    `json:"status"`
+	UserID         string    `json:"user_id,omitempty"`
+}
+
+func qrLoginKey(id string) string {
+	return "qr_login:" + HashToken(id)
+}
+
+func qrDecisionKey(id string) string {
+	return "qr_decision:" + HashToken(id)
+}
+
+func (s *Server) getQRLogin(c echo.Context, id string) *QRLogin {
+	data, err := s.RDB.Get(c.Request().Context(), qrLoginKey(id)).Bytes()
+	if err != nil {
+		return nil
+	}
+
+	var login QRLogin
+	err = json.Unmarshal(data, &login)
+	if err != nil {
+		return nil
+	}
+	return &login
+}
+
+// QRLoginStartHandler starts a sign-in for the desktop to show as a QR code.
+func (s *Server) QRLoginStartHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := RandomToken()
+	pollSecret := RandomToken()
+	login := QRLogin{
+		PollSecretHash: HashToken(pollSecret),
+		IP:             c.RealIP(),
+		UserAgent:      c.Request().UserAgent(),
+		CreatedAt:      time.Now().UTC(),
+		Status:         DeviceStatusPending,
+	}
+	data, err := json.Marshal(login)
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+
+	_, err = s.RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, qrLoginKey(id), data, qrLoginLifetime)
+		pipe.Set(ctx, qrDecisionKey(id), 1, qrLoginLifetime)
+		return nil
+	})
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store QR login", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	c.SetCookie(&http.Cookie{
+		Name:     "qr_login",
+		Value:    pollSecret,
+		Path:     "/qr/",
+		HttpOnly: true,
+		Secure:   s.Cookie.Secure,
+		SameSite: http.SameSiteStrictMode,
+		Expires:  time.Now().Add(qrLoginLifetime),
+	})
+
+	return c.JSON(200, echo.Map{
+		"id":         id,
+		"qr_content": s.IssuerURL + "/qr/session/" + id,
+		"expires_in": int(qrLoginLifetime.Seconds()),
+		"interval":   int(qrLoginPollInterval.Seconds()),
+	})
+}
+
+// QRLoginPollHandler is polled by the desktop until the phone decides. Once
+// approved, the first poll signs the desktop in.
+func (s *Server) QRLoginPollHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	login := s.getQRLogin(c, id)
+	if login == nil {
+		return NotFoundError(c)
+	}
+
+	cookie, err := c.Cookie("qr_login")
+	if err != nil || HashToken(cookie.Value) != login.PollSecretHash {
+		return UnauthorizedError(c)
+	}
+
+	switch login.Status {
+	case DeviceStatusPending:
+		return c.JSON(202, echo.Map{"status": DeviceStatusPending})
+	case DeviceStatusDenied:
+		s.RDB.Del(ctx, qrLoginKey(id))
+		return c.JSON(403, echo.Map{"error": "Sign-in was denied"})
+	}
+
+	// Deleting the login makes it single-use even under concurrent polls
+	deleted, err := s.RDB.Del(ctx, qrLoginKey(id)).Result()
+	if err != nil || deleted == 0 {
+		return NotFoundError(c)
+	}
+
+	var email string
+	err = s.DB.QueryRowContext(ctx, "SELECT COALESCE(email, '') FROM users WHERE user_id=$1", login.UserID).Scan(&email)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "QR login user no longer exists", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	return s.StartUserSession(c, login.UserID, email, false, "qr")
+}
+
+// QRLoginDetailsHandler tells the phone where the sign-in comes from, so the
+// user can check it is their own desktop before approving.
+func (s *Server) QRLoginDetailsHandler(c echo.Context) error {
+	login := s.getQRLogin(c, c.Param("id"))
+	if login == nil || login.Status != DeviceStatusPending {
+		return NotFoundError(c)
+	}
+
+	return c.JSON(200, echo.Map{
+		"ip":         login.IP,
+		"user_agent": login.UserAgent,
+		"created_at": login.CreatedAt,
+	})
+}
+
+func (s *Server) QRLoginApproveHandler(c echo.Context) error {
+	return s.decideQRLogin(c, DeviceStatusApproved)
+}
+
+func (s *Server) QRLoginDenyHandler(c echo.Context) error {
+	return s.decideQRLogin(c, DeviceStatusDenied)
+}
+
+func (s *Server) decideQRLogin(c echo.Context, status string) error {
+	ctx := c.Request().Context()
+	id := c.Param("id")
+	userID := c.Get("userID").(string)
+
+	// The login only gets one decision, so it can't be flipped later
+	login := s.getQRLogin(c, id)
+	if login == nil || login.Status != DeviceStatusPending || s.RDB.Del(ctx, qrDecisionKey(id)).Val() == 0 {
+		return NotFoundError(c)
+	}
+
+	login.Status = status
+	if status == DeviceStatusApproved {
+		login.UserID = userID
+	}
+	data, err := json.Marshal(login)
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+	err = s.RDB.Set(ctx, qrLoginKey(id), data, redis.KeepTTL).Err()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store QR login decision", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": status})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func ReauthenticationRequiredError(c echo.Context) error {
+	return c.JSON(403, echo.Map{"error": "Reauthentication required"})
+}
+
+func SudoRequiredError(c echo.Context) error {
+	return c.JSON(403, echo.Map{"error": "Sudo mode required", "sudo_required": true})
+}
+
+// RequireRecentAuth lets a request through only when the user proved who
+// they are within maxAge, so a session left open somewhere can't be used
+// for sensitive changes. Remembered sessions are no exception, however long
+// they last. It has to run after SessionMiddleware.
+func (s *Server) RequireRecentAuth(maxAge time.Duration) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			session := c.Get("session").(*Session)
+			if time.Since(session.LastAuthenticated()) > maxAge {
+				return ReauthenticationRequiredError(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+// RequireSudo guards destructive endpoints by requiring sudo mode, which
+// lasts SudoLifetime from when the user signed in or last went through
+// ReauthenticateHandler. It is meant to be much shorter than the window of
+// RequireRecentAuth. It has to run after SessionMiddleware.
+func (s *Server) RequireSudo(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session := c.Get("session").(*Session)
+		if !time.Now().Before(session.SudoUntil) {
+			return SudoRequiredError(c)
+		}
+		return next(c)
+	}
+}
+
+// ReauthenticateHandler renews the last-auth time of the current session
+// after the user enters their password or a TOTP code again, and puts the
+// session in sudo mode for SudoLifetime.
+func (s *Server) ReauthenticateHandler(c echo.Context) error {
+	var body struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+	err := c.Bind(&body)
+	if err != nil || (len(body.Password) == 0 && len(body.Code) == 0) {
+		return InvalidRequestError(c)
+	}
+	if len(body.Password) > 0 && s.PasswordlessOnly {
+		return PasswordsDisabledError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+	sessionID := c.Get("sessionID").(string)
+	session := c.Get("session").(*Session)
+
+	// Failures are counted per user, as the session already names them
+	if lockout := s.LoginLockout(ctx, userID); lockout > 0 {
+		return LoginLockedError(c, lockout)
+	}
+	s.DelayLogin(c, userID)
+
+	if !s.checkReauthentication(ctx, userID, body.Password, body.Code) {
+		s.Logger.InfoContext(ctx, "Reauthentication failed", "user_id", userID)
+		s.RecordLoginFailure(ctx, userID)
+		s.RecordAuthEvent(c, EventLoginFailure, userID, "")
+		return UnauthorizedError(c)
+	}
+	s.ClearLoginFailures(ctx, userID)
+
+	session.AuthenticatedAt = time.Now().UTC()
+	session.SudoUntil = session.AuthenticatedAt.Add(s.SudoLifetime)
+	err = s.UpdateSession(c, sessionID, session)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update session", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{
+		"status":           "Reauthenticated",
+		"authenticated_at": session.AuthenticatedAt,
+		"sudo_until":       session.SudoUntil,
+	})
+}
+
+func (s *Server) checkReauthentication(ctx context.Context, userID string, password string, code string) bool {
+	var hashedPassword, secret string
+	var totpEnabled bool
+	err := s.DB.QueryRowContext(ctx, "SELECT COALESCE(password, ''), COALESCE(totp_secret, ''), totp_enabled FROM users WHERE user_id=$1",
+		userID).Scan(&hashedPassword, &secret, &totpEnabled)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not find user information", "error", err)
+		return false
+	}
+
+	if len(password) > 0 {
+		return len(hashedPassword) > 0 && bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) == nil
+	}
+	return totpEnabled && s.VerifyTOTP(ctx, userID, secret, code)
+}
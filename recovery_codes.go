@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const recoveryCodeCount = 10
+
+// NewRecoveryCode returns a code like "k3jx7-q2mzp", 50 random bits in a
+// form that is easy to write down.
+func NewRecoveryCode() string {
+	b := make([]byte, 10)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+	return code[:5] + "-" + code[5:]
+}
+
+// normalizeRecoveryCode accepts the code however it was typed back in.
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// GenerateRecoveryCodes replaces the user's recovery codes with a new set.
+// Only their hashes are stored, the codes are shown to the user once.
+func (s *Server) GenerateRecoveryCodes(ctx context.Context, userID string) ([]string, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id=$1", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = NewRecoveryCode()
+		_, err = tx.ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES($1, $2)",
+			userID, HashToken(normalizeRecoveryCode(codes[i])))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return codes, tx.Commit()
+}
+
+// EnsureRecoveryCodes gives the user a set of codes when they turn on a
+// second factor, unless they still have unused ones from an earlier one.
+// The new codes are returned, or nil when the old ones were kept.
+func (s *Server) EnsureRecoveryCodes(ctx context.Context, userID string) ([]string, error) {
+	var unused int
+	err := s.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM recovery_codes WHERE user_id=$1 AND used_at IS NULL",
+		userID).Scan(&unused)
+	if err != nil || unused > 0 {
+		return nil, err
+	}
+	return s.GenerateRecoveryCodes(ctx, userID)
+}
+
+// mfaEnabledResponse confirms a second factor was turned on, along with the
+// recovery codes when this is the user's first one.
+func (s *Server) mfaEnabledResponse(c echo.Context, userID string, status string) error {
+	ctx := c.Request().Context()
+	response := echo.Map{"status": status}
+
+	codes, err := s.EnsureRecoveryCodes(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not generate recovery codes", "error", err)
+	}
+	if codes != nil {
+		response["recovery_codes"] = codes
+	}
+	return c.JSON(200, response)
+}
+
+// DropUnneededRecoveryCodes deletes the codes once no second factor is left
+// for them to stand in for.
+func (s *Server) DropUnneededRecoveryCodes(ctx context.Context, userID string) {
+	_, err := s.DB.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id=$1 AND NOT EXISTS
+		(SELECT 1 FROM users WHERE user_id=$1 AND (totp_enabled OR sms_mfa_enabled))`, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not delete recovery codes", "error", err)
+	}
+}
+
+// RegenerateRecoveryCodesHandler issues a fresh set, making the old ones useless.
+func (s *Server) RegenerateRecoveryCodesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	methods, err := s.MFAMethods(ctx, userID, "")
+	if err != nil || len(methods) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	codes, err := s.GenerateRecoveryCodes(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not generate recovery codes", "error", err)
+		return InvalidRequestError(c)
+	}
+	return c.JSON(200, echo.Map{"recovery_codes": codes})
+}
+
+// RecoveryCodeLoginHandler completes a sign-in with a recovery code when the
+// user's second factor is unavailable. Each code works once.
+func (s *Server) RecoveryCodeLoginHandler(c echo.Context) error {
+	var body struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.MFAToken) == 0 || len(body.Code) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	return s.CompleteMFAChallenge(c, body.MFAToken, func(ctx context.Context, challenge mfaChallenge) bool {
+		result, err := s.DB.ExecContext(ctx, "UPDATE recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL",
+			challenge.UserID, HashToken(normalizeRecoveryCode(body.Code)))
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not use recovery code", "error", err)
+			return false
+		}
+		if used, _ := result.RowsAffected(); used != 1 {
+			return false
+		}
+		s.RecordAuthEvent(c, EventRecoveryCodeUsed, challenge.UserID, challenge.Email)
+		return true
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import "github.com/redis/go-redis/v9"
+
+const (
+	RedisModeSingle   = "single"
+	RedisModeSentinel = "sentinel"
+	RedisModeCluster  = "cluster"
+)
+
+// NewRedisClient connects to Redis the way the deployment runs it. With
+// Sentinel the client follows the master through failovers, and with a
+// cluster it routes every key to the node owning its slot.
+func NewRedisClient(config *Config) redis.UniversalClient {
+	switch config.RedisMode {
+	case RedisModeSentinel:
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       config.RedisSentinelMaster,
+			SentinelAddrs:    config.RedisAddrs,
+			SentinelPassword: config.RedisSentinelPassword,
+			Password:         config.RedisPassword,
+		})
+	case RedisModeCluster:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:    config.RedisAddrs,
+			Password: config.RedisPassword,
+		})
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:     config.RedisAddrs[0],
+		Password: config.RedisPassword,
+		DB:       0,
+	})
+}
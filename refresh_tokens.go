@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used")
+)
+
+// RefreshToken is a single-use credential. Each use rotates it into a new
+// token of the same family, and presenting an already used token revokes
+// the whole family since it means one of them leaked.
+type RefreshToken struct {
+	FamilyID string `json:"family_id"`
+	UserID   string `json:"user_id"`
+	// ClientID is set for tokens issued to OAuth clients, SessionID for
+	// tokens issued at sign-in.
+	ClientID  string `json:"client_id,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+}
+
+func refreshTokenKey(tokenHash string) string {
+	return "refresh_token:" + tokenHash
+}
+
+func refreshTokenUsedKey(tokenHash string) string {
+	return "refresh_used:" + tokenHash
+}
+
+func refreshFamilyKey(familyID string) string {
+	return "refresh_family:" + familyID
+}
+
+// userRefreshFamiliesKey names the set of the user's refresh token families,
+// so they can all be revoked when the account goes away.
+func userRefreshFamiliesKey(userID string) string {
+	return "user_refresh_families:" + userID
+}
+
+// IssueRefreshToken stores a new refresh token, starting a new family unless
+// the token already belongs to one.
+func (s *Server) IssueRefreshToken(ctx context.Context, refreshToken RefreshToken) (string, error) {
+	if refreshToken.FamilyID == "" {
+		refreshToken.FamilyID = uuid.New().String()
+	}
+
+	data, err := json.Marshal(refreshToken)
+	if err != nil {
+		return "", err
+	}
+
+	token := RandomToken()
+	_, err = s.RDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, refreshTokenKey(HashToken(token)), data, s.RefreshTokenLifetime)
+		pipe.Set(ctx, refreshFamilyKey(refreshToken.FamilyID), refreshToken.UserID, s.RefreshTokenLifetime)
+		pipe.SAdd(ctx, userRefreshFamiliesKey(refreshToken.UserID), refreshToken.FamilyID)
+		pipe.Expire(ctx, userRefreshFamiliesKey(refreshToken.UserID), s.RefreshTokenLifetime)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RotateRefreshToken consumes the token and returns its details together
+// with its replacement.
+func (s *Server) RotateRefreshToken(ctx context.Context, token string) (*RefreshToken, string, error) {
+	tokenHash := HashToken(token)
+	data, err := s.RDB.Get(ctx, refreshTokenKey(tokenHash)).Bytes()
+	if err != nil {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+
+	var refreshToken RefreshToken
+	err = json.Unmarshal(data, &refreshToken)
+	if err != nil {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+
+	exists, err := s.RDB.Exists(ctx, refreshFamilyKey(refreshToken.FamilyID)).Result()
+	if err != nil || exists == 0 {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+
+	// The account may have been suspended since, its families end here
+	if !s.TokenOwnerActive(ctx, refreshToken.UserID) {
+		s.RDB.Del(ctx, refreshFamilyKey(refreshToken.FamilyID))
+		return nil, "", ErrRefreshTokenInvalid
+	}
+
+	// The used marker is kept as long as the token itself, so a replay is
+	// still detected later on. SetNX makes concurrent uses race safely.
+	first, err := s.RDB.SetNX(ctx, refreshTokenUsedKey(tokenHash), 1, s.RefreshTokenLifetime).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	if !first {
+		s.RDB.Del(ctx, refreshFamilyKey(refreshToken.FamilyID))
+		return nil, "", ErrRefreshTokenReused
+	}
+
+	newToken, err := s.IssueRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return nil, "", err
+	}
+	return &refreshToken, newToken, nil
+}
+
+// RevokeUserRefreshTokens ends every refresh token family of the user, which
+// also stops the access tokens issued from them.
+func (s *Server) RevokeUserRefreshTokens(ctx context.Context, userID string) error {
+	key := userRefreshFamiliesKey(userID)
+	familyIDs, err := s.RDB.SMembers(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	// One key per command, they can live on different cluster nodes
+	_, err = s.RDB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, familyID := range familyIDs {
+			pipe.Del(ctx, refreshFamilyKey(familyID))
+		}
+		pipe.Del(ctx, key)
+		return nil
+	})
+	return err
+}
+
+// RefreshTokenHandler trades a sign-in refresh token for a new JWT, as long as
+// the session it was issued with is still active.
+func (s *Server) RefreshTokenHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	c.Response().Header().Set("Cache-Control", "no-store")
+
+	if s.JWTAlgorithm == "" {
+		return NotFoundError(c)
+	}
+
+	var body struct {
+		RefreshToken string `json:"refresh_token" form:"refresh_token"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.RefreshToken) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	refreshToken, newToken, err := s.RotateRefreshToken(ctx, body.RefreshToken)
+	if err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			s.Logger.WarnContext(ctx, "Refresh token reuse detected, revoking token family")
+		} else {
+			s.Logger.InfoContext(ctx, "Could not rotate refresh token", "error", err)
+		}
+		return UnauthorizedError(c)
+	}
+
+	if refreshToken.SessionID == "" || s.VerifySessionAndUserID(ctx, refreshToken.SessionID, refreshToken.UserID) == nil {
+		s.RDB.Del(ctx, refreshFamilyKey(refreshToken.FamilyID))
+		return UnauthorizedError(c)
+	}
+
+	accessToken, err := s.IssueSessionJWT(ctx, refreshToken.UserID, refreshToken.SessionID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Failed to issue JWT", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	return c.JSON(200, echo.Map{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(s.AccessTokenLifetime.Seconds()),
+		"refresh_token": newToken,
+	})
+}
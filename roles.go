@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// Every user has RoleUser without it being granted, which makes it the place
+// for permissions everyone gets. Other roles are granted through user_roles,
+// and RoleAdmin is built in.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+var rolePattern = regexp.MustCompile(`^[a-z][a-z0-9_.:-]{0,63}$`)
+
+var errUnknownRole = errors.New("role does not exist")
+
+var errLastAdmin = errors.New("nobody would be left with the admin role")
+
+// LastAdminError refuses a change that would leave nobody able to
+// administer the server.
+func LastAdminError(c echo.Context) error {
+	return c.JSON(409, echo.Map{"error": "Nobody would be left with the admin role"})
+}
+
+// userRolesQuery selects the roles of the user given as $1, whether granted
+// to them or to one of their groups.
+const userRolesQuery = `SELECT role FROM user_roles WHERE user_id=$1
+	UNION SELECT role FROM group_roles JOIN group_members USING (group_id) WHERE user_id=$1`
+
+// UserRoles lists the roles of the user, sorted.
+func (s *Server) UserRoles(ctx context.Context, userID string) ([]string, error) {
+	roles := []string{}
+	err := s.DB.QueryRowContext(ctx, "SELECT ARRAY(SELECT role FROM ("+userRolesQuery+") roles ORDER BY role)", userID).Scan(pq.Array(&roles))
+	return roles, err
+}
+
+// HasRole tells whether the user has any of the roles.
+func (s *Server) HasRole(ctx context.Context, userID string, roles ...string) (bool, error) {
+	for _, role := range roles {
+		if role == RoleUser {
+			return true, nil
+		}
+	}
+	var granted bool
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM ("+userRolesQuery+") roles WHERE role=ANY($2))", userID, pq.Array(roles)).Scan(&granted)
+	return granted, err
+}
+
+// RequireRole lets through users with any of the roles. It goes after
+// SessionMiddleware, and reads the roles from the database so revoking one
+// takes effect right away.
+func (s *Server) RequireRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ctx := c.Request().Context()
+			granted, err := s.HasRole(ctx, c.Get("userID").(string), roles...)
+			if err != nil {
+				s.Logger.ErrorContext(ctx, "Could not look up roles", "error", err)
+				return ForbiddenError(c)
+			}
+			if !granted {
+				return ForbiddenError(c)
+			}
+			return next(c)
+		}
+	}
+}
+
+// adminsQuery tells whether any active account has the role in $1, directly
+// or through a group. Suspended admins can't sign in, so they don't count.
+const adminsQuery = `SELECT EXISTS(SELECT 1 FROM user_roles JOIN users USING (user_id) WHERE role=$1 AND status=$2
+	UNION ALL SELECT 1 FROM group_roles JOIN group_members USING (group_id) JOIN users USING (user_id) WHERE role=$1 AND status=$2)`
+
+// execKeepingAdmin runs a statement that could take RoleAdmin away from
+// users, returning how many rows it changed. It is rolled back with
+// errLastAdmin when it would leave nobody with the role. These statements
+// take turns, so two admins can't remove each other at the same time.
+func (s *Server) execKeepingAdmin(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext('admins'))")
+	if err != nil {
+		return 0, err
+	}
+
+	var hadAdmin bool
+	err = tx.QueryRowContext(ctx, adminsQuery, RoleAdmin, AccountActive).Scan(&hadAdmin)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	var hasAdmin bool
+	err = tx.QueryRowContext(ctx, adminsQuery, RoleAdmin, AccountActive).Scan(&hasAdmin)
+	if err != nil {
+		return 0, err
+	}
+	if hadAdmin && !hasAdmin {
+		return 0, errLastAdmin
+	}
+	return rows, tx.Commit()
+}
+
+// GrantAdminByEmail gives RoleAdmin to the user with the email, which is how
+// the first admin is made.
+func (s *Server) GrantAdminByEmail(ctx context.Context, email string) error {
+	result, err := s.DB.ExecContext(ctx, `INSERT INTO user_roles (user_id, role)
+		SELECT user_id, $2 FROM users WHERE LOWER(email)=LOWER($1) ON CONFLICT DO NOTHING`, email, RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		var exists bool
+		err = s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE LOWER(email)=LOWER($1))", email).Scan(&exists)
+		if err == nil && !exists {
+			return sql.ErrNoRows
+		}
+		return err
+	}
+	return nil
+}
+
+// grantRoles grants roles inside a transaction, failing with errUnknownRole
+// when one isn't defined.
+func grantRoles(ctx context.Context, tx *sql.Tx, userID string, roles []string, grantedBy string) error {
+	_, err := tx.ExecContext(ctx, `INSERT INTO user_roles (user_id, role, granted_by) SELECT $1, role, $3 FROM unnest($2::text[]) AS role
+		WHERE role<>$4 ON CONFLICT DO NOTHING`, userID, pq.Array(roles), nullString(grantedBy), RoleUser)
+	if isForeignKeyViolation(err) {
+		return errUnknownRole
+	}
+	return err
+}
+
+func (s *Server) ListRolesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	rows, err := s.DB.QueryContext(ctx, `SELECT name, description, created_at, (SELECT count(*) FROM user_roles WHERE role=name)
+		FROM roles ORDER BY name`)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read roles", "error", err)
+		return InvalidRequestError(c)
+	}
+	defer rows.Close()
+
+	roles := []echo.Map{}
+	for rows.Next() {
+		var name, description string
+		var createdAt time.Time
+		var members int
+		err = rows.Scan(&name, &description, &createdAt, &members)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read roles", "error", err)
+			return InvalidRequestError(c)
+		}
+		roles = append(roles, echo.Map{"name": name, "description": description, "created_at": createdAt, "members": members})
+	}
+
+	return c.JSON(200, echo.Map{"roles": roles})
+}
+
+func (s *Server) CreateRoleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	var body struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	err := c.Bind(&body)
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+	if !rolePattern.MatchString(body.Name) {
+		return ValidationError(c, map[string]string{"name": "Must be up to 64 lowercase letters, digits, dots, colons, dashes or underscores"})
+	}
+
+	_, err = s.DB.ExecContext(ctx, "INSERT INTO roles (name, description) VALUES($1, $2)", body.Name, body.Description)
+	if isUniqueViolation(err) {
+		return ConflictError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create role", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(201, echo.Map{"name": body.Name, "description": body.Description})
+}
+
+// DeleteRoleHandler deletes a role, taking it from everyone who had it. The
+// built in roles can't be deleted.
+func (s *Server) DeleteRoleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	role := c.Param("role")
+	if role == RoleAdmin || role == RoleUser {
+		return ForbiddenError(c)
+	}
+
+	result, err := s.DB.ExecContext(ctx, "DELETE FROM roles WHERE name=$1", role)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not delete role", "error", err)
+		return InvalidRequestError(c)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return NotFoundError(c)
+	}
+	return c.JSON(200, echo.Map{"status": "Role deleted"})
+}
+
+func (s *Server) ListUserRolesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+
+	var exists bool
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE user_id=$1)", userID).Scan(&exists)
+	if err != nil || !exists {
+		return NotFoundError(c)
+	}
+
+	roles, err := s.UserRoles(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read roles", "error", err)
+		return InvalidRequestError(c)
+	}
+	return c.JSON(200, echo.Map{"user_id": userID, "roles": roles})
+}
+
+func (s *Server) GrantRoleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	adminID := c.Get("userID").(string)
+	userID := c.Param("id")
+	role := c.Param("role")
+	if role == RoleUser {
+		return InvalidRequestError(c)
+	}
+
+	var exists bool
+	err := s.DB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM users WHERE user_id=$1)", userID).Scan(&exists)
+	if err != nil || !exists {
+		return NotFoundError(c)
+	}
+
+	result, err := s.DB.ExecContext(ctx, "INSERT INTO user_roles (user_id, role, granted_by) VALUES($1, $2, $3) ON CONFLICT DO NOTHING",
+		userID, role, adminID)
+	if isForeignKeyViolation(err) {
+		return NotFoundError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not grant role", "error", err)
+		return InvalidRequestError(c)
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		s.RecordAuthEvent(c, EventRoleGranted, userID, "")
+	}
+
+	roles, err := s.UserRoles(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read roles", "error", err)
+		return InvalidRequestError(c)
+	}
+	return c.JSON(200, echo.Map{"user_id": userID, "roles": roles})
+}
+
+// RevokeRoleHandler takes a role from the user, as long as someone is left
+// with RoleAdmin so nobody gets locked out by accident.
+func (s *Server) RevokeRoleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Param("id")
+	role := c.Param("role")
+	if role == RoleUser {
+		return ForbiddenError(c)
+	}
+	if _, err := uuid.Parse(userID); err != nil {
+		return NotFoundError(c)
+	}
+
+	rows, err := s.execKeepingAdmin(ctx, "DELETE FROM user_roles WHERE user_id=$1 AND role=$2", userID, role)
+	if errors.Is(err, errLastAdmin) {
+		return LastAdminError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not revoke role", "error", err)
+		return ServerError(c)
+	}
+	if rows == 0 {
+		return NotFoundError(c)
+	}
+
+	s.RecordAuthEvent(c, EventRoleRevoked, userID, "")
+
+	roles, err := s.UserRoles(ctx, userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read roles", "error", err)
+		return InvalidRequestError(c)
+	}
+	return c.JSON(200, echo.Map{"user_id": userID, "roles": roles})
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/redis/go-redis/v9"
+)
+
+// testServer connects to the database in TEST_DATABASE_URL, skipping the
+// test without one. It has to be a throwaway database: every user and group
+// in it is deleted, since the last admin checks look at all of them. Redis
+// runs in process.
+func testServer(t *testing.T) *Server {
+	t.Helper()
+	dbURL := os.Getenv("TEST_DATABASE_URL")
+	if dbURL == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	initDB(db)
+
+	_, err = db.Exec("TRUNCATE users, groups CASCADE")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return &Server{DB: db, RDB: rdb, Sessions: NewMemorySessionStore(), Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+}
+
+func createTestUser(t *testing.T, s *Server, roles ...string) string {
+	t.Helper()
+	var userID string
+	err := s.DB.QueryRow("INSERT INTO users (email) VALUES($1) RETURNING user_id", uuid.New().String()+"@example.com").Scan(&userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, role := range roles {
+		_, err = s.DB.Exec("INSERT INTO user_roles (user_id, role) VALUES($1, $2)", userID, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return userID
+}
+
+// createTestGroup makes a group with the roles and members.
+func createTestGroup(t *testing.T, s *Server, roles []string, members ...string) string {
+	t.Helper()
+	var groupID string
+	err := s.DB.QueryRow("INSERT INTO groups (name) VALUES($1) RETURNING group_id", uuid.New().String()).Scan(&groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, role := range roles {
+		_, err = s.DB.Exec("INSERT INTO group_roles (group_id, role) VALUES($1, $2)", groupID, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, userID := range members {
+		_, err = s.DB.Exec("INSERT INTO group_members (group_id, user_id) VALUES($1, $2)", groupID, userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return groupID
+}
+
+// callAdminHandler runs the handler as the admin, with the route params
+// given as name and value pairs, and returns the response status.
+func callAdminHandler(t *testing.T, handler echo.HandlerFunc, adminID string, params ...string) int {
+	t.Helper()
+	e := echo.New()
+	recorder := httptest.NewRecorder()
+	c := e.NewContext(httptest.NewRequest(http.MethodDelete, "/", nil), recorder)
+	var names, values []string
+	for i := 0; i+1 < len(params); i += 2 {
+		names = append(names, params[i])
+		values = append(values, params[i+1])
+	}
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+	c.Set("userID", adminID)
+
+	err := handler(c)
+	if err != nil {
+		t.Fatalf("handler returned %v", err)
+	}
+	return recorder.Code
+}
+
+func TestHasRole(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+
+	direct := createTestUser(t, s, RoleAdmin)
+	member := createTestUser(t, s)
+	outsider := createTestUser(t, s)
+	groupID := createTestGroup(t, s, []string{RoleAdmin}, member)
+	createTestGroup(t, s, nil, outsider)
+
+	tests := []struct {
+		name   string
+		userID string
+		roles  []string
+		want   bool
+	}{
+		{"granted directly", direct, []string{RoleAdmin}, true},
+		{"granted through a group", member, []string{RoleAdmin}, true},
+		{"group without the role", outsider, []string{RoleAdmin}, false},
+		{"any of several", member, []string{"auditor", RoleAdmin}, true},
+		{"none of several", outsider, []string{"auditor", RoleAdmin}, false},
+		{"everyone has RoleUser", outsider, []string{RoleUser}, true},
+	}
+	for _, test := range tests {
+		granted, err := s.HasRole(ctx, test.userID, test.roles...)
+		if err != nil {
+			t.Fatalf("%s: HasRole: %v", test.name, err)
+		}
+		if granted != test.want {
+			t.Errorf("%s: HasRole = %v, want %v", test.name, granted, test.want)
+		}
+	}
+
+	// Group roles last only as long as the membership
+	_, err := s.DB.Exec("DELETE FROM group_members WHERE group_id=$1 AND user_id=$2", groupID, member)
+	if err != nil {
+		t.Fatal(err)
+	}
+	granted, err := s.HasRole(ctx, member, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if granted {
+		t.Error("HasRole = true after leaving the group, want false")
+	}
+}
+
+func TestRevokeRoleHandler(t *testing.T) {
+	t.Run("admins can't remove each other down to none", func(t *testing.T) {
+		s := testServer(t)
+		first := createTestUser(t, s, RoleAdmin)
+		second := createTestUser(t, s, RoleAdmin)
+
+		if code := callAdminHandler(t, s.RevokeRoleHandler, first, "id", second, "role", RoleAdmin); code != 200 {
+			t.Errorf("revoking another admin: status %d, want 200", code)
+		}
+		if code := callAdminHandler(t, s.RevokeRoleHandler, second, "id", first, "role", RoleAdmin); code != 409 {
+			t.Errorf("revoking the last admin: status %d, want 409", code)
+		}
+		if granted, _ := s.HasRole(context.Background(), first, RoleAdmin); !granted {
+			t.Error("last admin lost the role")
+		}
+	})
+
+	t.Run("admins through a group count", func(t *testing.T) {
+		s := testServer(t)
+		direct := createTestUser(t, s, RoleAdmin)
+		member := createTestUser(t, s)
+		createTestGroup(t, s, []string{RoleAdmin}, member)
+
+		if code := callAdminHandler(t, s.RevokeRoleHandler, direct, "id", direct, "role", RoleAdmin); code != 200 {
+			t.Errorf("revoking own admin with a group admin left: status %d, want 200", code)
+		}
+	})
+
+	t.Run("group admins are protected too", func(t *testing.T) {
+		s := testServer(t)
+		direct := createTestUser(t, s, RoleAdmin)
+		member := createTestUser(t, s)
+		groupID := createTestGroup(t, s, []string{RoleAdmin}, member)
+
+		if code := callAdminHandler(t, s.RevokeRoleHandler, member, "id", direct, "role", RoleAdmin); code != 200 {
+			t.Fatalf("revoking the direct admin: status %d, want 200", code)
+		}
+		if code := callAdminHandler(t, s.RemoveGroupMemberHandler, member, "id", groupID, "user", member); code != 409 {
+			t.Errorf("removing the last admin from the group: status %d, want 409", code)
+		}
+		if code := callAdminHandler(t, s.RevokeGroupRoleHandler, member, "id", groupID, "role", RoleAdmin); code != 409 {
+			t.Errorf("revoking the admin role of the last admin group: status %d, want 409", code)
+		}
+		if code := callAdminHandler(t, s.DeleteGroupHandler, member, "id", groupID); code != 409 {
+			t.Errorf("deleting the last admin group: status %d, want 409", code)
+		}
+	})
+
+	t.Run("suspended admins don't count", func(t *testing.T) {
+		s := testServer(t)
+		first := createTestUser(t, s, RoleAdmin)
+		second := createTestUser(t, s, RoleAdmin)
+
+		if code := callAdminHandler(t, s.SuspendUserHandler, first, "id", second); code != 200 {
+			t.Fatalf("suspending another admin: status %d, want 200", code)
+		}
+		if code := callAdminHandler(t, s.RevokeRoleHandler, first, "id", first, "role", RoleAdmin); code != 409 {
+			t.Errorf("revoking own admin with only a suspended admin left: status %d, want 409", code)
+		}
+		if code := callAdminHandler(t, s.SuspendUserHandler, first, "id", first); code != 409 {
+			t.Errorf("suspending the last active admin: status %d, want 409", code)
+		}
+		if status, _ := s.AccountStatus(context.Background(), first); status != AccountActive {
+			t.Errorf("last active admin status = %q, want %q", status, AccountActive)
+		}
+	})
+
+	t.Run("other roles", func(t *testing.T) {
+		s := testServer(t)
+		admin := createTestUser(t, s, RoleAdmin)
+		_, err := s.DB.Exec("INSERT INTO roles (name) VALUES('auditor') ON CONFLICT DO NOTHING")
+		if err != nil {
+			t.Fatal(err)
+		}
+		user := createTestUser(t, s, "auditor")
+
+		if code := callAdminHandler(t, s.RevokeRoleHandler, admin, "id", user, "role", "auditor"); code != 200 {
+			t.Errorf("revoking a granted role: status %d, want 200", code)
+		}
+		if code := callAdminHandler(t, s.RevokeRoleHandler, admin, "id", user, "role", "auditor"); code != 404 {
+			t.Errorf("revoking a role the user lacks: status %d, want 404", code)
+		}
+		if code := callAdminHandler(t, s.RevokeRoleHandler, admin, "id", "not-a-uuid", "role", "auditor"); code != 404 {
+			t.Errorf("revoking from a malformed user ID: status %d, want 404", code)
+		}
+		if code := callAdminHandler(t, s.RevokeRoleHandler, admin, "id", user, "role", RoleUser); code != 403 {
+			t.Errorf("revoking RoleUser: status %d, want 403", code)
+		}
+	})
+}
+
+func TestGrantAdminByEmail(t *testing.T) {
+	s := testServer(t)
+	ctx := context.Background()
+	userID := createTestUser(t, s)
+	var email string
+	if err := s.DB.QueryRow("SELECT email FROM users WHERE user_id=$1", userID).Scan(&email); err != nil {
+		t.Fatal(err)
+	}
+
+	// Granting twice is fine, and the email is matched regardless of case
+	for _, given := range []string{email, strings.ToUpper(email)} {
+		if err := s.GrantAdminByEmail(ctx, given); err != nil {
+			t.Fatalf("GrantAdminByEmail(%q): %v", given, err)
+		}
+	}
+	if granted, _ := s.HasRole(ctx, userID, RoleAdmin); !granted {
+		t.Error("user didn't get the admin role")
+	}
+	if err := s.GrantAdminByEmail(ctx, "nobody@example.com"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("GrantAdminByEmail of an unknown email: error %v, want sql.ErrNoRows", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/labstack/echo/v4"
+)
+
+// Attribute names IdPs commonly use for the user's email and display name
+var (
+	samlEmailAttributes = []string{"email", "mail", "emailaddress",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress", "urn:oid:0.9.2342.19200300.100.1.3"}
+	samlNameAttributes = []string{"name", "displayName", "cn",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name", "urn:oid:2.16.840.1.113730.3.1.241"}
+)
+
+// samlRequest is what we remember about an AuthnRequest until the IdP
+// posts its response back.
+type samlRequest struct {
+	RequestID string `json:"request_id"`
+	ReturnTo  string `json:"return_to"`
+	// LinkUserID is set when a signed in user is linking the identity
+	LinkUserID string `json:"link_user_id,omitempty"`
+}
+
+func samlRequestKey(relayState string) string {
+	return "saml_request:" + HashToken(relayState)
+}
+
+// NewSAMLServiceProvider sets up the SP side of SAML, with the IdP described
+// by the metadata it publishes. The key and certificate sign our requests
+// and are what the IdP encrypts assertions to.
+func NewSAMLServiceProvider(ctx context.Context, entityID string, baseURL string, idpMetadataURL string, certFile string, keyFile string) (*saml.ServiceProvider, error) {
+	key, err := LoadSigningKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in SAML certificate")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	metadataURL, err := url.Parse(idpMetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	idpMetadata, err := samlsp.FetchMetadata(ctx, http.DefaultClient, *metadataURL)
+	if err != nil {
+		return nil, err
+	}
+
+	ownMetadataURL, _ := url.Parse(baseURL + "/saml/metadata")
+	acsURL, _ := url.Parse(baseURL + "/saml/acs")
+	return &saml.ServiceProvider{
+		EntityID:    entityID,
+		Key:         key.Private,
+		Certificate: certificate,
+		MetadataURL: *ownMetadataURL,
+		AcsURL:      *acsURL,
+		IDPMetadata: idpMetadata,
+	}, nil
+}
+
+func samlAttribute(assertion *saml.Assertion, names []string) string {
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			if !containsString(names, attribute.Name) && !containsString(names, attribute.FriendlyName) {
+				continue
+			}
+			if len(attribute.Values) > 0 {
+				return attribute.Values[0].Value
+			}
+		}
+	}
+	return ""
+}
+
+func (s *Server) SAMLMetadataHandler(c echo.Context) error {
+	if s.SAML == nil {
+		return NotFoundError(c)
+	}
+
+	data, err := xml.MarshalIndent(s.SAML.Metadata(), "", "  ")
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+	return c.Blob(http.StatusOK, "application/samlmetadata+xml", data)
+}
+
+func (s *Server) SAMLLoginHandler(c echo.Context) error {
+	if s.SAML == nil {
+		return NotFoundError(c)
+	}
+
+	redirectURL, err := s.StartSAMLLogin(c, s.SafeReturnTo(c.QueryParam("return_to")), "")
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+	return c.Redirect(http.StatusFound, redirectURL)
+}
+
+// StartSAMLLogin remembers a new AuthnRequest and returns the IdP URL to send
+// the browser to. With linkUserID set, the identity gets linked to that user
+// instead of signing anyone in.
+func (s *Server) StartSAMLLogin(c echo.Context, returnTo string, linkUserID string) (string, error) {
+	ctx := c.Request().Context()
+	request, err := s.SAML.MakeAuthenticationRequest(s.SAML.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+		saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not create SAML request", "error", err)
+		return "", err
+	}
+
+	relayState := RandomToken()
+	data, err := json.Marshal(samlRequest{
+		RequestID:  request.ID,
+		ReturnTo:   returnTo,
+		LinkUserID: linkUserID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	err = s.RDB.Set(ctx, samlRequestKey(relayState), data, upstreamStateLifetime).Err()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store SAML request", "error", err)
+		return "", err
+	}
+
+	// The IdP posts its response back cross-site, so the cookie tying it to
+	// this browser has to be SameSite=None
+	c.SetCookie(&http.Cookie{
+		Name:     "saml_request",
+		Value:    relayState,
+		Path:     "/saml/",
+		HttpOnly: true,
+		Secure:   s.Cookie.Secure,
+		SameSite: http.SameSiteNoneMode,
+		Expires:  time.Now().Add(upstreamStateLifetime),
+	})
+
+	redirectURL, err := request.Redirect(relayState, s.SAML)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not encode SAML request", "error", err)
+		return "", err
+	}
+	return redirectURL.String(), nil
+}
+
+// SAMLAssertionConsumerHandler accepts the IdP's response. Only responses to
+// a request this browser started are accepted, IdP-initiated sign-in is not.
+func (s *Server) SAMLAssertionConsumerHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if s.SAML == nil {
+		return NotFoundError(c)
+	}
+
+	relayState := c.FormValue("RelayState")
+	cookie, err := c.Cookie("saml_request")
+	if err != nil || len(relayState) == 0 || cookie.Value != relayState {
+		s.Logger.InfoContext(ctx, "SAML relay state does not match")
+		return UnauthorizedError(c)
+	}
+
+	data, err := s.RDB.GetDel(ctx, samlRequestKey(relayState)).Bytes()
+	if err != nil {
+		s.Logger.InfoContext(ctx, "SAML request not found or expired", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	var pending samlRequest
+	err = json.Unmarshal(data, &pending)
+	if err != nil {
+		return UnauthorizedError(c)
+	}
+
+	// Checks the signature, audience, validity window and that the
+	// response answers our request
+	assertion, err := s.SAML.ParseResponse(c.Request(), []string{pending.RequestID})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			err = invalid.PrivateErr
+		}
+		s.Logger.InfoContext(ctx, "Invalid SAML response", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		s.Logger.InfoContext(ctx, "SAML assertion has no subject")
+		return UnauthorizedError(c)
+	}
+
+	// The IdP is the customer's own directory, so the addresses it asserts
+	// are trusted like a verified email
+	email := samlAttribute(assertion, samlEmailAttributes)
+	if email == "" && strings.Contains(assertion.Subject.NameID.Value, "@") {
+		email = assertion.Subject.NameID.Value
+	}
+	identity := &UpstreamIdentity{
+		Subject:       assertion.Subject.NameID.Value,
+		Email:         email,
+		EmailVerified: email != "",
+		Name:          samlAttribute(assertion, samlNameAttributes),
+	}
+
+	provider := "saml:" + s.SAML.IDPMetadata.EntityID
+	if pending.LinkUserID != "" {
+		return s.CompleteIdentityLink(c, pending.LinkUserID, provider, identity, pending.ReturnTo)
+	}
+	return s.CompleteUpstreamLogin(c, provider, identity, pending.ReturnTo)
+}
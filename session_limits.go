@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	SessionLimitEvict  = "evict"
+	SessionLimitRefuse = "refuse"
+)
+
+var errSessionLimitReached = errors.New("too many active sessions")
+
+func SessionLimitError(c echo.Context) error {
+	return c.JSON(409, echo.Map{"error": "Too many active sessions", "session_limit_reached": true})
+}
+
+// SessionLimit is how many sessions the user may have at once, or zero for
+// no limit. Users are grouped into tenants by the domain of their email, so
+// a company can get a stricter limit than everyone else.
+func (s *Server) SessionLimit(ctx context.Context, userID string) (int64, error) {
+	if len(s.MaxSessionsByDomain) == 0 {
+		return s.MaxSessions, nil
+	}
+
+	var email string
+	err := s.DB.QueryRowContext(ctx, "SELECT COALESCE(email, '') FROM users WHERE user_id=$1", userID).Scan(&email)
+	if err != nil {
+		return 0, err
+	}
+
+	_, domain, found := strings.Cut(normalizeEmail(email), "@")
+	if limit, ok := s.MaxSessionsByDomain[domain]; found && ok {
+		return limit, nil
+	}
+	return s.MaxSessions, nil
+}
+
+// EnforceSessionLimit makes room for one more session of the user, either by
+// signing out their oldest sessions or by refusing with
+// errSessionLimitReached, depending on the configured action.
+func (s *Server) EnforceSessionLimit(ctx context.Context, userID string) error {
+	limit, err := s.SessionLimit(ctx, userID)
+	if err != nil || limit == 0 {
+		return err
+	}
+
+	active, err := s.Sessions.List(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	excess := int64(len(active)) - limit + 1
+	if excess <= 0 {
+		return nil
+	}
+	if s.SessionLimitAction == SessionLimitRefuse {
+		return errSessionLimitReached
+	}
+
+	for _, sessionID := range active[:excess] {
+		err = s.RemoveUserSession(ctx, userID, sessionID)
+		if err != nil {
+			return err
+		}
+	}
+	s.Logger.InfoContext(ctx, "Evicted sessions over the limit", "user_id", userID, "count", excess)
+	return nil
+}
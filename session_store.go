@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	SessionStorePostgres = "postgres"
+	SessionStoreMemory   = "memory"
+)
+
+var errSessionNotFound = errors.New("session not found or expired")
+
+// sessionIDPattern matches the UUIDs sessions are created with. Stores look
+// up nothing else, so a cookie can't name a record that isn't a session.
+var sessionIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+func validSessionID(sessionID string) bool {
+	return sessionIDPattern.MatchString(sessionID)
+}
+
+// SessionStore keeps sessions until they expire, along with which sessions
+// each user has.
+type SessionStore interface {
+	Create(ctx context.Context, sessionID string, session *Session, lifetime time.Duration) error
+	Get(ctx context.Context, sessionID string) (*Session, error)
+	// Save overwrites the session without changing when it expires
+	Save(ctx context.Context, sessionID string, session *Session) error
+	TTL(ctx context.Context, sessionID string) (time.Duration, error)
+	// Extend makes the session expire lifetime from now
+	Extend(ctx context.Context, userID string, sessionID string, lifetime time.Duration) error
+	Delete(ctx context.Context, userID string, sessionID string) error
+	// List returns the IDs of the user's live sessions, oldest first
+	List(ctx context.Context, userID string) ([]string, error)
+}
+
+// RedisSessionStore keeps each session under sessionKey, with a sorted set
+// per user indexing their sessions by creation time.
+type RedisSessionStore struct {
+	RDB redis.UniversalClient
+	// IndexLifetime is how long the longest-lived session could last
+	IndexLifetime time.Duration
+}
+
+// sessionKey keeps sessions apart from the other records in Redis.
+func sessionKey(sessionID string) string {
+	return "session:" + sessionID
+}
+
+// userSessionsKey is a sorted set of the user's session IDs, scored by the
+// session creation time.
+func userSessionsKey(userID string) string {
+	return "user_sessions:" + userID
+}
+
+func (store *RedisSessionStore) Create(ctx context.Context, sessionID string, session *Session, lifetime time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	err = store.RDB.Set(ctx, sessionKey(sessionID), data, lifetime).Err()
+	if err != nil {
+		return err
+	}
+
+	key := userSessionsKey(session.UserID)
+	err = store.RDB.ZAdd(ctx, key, redis.Z{
+		Score:  float64(session.CreatedAt.Unix()),
+		Member: sessionID,
+	}).Err()
+	if err != nil {
+		return err
+	}
+	return store.RDB.Expire(ctx, key, store.IndexLifetime).Err()
+}
+
+func (store *RedisSessionStore) Get(ctx context.Context, sessionID string) (*Session, error) {
+	if !validSessionID(sessionID) {
+		return nil, errSessionNotFound
+	}
+	data, err := store.RDB.Get(ctx, sessionKey(sessionID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	err = json.Unmarshal(data, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (store *RedisSessionStore) Save(ctx context.Context, sessionID string, session *Session) error {
+	if !validSessionID(sessionID) {
+		return errSessionNotFound
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return store.RDB.Set(ctx, sessionKey(sessionID), data, redis.KeepTTL).Err()
+}
+
+func (store *RedisSessionStore) TTL(ctx context.Context, sessionID string) (time.Duration, error) {
+	if !validSessionID(sessionID) {
+		return 0, errSessionNotFound
+	}
+	return store.RDB.TTL(ctx, sessionKey(sessionID)).Result()
+}
+
+func (store *RedisSessionStore) Extend(ctx context.Context, userID string, sessionID string, lifetime time.Duration) error {
+	if !validSessionID(sessionID) {
+		return errSessionNotFound
+	}
+	err := store.RDB.Expire(ctx, sessionKey(sessionID), lifetime).Err()
+	if err != nil {
+		return err
+	}
+	return store.RDB.Expire(ctx, userSessionsKey(userID), store.IndexLifetime).Err()
+}
+
+func (store *RedisSessionStore) Delete(ctx context.Context, userID string, sessionID string) error {
+	if !validSessionID(sessionID) {
+		return nil
+	}
+	err := store.RDB.Del(ctx, sessionKey(sessionID)).Err()
+	if err != nil {
+		return err
+	}
+	return store.RDB.ZRem(ctx, userSessionsKey(userID), sessionID).Err()
+}
+
+func (store *RedisSessionStore) List(ctx context.Context, userID string) ([]string, error) {
+	key := userSessionsKey(userID)
+	sessionIDs, err := store.RDB.ZRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	// Index entries outlive sessions that expired on their own
+	live := []string{}
+	for _, sessionID := range sessionIDs {
+		exists, err := store.RDB.Exists(ctx, sessionKey(sessionID)).Result()
+		if err != nil {
+			return nil, err
+		}
+		if exists == 0 {
+			store.RDB.ZRem(ctx, key, sessionID)
+			continue
+		}
+		live = append(live, sessionID)
+	}
+	return live, nil
+}
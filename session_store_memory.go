@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memorySession struct {
+	Session   Session
+	ExpiresAt time.Time
+}
+
+// MemorySessionStore keeps sessions in process memory. Sessions are lost on
+// restart and not shared between instances, so it suits development and
+// single-instance deployments.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*memorySession
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: map[string]*memorySession{}}
+}
+
+// live returns the session when it hasn't expired, dropping it otherwise.
+// The caller holds the lock.
+func (store *MemorySessionStore) live(sessionID string) *memorySession {
+	if !validSessionID(sessionID) {
+		return nil
+	}
+	stored, ok := store.sessions[sessionID]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		delete(store.sessions, sessionID)
+		return nil
+	}
+	return stored
+}
+
+func (store *MemorySessionStore) Create(ctx context.Context, sessionID string, session *Session, lifetime time.Duration) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.sessions[sessionID] = &memorySession{Session: *session, ExpiresAt: time.Now().Add(lifetime)}
+	return nil
+}
+
+func (store *MemorySessionStore) Get(ctx context.Context, sessionID string) (*Session, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored := store.live(sessionID)
+	if stored == nil {
+		return nil, errSessionNotFound
+	}
+	// Hand out a copy so changes only stick through Save
+	session := stored.Session
+	return &session, nil
+}
+
+func (store *MemorySessionStore) Save(ctx context.Context, sessionID string, session *Session) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored := store.live(sessionID)
+	if stored == nil {
+		return errSessionNotFound
+	}
+	stored.Session = *session
+	return nil
+}
+
+func (store *MemorySessionStore) TTL(ctx context.Context, sessionID string) (time.Duration, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored := store.live(sessionID)
+	if stored == nil {
+		return 0, errSessionNotFound
+	}
+	return time.Until(stored.ExpiresAt), nil
+}
+
+func (store *MemorySessionStore) Extend(ctx context.Context, userID string, sessionID string, lifetime time.Duration) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	stored := store.live(sessionID)
+	if stored == nil {
+		return errSessionNotFound
+	}
+	stored.ExpiresAt = time.Now().Add(lifetime)
+	return nil
+}
+
+func (store *MemorySessionStore) Delete(ctx context.Context, userID string, sessionID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.sessions, sessionID)
+	return nil
+}
+
+func (store *MemorySessionStore) List(ctx context.Context, userID string) ([]string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	found := []string{}
+	for sessionID := range store.sessions {
+		stored := store.live(sessionID)
+		if stored != nil && stored.Session.UserID == userID {
+			found = append(found, sessionID)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		return store.sessions[found[i]].Session.CreatedAt.Before(store.sessions[found[j]].Session.CreatedAt)
+	})
+	return found, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// PostgresSessionStore keeps sessions in the sessions table, for
+// deployments that would rather not run Redis.
+type PostgresSessionStore struct {
+	DB *sql.DB
+}
+
+func (store *PostgresSessionStore) Create(ctx context.Context, sessionID string, session *Session, lifetime time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	// Expired sessions are never read again, clear them out on the way
+	_, err = store.DB.ExecContext(ctx, "DELETE FROM sessions WHERE expires_at < now()")
+	if err != nil {
+		return err
+	}
+
+	_, err = store.DB.ExecContext(ctx, "INSERT INTO sessions (session_id, user_id, data, created_at, expires_at) VALUES($1, $2, $3, $4, $5)",
+		sessionID, session.UserID, data, session.CreatedAt, time.Now().Add(lifetime))
+	return err
+}
+
+func (store *PostgresSessionStore) Get(ctx context.Context, sessionID string) (*Session, error) {
+	if !validSessionID(sessionID) {
+		return nil, errSessionNotFound
+	}
+	var data []byte
+	err := store.DB.QueryRowContext(ctx, "SELECT data FROM sessions WHERE session_id=$1 AND expires_at > now()", sessionID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	err = json.Unmarshal(data, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (store *PostgresSessionStore) Save(ctx context.Context, sessionID string, session *Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = store.DB.ExecContext(ctx, "UPDATE sessions SET data=$2 WHERE session_id=$1", sessionID, data)
+	return err
+}
+
+func (store *PostgresSessionStore) TTL(ctx context.Context, sessionID string) (time.Duration, error) {
+	if !validSessionID(sessionID) {
+		return 0, errSessionNotFound
+	}
+	var expiresAt time.Time
+	err := store.DB.QueryRowContext(ctx, "SELECT expires_at FROM sessions WHERE session_id=$1 AND expires_at > now()", sessionID).Scan(&expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errSessionNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Until(expiresAt), nil
+}
+
+func (store *PostgresSessionStore) Extend(ctx context.Context, userID string, sessionID string, lifetime time.Duration) error {
+	_, err := store.DB.ExecContext(ctx, "UPDATE sessions SET expires_at=$2 WHERE session_id=$1", sessionID, time.Now().Add(lifetime))
+	return err
+}
+
+func (store *PostgresSessionStore) Delete(ctx context.Context, userID string, sessionID string) error {
+	_, err := store.DB.ExecContext(ctx, "DELETE FROM sessions WHERE session_id=$1 AND user_id=$2", sessionID, userID)
+	return err
+}
+
+func (store *PostgresSessionStore) List(ctx context.Context, userID string) ([]string, error) {
+	rows, err := store.DB.QueryContext(ctx, "SELECT session_id FROM sessions WHERE user_id=$1 AND expires_at > now() ORDER BY created_at",
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessionIDs := []string{}
+	for rows.Next() {
+		var sessionID string
+		err = rows.Scan(&sessionID)
+		if err != nil {
+			return nil, err
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+	return sessionIDs, rows.Err()
+}
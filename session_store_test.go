@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testSessionStore checks the behaviour every SessionStore has to share.
+// newStore returns an empty store for each subtest.
+func testSessionStore(t *testing.T, newStore func(t *testing.T) SessionStore) {
+	ctx := context.Background()
+	userID := uuid.New().String()
+
+	t.Run("create and get", func(t *testing.T) {
+		store := newStore(t)
+		sessionID := uuid.New().String()
+		created := Session{UserID: userID, IP: "192.0.2.1", CreatedAt: time.Now().UTC().Truncate(time.Second), Roles: []string{RoleAdmin}}
+		if err := store.Create(ctx, sessionID, &created, time.Hour); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		session, err := store.Get(ctx, sessionID)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if session.UserID != userID || session.IP != created.IP || !session.CreatedAt.Equal(created.CreatedAt) ||
+			len(session.Roles) != 1 || session.Roles[0] != RoleAdmin {
+			t.Errorf("Get = %+v, want %+v", session, created)
+		}
+	})
+
+	t.Run("unknown and malformed IDs", func(t *testing.T) {
+		store := newStore(t)
+		for _, sessionID := range []string{uuid.New().String(), "", "mfa_challenge:abc", "user_sessions:" + userID, "ABCDEF00-0000-0000-0000-000000000000"} {
+			if _, err := store.Get(ctx, sessionID); !errors.Is(err, errSessionNotFound) {
+				t.Errorf("Get(%q) error = %v, want errSessionNotFound", sessionID, err)
+			}
+			if _, err := store.TTL(ctx, sessionID); !errors.Is(err, errSessionNotFound) {
+				t.Errorf("TTL(%q) error = %v, want errSessionNotFound", sessionID, err)
+			}
+		}
+	})
+
+	t.Run("save keeps the expiry", func(t *testing.T) {
+		store := newStore(t)
+		sessionID := uuid.New().String()
+		session := Session{UserID: userID, CreatedAt: time.Now()}
+		if err := store.Create(ctx, sessionID, &session, time.Minute); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		session.PasswordExpired = true
+		if err := store.Save(ctx, sessionID, &session); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		saved, err := store.Get(ctx, sessionID)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if !saved.PasswordExpired {
+			t.Error("Save did not store the change")
+		}
+		ttl, err := store.TTL(ctx, sessionID)
+		if err != nil {
+			t.Fatalf("TTL: %v", err)
+		}
+		if ttl <= 0 || ttl > time.Minute {
+			t.Errorf("TTL after Save = %v, want at most a minute", ttl)
+		}
+	})
+
+	t.Run("changes only stick through save", func(t *testing.T) {
+		store := newStore(t)
+		sessionID := uuid.New().String()
+		if err := store.Create(ctx, sessionID, &Session{UserID: userID, CreatedAt: time.Now()}, time.Hour); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		session, _ := store.Get(ctx, sessionID)
+		session.UserID = "someone else"
+		again, _ := store.Get(ctx, sessionID)
+		if again.UserID != userID {
+			t.Errorf("Get = %q after changing an earlier copy, want %q", again.UserID, userID)
+		}
+	})
+
+	t.Run("extend", func(t *testing.T) {
+		store := newStore(t)
+		sessionID := uuid.New().String()
+		if err := store.Create(ctx, sessionID, &Session{UserID: userID, CreatedAt: time.Now()}, time.Minute); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		if err := store.Extend(ctx, userID, sessionID, time.Hour); err != nil {
+			t.Fatalf("Extend: %v", err)
+		}
+		ttl, err := store.TTL(ctx, sessionID)
+		if err != nil {
+			t.Fatalf("TTL: %v", err)
+		}
+		if ttl <= time.Minute || ttl > time.Hour {
+			t.Errorf("TTL after Extend = %v, want between a minute and an hour", ttl)
+		}
+	})
+
+	t.Run("expiry", func(t *testing.T) {
+		store := newStore(t)
+		sessionID := uuid.New().String()
+		if err := store.Create(ctx, sessionID, &Session{UserID: userID, CreatedAt: time.Now()}, 50*time.Millisecond); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		if _, err := store.Get(ctx, sessionID); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("Get of expired session error = %v, want errSessionNotFound", err)
+		}
+		if _, err := store.TTL(ctx, sessionID); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("TTL of expired session error = %v, want errSessionNotFound", err)
+		}
+		sessionIDs, err := store.List(ctx, userID)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(sessionIDs) != 0 {
+			t.Errorf("List = %v, want expired session left out", sessionIDs)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		store := newStore(t)
+		sessionID := uuid.New().String()
+		if err := store.Create(ctx, sessionID, &Session{UserID: userID, CreatedAt: time.Now()}, time.Hour); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		if err := store.Delete(ctx, userID, sessionID); err != nil {
+			t.Fatalf("Delete: %v", err)
+		}
+		if _, err := store.Get(ctx, sessionID); !errors.Is(err, errSessionNotFound) {
+			t.Errorf("Get of deleted session error = %v, want errSessionNotFound", err)
+		}
+		sessionIDs, err := store.List(ctx, userID)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(sessionIDs) != 0 {
+			t.Errorf("List = %v, want deleted session left out", sessionIDs)
+		}
+	})
+
+	t.Run("list oldest first", func(t *testing.T) {
+		store := newStore(t)
+		start := time.Now().Add(-time.Hour)
+		want := []string{uuid.New().String(), uuid.New().String(), uuid.New().String()}
+		// Created out of order, so the order can't come from insertion
+		for _, i := range []int{2, 0, 1} {
+			session := Session{UserID: userID, CreatedAt: start.Add(time.Duration(i) * time.Minute)}
+			if err := store.Create(ctx, want[i], &session, time.Hour); err != nil {
+				t.Fatalf("Create: %v", err)
+			}
+		}
+		other := Session{UserID: uuid.New().String(), CreatedAt: start}
+		if err := store.Create(ctx, uuid.New().String(), &other, time.Hour); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+
+		sessionIDs, err := store.List(ctx, userID)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		if len(sessionIDs) != len(want) {
+			t.Fatalf("List = %v, want %v", sessionIDs, want)
+		}
+		for i := range want {
+			if sessionIDs[i] != want[i] {
+				t.Fatalf("List = %v, want %v", sessionIDs, want)
+			}
+		}
+	})
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, func(t *testing.T) SessionStore {
+		return NewMemorySessionStore()
+	})
+}
+
+func TestValidSessionID(t *testing.T) {
+	tests := []struct {
+		sessionID string
+		want      bool
+	}{
+		{uuid.New().String(), true},
+		{"", false},
+		{"mfa_challenge:" + HashToken("token"), false},
+		{"ABCDEF00-0000-0000-0000-000000000000", false},
+		{"{abcdef00-0000-0000-0000-000000000000}", false},
+		{"urn:uuid:abcdef00-0000-0000-0000-000000000000", false},
+		{"abcdef00000000000000000000000000", false},
+	}
+	for _, test := range tests {
+		if got := validSessionID(test.sessionID); got != test.want {
+			t.Errorf("validSessionID(%q) = %v, want %v", test.sessionID, got, test.want)
+		}
+	}
+}
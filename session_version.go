@@ -0,0 +1,32 @@
+package main
+
+import "context"
+
+// UserSessionVersion is the version every live session of the user has to
+// be stamped with.
+func (s *Server) UserSessionVersion(ctx context.Context, userID string) (int64, error) {
+	var version int64
+	err := s.DB.QueryRowContext(ctx, "SELECT session_version FROM users WHERE user_id=$1", userID).Scan(&version)
+	return version, err
+}
+
+// BumpSessionVersion invalidates every session of the user at once,
+// including ones the session store has lost track of, and returns the new
+// version.
+func (s *Server) BumpSessionVersion(ctx context.Context, userID string) (int64, error) {
+	var version int64
+	err := s.DB.QueryRowContext(ctx, "UPDATE users SET session_version=session_version+1 WHERE user_id=$1 RETURNING session_version",
+		userID).Scan(&version)
+	return version, err
+}
+
+// SessionVersionCurrent reports whether the session was stamped with the
+// user's current session version. Failing to check counts as stale.
+func (s *Server) SessionVersionCurrent(ctx context.Context, session *Session) bool {
+	version, err := s.UserSessionVersion(ctx, session.UserID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read session version", "error", err)
+		return false
+	}
+	return session.Version == version
+}
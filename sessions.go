@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+type Session struct {
+	UserID    string    `json:"user_id"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+	Remember  bool      `json:"remember"`
+	// Location is roughly where the session was created, when known
+	Location string `json:"location,omitempty"`
+	// AuthenticatedAt is when the user last entered a password or factor
+	AuthenticatedAt time.Time `json:"authenticated_at"`
+	// Device is parsed from UserAgent when the session is created
+	Device *DeviceInfo `json:"device,omitempty"`
+	// Fingerprint ties the session to the client that created it
+	Fingerprint string `json:"fingerprint,omitempty"`
+	// SudoUntil is when the sudo mode granted by reauthenticating ends
+	SudoUntil time.Time `json:"sudo_until,omitempty"`
+	// Version has to match the user's session version for the session to work
+	Version int64 `json:"version"`
+	// PasswordExpired holds the session to changing the password
+	PasswordExpired bool `json:"password_expired,omitempty"`
+	// Consented is the set of document versions the user had accepted when
+	// last checked
+	Consented string `json:"consented,omitempty"`
+	// Roles and Groups are what the user had when signing in. RequireRole
+	// looks roles up again instead of trusting these.
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+// ClientFingerprint hashes the network and user agent of the request. Only
+// the /24 (or /48 for IPv6) prefix of the address is used, so clients that
+// hop between addresses of the same network keep their sessions.
+func ClientFingerprint(request *http.Request, ip string) string {
+	network := ip
+	if addr := net.ParseIP(ip); addr != nil {
+		if v4 := addr.To4(); v4 != nil {
+			network = v4.Mask(net.CIDRMask(24, 32)).String()
+		} else {
+			network = addr.Mask(net.CIDRMask(48, 128)).String()
+		}
+	}
+	return HashToken(network + "|" + request.UserAgent())
+}
+
+// DeviceInfo describes the device the session was created on, parsing it
+// for sessions stored before devices were recorded.
+func (session *Session) DeviceInfo() DeviceInfo {
+	if session.Device == nil {
+		return ParseUserAgent(session.UserAgent)
+	}
+	return *session.Device
+}
+
+// deviceJSON is how devices are shown in the session list and audit log.
+func deviceJSON(device DeviceInfo) echo.Map {
+	return echo.Map{
+		"name":    device.Name(),
+		"browser": device.Browser,
+		"os":      device.OS,
+		"type":    device.Type,
+	}
+}
+
+// LastAuthenticated falls back to the creation time for sessions stored
+// before the last-auth time was recorded.
+func (session *Session) LastAuthenticated() time.Time {
+	if session.AuthenticatedAt.IsZero() {
+		return session.CreatedAt
+	}
+	return session.AuthenticatedAt
+}
+
+// Geolocation headers set by common CDNs and load balancers, as pairs of
+// country and city header names
+var locationHeaders = [][2]string{
+	{"CF-IPCountry", "CF-IPCity"},
+	{"CloudFront-Viewer-Country", "CloudFront-Viewer-City"},
+	{"X-Vercel-IP-Country", "X-Vercel-IP-City"},
+	{"X-AppEngine-Country", "X-AppEngine-City"},
+}
+
+// requestLocation returns the approximate location the CDN in front of us
+// resolved for the client, like "Berlin, DE". It is shown to users to help
+// them recognize their sessions. A client reaching us directly could set
+// these headers itself, so they only ever make a sign-in look riskier,
+// never let one through.
+func requestLocation(request *http.Request) string {
+	for _, headers := range locationHeaders {
+		country := request.Header.Get(headers[0])
+		if country == "" {
+			continue
+		}
+		if city := request.Header.Get(headers[1]); city != "" {
+			return city + ", " + country
+		}
+		return country
+	}
+	return ""
+}
+
+// CreateSession stores a new session for the user, along with the client
+// details of the request that created it, and returns the session ID. The
+// user's session limit is enforced first.
+func (s *Server) CreateSession(c echo.Context, userID string, remember bool) (string, error) {
+	ctx := c.Request().Context()
+	err := s.EnforceSessionLimit(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.ActivateForSignIn(c, userID)
+	if err != nil {
+		return "", err
+	}
+
+	// Signing in during the grace period keeps the account
+	err = s.CancelAccountDeletion(c, userID)
+	if err != nil {
+		return "", err
+	}
+
+	version, err := s.UserSessionVersion(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	passwordExpired, err := s.PasswordExpired(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	roles, err := s.UserRoles(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	groups, err := s.UserGroups(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	device := ParseUserAgent(c.Request().UserAgent())
+	session := Session{
+		UserID:          userID,
+		IP:              c.RealIP(),
+		UserAgent:       c.Request().UserAgent(),
+		CreatedAt:       now,
+		Remember:        remember,
+		Location:        requestLocation(c.Request()),
+		AuthenticatedAt: now,
+		Device:          &device,
+		Fingerprint:     ClientFingerprint(c.Request(), c.RealIP()),
+		Version:         version,
+		SudoUntil:       now.Add(s.SudoLifetime),
+		PasswordExpired: passwordExpired,
+		Roles:           roles,
+		Groups:          groups,
+	}
+
+	lifetime, _ := s.SessionLifetimes(remember)
+	if s.SessionMaxLifetime > 0 && s.SessionMaxLifetime < lifetime {
+		lifetime = s.SessionMaxLifetime
+	}
+	var sessionID string
+	if s.StatelessSessions {
+		sessionID, err = s.createStatelessSession(session, lifetime)
+	} else {
+		sessionID = uuid.New().String()
+		err = s.Sessions.Create(ctx, sessionID, &session, lifetime)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	s.NotifyNewDevice(ctx, userID, sessionID, &session, lifetime)
+	return sessionID, nil
+}
+
+func (s *Server) GetSession(ctx context.Context, sessionID string) (*Session, error) {
+	if s.StatelessSessions {
+		sealed, err := s.getStatelessSession(ctx, sessionID)
+		if err != nil {
+			return nil, err
+		}
+		return &sealed.Session, nil
+	}
+	return s.Sessions.Get(ctx, sessionID)
+}
+
+// SessionTTL is how long the session has left before it expires.
+func (s *Server) SessionTTL(ctx context.Context, sessionID string) (time.Duration, error) {
+	if s.StatelessSessions {
+		sealed, err := s.openSession(sessionID)
+		if err != nil {
+			return 0, err
+		}
+		return time.Until(sealed.ExpiresAt), nil
+	}
+	return s.Sessions.TTL(ctx, sessionID)
+}
+
+// SaveSession overwrites a stored session without changing when it expires.
+// Stateless sessions are changed with reissueStatelessSession instead.
+func (s *Server) SaveSession(ctx context.Context, sessionID string, session *Session) error {
+	return s.Sessions.Save(ctx, sessionID, session)
+}
+
+// UpdateSession stores changes to the session of the request, re-issuing
+// the cookie for stateless sessions.
+func (s *Server) UpdateSession(c echo.Context, sessionID string, session *Session) error {
+	ctx := c.Request().Context()
+	if !s.StatelessSessions {
+		return s.SaveSession(ctx, sessionID, session)
+	}
+
+	ttl, err := s.SessionTTL(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	return s.reissueStatelessSession(c, sessionID, session, time.Now().Add(ttl))
+}
+
+func (s *Server) RemoveUserSession(ctx context.Context, userID string, sessionID string) error {
+	if s.StatelessSessions {
+		return s.revokeStatelessSession(ctx, sessionID)
+	}
+
+	err := s.Sessions.Delete(ctx, userID, sessionID)
+	if err != nil {
+		return err
+	}
+	s.BackchannelLogout(ctx, userID, sessionID)
+	return nil
+}
+
+func (s *Server) DeleteUserSessions(ctx context.Context, userID string) error {
+	return s.DeleteUserSessionsExcept(ctx, userID, "")
+}
+
+// DeleteUserSessionsExcept removes every session of the user apart from
+// keepSessionID, which is usually the session making the request. The
+// session version is bumped first so every other session stops working at
+// once, and the kept session gets stamped with the new version.
+func (s *Server) DeleteUserSessionsExcept(ctx context.Context, userID string, keepSessionID string) error {
+	if s.StatelessSessions {
+		return s.revokeStatelessSessionsExcept(ctx, userID, keepSessionID)
+	}
+
+	// A deleted account has no version left to bump, its sessions still
+	// get removed below
+	version, err := s.BumpSessionVersion(ctx, userID)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not bump session version", "user_id", userID, "error", err)
+	} else if keepSessionID != "" {
+		session, err := s.Sessions.Get(ctx, keepSessionID)
+		if err == nil {
+			session.Version = version
+			err = s.Sessions.Save(ctx, keepSessionID, session)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	sessionIDs, err := s.Sessions.List(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, sessionID := range sessionIDs {
+		if sessionID == keepSessionID {
+			continue
+		}
+		err = s.RemoveUserSession(ctx, userID, sessionID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeSessions lists the user's live sessions the way the API shows them,
+// marking the one making the request.
+func (s *Server) describeSessions(ctx context.Context, userID string, currentSessionID string) ([]echo.Map, error) {
+	// Stateless sessions aren't kept anywhere, only the current one is known
+	sessionIDs := []string{currentSessionID}
+	if !s.StatelessSessions {
+		var err error
+		sessionIDs, err = s.Sessions.List(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sessions := []echo.Map{}
+	for _, sessionID := range sessionIDs {
+		session, err := s.GetSession(ctx, sessionID)
+		if err != nil {
+			// The session expired since it was listed
+			continue
+		}
+
+		ttl, err := s.SessionTTL(ctx, sessionID)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not read session TTL", "error", err)
+			continue
+		}
+
+		sessions = append(sessions, echo.Map{
+			"id":         sessionID,
+			"ip":         session.IP,
+			"user_agent": session.UserAgent,
+			"device":     deviceJSON(session.DeviceInfo()),
+			"location":   session.Location,
+			"remembered": session.Remember,
+			"created_at": session.CreatedAt,
+			"expires_at": time.Now().Add(ttl).UTC(),
+			"current":    sessionID == currentSessionID,
+		})
+	}
+	return sessions, nil
+}
+
+func (s *Server) ListSessionsHandler(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	currentSessionID := c.Get("sessionID").(string)
+	ctx := c.Request().Context()
+
+	sessions, err := s.describeSessions(ctx, userID, currentSessionID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not list user sessions", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"sessions": sessions})
+}
+
+// RenewSessionHandler extends the current session to its full lifetime, so
+// single-page apps can keep the user signed in without asking for their
+// credentials again. The absolute maximum lifetime still applies.
+func (s *Server) RenewSessionHandler(c echo.Context) error {
+	sessionID := c.Get("sessionID").(string)
+	session := c.Get("session").(*Session)
+	ctx := c.Request().Context()
+
+	ttl, err := s.SessionTTL(ctx, sessionID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not read session TTL", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	lifetime := s.RenewalLifetime(session)
+	if lifetime > ttl {
+		err = s.ExtendSession(c, sessionID, session, lifetime)
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Failed to renew user session", "error", err)
+			return InvalidRequestError(c)
+		}
+		ttl = lifetime
+	}
+
+	return c.JSON(200, echo.Map{
+		"status":     "success",
+		"expires_at": time.Now().Add(ttl).UTC(),
+	})
+}
+
+func (s *Server) RevokeSessionHandler(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	currentSessionID := c.Get("sessionID").(string)
+	sessionID := c.Param("id")
+	ctx := c.Request().Context()
+
+	// Only allow revoking sessions that belong to the requesting user
+	if s.StatelessSessions {
+		if sessionID != currentSessionID {
+			return NotFoundError(c)
+		}
+	} else {
+		session, err := s.GetSession(ctx, sessionID)
+		if err != nil || session.UserID != userID {
+			s.Logger.InfoContext(ctx, "Session not found for user", "error", err)
+			return NotFoundError(c)
+		}
+	}
+
+	err := s.RemoveUserSession(ctx, userID, sessionID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not revoke session", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	if sessionID == currentSessionID {
+		s.ClearSessionCookie(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "success"})
+}
+
+// RevokeAllSessionsHandler signs the user out everywhere. With
+// keep_current=true the session making the request is left alone.
+func (s *Server) RevokeAllSessionsHandler(c echo.Context) error {
+	userID := c.Get("userID").(string)
+	currentSessionID := c.Get("sessionID").(string)
+	ctx := c.Request().Context()
+
+	keepSessionID := ""
+	if c.QueryParam("keep_current") == "true" {
+		keepSessionID = currentSessionID
+	}
+
+	err := s.DeleteUserSessionsExcept(ctx, userID, keepSessionID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not revoke sessions", "error", err)
+		return InvalidRequestError(c)
+	}
+	s.RecordAuthEvent(c, EventLogout, userID, "")
+
+	if keepSessionID == "" {
+		s.ClearSessionCookie(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "success"})
+}
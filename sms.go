@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+var e164Pattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// normalizePhone brings a phone number to E.164 form, dropping the spaces and
+// punctuation people type. Numbers without a country code are rejected
+// rather than guessed.
+func normalizePhone(phone string) (string, bool) {
+	phone = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" -().", r) {
+			return -1
+		}
+		return r
+	}, phone)
+	if strings.HasPrefix(phone, "00") {
+		phone = "+" + phone[2:]
+	}
+	return phone, e164Pattern.MatchString(phone)
+}
+
+// SMSSender delivers text messages, so the SMS provider can be swapped.
+type SMSSender interface {
+	SendSMS(ctx context.Context, to string, body string) error
+}
+
+// TwilioSender sends messages through Twilio's Messages API.
+type TwilioSender struct {
+	AccountSID string
+	AuthToken  string
+	From       string
+}
+
+func (t *TwilioSender) SendSMS(ctx context.Context, to string, body string) error {
+	form := url.Values{"To": {to}, "From": {t.From}, "Body": {body}}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		"https://api.twilio.com/2010-04-01/Accounts/"+url.PathEscape(t.AccountSID)+"/Messages.json", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(t.AccountSID, t.AuthToken)
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		return fmt.Errorf("Twilio returned %s", response.Status)
+	}
+	return nil
+}
+
+// SendSMSCode creates a code under key and texts it to phone.
+func (s *Server) SendSMSCode(ctx context.Context, key string, phone string, payload string) error {
+	if !s.AllowOTPSend(ctx, phone) {
+		return errTooManyCodes
+	}
+
+	code, err := s.CreateOTP(ctx, key, payload)
+	if err != nil {
+		return err
+	}
+	return s.SMS.SendSMS(ctx, phone, "Your "+s.TOTPIssuer+" code is "+code)
+}
+
+// PhoneEnrollHandler starts adding a phone number by texting it a code.
+func (s *Server) PhoneEnrollHandler(c echo.Context) error {
+	if s.SMS == nil {
+		return NotFoundError(c)
+	}
+
+	var body struct {
+		Phone string `json:"phone"`
+	}
+	err := c.Bind(&body)
+	phone, ok := normalizePhone(body.Phone)
+	if err != nil || !ok {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+	err = s.SendSMSCode(ctx, otpKey("phone", userID), phone, phone)
+	if errors.Is(err, errTooManyCodes) {
+		return TooManyRequestsError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not send SMS code", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Code sent"})
+}
+
+// PhoneVerifyHandler saves the phone number once the texted code comes back.
+func (s *Server) PhoneVerifyHandler(c echo.Context) error {
+	var body struct {
+		Code string `json:"code"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.Code) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+	phone, ok := s.CheckOTP(ctx, otpKey("phone", userID), body.Code)
+	if !ok {
+		s.Logger.InfoContext(ctx, "Invalid phone verification code", "user_id", userID)
+		return UnauthorizedError(c)
+	}
+
+	_, err = s.DB.ExecContext(ctx, "UPDATE users SET phone=$1, phone_verified=true WHERE user_id=$2", phone, userID)
+	if isUniqueViolation(err) {
+		return ConflictError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not save phone number", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Phone verified", "phone": phone})
+}
+
+func phoneVerificationKey(phone string) string {
+	return otpKey("verify_phone", phone)
+}
+
+// PhoneVerificationRequestHandler texts a new code to a number registered
+// in place of an email. It answers the same whether or not the number is
+// waiting to be verified.
+func (s *Server) PhoneVerificationRequestHandler(c echo.Context) error {
+	if s.SMS == nil {
+		return NotFoundError(c)
+	}
+
+	var body struct {
+		Phone string `json:"phone"`
+	}
+	err := c.Bind(&body)
+	phone, ok := normalizePhone(body.Phone)
+	if err != nil || !ok {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	response := echo.Map{"status": "If the number is awaiting verification, a code has been sent"}
+
+	var userID string
+	err = s.DB.QueryRowContext(ctx, "SELECT user_id FROM users WHERE phone=$1 AND NOT phone_verified", phone).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.Logger.InfoContext(ctx, "Phone verification requested for unknown number")
+		return c.JSON(200, response)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	err = s.SendSMSCode(ctx, phoneVerificationKey(phone), phone, userID)
+	if errors.Is(err, errTooManyCodes) {
+		return TooManyRequestsError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not send SMS code", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, response)
+}
+
+// PhoneVerificationHandler activates an account registered with a phone
+// number once the texted code comes back.
+func (s *Server) PhoneVerificationHandler(c echo.Context) error {
+	var body struct {
+		Phone string `json:"phone"`
+		Code  string `json:"code"`
+	}
+	err := c.Bind(&body)
+	phone, ok := normalizePhone(body.Phone)
+	if err != nil || !ok || len(body.Code) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID, ok := s.CheckOTP(ctx, phoneVerificationKey(phone), body.Code)
+	if !ok {
+		s.Logger.InfoContext(ctx, "Invalid phone verification code")
+		return UnauthorizedError(c)
+	}
+
+	_, err = s.DB.ExecContext(ctx, "UPDATE users SET phone_verified=true WHERE user_id=$1 AND phone=$2", userID, phone)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not verify phone", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Phone verified"})
+}
+
+// SMSMFAEnableHandler turns on texted codes as a second factor, which needs
+// a verified phone number.
+func (s *Server) SMSMFAEnableHandler(c echo.Context) error {
+	if s.SMS == nil {
+		return NotFoundError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var email string
+	err := s.DB.QueryRowContext(ctx, "UPDATE users SET sms_mfa_enabled=true WHERE user_id=$1 AND phone_verified RETURNING email",
+		userID).Scan(&email)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not enable SMS MFA", "error", err)
+		return InvalidRequestError(c)
+	}
+	s.RecordAuthEvent(c, EventMFAEnabled, userID, email)
+
+	return s.mfaEnabledResponse(c, userID, "SMS two-factor authentication enabled")
+}
+
+func (s *Server) SMSMFADisableHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var email string
+	err := s.DB.QueryRowContext(ctx, "UPDATE users SET sms_mfa_enabled=false WHERE user_id=$1 RETURNING email", userID).Scan(&email)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not disable SMS MFA", "error", err)
+		return InvalidRequestError(c)
+	}
+	s.RecordAuthEvent(c, EventMFADisabled, userID, email)
+	s.DropUnneededRecoveryCodes(ctx, userID)
+
+	return c.JSON(200, echo.Map{"status": "SMS two-factor authentication disabled"})
+}
+
+// SMSLoginRequestHandler texts a sign-in code to a verified phone number. It
+// answers the same whether or not the number is registered.
+func (s *Server) SMSLoginRequestHandler(c echo.Context) error {
+	if s.SMS == nil {
+		return NotFoundError(c)
+	}
+
+	var body struct {
+		Phone string `json:"phone"`
+	}
+	err := c.Bind(&body)
+	phone, ok := normalizePhone(body.Phone)
+	if err != nil || !ok {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	response := echo.Map{"status": "If the number is registered, a code has been sent"}
+
+	var userID string
+	err = s.DB.QueryRowContext(ctx, "SELECT user_id FROM users WHERE phone=$1 AND phone_verified", phone).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.Logger.InfoContext(ctx, "SMS code requested for unknown number")
+		return c.JSON(200, response)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not look up user", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	err = s.SendSMSCode(ctx, otpKey("sms_login", phone), phone, userID)
+	if errors.Is(err, errTooManyCodes) {
+		return TooManyRequestsError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not send SMS code", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, response)
+}
+
+// SMSLoginVerifyHandler signs in with a texted code in place of a password.
+func (s *Server) SMSLoginVerifyHandler(c echo.Context) error {
+	var body struct {
+		Phone    string `json:"phone"`
+		Code     string `json:"code"`
+		Remember bool   `json:"remember"`
+	}
+	err := c.Bind(&body)
+	phone, ok := normalizePhone(body.Phone)
+	if err != nil || !ok || len(body.Code) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID, ok := s.CheckOTP(ctx, otpKey("sms_login", phone), body.Code)
+	if !ok {
+		s.Logger.InfoContext(ctx, "Invalid SMS sign-in code")
+		s.RecordLogin(c, false, MFAMethodSMS, "", "")
+		return UnauthorizedError(c)
+	}
+
+	var email string
+	err = s.DB.QueryRowContext(ctx, "SELECT email FROM users WHERE user_id=$1", userID).Scan(&email)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "SMS sign-in user no longer exists", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	return s.FinishSignIn(c, userID, email, body.Remember, MFAMethodSMS)
+}
+
+// SMSMFASendHandler texts the second factor code for a pending sign-in.
+func (s *Server) SMSMFASendHandler(c echo.Context) error {
+	if s.SMS == nil {
+		return NotFoundError(c)
+	}
+
+	var body struct {
+		MFAToken string `json:"mfa_token"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.MFAToken) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	challenge, err := s.GetMFAChallenge(ctx, body.MFAToken)
+	if err != nil {
+		return UnauthorizedError(c)
+	}
+
+	var phone string
+	err = s.DB.QueryRowContext(ctx, "SELECT phone FROM users WHERE user_id=$1 AND sms_mfa_enabled AND phone_verified",
+		challenge.UserID).Scan(&phone)
+	if err != nil {
+		return UnauthorizedError(c)
+	}
+
+	err = s.SendSMSCode(ctx, otpKey("sms_mfa", challenge.UserID), phone, "")
+	if errors.Is(err, errTooManyCodes) {
+		return TooManyRequestsError(c)
+	}
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not send SMS code", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	return c.JSON(200, echo.Map{"status": "Code sent"})
+}
+
+// SMSMFALoginHandler is the second step of signing in with a texted code.
+func (s *Server) SMSMFALoginHandler(c echo.Context) error {
+	var body struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.MFAToken) == 0 || len(body.Code) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	return s.CompleteMFAChallenge(c, body.MFAToken, func(ctx context.Context, challenge mfaChallenge) bool {
+		_, ok := s.CheckOTP(ctx, otpKey("sms_mfa", challenge.UserID), body.Code)
+		return ok
+	})
+}
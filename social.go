@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
+)
+
+const upstreamStateLifetime = time.Minute * 10
+
+// UpstreamIdentity is who an upstream identity provider says the user is.
+type UpstreamIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// UpstreamProvider is an external identity provider users can sign in with.
+type UpstreamProvider struct {
+	Name   string
+	OAuth2 *oauth2.Config
+	// AuthCodeOptions are extra parameters sent with the authorization request
+	AuthCodeOptions []oauth2.AuthCodeOption
+	// FormPost providers send the callback as a cross-site POST
+	FormPost bool
+	// ClientSecret, when set, generates the client secret for each token request
+	ClientSecret func() (string, error)
+	// FetchIdentity resolves the user behind the token the provider issued
+	FetchIdentity func(ctx context.Context, token *oauth2.Token, nonce string) (*UpstreamIdentity, error)
+	// CallbackIdentity, when set, fills in details sent with the callback itself
+	CallbackIdentity func(identity *UpstreamIdentity, form url.Values)
+}
+
+// upstreamState is what we remember about a sign-in while the browser is
+// away at the provider.
+type upstreamState struct {
+	Provider     string `json:"provider"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier"`
+	ReturnTo     string `json:"return_to"`
+	// LinkUserID is set when a signed in user is linking the identity
+	LinkUserID string `json:"link_user_id,omitempty"`
+}
+
+func upstreamStateKey(state string) string {
+	return "upstream_state:" + HashToken(state)
+}
+
+// SafeReturnTo only lets sign-in flows send the browser back to a path on
+// this server or to one of the allowed origins, so they can't be used as
+// open redirects.
+func (s *Server) SafeReturnTo(returnTo string) string {
+	if strings.HasPrefix(returnTo, "/") && !strings.HasPrefix(returnTo, "//") {
+		return returnTo
+	}
+
+	uri, err := url.Parse(returnTo)
+	if err == nil && uri.IsAbs() {
+		origin := uri.Scheme + "://" + uri.Host
+		for _, allowed := range s.AllowedOrigins {
+			if origin == allowed {
+				return returnTo
+			}
+		}
+	}
+	return s.SocialLoginRedirectURL
+}
+
+// ParseUpstreamIDToken reads the identity out of an OIDC ID token returned
+// by a provider's token endpoint. The token came over a direct TLS
+// connection to the provider, which OIDC Core 3.1.3.7 accepts in place of
+// checking its signature, but the claims still have to be checked.
+func ParseUpstreamIDToken(token *oauth2.Token, issuers []string, clientID string, nonce string) (*UpstreamIdentity, jwt.MapClaims, error) {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, errors.New("token response has no id_token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, _, err := jwt.NewParser().ParseUnverified(rawIDToken, claims)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	issuer, _ := claims.GetIssuer()
+	if issuers != nil && !containsString(issuers, issuer) {
+		return nil, nil, fmt.Errorf("unexpected issuer %q", issuer)
+	}
+
+	audience, _ := claims.GetAudience()
+	if !containsString(audience, clientID) {
+		return nil, nil, errors.New("ID token was issued to another client")
+	}
+
+	expiresAt, err := claims.GetExpirationTime()
+	if err != nil || expiresAt == nil || expiresAt.Before(time.Now()) {
+		return nil, nil, errors.New("ID token is expired")
+	}
+
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, nil, errors.New("ID token nonce does not match")
+	}
+
+	identity := &UpstreamIdentity{}
+	identity.Subject, _ = claims.GetSubject()
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+
+	if identity.Subject == "" {
+		return nil, nil, errors.New("ID token has no subject")
+	}
+	return identity, claims, nil
+}
+
+func containsString(items []string, wanted string) bool {
+	for _, item := range items {
+		if item == wanted {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) UpstreamLoginHandler(c echo.Context) error {
+	provider, ok := s.Providers[c.Param("provider")]
+	if !ok {
+		return NotFoundError(c)
+	}
+
+	authURL, err := s.StartUpstreamLogin(c, provider, s.SafeReturnTo(c.QueryParam("return_to")), "")
+	if err != nil {
+		return InvalidRequestError(c)
+	}
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+// StartUpstreamLogin remembers a new sign-in with the provider and returns
+// the URL to send the browser to. With linkUserID set, the identity gets
+// linked to that user instead of signing anyone in.
+func (s *Server) StartUpstreamLogin(c echo.Context, provider *UpstreamProvider, returnTo string, linkUserID string) (string, error) {
+	ctx := c.Request().Context()
+	state := RandomToken()
+	pending := upstreamState{
+		Provider:     provider.Name,
+		Nonce:        RandomToken(),
+		CodeVerifier: oauth2.GenerateVerifier(),
+		ReturnTo:     returnTo,
+		LinkUserID:   linkUserID,
+	}
+
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.RDB.Set(ctx, upstreamStateKey(state), data, upstreamStateLifetime).Err()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store sign-in state", "error", err)
+		return "", err
+	}
+
+	// The state cookie ties the callback to the browser that started the
+	// flow. Lax is needed for it to be sent on the provider's redirect, and
+	// None when the provider posts the callback instead.
+	sameSite := http.SameSiteLaxMode
+	if provider.FormPost {
+		sameSite = http.SameSiteNoneMode
+	}
+	c.SetCookie(&http.Cookie{
+		Name:     "upstream_state",
+		Value:    state,
+		Path:     "/callback/",
+		HttpOnly: true,
+		Secure:   s.Cookie.Secure,
+		SameSite: sameSite,
+		Expires:  time.Now().Add(upstreamStateLifetime),
+	})
+
+	options := append([]oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("nonce", pending.Nonce),
+		oauth2.S256ChallengeOption(pending.CodeVerifier),
+	}, provider.AuthCodeOptions...)
+	return provider.OAuth2.AuthCodeURL(state, options...), nil
+}
+
+func (s *Server) UpstreamCallbackHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	provider, ok := s.Providers[c.Param("provider")]
+	if !ok {
+		return NotFoundError(c)
+	}
+
+	// FormValue covers both providers that redirect and ones that post
+	state := c.FormValue("state")
+	cookie, err := c.Cookie("upstream_state")
+	if err != nil || len(state) == 0 || cookie.Value != state {
+		s.Logger.InfoContext(ctx, "Sign-in state does not match", "provider", provider.Name)
+		return UnauthorizedError(c)
+	}
+
+	data, err := s.RDB.GetDel(ctx, upstreamStateKey(state)).Bytes()
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Sign-in state not found or expired", "error", err)
+		return UnauthorizedError(c)
+	}
+
+	var pending upstreamState
+	err = json.Unmarshal(data, &pending)
+	if err != nil || pending.Provider != provider.Name {
+		return UnauthorizedError(c)
+	}
+
+	if providerError := c.FormValue("error"); providerError != "" {
+		s.Logger.InfoContext(ctx, "Provider refused sign-in", "provider", provider.Name, "error", providerError)
+		return UnauthorizedError(c)
+	}
+
+	options := []oauth2.AuthCodeOption{oauth2.VerifierOption(pending.CodeVerifier)}
+	if provider.ClientSecret != nil {
+		secret, err := provider.ClientSecret()
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not generate client secret", "provider", provider.Name, "error", err)
+			return UnauthorizedError(c)
+		}
+		options = append(options, oauth2.SetAuthURLParam("client_secret", secret))
+	}
+
+	token, err := provider.OAuth2.Exchange(ctx, c.FormValue("code"), options...)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not exchange code with provider", "provider", provider.Name, "error", err)
+		return UnauthorizedError(c)
+	}
+
+	identity, err := provider.FetchIdentity(ctx, token, pending.Nonce)
+	if err != nil {
+		s.Logger.WarnContext(ctx, "Could not resolve upstream identity", "provider", provider.Name, "error", err)
+		return UnauthorizedError(c)
+	}
+	if provider.CallbackIdentity != nil {
+		form, err := c.FormParams()
+		if err == nil {
+			provider.CallbackIdentity(identity, form)
+		}
+	}
+
+	if pending.LinkUserID != "" {
+		return s.CompleteIdentityLink(c, pending.LinkUserID, provider.Name, identity, pending.ReturnTo)
+	}
+	return s.CompleteUpstreamLogin(c, provider.Name, identity, pending.ReturnTo)
+}
+
+// CompleteUpstreamLogin signs in the local user behind an identity an
+// upstream provider vouched for, and sends the browser back to returnTo.
+// Users with a second factor turned on come back with an MFA challenge
+// instead of a session.
+func (s *Server) CompleteUpstreamLogin(c echo.Context, provider string, identity *UpstreamIdentity, returnTo string) error {
+	ctx := c.Request().Context()
+	userID, err := s.FindOrCreateUpstreamUser(ctx, provider, identity)
+	if errors.Is(err, errRegistrationClosed) {
+		s.RecordLogin(c, false, provider, "", identity.Email)
+		return RegistrationClosedError(c)
+	}
+	if errors.Is(err, errEmailDomainNotAllowed) {
+		s.RecordLogin(c, false, provider, "", identity.Email)
+		return EmailDomainNotAllowedError(c)
+	}
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not sign in upstream user", "provider", provider, "error", err)
+		s.RecordLogin(c, false, provider, "", identity.Email)
+		return UnauthorizedError(c)
+	}
+
+	// Upstream providers only stand in for the first factor
+	return s.FinishRedirectSignIn(c, userID, identity.Email, false, provider, returnTo)
+}
+
+// FindOrCreateUpstreamUser returns the local user linked to the upstream
+// identity. An identity seen for the first time gets linked to the local
+// user with the same email, or to a newly registered one while registration
+// is open. Only emails the provider verified are trusted for this, since
+// otherwise anyone could claim someone else's account.
+func (s *Server) FindOrCreateUpstreamUser(ctx context.Context, provider string, identity *UpstreamIdentity) (string, error) {
+	var userID string
+	err := s.DB.QueryRowContext(ctx, "SELECT user_id FROM identities WHERE provider=$1 AND provider_user_id=$2",
+		provider, identity.Subject).Scan(&userID)
+	if err == nil {
+		return userID, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+
+	email := normalizeEmail(identity.Email)
+	if email == "" || !identity.EmailVerified {
+		return "", errors.New("provider did not return a verified email")
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx, "SELECT user_id FROM users WHERE LOWER(email)=$1", email).Scan(&userID)
+	if err == nil {
+		// The provider proved ownership of the address
+		_, err = tx.ExecContext(ctx, "UPDATE users SET verified=true WHERE user_id=$1", userID)
+	} else if errors.Is(err, sql.ErrNoRows) && s.RegistrationClosed {
+		return "", errRegistrationClosed
+	} else if errors.Is(err, sql.ErrNoRows) && !s.EmailDomainAllowed(email) {
+		return "", errEmailDomainNotAllowed
+	} else if errors.Is(err, sql.ErrNoRows) {
+		// Accounts created this way have no password until the user sets
+		// one through the reset flow
+		status := AccountActive
+		if s.RequireApproval {
+			status = AccountPending
+		}
+		err = tx.QueryRowContext(ctx, "INSERT INTO users (name, email, verified, status) VALUES($1, $2, true, $3) RETURNING user_id",
+			identity.Name, email, status).Scan(&userID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO identities (provider, provider_user_id, user_id, email) VALUES($1, $2, $3, $4)",
+		provider, identity.Subject, userID, email)
+	if err != nil {
+		return "", err
+	}
+	return userID, tx.Commit()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	SessionStoreRedis     = "redis"
+	SessionStoreStateless = "stateless"
+)
+
+var (
+	errSessionInvalid = errors.New("session is invalid or expired")
+	errSessionRevoked = errors.New("session was revoked")
+)
+
+// sealedSession is what a stateless session token carries. The token itself
+// is the session ID handed around the rest of the server, while ID names the
+// session in the revocation list and stays the same when the token gets
+// re-issued.
+type sealedSession struct {
+	ID string `json:"id"`
+	Session
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// sessionSealingKeys derives the AES keys of stateless sessions from the
+// cookie secrets, newest first.
+func (s *Server) sessionSealingKeys() []cipher.AEAD {
+	var keys []cipher.AEAD
+	for _, secret := range s.CookieSecrets {
+		sum := sha256.Sum256(append([]byte("stateless-session:"), secret...))
+		block, err := aes.NewCipher(sum[:])
+		if err != nil {
+			continue
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			continue
+		}
+		keys = append(keys, aead)
+	}
+	return keys
+}
+
+// sealSession encrypts the session into a token, so clients can carry it
+// without being able to read or change it.
+func (s *Server) sealSession(sealed *sealedSession) (string, error) {
+	keys := s.sessionSealingKeys()
+	if len(keys) == 0 {
+		return "", errors.New("stateless sessions need COOKIE_SECRETS")
+	}
+
+	data, err := json.Marshal(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, keys[0].NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(keys[0].Seal(nonce, nonce, data, nil)), nil
+}
+
+// openSession decrypts a session token, accepting any of the cookie secrets,
+// and checks it hasn't expired.
+func (s *Server) openSession(token string) (*sealedSession, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errSessionInvalid
+	}
+
+	for _, key := range s.sessionSealingKeys() {
+		if len(data) < key.NonceSize() {
+			return nil, errSessionInvalid
+		}
+		plaintext, err := key.Open(nil, data[:key.NonceSize()], data[key.NonceSize():], nil)
+		if err != nil {
+			continue
+		}
+
+		var sealed sealedSession
+		err = json.Unmarshal(plaintext, &sealed)
+		if err != nil || time.Now().After(sealed.ExpiresAt) {
+			return nil, errSessionInvalid
+		}
+		return &sealed, nil
+	}
+	return nil, errSessionInvalid
+}
+
+// createStatelessSession seals a new session into the token that works as
+// its session ID.
+func (s *Server) createStatelessSession(session Session, lifetime time.Duration) (string, error) {
+	return s.sealSession(&sealedSession{
+		ID:        uuid.New().String(),
+		Session:   session,
+		ExpiresAt: time.Now().Add(lifetime).UTC(),
+	})
+}
+
+// getStatelessSession opens a session token and checks the revocation list,
+// which is the only thing kept about stateless sessions.
+func (s *Server) getStatelessSession(ctx context.Context, token string) (*sealedSession, error) {
+	sealed, err := s.openSession(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var revoked bool
+	err = s.DB.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM revoked_sessions WHERE session_id=$1)
+		OR EXISTS(SELECT 1 FROM session_cutoffs WHERE user_id=$2 AND revoked_before >= $3 AND kept_session_id IS DISTINCT FROM $1)`,
+		sealed.ID, sealed.UserID, sealed.CreatedAt).Scan(&revoked)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errSessionRevoked
+	}
+	return sealed, nil
+}
+
+// reissueStatelessSession replaces the session cookie with a token for the
+// same session that expires at expiresAt. The previous token stays valid
+// until it expires, but it is revoked along with the new one.
+func (s *Server) reissueStatelessSession(c echo.Context, token string, session *Session, expiresAt time.Time) error {
+	sealed, err := s.openSession(token)
+	if err != nil {
+		return err
+	}
+	sealed.Session = *session
+	sealed.ExpiresAt = expiresAt.UTC()
+
+	reissued, err := s.sealSession(sealed)
+	if err != nil {
+		return err
+	}
+
+	expiration := time.Time{}
+	if session.Remember {
+		expiration = expiresAt
+	}
+	s.SetSessionCookie(c, reissued, expiration)
+	return nil
+}
+
+// revokeStatelessSession adds the session to the revocation list until the
+// longest it could still be refreshed for. Expired entries are cleared out
+// on the way, which keeps the list small.
+func (s *Server) revokeStatelessSession(ctx context.Context, token string) error {
+	sealed, err := s.openSession(token)
+	if err != nil {
+		// Nothing to revoke for a token that no longer works anyway
+		return nil
+	}
+
+	_, err = s.DB.ExecContext(ctx, "DELETE FROM revoked_sessions WHERE expires_at < now()")
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.ExecContext(ctx, "INSERT INTO revoked_sessions (session_id, expires_at) VALUES($1, $2) ON CONFLICT DO NOTHING",
+		sealed.ID, time.Now().Add(s.RememberSessionLifetime))
+	return err
+}
+
+// revokeStatelessSessionsExcept revokes every session the user created so
+// far, apart from the one named by keepToken.
+func (s *Server) revokeStatelessSessionsExcept(ctx context.Context, userID string, keepToken string) error {
+	var keepSessionID *string
+	if keepToken != "" {
+		if sealed, err := s.openSession(keepToken); err == nil {
+			keepSessionID = &sealed.ID
+		}
+	}
+
+	_, err := s.DB.ExecContext(ctx, `INSERT INTO session_cutoffs (user_id, revoked_before, kept_session_id) VALUES($1, now(), $2)
+		ON CONFLICT (user_id) DO UPDATE SET revoked_before=now(), kept_session_id=$2`, userID, keepSessionID)
+	return err
+}
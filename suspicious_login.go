@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// What happens to a sign-in that looks suspicious. Every action reports it
+// to the security webhook and the user.
+const (
+	SuspiciousLoginAlert = "alert"
+	// SuspiciousLoginMFA asks for a second factor, falling back to a code
+	// sent by email for users without one, and blocks the sign-in when
+	// there is no way to ask
+	SuspiciousLoginMFA   = "mfa"
+	SuspiciousLoginBlock = "block"
+)
+
+// Reasons a sign-in looks suspicious
+const (
+	RiskTorExitNode      = "tor_exit_node"
+	RiskUnusualCountry   = "unusual_country"
+	RiskImpossibleTravel = "impossible_travel"
+)
+
+// Faster than an airliner between two sign-ins is impossible travel. Short
+// hops are left alone, since geolocation is rough.
+const (
+	maxTravelSpeed    = 1000 // km/h
+	minTravelDistance = 300  // km
+)
+
+// Coordinate headers of the CDNs in locationHeaders, as pairs of latitude
+// and longitude header names. App Engine sends both in one header.
+var coordinateHeaders = [][2]string{
+	{"CF-IPLatitude", "CF-IPLongitude"},
+	{"CloudFront-Viewer-Latitude", "CloudFront-Viewer-Longitude"},
+	{"X-Vercel-IP-Latitude", "X-Vercel-IP-Longitude"},
+}
+
+// requestCountry is the country part of requestLocation.
+func requestCountry(request *http.Request) string {
+	for _, headers := range locationHeaders {
+		if country := request.Header.Get(headers[0]); country != "" {
+			return strings.ToUpper(country)
+		}
+	}
+	return ""
+}
+
+// requestCoordinates returns where the CDN placed the client, when it did.
+func requestCoordinates(request *http.Request) (latitude float64, longitude float64, ok bool) {
+	for _, headers := range coordinateHeaders {
+		latitude, err := strconv.ParseFloat(request.Header.Get(headers[0]), 64)
+		if err != nil {
+			continue
+		}
+		longitude, err := strconv.ParseFloat(request.Header.Get(headers[1]), 64)
+		if err != nil {
+			continue
+		}
+		return latitude, longitude, true
+	}
+	if lat, long, found := strings.Cut(request.Header.Get("X-AppEngine-CityLatLong"), ","); found {
+		latitude, err := strconv.ParseFloat(lat, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		longitude, err := strconv.ParseFloat(long, 64)
+		return latitude, longitude, err == nil
+	}
+	return 0, 0, false
+}
+
+// distance is the great-circle distance between two points in kilometers.
+func distance(latitude1 float64, longitude1 float64, latitude2 float64, longitude2 float64) float64 {
+	const earthRadius = 6371
+	radians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLat := radians(latitude2 - latitude1)
+	dLong := radians(longitude2 - longitude1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(radians(latitude1))*math.Cos(radians(latitude2))*math.Sin(dLong/2)*math.Sin(dLong/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// LoadTorExitNodes reads the addresses of Tor exit nodes, one per line, as
+// published at https://check.torproject.org/torbulkexitlist. An empty path
+// turns the check off.
+func LoadTorExitNodes(path string) (map[string]bool, error) {
+	nodes := map[string]bool{}
+	if path == "" {
+		return nodes, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if ip := net.ParseIP(line); ip != nil {
+			nodes[ip.String()] = true
+		}
+	}
+	return nodes, scanner.Err()
+}
+
+// LoginRisks lists the reasons the sign-in looks suspicious, compared with
+// the user's earlier successful sign-ins. Locations come from CDN headers,
+// so the checks are only as good as the proxy that sets them.
+func (s *Server) LoginRisks(c echo.Context, userID string) ([]string, error) {
+	ctx := c.Request().Context()
+	risks := []string{}
+	if s.TorExitNodes[c.RealIP()] {
+		risks = append(risks, RiskTorExitNode)
+	}
+
+	country := requestCountry(c.Request())
+	if country != "" {
+		var located, fromCountry int
+		err := s.DB.QueryRowContext(ctx, `SELECT COUNT(*) FILTER (WHERE country IS NOT NULL), COUNT(*) FILTER (WHERE country=$2)
+			FROM login_events WHERE user_id=$1 AND success`, userID, country).Scan(&located, &fromCountry)
+		if err != nil {
+			return nil, err
+		}
+		if located > 0 && fromCountry == 0 {
+			risks = append(risks, RiskUnusualCountry)
+		}
+	}
+
+	if latitude, longitude, ok := requestCoordinates(c.Request()); ok {
+		var lastLatitude, lastLongitude float64
+		var lastAt time.Time
+		err := s.DB.QueryRowContext(ctx, `SELECT latitude, longitude, created_at FROM login_events
+			WHERE user_id=$1 AND success AND latitude IS NOT NULL ORDER BY created_at DESC LIMIT 1`, userID).
+			Scan(&lastLatitude, &lastLongitude, &lastAt)
+		if err == nil {
+			km := distance(lastLatitude, lastLongitude, latitude, longitude)
+			hours := max(time.Since(lastAt).Hours(), 0.01)
+			if km > minTravelDistance && km/hours > maxTravelSpeed {
+				risks = append(risks, RiskImpossibleTravel)
+			}
+		}
+	}
+	return risks, nil
+}
+
+// SecurityEvent is what the security webhook receives.
+type SecurityEvent struct {
+	Event     string    `json:"event"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email,omitempty"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Location  string    `json:"location,omitempty"`
+	Risks     []string  `json:"risks"`
+	Action    string    `json:"action"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SecurityWebhook posts security events as JSON, for a SIEM or on-call
+// tooling to pick up.
+type SecurityWebhook struct {
+	URL string
+}
+
+func (w *SecurityWebhook) Send(ctx context.Context, event SecurityEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("security webhook returned %s", response.Status)
+	}
+	return nil
+}
+
+// userEmail is the address to email the user at, empty when they have none.
+func (s *Server) userEmail(ctx context.Context, userID string) string {
+	var email string
+	s.DB.QueryRowContext(ctx, "SELECT COALESCE(email, '') FROM users WHERE user_id=$1", userID).Scan(&email)
+	return email
+}
+
+// ReportSuspiciousLogin records the sign-in in the audit log and sends it
+// to the security webhook and the user, in the background.
+func (s *Server) ReportSuspiciousLogin(c echo.Context, userID string, risks []string) {
+	ctx := c.Request().Context()
+	email := s.userEmail(ctx, userID)
+	s.Logger.WarnContext(ctx, "Suspicious sign-in", "user_id", userID, "risks", risks)
+	s.RecordAuthEvent(c, EventSuspiciousLogin, userID, email)
+
+	event := SecurityEvent{
+		Event:     EventSuspiciousLogin,
+		UserID:    userID,
+		Email:     email,
+		IP:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+		Location:  requestLocation(c.Request()),
+		Risks:     risks,
+		Action:    s.SuspiciousLoginAction,
+		CreatedAt: time.Now().UTC(),
+	}
+	go func(ctx context.Context) {
+		if s.SecurityWebhook != nil {
+			err := s.SecurityWebhook.Send(ctx, event)
+			if err != nil {
+				s.Logger.ErrorContext(ctx, "Could not send security event", "error", err)
+			}
+		}
+
+		if s.Mailer != nil && email != "" {
+			where := event.IP
+			if event.Location != "" {
+				where += ", " + event.Location
+			}
+			err := s.Mailer.Send(email, "Unusual sign-in to your account",
+				fmt.Sprintf("We noticed an unusual sign-in to your account.\n\nDevice: %s\nAddress: %s\nTime: %s\n\n"+
+					"If this wasn't you, change your password and sign out your other sessions.\n",
+					ParseUserAgent(event.UserAgent).Name(), where, event.CreatedAt.Format(time.RFC1123)))
+			if err != nil {
+				s.Logger.ErrorContext(ctx, "Could not send unusual sign-in email", "user_id", userID, "error", err)
+			}
+		}
+	}(context.WithoutCancel(ctx))
+}
+
+func SuspiciousLoginError(c echo.Context) error {
+	return c.JSON(403, echo.Map{"error": "Sign-in blocked as suspicious"})
+}
+
+// EmailMFASendHandler emails the code for a pending sign-in that asked for
+// one, which suspicious sign-ins of users without a second factor do.
+func (s *Server) EmailMFASendHandler(c echo.Context) error {
+	if s.Mailer == nil {
+		return NotFoundError(c)
+	}
+
+	var body struct {
+		MFAToken string `json:"mfa_token"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.MFAToken) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	challenge, err := s.GetMFAChallenge(ctx, body.MFAToken)
+	if err != nil || !slices.Contains(challenge.Methods, MFAMethodEmail) {
+		return UnauthorizedError(c)
+	}
+
+	// The challenge holds whatever the user signed in with, which may be a
+	// username
+	email := s.userEmail(ctx, challenge.UserID)
+	if email == "" {
+		return UnauthorizedError(c)
+	}
+
+	if !s.AllowOTPSend(ctx, email) {
+		return TooManyRequestsError(c)
+	}
+
+	code, err := s.CreateOTP(ctx, otpKey("email_mfa", challenge.UserID), challenge.UserID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not store email code", "error", err)
+		return InvalidRequestError(c)
+	}
+
+	go func(ctx context.Context) {
+		err := s.Mailer.Send(email, "Your sign-in code",
+			"Your sign-in code is "+code+". It expires in "+s.OTPLifetime.String()+".\n")
+		if err != nil {
+			s.Logger.ErrorContext(ctx, "Could not send email code", "user_id", challenge.UserID, "error", err)
+		}
+	}(context.WithoutCancel(ctx))
+
+	return c.JSON(200, echo.Map{"status": "Code sent"})
+}
+
+// EmailMFALoginHandler is the second step of a sign-in that asked for an
+// emailed code.
+func (s *Server) EmailMFALoginHandler(c echo.Context) error {
+	var body struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.MFAToken) == 0 || len(body.Code) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	return s.CompleteMFAChallenge(c, body.MFAToken, func(ctx context.Context, challenge mfaChallenge) bool {
+		if !slices.Contains(challenge.Methods, MFAMethodEmail) {
+			return false
+		}
+		_, ok := s.CheckOTP(ctx, otpKey("email_mfa", challenge.UserID), body.Code)
+		return ok
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+	jwtTokenType           = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// exchangeToken trades a token the caller holds for a user, either an
+// access token or a sign-in JWT, for a narrower access token, as described
+// in RFC 8693. Services use it to call each other on the user's behalf
+// without passing the user's own credentials along. Access tokens have to
+// have been issued to the caller, and the new token can only be for the
+// caller itself or an audience an admin allowed it.
+func (s *Server) exchangeToken(c echo.Context, client *Client) error {
+	ctx := c.Request().Context()
+	if client.Public {
+		return OAuthError(c, 400, "unauthorized_client", "Public clients can't exchange tokens")
+	}
+
+	requestedType := c.FormValue("requested_token_type")
+	if requestedType != "" && requestedType != accessTokenType {
+		return OAuthError(c, 400, "invalid_request", "Only access tokens can be requested")
+	}
+	if c.FormValue("actor_token") != "" {
+		return OAuthError(c, 400, "invalid_request", "Actor tokens are not supported, the client is the actor")
+	}
+	if c.FormValue("resource") != "" {
+		return OAuthError(c, 400, "invalid_target", "Use audience to name the target service")
+	}
+
+	subjectToken := c.FormValue("subject_token")
+	if len(subjectToken) == 0 {
+		return OAuthError(c, 400, "invalid_request", "Missing subject token")
+	}
+
+	// The new token never grants more than the subject token, nor outlives it
+	var subject AccessToken
+	var availableScopes []string
+	switch c.FormValue("subject_token_type") {
+	case accessTokenType:
+		accessToken, err := s.LookupBearerToken(ctx, subjectToken)
+		if err != nil {
+			s.Logger.InfoContext(ctx, "Subject token not found or expired", "error", err)
+			return OAuthError(c, 400, "invalid_grant", "Invalid or expired subject token")
+		}
+		// Otherwise any client could turn a token it intercepted into one
+		// for itself
+		if accessToken.ClientID != client.ClientID {
+			return OAuthError(c, 400, "invalid_grant", "Subject token was not issued to this client")
+		}
+		subject = *accessToken
+		availableScopes = strings.Fields(accessToken.Scope)
+	case jwtTokenType:
+		if s.JWTAlgorithm == "" {
+			return OAuthError(c, 400, "invalid_request", "Sign-in JWTs are not enabled")
+		}
+		claims, err := s.ParseSessionJWT(subjectToken)
+		if err != nil || s.VerifySessionAndUserID(ctx, claims.SessionID, claims.Subject) == nil {
+			s.Logger.InfoContext(ctx, "Invalid subject JWT", "error", err)
+			return OAuthError(c, 400, "invalid_grant", "Invalid or expired subject token")
+		}
+		subject = AccessToken{UserID: claims.Subject, ExpiresAt: claims.ExpiresAt.Time}
+		// A sign-in carries all of the user's rights, the client's own
+		// scopes bound what it can pass on, and only to audiences an admin
+		// allowed below
+		availableScopes = client.AllowedScopes
+	default:
+		return OAuthError(c, 400, "invalid_request", "Subject token type is not supported")
+	}
+
+	scope := strings.Join(availableScopes, " ")
+	if requested := c.FormValue("scope"); requested != "" {
+		for _, item := range strings.Fields(requested) {
+			if !containsString(availableScopes, item) {
+				return OAuthError(c, 400, "invalid_scope", "Scope "+item+" is not covered by the subject token")
+			}
+		}
+		scope = requested
+	}
+
+	audience := client.ClientID
+	if requested := c.FormValue("audience"); requested != "" {
+		audience = requested
+	}
+	// Sign-in JWTs aren't issued to any client, so even the caller itself
+	// has to be on its list to take one
+	if (audience != client.ClientID || subject.ClientID == "") && !containsString(client.ExchangeAudiences, audience) {
+		return OAuthError(c, 400, "invalid_target", "Client may not exchange tokens for this audience")
+	}
+	if _, err := s.GetClient(ctx, audience); err != nil {
+		return OAuthError(c, 400, "invalid_target", "Unknown audience")
+	}
+
+	token, err := s.IssueAccessToken(ctx, AccessToken{
+		ClientID:      audience,
+		UserID:        subject.UserID,
+		Scope:         scope,
+		ExpiresAt:     subject.ExpiresAt,
+		FamilyID:      subject.FamilyID,
+		ActorClientID: client.ClientID,
+	})
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not issue access token", "error", err)
+		return OAuthError(c, 500, "server_error", "Could not issue access token")
+	}
+
+	expiresIn := s.AccessTokenLifetime
+	if !subject.ExpiresAt.IsZero() && time.Until(subject.ExpiresAt) < expiresIn {
+		expiresIn = time.Until(subject.ExpiresAt)
+	}
+
+	return c.JSON(200, echo.Map{
+		"access_token":      token,
+		"issued_token_type": accessTokenType,
+		"token_type":        "Bearer",
+		"expires_in":        int(expiresIn.Seconds()),
+		"scope":             scope,
+	})
+}
+
+// AllowExchangeAudienceHandler lets the client exchange tokens for the
+// audience client.
+func (s *Server) AllowExchangeAudienceHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	clientID := c.Param("id")
+	audience, err := s.GetClient(ctx, c.Param("audience"))
+	if err != nil {
+		return NotFoundError(c)
+	}
+
+	_, err = s.DB.ExecContext(ctx, `UPDATE clients SET exchange_audiences=array_append(exchange_audiences, $2)
+		WHERE client_id::text=$1 AND NOT public AND NOT $2=ANY(exchange_audiences)`, clientID, audience.ClientID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update client", "error", err)
+		return ServerError(c)
+	}
+	return s.exchangeAudiencesResponse(c, clientID)
+}
+
+func (s *Server) DisallowExchangeAudienceHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	clientID := c.Param("id")
+
+	_, err := s.DB.ExecContext(ctx, "UPDATE clients SET exchange_audiences=array_remove(exchange_audiences, $2) WHERE client_id::text=$1",
+		clientID, c.Param("audience"))
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not update client", "error", err)
+		return ServerError(c)
+	}
+	return s.exchangeAudiencesResponse(c, clientID)
+}
+
+func (s *Server) exchangeAudiencesResponse(c echo.Context, clientID string) error {
+	client, err := s.GetClient(c.Request().Context(), clientID)
+	if err != nil || client.Public {
+		return NotFoundError(c)
+	}
+	return c.JSON(200, echo.Map{"client_id": client.ClientID, "exchange_audiences": client.ExchangeAudiences})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// Codes from one period either side are accepted to allow for clock drift
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func totpUsedKey(userID string, step int64) string {
+	return "totp_used:" + userID + ":" + strconv.FormatInt(step, 10)
+}
+
+func GenerateTOTPSecret() string {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// TOTPCode computes the RFC 6238 code for a time step, with the defaults
+// every authenticator app supports: SHA-1, 6 digits and 30 second periods.
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// MatchTOTPCode returns the time step the code belongs to, or -1 if it
+// doesn't match any step within the allowed skew.
+func MatchTOTPCode(secret string, code string, now time.Time) int64 {
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return -1
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step
+		}
+	}
+	return -1
+}
+
+// VerifyTOTP checks a code against the user's secret. Each code only works
+// once, so one seen over someone's shoulder can't be replayed.
+func (s *Server) VerifyTOTP(ctx context.Context, userID string, secret string, code string) bool {
+	step := MatchTOTPCode(secret, code, time.Now())
+	if step < 0 {
+		return false
+	}
+
+	fresh, err := s.RDB.SetNX(ctx, totpUsedKey(userID, step), 1, time.Second*totpPeriod*(2*totpSkew+2)).Result()
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not record used TOTP code", "error", err)
+		return false
+	}
+	return fresh
+}
+
+// TOTPEnrollHandler starts enrollment with a new secret. 2FA is only turned
+// on once a code from it is confirmed, so a failed scan can't lock anyone out.
+func (s *Server) TOTPEnrollHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	secret := GenerateTOTPSecret()
+	var email string
+	err := s.DB.QueryRowContext(ctx, "UPDATE users SET totp_secret=$1 WHERE user_id=$2 AND NOT totp_enabled RETURNING email",
+		secret, userID).Scan(&email)
+	if err != nil {
+		s.Logger.InfoContext(ctx, "Could not start TOTP enrollment", "error", err)
+		return ConflictError(c)
+	}
+
+	label := url.PathEscape(s.TOTPIssuer + ":" + email)
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {s.TOTPIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	return c.JSON(200, echo.Map{
+		"secret":           secret,
+		"provisioning_uri": "otpauth://totp/" + label + "?" + params.Encode(),
+	})
+}
+
+func (s *Server) TOTPConfirmHandler(c echo.Context) error {
+	var body struct {
+		Code string `json:"code"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.Code) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var secret, email string
+	var enabled bool
+	err = s.DB.QueryRowContext(ctx, "SELECT COALESCE(totp_secret, ''), totp_enabled, email FROM users WHERE user_id=$1",
+		userID).Scan(&secret, &enabled, &email)
+	if err != nil || secret == "" || enabled {
+		return InvalidRequestError(c)
+	}
+
+	if !s.VerifyTOTP(ctx, userID, secret, body.Code) {
+		s.Logger.InfoContext(ctx, "Invalid TOTP code during enrollment", "user_id", userID)
+		return UnauthorizedError(c)
+	}
+
+	_, err = s.DB.ExecContext(ctx, "UPDATE users SET totp_enabled=true WHERE user_id=$1", userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not enable TOTP", "error", err)
+		return InvalidRequestError(c)
+	}
+	s.RecordAuthEvent(c, EventMFAEnabled, userID, email)
+
+	return s.mfaEnabledResponse(c, userID, "Two-factor authentication enabled")
+}
+
+// TOTPDisableHandler turns 2FA off, which takes a current code so a stolen
+// session alone can't remove it.
+func (s *Server) TOTPDisableHandler(c echo.Context) error {
+	var body struct {
+		Code string `json:"code"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.Code) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	ctx := c.Request().Context()
+	userID := c.Get("userID").(string)
+
+	var secret, email string
+	var enabled bool
+	err = s.DB.QueryRowContext(ctx, "SELECT COALESCE(totp_secret, ''), totp_enabled, email FROM users WHERE user_id=$1",
+		userID).Scan(&secret, &enabled, &email)
+	if err != nil || !enabled {
+		return InvalidRequestError(c)
+	}
+
+	if !s.VerifyTOTP(ctx, userID, secret, body.Code) {
+		s.Logger.InfoContext(ctx, "Invalid TOTP code", "user_id", userID)
+		return UnauthorizedError(c)
+	}
+
+	_, err = s.DB.ExecContext(ctx, "UPDATE users SET totp_enabled=false, totp_secret=NULL WHERE user_id=$1", userID)
+	if err != nil {
+		s.Logger.ErrorContext(ctx, "Could not disable TOTP", "error", err)
+		return InvalidRequestError(c)
+	}
+	s.RecordAuthEvent(c, EventMFADisabled, userID, email)
+	s.DropUnneededRecoveryCodes(ctx, userID)
+
+	return c.JSON(200, echo.Map{"status": "Two-factor authentication disabled"})
+}
+
+// TOTPLoginHandler is the second step of signing in with an authenticator app.
+func (s *Server) TOTPLoginHandler(c echo.Context) error {
+	var body struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+	err := c.Bind(&body)
+	if err != nil || len(body.MFAToken) == 0 || len(body.Code) == 0 {
+		return InvalidRequestError(c)
+	}
+
+	return s.CompleteMFAChallenge(c, body.MFAToken, func(ctx context.Context, challenge mfaChallenge) bool {
+		var secret string
+		err := s.DB.QueryRowContext(ctx, "SELECT COALESCE(totp_secret, '') FROM users WHERE user_id=$1 AND totp_enabled",
+			challenge.UserID).Scan(&secret)
+		return err == nil && s.VerifyTOTP(ctx, challenge.UserID, secret, body.Code)
+	})
+}
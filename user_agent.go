@@ -0,0 +1,89 @@
+package main
+
+import "strings"
+
+// DeviceInfo is a rough description of the client behind a user agent,
+// good enough for users to recognize their own devices.
+type DeviceInfo struct {
+	Browser string `json:"browser"`
+	OS      string `json:"os"`
+	// Type is desktop, mobile, tablet, bot or unknown
+	Type string `json:"type"`
+}
+
+// Name describes the device the way users talk about it, like "Firefox on Windows".
+func (device DeviceInfo) Name() string {
+	switch {
+	case device.Browser != "" && device.OS != "":
+		return device.Browser + " on " + device.OS
+	case device.Browser != "":
+		return device.Browser
+	case device.OS != "":
+		return device.OS
+	}
+	return "Unknown device"
+}
+
+// Browser tokens in the order they have to be checked, since most browsers
+// also claim to be the ones they are based on
+var userAgentBrowsers = [][2]string{
+	{"Edg/", "Edge"},
+	{"EdgA/", "Edge"},
+	{"EdgiOS/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+}
+
+var userAgentSystems = [][2]string{
+	{"Windows", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iPadOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Macintosh", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// ParseUserAgent picks the browser, operating system and form factor out of
+// a user agent string. User agents are easy to fake, so the result is only
+// ever shown to people and never used for access decisions.
+func ParseUserAgent(userAgent string) DeviceInfo {
+	device := DeviceInfo{Type: "unknown"}
+	if userAgent == "" {
+		return device
+	}
+
+	for _, browser := range userAgentBrowsers {
+		if strings.Contains(userAgent, browser[0]) {
+			device.Browser = browser[1]
+			break
+		}
+	}
+	for _, system := range userAgentSystems {
+		if strings.Contains(userAgent, system[0]) {
+			device.OS = system[1]
+			break
+		}
+	}
+
+	lower := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(lower, "bot") || strings.Contains(lower, "crawler") || strings.Contains(lower, "spider"):
+		device.Type = "bot"
+	case strings.Contains(userAgent, "iPad") || strings.Contains(userAgent, "Tablet") ||
+		(device.OS == "Android" && !strings.Contains(userAgent, "Mobile")):
+		device.Type = "tablet"
+	case strings.Contains(userAgent, "Mobile") || device.OS == "iOS":
+		device.Type = "mobile"
+	case device.OS != "":
+		device.Type = "desktop"
+	}
+	return device
+}
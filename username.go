@@ -0,0 +1,48 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Usernames start with a letter or digit so they can't be mistaken for
+// flags or paths, and never contain an @ so they can't be confused with
+// emails in the sign-in form.
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{2,31}$`)
+
+// reservedUsernames could pass for the service itself or for staff.
+var reservedUsernames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"auth":          true,
+	"help":          true,
+	"login":         true,
+	"logout":        true,
+	"me":            true,
+	"moderator":     true,
+	"noreply":       true,
+	"null":          true,
+	"oauth":         true,
+	"postmaster":    true,
+	"register":      true,
+	"root":          true,
+	"security":      true,
+	"staff":         true,
+	"support":       true,
+	"system":        true,
+	"webmaster":     true,
+}
+
+const usernameRulesMessage = "Must be 3 to 32 letters, digits, dots, dashes or underscores, starting with a letter or digit"
+
+// normalizeUsername lowercases the username, matching the LOWER(username)
+// unique index, and reports whether it has a valid format.
+func normalizeUsername(username string) (string, bool) {
+	username = strings.ToLower(strings.TrimSpace(username))
+	return username, usernamePattern.MatchString(username)
+}
+
+func isReservedUsername(username string) bool {
+	return reservedUsernames[username]
+}